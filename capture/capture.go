@@ -0,0 +1,233 @@
+// Package capture records and reads back raw flow datagrams so that exporter
+// traffic can be reproduced offline.
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// File layout:
+//
+//	header: magic (8 bytes) | listener name length (uint16) | listener name
+//	record: unix nanos (int64) | addr length (uint8) | addr | port (uint16) | payload length (uint32) | payload
+//
+// All integers are big endian.
+var fileMagic = []byte("MORBCAP1")
+
+var ErrNotCaptureFile = errors.New("not a morbius capture file")
+
+type Datagram struct {
+	Src      netip.AddrPort
+	RecvTime time.Time
+	Payload  []byte
+}
+
+type WriterConfig struct {
+	Path     string `yaml:"path"`
+	MaxSize  int64  `yaml:"max_size"`
+	MaxFiles int    `yaml:"max_files"`
+}
+
+// Writer appends datagrams to a capture file, rotating it once it grows past
+// MaxSize. Rotated files are renamed to `<path>.1`, `<path>.2`, etc. with the
+// highest number being the oldest, and at most MaxFiles rotated files are
+// kept. An existing capture at Path is rotated rather than overwritten so a
+// restart doesn't lose it.
+type Writer struct {
+	Config     *WriterConfig
+	listener   string
+	mu         sync.Mutex
+	f          *os.File
+	w          *bufio.Writer
+	size       int64
+	headerSize int64
+}
+
+func NewWriter(config *WriterConfig, listener string) (*Writer, error) {
+	if config == nil || config.Path == "" {
+		return nil, errors.New("capture: path is required")
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = 100 * 1024 * 1024
+	}
+	if config.MaxFiles == 0 {
+		config.MaxFiles = 5
+	}
+	w := &Writer{
+		Config:   config,
+		listener: listener,
+	}
+	if info, err := os.Stat(config.Path); err == nil && info.Size() > 0 {
+		if err := w.shiftFiles(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.Config.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("capture: error opening %s: %w", w.Config.Path, err)
+	}
+	w.f = f
+	w.w = bufio.NewWriter(f)
+	w.size = 0
+	header := make([]byte, 0, len(fileMagic)+2+len(w.listener))
+	header = append(header, fileMagic...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(w.listener)))
+	header = append(header, w.listener...)
+	n, err := w.w.Write(header)
+	w.size += int64(n)
+	w.headerSize = int64(n)
+	return err
+}
+
+func (w *Writer) rotate() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	if err := w.shiftFiles(); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// shiftFiles renames Path to `<path>.1`, `<path>.1` to `<path>.2`, etc.,
+// dropping the oldest once there are MaxFiles.
+func (w *Writer) shiftFiles() error {
+	for i := w.Config.MaxFiles; i > 0; i-- {
+		src := fmt.Sprintf("%s.%d", w.Config.Path, i-1)
+		if i == 1 {
+			src = w.Config.Path
+		}
+		dst := fmt.Sprintf("%s.%d", w.Config.Path, i)
+		if err := os.Rename(src, dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("capture: error rotating %s: %w", src, err)
+		}
+	}
+	return nil
+}
+
+func (w *Writer) Write(d Datagram) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return os.ErrClosed
+	}
+
+	addr := d.Src.Addr().Unmap().AsSlice()
+	record := make([]byte, 0, 8+1+len(addr)+2+4+len(d.Payload))
+	record = binary.BigEndian.AppendUint64(record, uint64(d.RecvTime.UnixNano()))
+	record = append(record, uint8(len(addr)))
+	record = append(record, addr...)
+	record = binary.BigEndian.AppendUint16(record, d.Src.Port())
+	record = binary.BigEndian.AppendUint32(record, uint32(len(d.Payload)))
+	record = append(record, d.Payload...)
+
+	if w.size+int64(len(record)) > w.Config.MaxSize && w.size > w.headerSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.w.Write(record)
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.w == nil {
+		return nil
+	}
+	return w.w.Flush()
+}
+
+func (w *Writer) closeFile() error {
+	if w.f == nil {
+		return nil
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	err := w.f.Close()
+	w.f = nil
+	w.w = nil
+	return err
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeFile()
+}
+
+// Reader reads datagrams back from a capture file written by Writer.
+type Reader struct {
+	Listener string
+	r        *bufio.Reader
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(fileMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != string(fileMagic) {
+		return nil, ErrNotCaptureFile
+	}
+	var nameLen uint16
+	if err := binary.Read(br, binary.BigEndian, &nameLen); err != nil {
+		return nil, fmt.Errorf("capture: error reading header: %w", err)
+	}
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(br, name); err != nil {
+		return nil, fmt.Errorf("capture: error reading header: %w", err)
+	}
+	return &Reader{
+		Listener: string(name),
+		r:        br,
+	}, nil
+}
+
+// Next returns the next datagram in the capture or io.EOF when there are no
+// more.
+func (r *Reader) Next() (Datagram, error) {
+	var d Datagram
+	var fixed [9]byte
+	if _, err := io.ReadFull(r.r, fixed[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return d, fmt.Errorf("capture: truncated record: %w", err)
+		}
+		return d, err
+	}
+	d.RecvTime = time.Unix(0, int64(binary.BigEndian.Uint64(fixed[0:8])))
+	addrBytes := make([]byte, fixed[8])
+	if _, err := io.ReadFull(r.r, addrBytes); err != nil {
+		return d, fmt.Errorf("capture: truncated record: %w", err)
+	}
+	addr, ok := netip.AddrFromSlice(addrBytes)
+	if !ok {
+		return d, fmt.Errorf("capture: invalid address length %d", len(addrBytes))
+	}
+	var rest [6]byte
+	if _, err := io.ReadFull(r.r, rest[:]); err != nil {
+		return d, fmt.Errorf("capture: truncated record: %w", err)
+	}
+	d.Src = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(rest[0:2]))
+	d.Payload = make([]byte, binary.BigEndian.Uint32(rest[2:6]))
+	if _, err := io.ReadFull(r.r, d.Payload); err != nil {
+		return d, fmt.Errorf("capture: truncated record: %w", err)
+	}
+	return d, nil
+}
@@ -0,0 +1,224 @@
+package capture_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/capture"
+)
+
+func TestWriterReader_RoundTrip(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.cap")
+	w, err := capture.NewWriter(&capture.WriterConfig{Path: path}, "netflowv9")
+	if err != nil {
+		t.Fatalf("NewWriter returned err: %v", err)
+	}
+
+	want := []capture.Datagram{
+		{
+			Src:      netip.MustParseAddrPort("192.0.2.1:1234"),
+			RecvTime: time.Unix(1666000000, 420),
+			Payload:  []byte("nice"),
+		},
+		{
+			Src:      netip.MustParseAddrPort("[2001:db8::1]:4321"),
+			RecvTime: time.Unix(1666000001, 69),
+			Payload:  []byte{},
+		},
+	}
+	for _, d := range want {
+		if err := w.Write(d); err != nil {
+			t.Fatalf("Write returned err: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned err: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := capture.NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader returned err: %v", err)
+	}
+	if r.Listener != "netflowv9" {
+		t.Errorf("expected listener netflowv9, got %s", r.Listener)
+	}
+	var got []capture.Datagram
+	for {
+		d, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next returned err: %v", err)
+		}
+		got = append(got, d)
+	}
+	if diff := cmp.Diff(want, got, cmp.Comparer(func(a, b netip.AddrPort) bool { return a == b })); diff != "" {
+		t.Errorf("round trip mismatch:\n%s", diff)
+	}
+}
+
+func TestWriter_Rotation(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.cap")
+	w, err := capture.NewWriter(&capture.WriterConfig{Path: path, MaxSize: 100, MaxFiles: 2}, "sflow")
+	if err != nil {
+		t.Fatalf("NewWriter returned err: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		err := w.Write(capture.Datagram{
+			Src:      netip.MustParseAddrPort("192.0.2.1:1234"),
+			RecvTime: time.Now(),
+			Payload:  make([]byte, 60),
+		})
+		if err != nil {
+			t.Fatalf("Write returned err: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned err: %v", err)
+	}
+	for _, name := range []string{"test.cap", "test.cap.1", "test.cap.2"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to exist: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test.cap.3")); err == nil {
+		t.Error("expected test.cap.3 to not exist")
+	}
+}
+
+func TestNewWriter_KeepsExistingCapture(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.cap")
+	config := &capture.WriterConfig{Path: path}
+	w, err := capture.NewWriter(config, "sflow")
+	if err != nil {
+		t.Fatalf("NewWriter returned err: %v", err)
+	}
+	want := capture.Datagram{
+		Src:      netip.MustParseAddrPort("192.0.2.1:1234"),
+		RecvTime: time.Unix(0, 1700000000000000000),
+		Payload:  []byte("before restart"),
+	}
+	if err := w.Write(want); err != nil {
+		t.Fatalf("Write returned err: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned err: %v", err)
+	}
+
+	w, err = capture.NewWriter(config, "sflow")
+	if err != nil {
+		t.Fatalf("NewWriter returned err: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned err: %v", err)
+	}
+
+	f, err := os.Open(path + ".1")
+	if err != nil {
+		t.Fatalf("expected the previous capture to be rotated: %v", err)
+	}
+	defer f.Close()
+	r, err := capture.NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader returned err: %v", err)
+	}
+	got, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next returned err: %v", err)
+	}
+	if string(got.Payload) != string(want.Payload) {
+		t.Errorf("expected payload %q, got %q", want.Payload, got.Payload)
+	}
+}
+
+func TestNewReader_NotCaptureFile(t *testing.T) {
+	t.Parallel()
+	_, err := capture.NewReader(bytes.NewReader([]byte("definitely not a capture")))
+	if !errors.Is(err, capture.ErrNotCaptureFile) {
+		t.Errorf("expected ErrNotCaptureFile, got %v", err)
+	}
+}
+
+func TestPcapReader_NextUDP(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 65535)
+	binary.LittleEndian.PutUint32(header[20:24], 1)
+	buf.Write(header)
+
+	payload := []byte("flow data")
+	frame := make([]byte, 0)
+	frame = append(frame, 0x00, 0x11, 0x22, 0x33, 0x44, 0x55) // dst mac
+	frame = append(frame, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb) // src mac
+	frame = append(frame, 0x08, 0x00)                         // IPv4
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+8+len(payload)))
+	ip[8] = 64
+	ip[9] = 17
+	copy(ip[12:16], []byte{192, 0, 2, 1})
+	copy(ip[16:20], []byte{192, 0, 2, 2})
+	frame = append(frame, ip...)
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], 50000)
+	binary.BigEndian.PutUint16(udp[2:4], 2055)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+	frame = append(frame, udp...)
+	frame = append(frame, payload...)
+
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:4], 1666000000)
+	binary.LittleEndian.PutUint32(record[4:8], 500000)
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(frame)))
+	buf.Write(record)
+	buf.Write(frame)
+
+	r, err := capture.NewPcapReader(&buf)
+	if err != nil {
+		t.Fatalf("NewPcapReader returned err: %v", err)
+	}
+	d, dstPort, err := r.NextUDP()
+	if err != nil {
+		t.Fatalf("NextUDP returned err: %v", err)
+	}
+	if dstPort != 2055 {
+		t.Errorf("expected dst port 2055, got %d", dstPort)
+	}
+	if d.Src != netip.MustParseAddrPort("192.0.2.1:50000") {
+		t.Errorf("unexpected source %s", d.Src)
+	}
+	if !d.RecvTime.Equal(time.Unix(1666000000, 500000000)) {
+		t.Errorf("unexpected timestamp %s", d.RecvTime)
+	}
+	if string(d.Payload) != string(payload) {
+		t.Errorf("unexpected payload %q", d.Payload)
+	}
+	if _, _, err := r.NextUDP(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
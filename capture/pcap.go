@@ -0,0 +1,114 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/sapslaj/morbius/packet"
+)
+
+var ErrNotPcapFile = errors.New("not a pcap file")
+
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+)
+
+type PcapPacket struct {
+	Timestamp time.Time
+	LinkType  uint32
+	Data      []byte
+	// Length of the packet on the wire, which can be larger than len(Data)
+	// when the snap length cut it short.
+	OrigLen int
+}
+
+// PcapReader reads packets from a classic libpcap capture file.
+type PcapReader struct {
+	LinkType uint32
+	SnapLen  uint32
+	r        *bufio.Reader
+	order    binary.ByteOrder
+	nanos    bool
+}
+
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrNotPcapFile
+	}
+	pr := &PcapReader{r: br}
+	switch {
+	case binary.LittleEndian.Uint32(header[0:4]) == pcapMagicMicros:
+		pr.order = binary.LittleEndian
+	case binary.LittleEndian.Uint32(header[0:4]) == pcapMagicNanos:
+		pr.order = binary.LittleEndian
+		pr.nanos = true
+	case binary.BigEndian.Uint32(header[0:4]) == pcapMagicMicros:
+		pr.order = binary.BigEndian
+	case binary.BigEndian.Uint32(header[0:4]) == pcapMagicNanos:
+		pr.order = binary.BigEndian
+		pr.nanos = true
+	default:
+		return nil, ErrNotPcapFile
+	}
+	pr.SnapLen = pr.order.Uint32(header[16:20])
+	// The upper bits of the link type field are used for FCS information.
+	pr.LinkType = pr.order.Uint32(header[20:24]) & 0x0fffffff
+	return pr, nil
+}
+
+// Next returns the next packet in the file or io.EOF when there are no more.
+func (pr *PcapReader) Next() (PcapPacket, error) {
+	var p PcapPacket
+	var header [16]byte
+	if _, err := io.ReadFull(pr.r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return p, fmt.Errorf("pcap: truncated record header: %w", err)
+		}
+		return p, err
+	}
+	sec := int64(pr.order.Uint32(header[0:4]))
+	frac := int64(pr.order.Uint32(header[4:8]))
+	if !pr.nanos {
+		frac *= int64(time.Microsecond)
+	}
+	capLen := pr.order.Uint32(header[8:12])
+	if capLen > 256*1024 {
+		return p, fmt.Errorf("pcap: invalid capture length %d", capLen)
+	}
+	p.Timestamp = time.Unix(sec, frac)
+	p.LinkType = pr.LinkType
+	p.OrigLen = int(pr.order.Uint32(header[12:16]))
+	p.Data = make([]byte, capLen)
+	if _, err := io.ReadFull(pr.r, p.Data); err != nil {
+		return p, fmt.Errorf("pcap: truncated record: %w", err)
+	}
+	return p, nil
+}
+
+// NextUDP skips ahead to the next UDP packet in the file and returns it as a
+// Datagram along with its destination port.
+func (pr *PcapReader) NextUDP() (Datagram, uint16, error) {
+	for {
+		p, err := pr.Next()
+		if err != nil {
+			return Datagram{}, 0, err
+		}
+		decoded, err := packet.Decode(p.LinkType, p.Data)
+		if err != nil || decoded.Proto != packet.ProtoUDP || decoded.FragmentOffset != 0 {
+			continue
+		}
+		return Datagram{
+			Src:      netip.AddrPortFrom(decoded.SrcAddr, decoded.SrcPort),
+			RecvTime: p.Timestamp,
+			Payload:  decoded.Payload,
+		}, decoded.DstPort, nil
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/Masterminds/sprig/v3"
 	"github.com/sapslaj/morbius/destination"
 	"github.com/sapslaj/morbius/enricher"
+	"github.com/sapslaj/morbius/passivedns"
 	"github.com/sapslaj/morbius/server"
 	"github.com/sapslaj/morbius/transport"
 	"gopkg.in/yaml.v2"
@@ -21,20 +22,38 @@ type Config struct {
 	Server    *server.ServerConfig   `yaml:"server"`
 	Transport map[string]interface{} `yaml:"transport"` // TODO: better way of handling this (see Config.BuildTransport)
 	Enrichers struct {
-		AddrType    *enricher.AddrTypeEnricherConfig    `yaml:"addr_type"`
-		MaxmindDB   *enricher.MaxmindDBEnricherConfig   `yaml:"maxmind_db"`
-		NetDB       *enricher.NetDBEnricherConfig       `yaml:"netdb"`
-		ProtoNames  *enricher.ProtonamesEnricherConfig  `yaml:"proto_names"`
-		RDNS        *enricher.RDNSEnricherConfig        `yaml:"rdns"`
-		FieldMapper *enricher.FieldMapperEnricherConfig `yaml:"field_mapper"`
+		AddrType         *enricher.AddrTypeEnricherConfig         `yaml:"addr_type"`
+		MaxmindDB        *enricher.MaxmindDBEnricherConfig        `yaml:"maxmind_db"`
+		NetDB            *enricher.NetDBEnricherConfig            `yaml:"netdb"`
+		ProtoNames       *enricher.ProtonamesEnricherConfig       `yaml:"proto_names"`
+		RDNS             *enricher.RDNSEnricherConfig             `yaml:"rdns"`
+		FieldMapper      *enricher.FieldMapperEnricherConfig      `yaml:"field_mapper"`
+		PassiveDNS       *enricher.PassiveDNSEnricherConfig       `yaml:"passive_dns"`
+		CommunityID      *enricher.CommunityIDEnricherConfig      `yaml:"community_id"`
+		Flags            *enricher.FlagsEnricherConfig            `yaml:"flags"`
+		Leases           *enricher.LeasesEnricherConfig           `yaml:"leases"`
+		MACVendor        *enricher.MACVendorEnricherConfig        `yaml:"mac_vendor"`
+		PrefixTable      *enricher.PrefixTableEnricherConfig      `yaml:"prefix_table"`
+		TrafficDirection *enricher.TrafficDirectionEnricherConfig `yaml:"traffic_direction"`
 	} `yaml:"enrichers"`
 	Destinations struct {
 		Discard       *destination.DiscardDestinationConfig      `yaml:"discard"`
 		Elasticsearch *destination.ElasticseachDestinationConfig `yaml:"elasticsearch"`
+		Kafka         *destination.KafkaDestinationConfig        `yaml:"kafka"`
 		Loki          *destination.LokiDestinationConfig         `yaml:"loki"`
 		Prometheus    *destination.PrometheusDestinationConfig   `yaml:"prometheus"`
 		Stdout        *destination.StdoutDestinationConfig       `yaml:"stdout"`
 	} `yaml:"destinations"`
+	// Passive DNS table shared by the sflow listener and the passive_dns
+	// enricher.
+	PassiveDNS *passivedns.TableConfig `yaml:"passive_dns"`
+	// Background lookup workers shared by the enrichers with `cache_only`.
+	LookupPool *enricher.LookupPoolConfig `yaml:"lookup_pool"`
+
+	passiveDNSTable *passivedns.Table
+	lookupPool      *enricher.LookupPool
+	// Caches of the enrichers built by BuildEnrichers, by config key.
+	caches map[string]enricher.Cache
 }
 
 func NewFromFile(filename string) *Config {
@@ -69,13 +88,21 @@ func NewFromBytes(b []byte) *Config {
 
 func (c *Config) BuildEnrichers() []enricher.Enricher {
 	var enrichers []enricher.Enricher
+	c.caches = make(map[string]enricher.Cache)
 	if c.Enrichers.AddrType != nil {
 		addrTypeEnricher := enricher.NewAddrTypeEnricher(c.Enrichers.AddrType)
 		enrichers = append(enrichers, &addrTypeEnricher)
 	}
 	if c.Enrichers.MaxmindDB != nil {
-		maxmindDBEnricher := enricher.NewMaxmindDBEnricher(c.Enrichers.MaxmindDB)
+		var pool *enricher.LookupPool
+		if c.Enrichers.MaxmindDB.CacheOnly {
+			pool = c.SharedLookupPool()
+		}
+		maxmindDBEnricher := enricher.NewMaxmindDBEnricher(c.Enrichers.MaxmindDB, pool)
 		enrichers = append(enrichers, &maxmindDBEnricher)
+		if c.Enrichers.MaxmindDB.EnableCache {
+			c.caches["maxmind_db"] = &maxmindDBEnricher
+		}
 	}
 	if c.Enrichers.NetDB != nil {
 		netdbEnricher := enricher.NewNetDBEnricher(c.Enrichers.NetDB)
@@ -85,9 +112,45 @@ func (c *Config) BuildEnrichers() []enricher.Enricher {
 		protnamesEnricher := enricher.NewProtonamesEnricher(c.Enrichers.ProtoNames)
 		enrichers = append(enrichers, &protnamesEnricher)
 	}
+	// Before RDNS so addresses with leases don't need a PTR lookup.
+	if c.Enrichers.Leases != nil {
+		leasesEnricher := enricher.NewLeasesEnricher(c.Enrichers.Leases)
+		enrichers = append(enrichers, &leasesEnricher)
+	}
 	if c.Enrichers.RDNS != nil {
-		rdnsEnricher := enricher.NewRDNSEnricher(c.Enrichers.RDNS)
+		var pool *enricher.LookupPool
+		if c.Enrichers.RDNS.CacheOnly {
+			pool = c.SharedLookupPool()
+		}
+		rdnsEnricher := enricher.NewRDNSEnricher(c.Enrichers.RDNS, pool)
 		enrichers = append(enrichers, &rdnsEnricher)
+		if c.Enrichers.RDNS.EnableCache {
+			c.caches["rdns"] = &rdnsEnricher
+		}
+	}
+	if c.Enrichers.PassiveDNS != nil {
+		passiveDNSEnricher := enricher.NewPassiveDNSEnricher(c.Enrichers.PassiveDNS, c.PassiveDNSTable())
+		enrichers = append(enrichers, &passiveDNSEnricher)
+	}
+	if c.Enrichers.CommunityID != nil {
+		communityIDEnricher := enricher.NewCommunityIDEnricher(c.Enrichers.CommunityID)
+		enrichers = append(enrichers, &communityIDEnricher)
+	}
+	if c.Enrichers.Flags != nil {
+		flagsEnricher := enricher.NewFlagsEnricher(c.Enrichers.Flags)
+		enrichers = append(enrichers, &flagsEnricher)
+	}
+	if c.Enrichers.MACVendor != nil {
+		macVendorEnricher := enricher.NewMACVendorEnricher(c.Enrichers.MACVendor)
+		enrichers = append(enrichers, &macVendorEnricher)
+	}
+	if c.Enrichers.PrefixTable != nil {
+		prefixTableEnricher := enricher.NewPrefixTableEnricher(c.Enrichers.PrefixTable)
+		enrichers = append(enrichers, &prefixTableEnricher)
+	}
+	if c.Enrichers.TrafficDirection != nil {
+		trafficDirectionEnricher := enricher.NewTrafficDirectionEnricher(c.Enrichers.TrafficDirection)
+		enrichers = append(enrichers, &trafficDirectionEnricher)
 	}
 	if c.Enrichers.FieldMapper != nil {
 		fieldMapperEnricher := enricher.NewFieldMapperEnricher(c.Enrichers.FieldMapper)
@@ -96,6 +159,40 @@ func (c *Config) BuildEnrichers() []enricher.Enricher {
 	return enrichers
 }
 
+// PassiveDNSTable returns the passive DNS table, creating it on first use.
+func (c *Config) PassiveDNSTable() *passivedns.Table {
+	if c.passiveDNSTable == nil {
+		c.passiveDNSTable = passivedns.NewTable(c.PassiveDNS)
+	}
+	return c.passiveDNSTable
+}
+
+// SharedLookupPool returns the lookup pool, creating it on first use. Only
+// enrichers with `cache_only` use it, so its workers aren't started otherwise.
+func (c *Config) SharedLookupPool() *enricher.LookupPool {
+	if c.lookupPool == nil {
+		c.lookupPool = enricher.NewLookupPool(c.LookupPool)
+	}
+	return c.lookupPool
+}
+
+// ReadOnlyState keeps the server and enrichers built from c from saving any
+// state files, for replaying captures next to a collector running with the
+// same config. NetFlow templates and the passive DNS table are still loaded,
+// but enricher caches start empty since they're saved in the background.
+func (c *Config) ReadOnlyState() {
+	if c.Server == nil {
+		c.Server = &server.ServerConfig{}
+	}
+	c.Server.ReadOnlyState = true
+	if c.Enrichers.RDNS != nil {
+		c.Enrichers.RDNS.CachePath = ""
+	}
+	if c.Enrichers.MaxmindDB != nil {
+		c.Enrichers.MaxmindDB.CachePath = ""
+	}
+}
+
 func (c *Config) BuildDestinations() []destination.Destination {
 	var destinations []destination.Destination
 	if c.Destinations.Discard != nil {
@@ -106,6 +203,10 @@ func (c *Config) BuildDestinations() []destination.Destination {
 		elasticsearchDestination := destination.NewElasticsearchDestination(c.Destinations.Elasticsearch)
 		destinations = append(destinations, &elasticsearchDestination)
 	}
+	if c.Destinations.Kafka != nil {
+		kafkaDestination := destination.NewKafkaDestination(c.Destinations.Kafka)
+		destinations = append(destinations, &kafkaDestination)
+	}
 	if c.Destinations.Loki != nil {
 		lokiDestination := destination.NewLokiDestination(c.Destinations.Loki)
 		destinations = append(destinations, &lokiDestination)
@@ -223,5 +324,11 @@ func (c *Config) BuildServer() server.Server {
 	if c.Server == nil {
 		c.Server = &server.ServerConfig{}
 	}
+	usesPassiveDNS := c.PassiveDNS != nil || c.Enrichers.PassiveDNS != nil ||
+		(c.Server.SFlow != nil && c.Server.SFlow.L7 != nil && c.Server.SFlow.L7.PassiveDNS)
+	if usesPassiveDNS {
+		c.Server.PassiveDNS = c.PassiveDNSTable()
+	}
+	c.Server.Caches = c.caches
 	return *server.NewServerWithTransportAndLogger(*c.Server, transport, nil)
 }
@@ -0,0 +1,110 @@
+package destination
+
+import (
+	"net"
+
+	goflowpb "github.com/cloudflare/goflow/v3/pb"
+)
+
+func msgUint(msg map[string]interface{}, key string) uint64 {
+	value, _ := msg[key].(int)
+	return uint64(value)
+}
+
+func msgIP(msg map[string]interface{}, key string) []byte {
+	s, _ := msg[key].(string)
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func msgMAC(msg map[string]interface{}, key string) uint64 {
+	s, _ := msg[key].(string)
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 {
+		return 0
+	}
+	var v uint64
+	for _, b := range mac {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// FlowMessageFromMap converts a message back into a goflow FlowMessage. It's
+// the inverse of transport.FormatFlowMessage, so fields goflow doesn't have,
+// like the ones added by enrichers, are dropped. Messages from other inputs
+// get a type of FLOWUNKNOWN.
+func FlowMessageFromMap(msg map[string]interface{}) *goflowpb.FlowMessage {
+	typ, _ := msg["type"].(string)
+	hasEncap, _ := msg["has_encap"].(bool)
+	hasMPLS, _ := msg["has_mpls"].(bool)
+	hasPPP, _ := msg["has_ppp"].(bool)
+	return &goflowpb.FlowMessage{
+		Type:                goflowpb.FlowMessage_FlowType(goflowpb.FlowMessage_FlowType_value[typ]),
+		TimeReceived:        msgUint(msg, "time_received"),
+		SequenceNum:         uint32(msgUint(msg, "sequence_num")),
+		SamplingRate:        msgUint(msg, "sampling_rate"),
+		FlowDirection:       uint32(msgUint(msg, "flow_direction")),
+		SamplerAddress:      msgIP(msg, "sampler_address"),
+		TimeFlowStart:       msgUint(msg, "time_flow_start"),
+		TimeFlowEnd:         msgUint(msg, "time_flow_end"),
+		Bytes:               msgUint(msg, "bytes"),
+		Packets:             msgUint(msg, "packets"),
+		SrcAddr:             msgIP(msg, "src_addr"),
+		DstAddr:             msgIP(msg, "dst_addr"),
+		Etype:               uint32(msgUint(msg, "ethernet_type")),
+		Proto:               uint32(msgUint(msg, "proto")),
+		SrcPort:             uint32(msgUint(msg, "src_port")),
+		DstPort:             uint32(msgUint(msg, "dst_port")),
+		InIf:                uint32(msgUint(msg, "in_interface")),
+		OutIf:               uint32(msgUint(msg, "out_interface")),
+		SrcMac:              msgMAC(msg, "src_mac"),
+		DstMac:              msgMAC(msg, "dst_mac"),
+		SrcVlan:             uint32(msgUint(msg, "src_vlan")),
+		DstVlan:             uint32(msgUint(msg, "dst_vlan")),
+		VlanId:              uint32(msgUint(msg, "vlan_id")),
+		IngressVrfID:        uint32(msgUint(msg, "ingress_vrf_id")),
+		EgressVrfID:         uint32(msgUint(msg, "egress_vrf_id")),
+		IPTos:               uint32(msgUint(msg, "ip_tos")),
+		ForwardingStatus:    uint32(msgUint(msg, "forwarding_status")),
+		IPTTL:               uint32(msgUint(msg, "ip_ttl")),
+		TCPFlags:            uint32(msgUint(msg, "tcp_flags")),
+		IcmpType:            uint32(msgUint(msg, "icmp_types")),
+		IcmpCode:            uint32(msgUint(msg, "icmp_code")),
+		IPv6FlowLabel:       uint32(msgUint(msg, "ipv6_flow_label")),
+		FragmentId:          uint32(msgUint(msg, "fragment_id")),
+		FragmentOffset:      uint32(msgUint(msg, "fragment_offset")),
+		BiFlowDirection:     uint32(msgUint(msg, "bi_flow_direction")),
+		SrcAS:               uint32(msgUint(msg, "src_as")),
+		DstAS:               uint32(msgUint(msg, "dst_as")),
+		NextHop:             msgIP(msg, "next_hop"),
+		NextHopAS:           uint32(msgUint(msg, "next_hop_as")),
+		SrcNet:              uint32(msgUint(msg, "src_net")),
+		DstNet:              uint32(msgUint(msg, "dst_net")),
+		HasEncap:            hasEncap,
+		SrcAddrEncap:        msgIP(msg, "src_addr_encap"),
+		DstAddrEncap:        msgIP(msg, "dst_addr_encap"),
+		ProtoEncap:          uint32(msgUint(msg, "proto_encap")),
+		EtypeEncap:          uint32(msgUint(msg, "ethernet_type_encap")),
+		IPTosEncap:          uint32(msgUint(msg, "ip_tos_encap")),
+		IPTTLEncap:          uint32(msgUint(msg, "ip_ttl_encap")),
+		IPv6FlowLabelEncap:  uint32(msgUint(msg, "ipv6_flow_label_encap")),
+		FragmentIdEncap:     uint32(msgUint(msg, "fragment_id_encap")),
+		FragmentOffsetEncap: uint32(msgUint(msg, "fragment_offset_encap")),
+		HasMPLS:             hasMPLS,
+		MPLSCount:           uint32(msgUint(msg, "mpls_count")),
+		MPLS1TTL:            uint32(msgUint(msg, "mpls_1_ttl")),
+		MPLS1Label:          uint32(msgUint(msg, "mpls_1_label")),
+		MPLS2TTL:            uint32(msgUint(msg, "mpls_2_ttl")),
+		MPLS2Label:          uint32(msgUint(msg, "mpls_2_label")),
+		MPLS3TTL:            uint32(msgUint(msg, "mpls_3_ttl")),
+		MPLS3Label:          uint32(msgUint(msg, "mpls_3_label")),
+		MPLSLastTTL:         uint32(msgUint(msg, "mpls_last_ttl")),
+		MPLSLastLabel:       uint32(msgUint(msg, "mpls_last_label")),
+		HasPPP:              hasPPP,
+		PPPAddressControl:   uint32(msgUint(msg, "ppp_address_control")),
+	}
+}
@@ -0,0 +1,134 @@
+package destination
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+var MetricKafkaDestinationRecords = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kafka_destination_records",
+		Help: "Number of records produced by the Kafka destination",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(MetricKafkaDestinationRecords)
+}
+
+type KafkaDestinationConfig struct {
+	Brokers  []string `yaml:"brokers"`
+	Topic    string   `yaml:"topic"`
+	ClientID string   `yaml:"client_id"`
+	TLS      bool     `yaml:"tls"`
+	// `json` (default) or `protobuf` for goflow FlowMessages. Only fields
+	// FlowMessage has are kept with `protobuf`.
+	Encoding string `yaml:"encoding"`
+	// Prefix protobuf messages with their varint encoded length, like goflow
+	// does with -kafka.fixedlen.
+	FixedLength bool `yaml:"fixed_length"`
+	// Message field to use as the record key. Records are partitioned by a
+	// hash of the key the same way the Java client does, so all records with
+	// the same value go to the same partition. Records are spread evenly if
+	// unset.
+	KeyField string `yaml:"key_field"`
+}
+
+type KafkaDestination struct {
+	Config *KafkaDestinationConfig
+	client *kgo.Client
+	encode func(map[string]interface{}) ([]byte, error)
+}
+
+func NewKafkaDestination(config *KafkaDestinationConfig) KafkaDestination {
+	if config == nil {
+		config = &KafkaDestinationConfig{}
+	}
+	if len(config.Brokers) == 0 {
+		config.Brokers = []string{"localhost:9092"}
+	}
+	if config.Topic == "" {
+		config.Topic = "flows"
+	}
+	if config.ClientID == "" {
+		config.ClientID = "morbius"
+	}
+	d := KafkaDestination{
+		Config: config,
+	}
+	switch config.Encoding {
+	case "protobuf":
+		d.encode = d.encodeProtobuf
+	case "json", "":
+		d.encode = d.encodeJSON
+	default:
+		panic(fmt.Errorf("KafkaDestination: unknown encoding %q", config.Encoding))
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.ClientID(config.ClientID),
+		kgo.DefaultProduceTopic(config.Topic),
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)),
+	}
+	if config.TLS {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{}))
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		panic(err)
+	}
+	d.client = client
+	return d
+}
+
+func (d *KafkaDestination) encodeJSON(msg map[string]interface{}) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (d *KafkaDestination) encodeProtobuf(msg map[string]interface{}) ([]byte, error) {
+	fmsg := FlowMessageFromMap(msg)
+	if !d.Config.FixedLength {
+		return proto.Marshal(fmsg)
+	}
+	buf := proto.NewBuffer(nil)
+	err := buf.EncodeMessage(fmsg)
+	return buf.Bytes(), err
+}
+
+// Publish blocks while the client's produce buffer is full, which holds up
+// the transport until the brokers catch up.
+func (d *KafkaDestination) Publish(msg map[string]interface{}) {
+	value, err := d.encode(msg)
+	if err != nil {
+		MetricKafkaDestinationRecords.With(prometheus.Labels{"status": "error"}).Inc()
+		return
+	}
+	record := &kgo.Record{Value: value}
+	if d.Config.KeyField != "" {
+		if key, ok := msg[d.Config.KeyField]; ok {
+			record.Key = []byte(fmt.Sprint(key))
+		}
+	}
+	d.client.Produce(context.Background(), record, func(_ *kgo.Record, err error) {
+		if err != nil {
+			MetricKafkaDestinationRecords.With(prometheus.Labels{"status": "error"}).Inc()
+			return
+		}
+		MetricKafkaDestinationRecords.With(prometheus.Labels{"status": "produced"}).Inc()
+	})
+}
+
+// Close waits for buffered records to be produced and closes the client.
+func (d *KafkaDestination) Close() error {
+	err := d.client.Flush(context.Background())
+	d.client.Close()
+	return err
+}
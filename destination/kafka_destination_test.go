@@ -0,0 +1,150 @@
+package destination_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	goflowpb "github.com/cloudflare/goflow/v3/pb"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/sapslaj/morbius/destination"
+)
+
+func consumeKafka(t *testing.T, brokers []string, topic string, n int) []*kgo.Record {
+	t.Helper()
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var records []*kgo.Record
+	for len(records) < n {
+		fetches := client.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatalf("timed out with %d of %d records", len(records), n)
+		}
+		records = append(records, fetches.Records()...)
+	}
+	return records
+}
+
+func TestKafkaDestination(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		config destination.KafkaDestinationConfig
+		input  []map[string]interface{}
+		check  func(t *testing.T, records []*kgo.Record)
+	}
+
+	flow := func(src string, bytes int) map[string]interface{} {
+		return map[string]interface{}{
+			"type":          "SFLOW_5",
+			"src_addr":      src,
+			"dst_addr":      "2001:db8::1",
+			"bytes":         bytes,
+			"src_mac":       "00:00:5e:00:53:01",
+			"src_addr_name": "enriched.example.com",
+		}
+	}
+
+	tests := map[string]test{
+		"json keyed by field": {
+			config: destination.KafkaDestinationConfig{KeyField: "src_addr"},
+			input: []map[string]interface{}{
+				flow("192.0.2.1", 100),
+				flow("192.0.2.2", 200),
+				flow("192.0.2.1", 300),
+			},
+			check: func(t *testing.T, records []*kgo.Record) {
+				partitions := make(map[string]int32)
+				var values []string
+				for _, r := range records {
+					if p, ok := partitions[string(r.Key)]; ok && p != r.Partition {
+						t.Errorf("key %s in partitions %d and %d", r.Key, p, r.Partition)
+					}
+					partitions[string(r.Key)] = r.Partition
+					if string(r.Key) == "192.0.2.2" {
+						values = append(values, string(r.Value))
+					}
+				}
+				if len(partitions) != 2 {
+					t.Errorf("expected 2 keys, got %v", partitions)
+				}
+				want := []string{`{"bytes":200,"dst_addr":"2001:db8::1","src_addr":"192.0.2.2","src_addr_name":"enriched.example.com","src_mac":"00:00:5e:00:53:01","type":"SFLOW_5"}`}
+				if diff := cmp.Diff(want, values); diff != "" {
+					t.Errorf("mismatch (-want +got):\n%s", diff)
+				}
+			},
+		},
+		"protobuf": {
+			config: destination.KafkaDestinationConfig{Encoding: "protobuf"},
+			input:  []map[string]interface{}{flow("192.0.2.1", 100)},
+			check: func(t *testing.T, records []*kgo.Record) {
+				if records[0].Key != nil {
+					t.Errorf("expected no key, got %q", records[0].Key)
+				}
+				fmsg := &goflowpb.FlowMessage{}
+				if err := proto.Unmarshal(records[0].Value, fmsg); err != nil {
+					t.Fatal(err)
+				}
+				want := &goflowpb.FlowMessage{
+					Type:    goflowpb.FlowMessage_SFLOW_5,
+					SrcAddr: []byte{192, 0, 2, 1},
+					DstAddr: []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+					Bytes:   100,
+					SrcMac:  0x00005e005301,
+				}
+				if !proto.Equal(want, fmsg) {
+					t.Errorf("expected %v, got %v", want, fmsg)
+				}
+			},
+		},
+		"protobuf with length prefix": {
+			config: destination.KafkaDestinationConfig{Encoding: "protobuf", FixedLength: true},
+			input:  []map[string]interface{}{flow("192.0.2.1", 100)},
+			check: func(t *testing.T, records []*kgo.Record) {
+				fmsg := &goflowpb.FlowMessage{}
+				if err := proto.NewBuffer(records[0].Value).DecodeMessage(fmsg); err != nil {
+					t.Fatal(err)
+				}
+				if fmsg.Bytes != 100 {
+					t.Errorf("expected 100 bytes, got %d", fmsg.Bytes)
+				}
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(8, "flows"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cluster.Close()
+
+			config := tc.config
+			config.Brokers = cluster.ListenAddrs()
+			d := destination.NewKafkaDestination(&config)
+			for _, msg := range tc.input {
+				d.Publish(msg)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatalf("\"%s\": Close returned err: %v", name, err)
+			}
+			tc.check(t, consumeKafka(t, cluster.ListenAddrs(), "flows", len(tc.input)))
+		})
+	}
+}
@@ -3,20 +3,26 @@ package enricher
 import (
 	"log"
 	"net/netip"
+
+	"github.com/sapslaj/morbius/prefixtree"
 )
 
 type AddrTypeEnricherConfig struct {
-}
-
-type addrTypeEnricherPrefix struct {
-	cidr   string
-	prefix netip.Prefix
-	typ    string
+	// Map of prefix to type. These take precedence over the built-in prefixes,
+	// even more specific ones.
+	Prefixes map[string]string `yaml:"prefixes"`
+	// Built-in types to leave out, e.g. `documentation`. Addresses in them fall
+	// back to the next matching built-in prefix or `global`.
+	DisabledTypes []string `yaml:"disabled_types"`
+	// Leaves out all of the built-in prefixes.
+	DisableBuiltIn bool `yaml:"disable_built_in"`
 }
 
 type AddrTypeEnricher struct {
 	Config   *AddrTypeEnricherConfig
-	prefixes []addrTypeEnricherPrefix
+	custom   *prefixtree.Tree[string]
+	builtIn  *prefixtree.Tree[string]
+	disabled map[string]bool
 }
 
 func NewAddrTypeEnricher(config *AddrTypeEnricherConfig) AddrTypeEnricher {
@@ -24,7 +30,23 @@ func NewAddrTypeEnricher(config *AddrTypeEnricherConfig) AddrTypeEnricher {
 		config = &AddrTypeEnricherConfig{}
 	}
 	e := AddrTypeEnricher{
-		Config: config,
+		Config:   config,
+		custom:   prefixtree.New[string](),
+		builtIn:  prefixtree.New[string](),
+		disabled: make(map[string]bool),
+	}
+	for _, typ := range config.DisabledTypes {
+		e.disabled[typ] = true
+	}
+	for cidr, typ := range config.Prefixes {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			panic(err)
+		}
+		e.custom.Insert(prefix, typ)
+	}
+	if config.DisableBuiltIn {
+		return e
 	}
 
 	e.addPrefix("255.255.255.255/32", "limited-broadcast")
@@ -67,15 +89,14 @@ func NewAddrTypeEnricher(config *AddrTypeEnricherConfig) AddrTypeEnricher {
 }
 
 func (e *AddrTypeEnricher) addPrefix(cidr, typ string) {
+	if e.disabled[typ] {
+		return
+	}
 	prefix, err := netip.ParsePrefix(cidr)
 	if err != nil {
 		panic(err)
 	}
-	e.prefixes = append(e.prefixes, addrTypeEnricherPrefix{
-		cidr:   cidr,
-		prefix: prefix,
-		typ:    typ,
-	})
+	e.builtIn.Insert(prefix, typ)
 }
 
 func (e *AddrTypeEnricher) Process(msg map[string]interface{}) map[string]interface{} {
@@ -102,14 +123,19 @@ func (e *AddrTypeEnricher) add(msg map[string]interface{}, originalField string,
 		return msg
 	}
 
-	typ := "global"
-	for _, p := range e.prefixes {
-		if p.prefix.Contains(netipAddr) {
-			typ = p.typ
-			break
-		}
+	typ, ok := e.lookup(netipAddr)
+	if !ok {
+		typ = "global"
 	}
 	msg[targetField] = typ
 
 	return msg
 }
+
+func (e *AddrTypeEnricher) lookup(addr netip.Addr) (string, bool) {
+	if _, typ, ok := e.custom.Lookup(addr); ok {
+		return typ, true
+	}
+	_, typ, ok := e.builtIn.Lookup(addr)
+	return typ, ok
+}
@@ -11,9 +11,10 @@ import (
 func TestAddrTypeEnricher(t *testing.T) {
 	t.Parallel()
 	type test struct {
-		skip  string
-		input map[string]interface{}
-		want  map[string]interface{}
+		skip   string
+		config *enricher.AddrTypeEnricherConfig
+		input  map[string]interface{}
+		want   map[string]interface{}
 	}
 
 	tests := map[string]test{
@@ -186,6 +187,33 @@ func TestAddrTypeEnricher(t *testing.T) {
 			input: map[string]interface{}{"src_addr": "2001::1"},
 			want:  map[string]interface{}{"src_addr": "2001::1", "src_addr_type": "ietf-protocol-assignments"},
 		},
+		"user prefixes take precedence over built-in prefixes": {
+			config: &enricher.AddrTypeEnricherConfig{
+				Prefixes: map[string]string{"10.0.0.0/8": "corp", "192.0.0.0/16": "anycast"},
+			},
+			input: map[string]interface{}{"src_addr": "10.69.4.20", "dst_addr": "192.0.2.1"},
+			want:  map[string]interface{}{"src_addr": "10.69.4.20", "src_addr_type": "corp", "dst_addr": "192.0.2.1", "dst_addr_type": "anycast"},
+		},
+		"user prefixes use the longest match": {
+			config: &enricher.AddrTypeEnricherConfig{
+				Prefixes: map[string]string{"198.51.0.0/16": "ours", "198.51.100.0/24": "ours-anycast"},
+			},
+			input: map[string]interface{}{"src_addr": "198.51.100.1", "dst_addr": "198.51.1.1"},
+			want:  map[string]interface{}{"src_addr": "198.51.100.1", "src_addr_type": "ours-anycast", "dst_addr": "198.51.1.1", "dst_addr_type": "ours"},
+		},
+		"disabled types fall back to the next built-in prefix": {
+			config: &enricher.AddrTypeEnricherConfig{DisabledTypes: []string{"ds-lite", "documentation"}},
+			input:  map[string]interface{}{"src_addr": "192.0.0.1", "dst_addr": "192.0.2.1"},
+			want:   map[string]interface{}{"src_addr": "192.0.0.1", "src_addr_type": "ietf-protocol-assignments", "dst_addr": "192.0.2.1", "dst_addr_type": "global"},
+		},
+		"disabling built-in prefixes leaves only user prefixes": {
+			config: &enricher.AddrTypeEnricherConfig{
+				DisableBuiltIn: true,
+				Prefixes:       map[string]string{"10.1.0.0/16": "lab"},
+			},
+			input: map[string]interface{}{"src_addr": "10.1.0.1", "dst_addr": "10.2.0.1"},
+			want:  map[string]interface{}{"src_addr": "10.1.0.1", "src_addr_type": "lab", "dst_addr": "10.2.0.1", "dst_addr_type": "global"},
+		},
 	}
 
 	for name, tc := range tests {
@@ -201,7 +229,11 @@ func TestAddrTypeEnricher(t *testing.T) {
 				t.Logf("\"%s\": skip (%s)", name, tc.skip)
 				return
 			}
-			e := enricher.NewAddrTypeEnricher(&enricher.AddrTypeEnricherConfig{})
+			config := tc.config
+			if config == nil {
+				config = &enricher.AddrTypeEnricherConfig{}
+			}
+			e := enricher.NewAddrTypeEnricher(config)
 			got := e.Process(tc.input)
 			if diff := cmp.Diff(tc.want, got); diff != "" {
 				t.Logf("\"%s\":\n%s", name, diff)
@@ -0,0 +1,92 @@
+package enricher
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sapslaj/morbius/atomicfile"
+)
+
+// CacheEntry is a cached lookup as shown by the cache admin endpoints.
+type CacheEntry struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	// Nil for entries that don't expire.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Cache is implemented by enrichers with a lookup cache so the server can save
+// it on shutdown and expose it over HTTP.
+type Cache interface {
+	// CacheEntries returns the unexpired entries, least recently used first.
+	CacheEntries() []CacheEntry
+	CacheLookup(key string) (CacheEntry, bool)
+	// CachePurge removes key, or every entry if key is empty, and returns the
+	// number of entries removed.
+	CachePurge(key string) int
+	// CloseCache stops saving the cache periodically and saves it one last
+	// time.
+	CloseCache() error
+}
+
+// readCacheFile decodes a file written by writeCacheFile into v. A missing
+// file is not an error and leaves v alone.
+func readCacheFile(path string, v interface{}) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeCacheFile writes v as JSON without losing the previous snapshot if the
+// write fails partway.
+func writeCacheFile(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, b)
+}
+
+// cacheSaver calls save every interval until it's stopped.
+type cacheSaver struct {
+	stop chan struct{}
+	once sync.Once
+}
+
+func startCacheSaver(name string, interval time.Duration, save func() error) *cacheSaver {
+	s := &cacheSaver{stop: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := save(); err != nil {
+					log.Printf("error saving %s cache: %v", name, err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Stop is safe to call more than once, and on a nil saver.
+func (s *cacheSaver) Stop() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		close(s.stop)
+	})
+}
@@ -0,0 +1,134 @@
+package enricher
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	communityIDProtoICMP   = 1
+	communityIDProtoTCP    = 6
+	communityIDProtoUDP    = 17
+	communityIDProtoICMPv6 = 58
+	communityIDProtoSCTP   = 132
+)
+
+// ICMP types and the type of their reply (or request), so both directions of
+// an exchange get the same ID. Other types are treated as one-way.
+var (
+	communityIDICMPEquivalents = map[int]int{
+		8: 0, 0: 8, // echo
+		13: 14, 14: 13, // timestamp
+		15: 16, 16: 15, // information
+		10: 9, 9: 10, // router solicitation and advertisement
+		17: 18, 18: 17, // address mask
+	}
+	communityIDICMPv6Equivalents = map[int]int{
+		128: 129, 129: 128, // echo
+		133: 134, 134: 133, // router solicitation and advertisement
+		135: 136, 136: 135, // neighbor solicitation and advertisement
+		130: 131, 131: 130, // multicast listener query and report
+		139: 140, 140: 139, // node information query and response
+		144: 145, 145: 144, // home agent address discovery
+	}
+)
+
+type CommunityIDEnricherConfig struct {
+	// Seed mixed into the hash. Must match the other tools computing IDs for
+	// them to be comparable. Default is 0.
+	Seed uint16 `yaml:"seed"`
+}
+
+// CommunityIDEnricher adds the Community ID (v1) of the flow, as also computed
+// by Zeek, Suricata, and others. See
+// https://github.com/corelight/community-id-spec.
+type CommunityIDEnricher struct {
+	Config *CommunityIDEnricherConfig
+}
+
+func NewCommunityIDEnricher(config *CommunityIDEnricherConfig) CommunityIDEnricher {
+	if config == nil {
+		config = &CommunityIDEnricherConfig{}
+	}
+	return CommunityIDEnricher{
+		Config: config,
+	}
+}
+
+func (e *CommunityIDEnricher) Process(msg map[string]interface{}) map[string]interface{} {
+	srcStr, _ := msg["src_addr"].(string)
+	dstStr, _ := msg["dst_addr"].(string)
+	src, err := netip.ParseAddr(srcStr)
+	if err != nil {
+		return msg
+	}
+	dst, err := netip.ParseAddr(dstStr)
+	if err != nil {
+		return msg
+	}
+	proto, ok := msg["proto"].(int)
+	if !ok {
+		return msg
+	}
+
+	srcPort, _ := msg["src_port"].(int)
+	dstPort, _ := msg["dst_port"].(int)
+	if proto == communityIDProtoICMP || proto == communityIDProtoICMPv6 {
+		typ, ok := msg["icmp_types"].(int)
+		code, _ := msg["icmp_code"].(int)
+		// NetFlow v5 and some v9 exporters put the type and code in the
+		// destination port instead. The ICMP fields are always set for v9,
+		// IPFIX, and sFlow, to 0 when the exporter didn't send them, so a zero
+		// type and code with a destination port means the port has them.
+		if !ok || (typ == 0 && code == 0 && dstPort != 0) {
+			typ, code = dstPort>>8, dstPort&0xff
+		}
+		srcPort, dstPort = typ, code
+	}
+
+	msg["community_id"] = CommunityID(e.Config.Seed, src, dst, proto, srcPort, dstPort)
+	return msg
+}
+
+// CommunityID returns the v1 Community ID for a flow. For ICMP and ICMPv6 the
+// ports are the type and code.
+func CommunityID(seed uint16, src, dst netip.Addr, proto, srcPort, dstPort int) string {
+	src, dst = src.Unmap(), dst.Unmap()
+	oneWay := false
+	switch proto {
+	case communityIDProtoICMP, communityIDProtoICMPv6:
+		equivalents := communityIDICMPEquivalents
+		if proto == communityIDProtoICMPv6 {
+			equivalents = communityIDICMPv6Equivalents
+		}
+		if reply, ok := equivalents[srcPort]; ok {
+			dstPort = reply
+		} else {
+			oneWay = true
+		}
+	}
+
+	srcBytes, dstBytes := src.AsSlice(), dst.AsSlice()
+	if !oneWay {
+		c := bytes.Compare(srcBytes, dstBytes)
+		if c > 0 || (c == 0 && srcPort > dstPort) {
+			srcBytes, dstBytes = dstBytes, srcBytes
+			srcPort, dstPort = dstPort, srcPort
+		}
+	}
+
+	h := sha1.New()
+	_ = binary.Write(h, binary.BigEndian, seed)
+	h.Write(srcBytes)
+	h.Write(dstBytes)
+	h.Write([]byte{byte(proto), 0})
+	switch proto {
+	case communityIDProtoICMP, communityIDProtoICMPv6, communityIDProtoTCP, communityIDProtoUDP, communityIDProtoSCTP:
+		_ = binary.Write(h, binary.BigEndian, uint16(srcPort))
+		_ = binary.Write(h, binary.BigEndian, uint16(dstPort))
+	}
+	return "1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
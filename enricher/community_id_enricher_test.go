@@ -0,0 +1,125 @@
+package enricher_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/enricher"
+)
+
+func TestCommunityIDEnricher(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		config *enricher.CommunityIDEnricherConfig
+		input  map[string]interface{}
+		want   map[string]interface{}
+	}
+
+	tests := map[string]test{
+		"does not modify message if an address field is not defined": {
+			input: map[string]interface{}{"src_addr": "128.232.110.120", "proto": 6},
+			want:  map[string]interface{}{"src_addr": "128.232.110.120", "proto": 6},
+		},
+		"does not modify message if proto is not defined": {
+			input: map[string]interface{}{"src_addr": "128.232.110.120", "dst_addr": "66.35.250.204"},
+			want:  map[string]interface{}{"src_addr": "128.232.110.120", "dst_addr": "66.35.250.204"},
+		},
+		// Test vectors from the spec.
+		"tcp": {
+			input: map[string]interface{}{"src_addr": "128.232.110.120", "dst_addr": "66.35.250.204", "proto": 6, "src_port": 34855, "dst_port": 80},
+			want:  map[string]interface{}{"src_addr": "128.232.110.120", "dst_addr": "66.35.250.204", "proto": 6, "src_port": 34855, "dst_port": 80, "community_id": "1:LQU9qZlK+B5F3KDmev6m5PMibrg="},
+		},
+		"tcp reply": {
+			input: map[string]interface{}{"src_addr": "66.35.250.204", "dst_addr": "128.232.110.120", "proto": 6, "src_port": 80, "dst_port": 34855},
+			want:  map[string]interface{}{"src_addr": "66.35.250.204", "dst_addr": "128.232.110.120", "proto": 6, "src_port": 80, "dst_port": 34855, "community_id": "1:LQU9qZlK+B5F3KDmev6m5PMibrg="},
+		},
+		"tcp with seed": {
+			config: &enricher.CommunityIDEnricherConfig{Seed: 1},
+			input:  map[string]interface{}{"src_addr": "128.232.110.120", "dst_addr": "66.35.250.204", "proto": 6, "src_port": 34855, "dst_port": 80},
+			want:   map[string]interface{}{"src_addr": "128.232.110.120", "dst_addr": "66.35.250.204", "proto": 6, "src_port": 34855, "dst_port": 80, "community_id": "1:3V71V58M3Ksw/yuFALMcW0LAHvc="},
+		},
+		"udp": {
+			input: map[string]interface{}{"src_addr": "192.168.1.52", "dst_addr": "8.8.8.8", "proto": 17, "src_port": 54585, "dst_port": 53},
+			want:  map[string]interface{}{"src_addr": "192.168.1.52", "dst_addr": "8.8.8.8", "proto": 17, "src_port": 54585, "dst_port": 53, "community_id": "1:d/FP5EW3wiY1vCndhwleRRKHowQ="},
+		},
+		"icmp echo request": {
+			input: map[string]interface{}{"src_addr": "192.168.0.89", "dst_addr": "192.168.0.1", "proto": 1, "icmp_types": 8, "icmp_code": 0},
+			want:  map[string]interface{}{"src_addr": "192.168.0.89", "dst_addr": "192.168.0.1", "proto": 1, "icmp_types": 8, "icmp_code": 0, "community_id": "1:X0snYXpgwiv9TZtqg64sgzUn6Dk="},
+		},
+		"icmp echo reply": {
+			input: map[string]interface{}{"src_addr": "192.168.0.1", "dst_addr": "192.168.0.89", "proto": 1, "icmp_types": 0, "icmp_code": 0},
+			want:  map[string]interface{}{"src_addr": "192.168.0.1", "dst_addr": "192.168.0.89", "proto": 1, "icmp_types": 0, "icmp_code": 0, "community_id": "1:X0snYXpgwiv9TZtqg64sgzUn6Dk="},
+		},
+		"icmp type and code from dst_port": {
+			input: map[string]interface{}{"src_addr": "192.168.0.89", "dst_addr": "192.168.0.1", "proto": 1, "src_port": 0, "dst_port": 0x0800},
+			want:  map[string]interface{}{"src_addr": "192.168.0.89", "dst_addr": "192.168.0.1", "proto": 1, "src_port": 0, "dst_port": 0x0800, "community_id": "1:X0snYXpgwiv9TZtqg64sgzUn6Dk="},
+		},
+		"icmp type and code from dst_port with zero icmp fields": {
+			input: map[string]interface{}{"type": "NETFLOW_V9", "src_addr": "192.168.0.89", "dst_addr": "192.168.0.1", "proto": 1, "src_port": 0, "dst_port": 0x0800, "icmp_types": 0, "icmp_code": 0},
+			want:  map[string]interface{}{"type": "NETFLOW_V9", "src_addr": "192.168.0.89", "dst_addr": "192.168.0.1", "proto": 1, "src_port": 0, "dst_port": 0x0800, "icmp_types": 0, "icmp_code": 0, "community_id": "1:X0snYXpgwiv9TZtqg64sgzUn6Dk="},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			e := enricher.NewCommunityIDEnricher(tc.config)
+			got := e.Process(tc.input)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
+
+func TestCommunityID_Direction(t *testing.T) {
+	t.Parallel()
+	a := netip.MustParseAddr
+	type test struct {
+		forward  string
+		reverse  string
+		wantSame bool
+	}
+
+	tests := map[string]test{
+		"icmpv6 neighbor solicitation and advertisement": {
+			forward:  enricher.CommunityID(0, a("fe80::1"), a("fe80::2"), 58, 135, 0),
+			reverse:  enricher.CommunityID(0, a("fe80::2"), a("fe80::1"), 58, 136, 0),
+			wantSame: true,
+		},
+		"one-way icmp isn't reordered": {
+			forward: enricher.CommunityID(0, a("192.168.0.1"), a("192.168.0.89"), 1, 11, 0),
+			reverse: enricher.CommunityID(0, a("192.168.0.89"), a("192.168.0.1"), 1, 11, 0),
+		},
+		"same address ordered by port": {
+			forward:  enricher.CommunityID(0, a("::1"), a("::1"), 6, 5432, 40000),
+			reverse:  enricher.CommunityID(0, a("::1"), a("::1"), 6, 40000, 5432),
+			wantSame: true,
+		},
+		"protocols without ports": {
+			forward:  enricher.CommunityID(0, a("10.0.0.1"), a("10.0.0.2"), 47, 1, 2),
+			reverse:  enricher.CommunityID(0, a("10.0.0.2"), a("10.0.0.1"), 47, 0, 0),
+			wantSame: true,
+		},
+		"ipv4-mapped addresses hash as ipv4": {
+			forward:  enricher.CommunityID(0, a("::ffff:128.232.110.120"), a("66.35.250.204"), 6, 34855, 80),
+			reverse:  "1:LQU9qZlK+B5F3KDmev6m5PMibrg=",
+			wantSame: true,
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if (tc.forward == tc.reverse) != tc.wantSame {
+				t.Errorf("\"%s\": expected same ID %v, got %s and %s", name, tc.wantSame, tc.forward, tc.reverse)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package enricher
+
+import (
+	"os"
+	"time"
+)
+
+type watchedFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Missing files get the zero state, so they're picked up once they appear.
+func statWatchedFiles(paths []string) []watchedFileState {
+	states := make([]watchedFileState, len(paths))
+	for i, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			states[i] = watchedFileState{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return states
+}
+
+// watchFiles calls reload every interval that any of the files' modification
+// time or size has changed since states was taken. It never returns.
+func watchFiles(paths []string, interval time.Duration, states []watchedFileState, reload func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		current := statWatchedFiles(paths)
+		changed := false
+		for i := range current {
+			if current[i] != states[i] {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			continue
+		}
+		states = current
+		reload()
+	}
+}
@@ -0,0 +1,117 @@
+package enricher
+
+import "strings"
+
+var flagsEnricherTCPFlags = []struct {
+	bit  int
+	name string
+}{
+	{0x01, "FIN"},
+	{0x02, "SYN"},
+	{0x04, "RST"},
+	{0x08, "PSH"},
+	{0x10, "ACK"},
+	{0x20, "URG"},
+	{0x40, "ECE"},
+	{0x80, "CWR"},
+	{0x100, "NS"},
+}
+
+// Per-hop behaviour names for DSCP values, from RFC 2474, 2597, 3246, 5865,
+// and 8622.
+var flagsEnricherDSCPNames = map[int]string{
+	0:  "DF",
+	1:  "LE",
+	8:  "CS1",
+	10: "AF11",
+	12: "AF12",
+	14: "AF13",
+	16: "CS2",
+	18: "AF21",
+	20: "AF22",
+	22: "AF23",
+	24: "CS3",
+	26: "AF31",
+	28: "AF32",
+	30: "AF33",
+	32: "CS4",
+	34: "AF41",
+	36: "AF42",
+	38: "AF43",
+	40: "CS5",
+	44: "VOICE-ADMIT",
+	46: "EF",
+	48: "CS6",
+	56: "CS7",
+}
+
+// ECN codepoint names from RFC 3168.
+var flagsEnricherECNNames = []string{
+	"Not-ECT",
+	"ECT(1)",
+	"ECT(0)",
+	"CE",
+}
+
+type FlagsEnricherConfig struct {
+}
+
+// FlagsEnricher decodes `tcp_flags` into flag names and booleans, and `ip_tos`
+// and `ip_tos_encap` into their DSCP and ECN parts.
+type FlagsEnricher struct {
+	Config *FlagsEnricherConfig
+}
+
+func NewFlagsEnricher(config *FlagsEnricherConfig) FlagsEnricher {
+	if config == nil {
+		config = &FlagsEnricherConfig{}
+	}
+	return FlagsEnricher{
+		Config: config,
+	}
+}
+
+func (e *FlagsEnricher) Process(msg map[string]interface{}) map[string]interface{} {
+	msg = e.addTCPFlags(msg)
+	msg = e.addTOS(msg, "ip_tos", "")
+	msg = e.addTOS(msg, "ip_tos_encap", "_encap")
+	return msg
+}
+
+func (e *FlagsEnricher) addTCPFlags(msg map[string]interface{}) map[string]interface{} {
+	flags, ok := msg["tcp_flags"].(int)
+	if !ok {
+		return msg
+	}
+	// Exporters set tcp_flags to 0 for other protocols, which would otherwise
+	// look like a TCP flow with no flags.
+	if proto, ok := msg["proto"].(int); ok && proto != 6 {
+		return msg
+	}
+	names := make([]string, 0)
+	for _, flag := range flagsEnricherTCPFlags {
+		set := flags&flag.bit != 0
+		if set {
+			names = append(names, flag.name)
+		}
+		msg["tcp_flag_"+strings.ToLower(flag.name)] = set
+	}
+	msg["tcp_flags_names"] = names
+	return msg
+}
+
+func (e *FlagsEnricher) addTOS(msg map[string]interface{}, originalField string, suffix string) map[string]interface{} {
+	tos, ok := msg[originalField].(int)
+	if !ok {
+		return msg
+	}
+	dscp := (tos >> 2) & 0x3f
+	ecn := tos & 0x03
+	msg["ip_dscp"+suffix] = dscp
+	if name, ok := flagsEnricherDSCPNames[dscp]; ok {
+		msg["ip_dscp_name"+suffix] = name
+	}
+	msg["ip_ecn"+suffix] = ecn
+	msg["ip_ecn_name"+suffix] = flagsEnricherECNNames[ecn]
+	return msg
+}
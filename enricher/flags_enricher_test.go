@@ -0,0 +1,114 @@
+package enricher_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/enricher"
+)
+
+func TestFlagsEnricher(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		input map[string]interface{}
+		want  map[string]interface{}
+	}
+
+	tcpFlags := func(set ...string) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, name := range []string{"fin", "syn", "rst", "psh", "ack", "urg", "ece", "cwr", "ns"} {
+			m["tcp_flag_"+name] = false
+		}
+		for _, name := range set {
+			m["tcp_flag_"+name] = true
+		}
+		return m
+	}
+	merge := func(maps ...map[string]interface{}) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, other := range maps {
+			for k, v := range other {
+				m[k] = v
+			}
+		}
+		return m
+	}
+
+	tests := map[string]test{
+		"does not modify message if no fields are defined": {
+			input: map[string]interface{}{"other": 69},
+			want:  map[string]interface{}{"other": 69},
+		},
+		"decodes SYN without ACK": {
+			input: map[string]interface{}{"proto": 6, "tcp_flags": 0x02},
+			want: merge(
+				map[string]interface{}{"proto": 6, "tcp_flags": 0x02, "tcp_flags_names": []string{"SYN"}},
+				tcpFlags("syn"),
+			),
+		},
+		"decodes accumulated flags": {
+			input: map[string]interface{}{"tcp_flags": 0x11b},
+			want: merge(
+				map[string]interface{}{"tcp_flags": 0x11b, "tcp_flags_names": []string{"FIN", "SYN", "PSH", "ACK", "NS"}},
+				tcpFlags("fin", "syn", "psh", "ack", "ns"),
+			),
+		},
+		"skips tcp_flags for other protocols": {
+			input: map[string]interface{}{"proto": 17, "tcp_flags": 0},
+			want:  map[string]interface{}{"proto": 17, "tcp_flags": 0},
+		},
+		"decodes EF with ECT(0)": {
+			input: map[string]interface{}{"ip_tos": 0xba},
+			want: map[string]interface{}{
+				"ip_tos":       0xba,
+				"ip_dscp":      46,
+				"ip_dscp_name": "EF",
+				"ip_ecn":       2,
+				"ip_ecn_name":  "ECT(0)",
+			},
+		},
+		"decodes AF41 with CE": {
+			input: map[string]interface{}{"ip_tos": 0x8b},
+			want: map[string]interface{}{
+				"ip_tos":       0x8b,
+				"ip_dscp":      34,
+				"ip_dscp_name": "AF41",
+				"ip_ecn":       3,
+				"ip_ecn_name":  "CE",
+			},
+		},
+		"leaves out the name of unassigned DSCP values": {
+			input: map[string]interface{}{"ip_tos": 0x0c},
+			want: map[string]interface{}{
+				"ip_tos":      0x0c,
+				"ip_dscp":     3,
+				"ip_ecn":      0,
+				"ip_ecn_name": "Not-ECT",
+			},
+		},
+		"decodes ip_tos_encap": {
+			input: map[string]interface{}{"ip_tos_encap": 0xc0},
+			want: map[string]interface{}{
+				"ip_tos_encap":       0xc0,
+				"ip_dscp_encap":      48,
+				"ip_dscp_name_encap": "CS6",
+				"ip_ecn_encap":       0,
+				"ip_ecn_name_encap":  "Not-ECT",
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			e := enricher.NewFlagsEnricher(&enricher.FlagsEnricherConfig{})
+			got := e.Process(tc.input)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
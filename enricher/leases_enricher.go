@@ -0,0 +1,374 @@
+package enricher
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	MetricLeasesEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "leases_entries",
+			Help: "Number of addresses loaded by the leases enricher",
+		},
+	)
+	MetricLeasesReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "leases_reloads",
+			Help: "Number of times the leases enricher reloaded its files",
+		},
+		[]string{"status"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(MetricLeasesEntries)
+	prometheus.MustRegister(MetricLeasesReloads)
+}
+
+type LeasesEnricherFileConfig struct {
+	Path string `yaml:"path"`
+	// One of `dhcpd` (ISC dhcpd.leases), `kea` (Kea memfile CSV), `dnsmasq`,
+	// or `hosts` (/etc/hosts format).
+	Format string `yaml:"format"`
+}
+
+type LeasesEnricherConfig struct {
+	// Later files take precedence for the same address.
+	Files []*LeasesEnricherFileConfig `yaml:"files"`
+	// How often to check the files for changes. Set to a negative duration to
+	// disable reloading.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type leaseEntry struct {
+	hostname string
+	mac      string
+	// Zero for entries that don't expire.
+	expires time.Time
+}
+
+// LeasesEnricher sets the hostname fields from DHCP leases and hosts files.
+// It goes before RDNSEnricher, which leaves hostnames that are already set
+// alone, so addresses without PTR records still get names and addresses with
+// leases don't need a lookup.
+type LeasesEnricher struct {
+	Config  *LeasesEnricherConfig
+	entries *atomic.Pointer[map[netip.Addr]leaseEntry]
+}
+
+func NewLeasesEnricher(config *LeasesEnricherConfig) LeasesEnricher {
+	if config == nil {
+		config = &LeasesEnricherConfig{}
+	}
+	if config.ReloadInterval == 0 {
+		config.ReloadInterval = 30 * time.Second
+	}
+	e := LeasesEnricher{
+		Config:  config,
+		entries: &atomic.Pointer[map[netip.Addr]leaseEntry]{},
+	}
+	paths := make([]string, len(config.Files))
+	for i, file := range config.Files {
+		paths[i] = file.Path
+	}
+	states := statWatchedFiles(paths)
+	if err := e.Reload(); err != nil {
+		panic(err)
+	}
+	if config.ReloadInterval > 0 {
+		go watchFiles(paths, config.ReloadInterval, states, func() {
+			if err := e.Reload(); err != nil {
+				log.Printf("error reloading leases, keeping the previous ones: %v", err)
+			}
+		})
+	}
+	return e
+}
+
+// Reload reads all of the files and replaces the index. The previous index is
+// kept if any of the files can't be loaded.
+func (e *LeasesEnricher) Reload() error {
+	entries := make(map[netip.Addr]leaseEntry)
+	for _, file := range e.Config.Files {
+		// Files are parsed separately so a released lease in one doesn't
+		// remove an address that another file names.
+		fileEntries := make(map[netip.Addr]leaseEntry)
+		if err := loadLeasesFile(file, fileEntries); err != nil {
+			MetricLeasesReloads.With(prometheus.Labels{"status": "error"}).Inc()
+			return fmt.Errorf("leases: %s: %w", file.Path, err)
+		}
+		for addr, entry := range fileEntries {
+			entries[addr] = entry
+		}
+	}
+	e.entries.Store(&entries)
+	MetricLeasesEntries.Set(float64(len(entries)))
+	MetricLeasesReloads.With(prometheus.Labels{"status": "ok"}).Inc()
+	return nil
+}
+
+// A file that doesn't exist yet, e.g. because the DHCP server hasn't started,
+// is treated as empty. It's loaded on the next reload after it's created.
+func loadLeasesFile(file *LeasesEnricherFileConfig, entries map[netip.Addr]leaseEntry) error {
+	f, err := os.Open(file.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch file.Format {
+	case "dhcpd":
+		return parseDhcpdLeases(f, entries)
+	case "kea":
+		return parseKeaLeases(f, entries)
+	case "dnsmasq":
+		return parseDnsmasqLeases(f, entries)
+	case "hosts":
+		return parseHostsFile(f, entries)
+	default:
+		return fmt.Errorf("unknown format %q", file.Format)
+	}
+}
+
+// Lease hostnames are sometimes given as FQDNs with a trailing dot.
+func normalizeLeaseHostname(hostname string) string {
+	return strings.TrimSuffix(strings.TrimSpace(hostname), ".")
+}
+
+func normalizeLeaseMAC(mac string) string {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil {
+		return ""
+	}
+	return hw.String()
+}
+
+// ISC dhcpd appends a new lease block every time a lease changes, so the last
+// block for an address wins. Blocks that aren't active remove the address.
+func parseDhcpdLeases(r io.Reader, entries map[netip.Addr]leaseEntry) error {
+	scanner := bufio.NewScanner(r)
+	var (
+		addr   netip.Addr
+		entry  leaseEntry
+		active bool
+		depth  int
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if depth == 0 {
+			if strings.HasPrefix(line, "lease ") && strings.HasSuffix(line, "{") {
+				fields := strings.Fields(line)
+				a, err := netip.ParseAddr(fields[1])
+				if err != nil {
+					return fmt.Errorf("invalid lease address %q", fields[1])
+				}
+				addr, entry, active = a, leaseEntry{}, true
+				depth = 1
+			} else if strings.HasSuffix(line, "{") {
+				// Something other than a lease, e.g. a failover peer.
+				addr = netip.Addr{}
+				depth = 1
+			}
+			continue
+		}
+		if strings.HasSuffix(line, "{") {
+			depth++
+			continue
+		}
+		if line == "}" {
+			depth--
+			if depth == 0 && addr.IsValid() {
+				if active {
+					entries[addr] = entry
+				} else {
+					delete(entries, addr)
+				}
+				addr = netip.Addr{}
+			}
+			continue
+		}
+		if depth != 1 || !addr.IsValid() {
+			continue
+		}
+		stmt := strings.TrimSuffix(line, ";")
+		switch {
+		case strings.HasPrefix(stmt, "binding state "):
+			active = strings.TrimPrefix(stmt, "binding state ") == "active"
+		case strings.HasPrefix(stmt, "hardware ethernet "):
+			entry.mac = normalizeLeaseMAC(strings.TrimPrefix(stmt, "hardware ethernet "))
+		case strings.HasPrefix(stmt, "client-hostname "):
+			hostname, err := strconv.Unquote(strings.TrimPrefix(stmt, "client-hostname "))
+			if err == nil {
+				entry.hostname = normalizeLeaseHostname(hostname)
+			}
+		case strings.HasPrefix(stmt, "ends "):
+			// ends <weekday> <yyyy/mm/dd> <hh:mm:ss>; in UTC, ends never;, or
+			// with `db-time-format local`, ends epoch <seconds>; # <local time>
+			fields := strings.Fields(stmt)
+			if len(fields) >= 3 && fields[1] == "epoch" {
+				if secs, err := strconv.ParseInt(strings.TrimSuffix(fields[2], ";"), 10, 64); err == nil {
+					entry.expires = time.Unix(secs, 0)
+				}
+			} else if len(fields) == 4 {
+				if t, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3]); err == nil {
+					entry.expires = t
+				}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Kea's memfile backend is a CSV file that's appended to as leases change, so
+// the last row for an address wins. Rows with a state other than 0 (assigned)
+// remove the address.
+func parseKeaLeases(r io.Reader, entries map[netip.Addr]leaseEntry) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cols := make(map[string]int)
+	for i, col := range header {
+		cols[strings.TrimSpace(col)] = i
+	}
+	if _, ok := cols["address"]; !ok {
+		return errors.New("missing address column")
+	}
+	get := func(record []string, col string) string {
+		i, ok := cols[col]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		// Kea escapes commas in values.
+		return strings.ReplaceAll(record[i], "&#x2c", ",")
+	}
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		addr, err := netip.ParseAddr(get(record, "address"))
+		if err != nil {
+			continue
+		}
+		if state := get(record, "state"); state != "" && state != "0" {
+			delete(entries, addr)
+			continue
+		}
+		entry := leaseEntry{
+			hostname: normalizeLeaseHostname(get(record, "hostname")),
+			mac:      normalizeLeaseMAC(get(record, "hwaddr")),
+		}
+		if expire, err := strconv.ParseInt(get(record, "expire"), 10, 64); err == nil && expire > 0 {
+			entry.expires = time.Unix(expire, 0)
+		}
+		entries[addr] = entry
+	}
+}
+
+// dnsmasq lease lines are `<expiry> <mac or IAID> <address> <hostname>
+// <client ID>`, where the expiry is 0 for infinite leases and the hostname is
+// `*` if unknown.
+func parseDnsmasqLeases(r io.Reader, entries map[netip.Addr]leaseEntry) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The DUID line before the DHCPv6 leases only has two fields.
+		if len(fields) < 4 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		entry := leaseEntry{mac: normalizeLeaseMAC(fields[1])}
+		if fields[3] != "*" {
+			entry.hostname = normalizeLeaseHostname(fields[3])
+		}
+		if expiry, err := strconv.ParseInt(fields[0], 10, 64); err == nil && expiry > 0 {
+			entry.expires = time.Unix(expiry, 0)
+		}
+		entries[addr] = entry
+	}
+	return scanner.Err()
+}
+
+// The first name on a hosts line is used, aliases are ignored.
+func parseHostsFile(r io.Reader, entries map[netip.Addr]leaseEntry) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		entries[addr] = leaseEntry{hostname: normalizeLeaseHostname(fields[1])}
+	}
+	return scanner.Err()
+}
+
+func (e *LeasesEnricher) Process(msg map[string]interface{}) map[string]interface{} {
+	entries := *e.entries.Load()
+	now := time.Now()
+	msg = e.add(msg, entries, now, "src_addr", "src_hostname", "src_lease_mac")
+	msg = e.add(msg, entries, now, "dst_addr", "dst_hostname", "dst_lease_mac")
+	msg = e.add(msg, entries, now, "src_addr_encap", "src_hostname_encap", "src_lease_mac_encap")
+	msg = e.add(msg, entries, now, "dst_addr_encap", "dst_hostname_encap", "dst_lease_mac_encap")
+	return msg
+}
+
+func (e *LeasesEnricher) add(msg map[string]interface{}, entries map[netip.Addr]leaseEntry, now time.Time, originalField string, hostnameField string, macField string) map[string]interface{} {
+	addrStr, ok := msg[originalField].(string)
+	if !ok {
+		return msg
+	}
+	addr, err := netip.ParseAddr(addrStr)
+	if err != nil {
+		return msg
+	}
+	entry, ok := entries[addr.Unmap()]
+	if !ok {
+		return msg
+	}
+	if !entry.expires.IsZero() && now.After(entry.expires) {
+		return msg
+	}
+	if entry.hostname != "" {
+		msg[hostnameField] = entry.hostname
+	}
+	if entry.mac != "" {
+		msg[macField] = entry.mac
+	}
+	return msg
+}
@@ -0,0 +1,280 @@
+package enricher_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/enricher"
+)
+
+func TestLeasesEnricher(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		input map[string]interface{}
+		want  map[string]interface{}
+	}
+
+	dir := t.TempDir()
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	dhcpdTime := func(t time.Time) string {
+		return t.UTC().Format("2006/01/02 15:04:05")
+	}
+
+	e := enricher.NewLeasesEnricher(&enricher.LeasesEnricherConfig{
+		ReloadInterval: -1,
+		Files: []*enricher.LeasesEnricherFileConfig{
+			{
+				Format: "hosts",
+				Path: write("hosts", `# static hosts
+127.0.0.1   localhost
+10.0.0.1    router.lan router
+10.0.0.2    printer.lan # in the closet
+2001:db8::2 printer.lan
+10.0.0.50   nas.lan
+`),
+			},
+			{
+				Format: "dhcpd",
+				Path: write("dhcpd.leases", fmt.Sprintf(`# The format of this file is documented in the dhcpd.leases(5) manual page.
+authoring-byte-order little-endian;
+
+lease 10.0.0.10 {
+  starts 4 %[1]s;
+  ends 4 %[1]s;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:0A;
+  client-hostname "laptop";
+}
+lease 10.0.0.10 {
+  starts 4 %[1]s;
+  ends 4 %[2]s;
+  cltt 4 %[1]s;
+  binding state active;
+  next binding state free;
+  rewind binding state free;
+  hardware ethernet 00:11:22:33:44:0a;
+  uid "\001\000\021\"3D\012";
+  client-hostname "laptop-renewed";
+}
+lease 10.0.0.11 {
+  starts 4 %[1]s;
+  ends 4 %[1]s;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:0b;
+  client-hostname "expired";
+}
+lease 10.0.0.12 {
+  starts 4 %[1]s;
+  ends never;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:0c;
+}
+lease 10.0.0.13 {
+  starts 4 %[1]s;
+  ends 4 %[2]s;
+  binding state active;
+  client-hostname "released";
+}
+lease 10.0.0.13 {
+  starts 4 %[1]s;
+  ends 4 %[2]s;
+  binding state free;
+}
+lease 10.0.0.50 {
+  starts 4 %[1]s;
+  ends 4 %[2]s;
+  binding state free;
+}
+lease 10.0.0.14 {
+  starts epoch %[3]d; # local time
+  ends epoch %[4]d; # local time
+  binding state active;
+  client-hostname "desktop.lan.";
+}
+lease 10.0.0.15 {
+  starts epoch %[3]d; # local time
+  ends epoch %[3]d; # local time
+  binding state active;
+  client-hostname "expired-epoch";
+}
+`, dhcpdTime(past), dhcpdTime(future), past.Unix(), future.Unix())),
+			},
+			{
+				Format: "kea",
+				Path: write("kea-leases4.csv", fmt.Sprintf(`address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context,pool_id
+10.0.1.10,00:11:22:33:44:1a,,3600,%[1]d,1,0,0,phone.lan.,0,,0
+10.0.1.11,00:11:22:33:44:1b,,3600,%[1]d,1,0,0,declined,1,,0
+10.0.1.12,00:11:22:33:44:1c,,3600,%[2]d,1,0,0,old,0,,0
+`, future.Unix(), past.Unix())),
+			},
+			{
+				Format: "dnsmasq",
+				Path: write("dnsmasq.leases", fmt.Sprintf(`%[1]d 00:11:22:33:44:2a 10.0.2.10 tv 01:00:11:22:33:44:2a
+0 00:11:22:33:44:2b 10.0.2.11 * *
+duid 00:01:00:01:2c:4d:5e:6f:00:11:22:33:44:55
+%[1]d 12345678 2001:db8::10 tablet 00:01:00:01:2c:4d:5e:6f:00:11:22:33:44:66
+`, future.Unix())),
+			},
+		},
+	})
+
+	tests := map[string]test{
+		"does not modify message if an address field is not defined": {
+			input: map[string]interface{}{"other": 69},
+			want:  map[string]interface{}{"other": 69},
+		},
+		"does not modify message for unknown addresses": {
+			input: map[string]interface{}{"src_addr": "192.0.2.1"},
+			want:  map[string]interface{}{"src_addr": "192.0.2.1"},
+		},
+		"hosts file": {
+			input: map[string]interface{}{"src_addr": "10.0.0.1", "dst_addr": "2001:db8::2"},
+			want:  map[string]interface{}{"src_addr": "10.0.0.1", "src_hostname": "router.lan", "dst_addr": "2001:db8::2", "dst_hostname": "printer.lan"},
+		},
+		"hosts file with a trailing comment": {
+			input: map[string]interface{}{"src_addr": "10.0.0.2"},
+			want:  map[string]interface{}{"src_addr": "10.0.0.2", "src_hostname": "printer.lan"},
+		},
+		"dhcpd uses the last lease": {
+			input: map[string]interface{}{"src_addr": "10.0.0.10"},
+			want:  map[string]interface{}{"src_addr": "10.0.0.10", "src_hostname": "laptop-renewed", "src_lease_mac": "00:11:22:33:44:0a"},
+		},
+		"dhcpd skips expired leases": {
+			input: map[string]interface{}{"src_addr": "10.0.0.11"},
+			want:  map[string]interface{}{"src_addr": "10.0.0.11"},
+		},
+		"dhcpd lease without a hostname or expiry": {
+			input: map[string]interface{}{"src_addr": "10.0.0.12"},
+			want:  map[string]interface{}{"src_addr": "10.0.0.12", "src_lease_mac": "00:11:22:33:44:0c"},
+		},
+		"dhcpd skips released leases": {
+			input: map[string]interface{}{"src_addr": "10.0.0.13"},
+			want:  map[string]interface{}{"src_addr": "10.0.0.13"},
+		},
+		"dhcpd with db-time-format local": {
+			input: map[string]interface{}{"src_addr": "10.0.0.14"},
+			want:  map[string]interface{}{"src_addr": "10.0.0.14", "src_hostname": "desktop.lan"},
+		},
+		"dhcpd skips expired leases with db-time-format local": {
+			input: map[string]interface{}{"src_addr": "10.0.0.15"},
+			want:  map[string]interface{}{"src_addr": "10.0.0.15"},
+		},
+		"released leases don't remove names from other files": {
+			input: map[string]interface{}{"src_addr": "10.0.0.50"},
+			want:  map[string]interface{}{"src_addr": "10.0.0.50", "src_hostname": "nas.lan"},
+		},
+		"kea": {
+			input: map[string]interface{}{"dst_addr": "10.0.1.10"},
+			want:  map[string]interface{}{"dst_addr": "10.0.1.10", "dst_hostname": "phone.lan", "dst_lease_mac": "00:11:22:33:44:1a"},
+		},
+		"kea skips leases that aren't assigned": {
+			input: map[string]interface{}{"dst_addr": "10.0.1.11"},
+			want:  map[string]interface{}{"dst_addr": "10.0.1.11"},
+		},
+		"kea skips expired leases": {
+			input: map[string]interface{}{"dst_addr": "10.0.1.12"},
+			want:  map[string]interface{}{"dst_addr": "10.0.1.12"},
+		},
+		"dnsmasq": {
+			input: map[string]interface{}{"src_addr": "10.0.2.10"},
+			want:  map[string]interface{}{"src_addr": "10.0.2.10", "src_hostname": "tv", "src_lease_mac": "00:11:22:33:44:2a"},
+		},
+		"dnsmasq without a hostname": {
+			input: map[string]interface{}{"src_addr": "10.0.2.11"},
+			want:  map[string]interface{}{"src_addr": "10.0.2.11", "src_lease_mac": "00:11:22:33:44:2b"},
+		},
+		"dnsmasq ipv6": {
+			input: map[string]interface{}{"src_addr": "2001:db8::10"},
+			want:  map[string]interface{}{"src_addr": "2001:db8::10", "src_hostname": "tablet"},
+		},
+		"encap addresses": {
+			input: map[string]interface{}{"src_addr_encap": "10.0.2.10", "dst_addr_encap": "10.0.0.1"},
+			want: map[string]interface{}{
+				"src_addr_encap":      "10.0.2.10",
+				"src_hostname_encap":  "tv",
+				"src_lease_mac_encap": "00:11:22:33:44:2a",
+				"dst_addr_encap":      "10.0.0.1",
+				"dst_hostname_encap":  "router.lan",
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := e.Process(tc.input)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
+
+func TestLeasesEnricher_Reload(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("10.0.0.1 router\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := enricher.NewLeasesEnricher(&enricher.LeasesEnricherConfig{
+		Files:          []*enricher.LeasesEnricherFileConfig{{Path: path, Format: "hosts"}},
+		ReloadInterval: 10 * time.Millisecond,
+	})
+
+	if err := os.WriteFile(path, []byte("10.0.0.1 gateway.lan\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := e.Process(map[string]interface{}{"src_addr": "10.0.0.1"})["src_hostname"]
+		if got == "gateway.lan" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected gateway.lan, got %v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLeasesEnricher_MissingFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "dhcpd.leases")
+	e := enricher.NewLeasesEnricher(&enricher.LeasesEnricherConfig{
+		Files:          []*enricher.LeasesEnricherFileConfig{{Path: path, Format: "dhcpd"}},
+		ReloadInterval: 10 * time.Millisecond,
+	})
+	if got := e.Process(map[string]interface{}{"src_addr": "10.0.0.10"}); got["src_hostname"] != nil {
+		t.Errorf("expected no hostname before the file exists, got %v", got["src_hostname"])
+	}
+
+	if err := os.WriteFile(path, []byte("lease 10.0.0.10 {\n  binding state active;\n  client-hostname \"laptop\";\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := e.Process(map[string]interface{}{"src_addr": "10.0.0.10"})["src_hostname"]
+		if got == "laptop" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected laptop, got %v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,136 @@
+package enricher
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	MetricLookupPoolQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "lookup_pool_queue_depth",
+			Help: "Number of background lookups waiting for a worker",
+		},
+	)
+	MetricLookupPoolSubmitted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lookup_pool_submitted",
+			Help: "Number of background lookups submitted, by whether they were queued, already in flight, or dropped because the queue was full",
+		},
+		[]string{"enricher", "status"},
+	)
+	MetricLookupPoolWaitSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lookup_pool_wait_seconds",
+			Help:    "Time background lookups spent in the queue",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+		[]string{"enricher"},
+	)
+	MetricLookupPoolLookupSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lookup_pool_lookup_seconds",
+			Help:    "Time background lookups took to run",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+		[]string{"enricher"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(MetricLookupPoolQueueDepth)
+	prometheus.MustRegister(MetricLookupPoolSubmitted)
+	prometheus.MustRegister(MetricLookupPoolWaitSeconds)
+	prometheus.MustRegister(MetricLookupPoolLookupSeconds)
+}
+
+type LookupPoolConfig struct {
+	// Number of lookups that run at once. Default is 16.
+	Workers int `yaml:"workers"`
+	// Number of lookups that can wait for a worker. Lookups submitted while the
+	// queue is full are dropped. Default is 1024.
+	QueueSize int `yaml:"queue_size"`
+}
+
+type lookupPoolJob struct {
+	enricher string
+	id       string
+	fn       func()
+	queued   time.Time
+}
+
+// LookupPool runs the background lookups of enrichers with `cache_only` on a
+// fixed number of workers, so a burst of new addresses can't start an
+// unbounded number of goroutines.
+type LookupPool struct {
+	Config   *LookupPoolConfig
+	queue    chan lookupPoolJob
+	mu       sync.Mutex
+	inFlight map[string]struct{}
+}
+
+func NewLookupPool(config *LookupPoolConfig) *LookupPool {
+	if config == nil {
+		config = &LookupPoolConfig{}
+	}
+	if config.Workers <= 0 {
+		config.Workers = 16
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1024
+	}
+	p := &LookupPool{
+		Config:   config,
+		queue:    make(chan lookupPoolJob, config.QueueSize),
+		inFlight: make(map[string]struct{}),
+	}
+	for i := 0; i < config.Workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues fn to run on a worker unless a lookup for the same enricher
+// and key is already queued or running. It returns false if the queue is
+// full and fn was dropped.
+func (p *LookupPool) Submit(enricher string, key string, fn func()) bool {
+	id := enricher + "\x00" + key
+	p.mu.Lock()
+	if _, ok := p.inFlight[id]; ok {
+		p.mu.Unlock()
+		MetricLookupPoolSubmitted.With(prometheus.Labels{"enricher": enricher, "status": "in_flight"}).Inc()
+		return true
+	}
+	p.inFlight[id] = struct{}{}
+	p.mu.Unlock()
+
+	select {
+	case p.queue <- lookupPoolJob{enricher: enricher, id: id, fn: fn, queued: time.Now()}:
+		MetricLookupPoolSubmitted.With(prometheus.Labels{"enricher": enricher, "status": "queued"}).Inc()
+		MetricLookupPoolQueueDepth.Set(float64(len(p.queue)))
+		return true
+	default:
+		p.done(id)
+		MetricLookupPoolSubmitted.With(prometheus.Labels{"enricher": enricher, "status": "dropped"}).Inc()
+		return false
+	}
+}
+
+func (p *LookupPool) work() {
+	for job := range p.queue {
+		MetricLookupPoolQueueDepth.Set(float64(len(p.queue)))
+		start := time.Now()
+		MetricLookupPoolWaitSeconds.With(prometheus.Labels{"enricher": job.enricher}).Observe(start.Sub(job.queued).Seconds())
+		job.fn()
+		MetricLookupPoolLookupSeconds.With(prometheus.Labels{"enricher": job.enricher}).Observe(time.Since(start).Seconds())
+		p.done(job.id)
+	}
+}
+
+func (p *LookupPool) done(id string) {
+	p.mu.Lock()
+	delete(p.inFlight, id)
+	p.mu.Unlock()
+}
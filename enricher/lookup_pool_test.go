@@ -0,0 +1,81 @@
+package enricher_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sapslaj/morbius/enricher"
+)
+
+func TestLookupPool(t *testing.T) {
+	t.Parallel()
+
+	t.Run("runs submitted lookups", func(t *testing.T) {
+		t.Parallel()
+		pool := enricher.NewLookupPool(nil)
+		done := make(chan struct{})
+		if !pool.Submit("test", "192.0.2.1", func() { close(done) }) {
+			t.Fatal("expected lookup to be queued")
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("lookup never ran")
+		}
+	})
+
+	t.Run("deduplicates in-flight keys", func(t *testing.T) {
+		t.Parallel()
+		pool := enricher.NewLookupPool(&enricher.LookupPoolConfig{Workers: 1, QueueSize: 10})
+		release := make(chan struct{})
+		var runs atomic.Int32
+		lookup := func() {
+			runs.Add(1)
+			<-release
+		}
+		for i := 0; i < 5; i++ {
+			pool.Submit("test", "192.0.2.1", lookup)
+		}
+		// The same key for another enricher is a different lookup.
+		otherDone := make(chan struct{})
+		pool.Submit("other", "192.0.2.1", func() { close(otherDone) })
+		close(release)
+		select {
+		case <-otherDone:
+		case <-time.After(5 * time.Second):
+			t.Fatal("lookup for other enricher never ran")
+		}
+		if n := runs.Load(); n != 1 {
+			t.Errorf("expected 1 run, got %d", n)
+		}
+
+		// Keys can be looked up again once they're done.
+		again := make(chan struct{})
+		pool.Submit("test", "192.0.2.1", func() { close(again) })
+		select {
+		case <-again:
+		case <-time.After(5 * time.Second):
+			t.Fatal("second lookup never ran")
+		}
+	})
+
+	t.Run("drops when full", func(t *testing.T) {
+		t.Parallel()
+		pool := enricher.NewLookupPool(&enricher.LookupPoolConfig{Workers: 1, QueueSize: 1})
+		release := make(chan struct{})
+		defer close(release)
+		started := make(chan struct{})
+		pool.Submit("test", "192.0.2.1", func() {
+			close(started)
+			<-release
+		})
+		<-started
+		if !pool.Submit("test", "192.0.2.2", func() {}) {
+			t.Error("expected second lookup to be queued")
+		}
+		if pool.Submit("test", "192.0.2.3", func() {}) {
+			t.Error("expected third lookup to be dropped")
+		}
+	})
+}
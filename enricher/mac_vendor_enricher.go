@@ -0,0 +1,157 @@
+package enricher
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// A small, curated snapshot of the IEEE MA-L registry covering common server,
+// network, and virtualization vendors. The assignments it covers are listed in
+// hack/update-oui-snapshot.py, which regenerates it. Use Files with the full
+// registries for complete coverage.
+//
+//go:embed oui_snapshot.csv
+var macVendorEnricherSnapshot string
+
+// Assignment lengths in hex digits for MA-S, MA-M, and MA-L, longest first.
+var macVendorEnricherAssignmentLengths = []int{9, 7, 6}
+
+type MACVendorEnricherConfig struct {
+	// IEEE registry CSV files (oui.csv, mam.csv, and oui36.csv from
+	// standards-oui.ieee.org). These take precedence over the built-in
+	// snapshot.
+	Files []string `yaml:"files"`
+	// Don't load the built-in snapshot.
+	DisableBuiltIn bool `yaml:"disable_built_in"`
+}
+
+// MACVendorEnricher adds the vendor that a MAC address block is registered to,
+// and whether the address is locally administered or multicast.
+type MACVendorEnricher struct {
+	Config  *MACVendorEnricherConfig
+	vendors map[string]string
+}
+
+func NewMACVendorEnricher(config *MACVendorEnricherConfig) MACVendorEnricher {
+	if config == nil {
+		config = &MACVendorEnricherConfig{}
+	}
+	e := MACVendorEnricher{
+		Config:  config,
+		vendors: make(map[string]string),
+	}
+	if !config.DisableBuiltIn {
+		if err := loadMACVendors(strings.NewReader(macVendorEnricherSnapshot), e.vendors); err != nil {
+			panic(err)
+		}
+	}
+	for _, path := range config.Files {
+		if err := loadMACVendorFile(path, e.vendors); err != nil {
+			if config.DisableBuiltIn {
+				log.Printf("error loading MAC vendor registry `%s`: %v", path, err)
+			} else {
+				log.Printf("error loading MAC vendor registry `%s`, falling back to the built-in snapshot: %v", path, err)
+			}
+		}
+	}
+	return e
+}
+
+func loadMACVendorFile(path string, vendors map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return loadMACVendors(f, vendors)
+}
+
+func loadMACVendors(r io.Reader, vendors map[string]string) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	assignmentCol, nameCol := -1, -1
+	for i, col := range header {
+		switch strings.TrimSpace(col) {
+		case "Assignment":
+			assignmentCol = i
+		case "Organization Name":
+			nameCol = i
+		}
+	}
+	if assignmentCol == -1 || nameCol == -1 {
+		return errors.New("missing Assignment or Organization Name column")
+	}
+	// Entries are collected first so a bad file doesn't leave half of its
+	// entries behind.
+	entries := make(map[string]string)
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) <= assignmentCol || len(record) <= nameCol {
+			continue
+		}
+		assignment := strings.ToUpper(strings.TrimSpace(record[assignmentCol]))
+		switch len(assignment) {
+		case 6, 7, 9:
+		default:
+			return fmt.Errorf("invalid assignment %q", assignment)
+		}
+		entries[assignment] = strings.TrimSpace(record[nameCol])
+	}
+	for assignment, name := range entries {
+		vendors[assignment] = name
+	}
+	return nil
+}
+
+func (e *MACVendorEnricher) Process(msg map[string]interface{}) map[string]interface{} {
+	msg = e.add(msg, "src_mac", "src_mac_")
+	msg = e.add(msg, "dst_mac", "dst_mac_")
+	return msg
+}
+
+func (e *MACVendorEnricher) add(msg map[string]interface{}, originalField string, targetPrefix string) map[string]interface{} {
+	macStr, ok := msg[originalField].(string)
+	if !ok {
+		return msg
+	}
+	mac, err := net.ParseMAC(macStr)
+	if err != nil || len(mac) != 6 {
+		return msg
+	}
+	multicast := mac[0]&0x01 != 0
+	local := mac[0]&0x02 != 0
+	msg[targetPrefix+"multicast"] = multicast
+	msg[targetPrefix+"locally_administered"] = local
+	if local {
+		// Locally administered addresses aren't registered to anyone.
+		return msg
+	}
+	// Multicast addresses use the OUI of the organization that owns them,
+	// e.g. 01:00:5e is IANA's 00-00-5E.
+	mac[0] &^= 0x01
+	digits := strings.ToUpper(fmt.Sprintf("%x", []byte(mac)))
+	for _, n := range macVendorEnricherAssignmentLengths {
+		if vendor, ok := e.vendors[digits[:n]]; ok {
+			msg[targetPrefix+"vendor"] = vendor
+			break
+		}
+	}
+	return msg
+}
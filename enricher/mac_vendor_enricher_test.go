@@ -0,0 +1,163 @@
+package enricher_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/enricher"
+)
+
+func TestMACVendorEnricher(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		config *enricher.MACVendorEnricherConfig
+		input  map[string]interface{}
+		want   map[string]interface{}
+	}
+
+	registry := filepath.Join(t.TempDir(), "oui.csv")
+	err := os.WriteFile(registry, []byte(`Registry,Assignment,Organization Name,Organization Address
+MA-L,001BC5,IEEE Registration Authority,"445 Hoes Lane Piscataway NJ US 08554 "
+MA-M,70B3D51,"Example Devices, Inc.",Somewhere
+MA-S,70B3D5123,Example Sensors Ltd,Somewhere
+MA-S,001BC5012,Example Meters GmbH,Somewhere
+MA-L,000C29,Overridden VMware,Somewhere
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileConfig := &enricher.MACVendorEnricherConfig{Files: []string{registry}}
+
+	tests := map[string]test{
+		"does not modify message if a mac field is not defined": {
+			input: map[string]interface{}{"other": 69},
+			want:  map[string]interface{}{"other": 69},
+		},
+		"does nothing on an invalid mac": {
+			input: map[string]interface{}{"src_mac": "not a mac"},
+			want:  map[string]interface{}{"src_mac": "not a mac"},
+		},
+		"adds src_mac_vendor from the built-in snapshot": {
+			input: map[string]interface{}{"src_mac": "00:50:56:01:02:03"},
+			want: map[string]interface{}{
+				"src_mac":                      "00:50:56:01:02:03",
+				"src_mac_vendor":               "VMware, Inc.",
+				"src_mac_multicast":            false,
+				"src_mac_locally_administered": false,
+			},
+		},
+		"adds dst_mac_vendor from the built-in snapshot": {
+			input: map[string]interface{}{"dst_mac": "b8:27:eb:aa:bb:cc"},
+			want: map[string]interface{}{
+				"dst_mac":                      "b8:27:eb:aa:bb:cc",
+				"dst_mac_vendor":               "Raspberry Pi Foundation",
+				"dst_mac_multicast":            false,
+				"dst_mac_locally_administered": false,
+			},
+		},
+		"flags multicast and uses the owner's OUI": {
+			input: map[string]interface{}{"dst_mac": "01:00:5e:00:00:fb"},
+			want: map[string]interface{}{
+				"dst_mac":                      "01:00:5e:00:00:fb",
+				"dst_mac_vendor":               "ICANN, IANA Department",
+				"dst_mac_multicast":            true,
+				"dst_mac_locally_administered": false,
+			},
+		},
+		"flags locally administered without a vendor": {
+			input: map[string]interface{}{"src_mac": "02:42:ac:11:00:02"},
+			want: map[string]interface{}{
+				"src_mac":                      "02:42:ac:11:00:02",
+				"src_mac_multicast":            false,
+				"src_mac_locally_administered": true,
+			},
+		},
+		"unknown vendor": {
+			input: map[string]interface{}{"src_mac": "00:11:22:33:44:55"},
+			want: map[string]interface{}{
+				"src_mac":                      "00:11:22:33:44:55",
+				"src_mac_multicast":            false,
+				"src_mac_locally_administered": false,
+			},
+		},
+		"files take precedence over the built-in snapshot": {
+			config: fileConfig,
+			input:  map[string]interface{}{"src_mac": "00:0c:29:01:02:03"},
+			want: map[string]interface{}{
+				"src_mac":                      "00:0c:29:01:02:03",
+				"src_mac_vendor":               "Overridden VMware",
+				"src_mac_multicast":            false,
+				"src_mac_locally_administered": false,
+			},
+		},
+		"MA-M assignment": {
+			config: fileConfig,
+			input:  map[string]interface{}{"src_mac": "70:b3:d5:1f:00:01"},
+			want: map[string]interface{}{
+				"src_mac":                      "70:b3:d5:1f:00:01",
+				"src_mac_vendor":               "Example Devices, Inc.",
+				"src_mac_multicast":            false,
+				"src_mac_locally_administered": false,
+			},
+		},
+		"MA-S assignment is preferred over MA-M": {
+			config: fileConfig,
+			input:  map[string]interface{}{"src_mac": "70:b3:d5:12:30:01"},
+			want: map[string]interface{}{
+				"src_mac":                      "70:b3:d5:12:30:01",
+				"src_mac_vendor":               "Example Sensors Ltd",
+				"src_mac_multicast":            false,
+				"src_mac_locally_administered": false,
+			},
+		},
+		"MA-S assignment is preferred over MA-L": {
+			config: fileConfig,
+			input:  map[string]interface{}{"src_mac": "00:1b:c5:01:20:01", "dst_mac": "00:1b:c5:09:00:01"},
+			want: map[string]interface{}{
+				"src_mac":                      "00:1b:c5:01:20:01",
+				"src_mac_vendor":               "Example Meters GmbH",
+				"src_mac_multicast":            false,
+				"src_mac_locally_administered": false,
+				"dst_mac":                      "00:1b:c5:09:00:01",
+				"dst_mac_vendor":               "IEEE Registration Authority",
+				"dst_mac_multicast":            false,
+				"dst_mac_locally_administered": false,
+			},
+		},
+		"falls back to the built-in snapshot when a file can't be loaded": {
+			config: &enricher.MACVendorEnricherConfig{Files: []string{filepath.Join(t.TempDir(), "missing.csv")}},
+			input:  map[string]interface{}{"src_mac": "00:50:56:01:02:03"},
+			want: map[string]interface{}{
+				"src_mac":                      "00:50:56:01:02:03",
+				"src_mac_vendor":               "VMware, Inc.",
+				"src_mac_multicast":            false,
+				"src_mac_locally_administered": false,
+			},
+		},
+		"built-in snapshot can be disabled": {
+			config: &enricher.MACVendorEnricherConfig{DisableBuiltIn: true},
+			input:  map[string]interface{}{"src_mac": "00:50:56:01:02:03"},
+			want: map[string]interface{}{
+				"src_mac":                      "00:50:56:01:02:03",
+				"src_mac_multicast":            false,
+				"src_mac_locally_administered": false,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			e := enricher.NewMACVendorEnricher(tc.config)
+			got := e.Process(tc.input)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
@@ -1,9 +1,10 @@
 package enricher
 
 import (
+	"fmt"
 	"log"
 	"net"
-	"sync"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/oschwald/maxminddb-golang"
@@ -259,6 +260,14 @@ type MaxmindDBEnricherConfig struct {
 	DatabasePaths      []string                 `yaml:"database_paths"`
 	EnabledFields      []MaxmindDBEnricherField `yaml:"enabled_fields"`
 	EnabledFieldGroups []string                 `yaml:"enabled_field_groups"`
+	// File to save the cached addresses to so the cache is still warm after a
+	// restart. Only the addresses are saved; they're looked up again at
+	// startup so the cache never has data from an older database. Not saved if
+	// empty.
+	CachePath string `yaml:"cache_path"`
+	// How often to save the cache to CachePath. It's also saved on shutdown.
+	// Default is 1m.
+	CacheSaveInterval time.Duration `yaml:"cache_save_interval"`
 }
 
 func (c *MaxmindDBEnricherConfig) DedupEnabledFields() []MaxmindDBEnricherField {
@@ -277,13 +286,16 @@ func (c *MaxmindDBEnricherConfig) DedupEnabledFields() []MaxmindDBEnricherField
 type MaxmindDBEnricherIPData map[MaxmindDBEnricherField]interface{}
 
 type MaxmindDBEnricher struct {
-	Config            *MaxmindDBEnricherConfig
-	cache             *lru.Cache[string, MaxmindDBEnricherIPData]
-	cacheLookupStatus sync.Map
-	readers           []*maxminddb.Reader
+	Config  *MaxmindDBEnricherConfig
+	cache   *lru.Cache[string, MaxmindDBEnricherIPData]
+	pool    *LookupPool
+	readers []*maxminddb.Reader
+	saver   *cacheSaver
 }
 
-func NewMaxmindDBEnricher(config *MaxmindDBEnricherConfig) MaxmindDBEnricher {
+// NewMaxmindDBEnricher creates a MaxmindDBEnricher. With `cache_only` lookups
+// run on pool, which is created if nil.
+func NewMaxmindDBEnricher(config *MaxmindDBEnricherConfig, pool *LookupPool) MaxmindDBEnricher {
 	if config == nil {
 		config = &MaxmindDBEnricherConfig{}
 	}
@@ -296,6 +308,9 @@ func NewMaxmindDBEnricher(config *MaxmindDBEnricherConfig) MaxmindDBEnricher {
 	if config.DatabasePaths == nil {
 		config.DatabasePaths = make([]string, 0)
 	}
+	if config.CacheSaveInterval == 0 {
+		config.CacheSaveInterval = time.Minute
+	}
 	if config.EnabledFieldGroups == nil && config.EnabledFields == nil {
 		config.EnabledFieldGroups = []string{
 			"asn",
@@ -354,15 +369,97 @@ func NewMaxmindDBEnricher(config *MaxmindDBEnricherConfig) MaxmindDBEnricher {
 		readers = append(readers, reader)
 	}
 
+	if config.CacheOnly && pool == nil {
+		pool = NewLookupPool(nil)
+	}
+
 	e := MaxmindDBEnricher{
 		Config:  config,
 		readers: readers,
 		cache:   cache,
+		pool:    pool,
+	}
+
+	if config.EnableCache && config.CachePath != "" {
+		// A bad cache file shouldn't stop the collector from starting; the
+		// cache will just be cold.
+		if err := e.loadCache(); err != nil {
+			log.Printf("error loading MaxMind DB cache: %v", err)
+		}
+		e.saver = startCacheSaver("MaxMind DB", config.CacheSaveInterval, e.SaveCache)
 	}
 
 	return e
 }
 
+// loadCache looks up the addresses saved by SaveCache again.
+func (e *MaxmindDBEnricher) loadCache() error {
+	var saved []string
+	if err := readCacheFile(e.Config.CachePath, &saved); err != nil {
+		return fmt.Errorf("%s: %w", e.Config.CachePath, err)
+	}
+	// Saved least recently used first so recency is preserved.
+	for _, addr := range saved {
+		e.resolveIP(addr)
+	}
+	MetricMMDBCacheSize.Set(float64(e.cache.Len()))
+	return nil
+}
+
+func (e *MaxmindDBEnricher) SaveCache() error {
+	if e.cache == nil || e.Config.CachePath == "" {
+		return nil
+	}
+	return writeCacheFile(e.Config.CachePath, e.cache.Keys())
+}
+
+func (e *MaxmindDBEnricher) CloseCache() error {
+	e.saver.Stop()
+	return e.SaveCache()
+}
+
+func (e *MaxmindDBEnricher) CacheEntries() []CacheEntry {
+	if e.cache == nil {
+		return nil
+	}
+	entries := make([]CacheEntry, 0, e.cache.Len())
+	for _, addr := range e.cache.Keys() {
+		if data, ok := e.cache.Peek(addr); ok {
+			entries = append(entries, CacheEntry{Key: addr, Value: data})
+		}
+	}
+	return entries
+}
+
+func (e *MaxmindDBEnricher) CacheLookup(key string) (CacheEntry, bool) {
+	if e.cache == nil {
+		return CacheEntry{}, false
+	}
+	data, ok := e.cache.Peek(key)
+	if !ok {
+		return CacheEntry{}, false
+	}
+	return CacheEntry{Key: key, Value: data}, true
+}
+
+func (e *MaxmindDBEnricher) CachePurge(key string) int {
+	if e.cache == nil {
+		return 0
+	}
+	defer func() {
+		MetricMMDBCacheSize.Set(float64(e.cache.Len()))
+	}()
+	if key == "" {
+		n := e.cache.Len()
+		e.cache.Purge()
+		return n
+	}
+	if e.cache.Remove(key) {
+		return 1
+	}
+	return 0
+}
+
 func (e *MaxmindDBEnricher) Process(msg map[string]interface{}) map[string]interface{} {
 	defer func() {
 		if e.Config.EnableCache {
@@ -395,14 +492,9 @@ func (e *MaxmindDBEnricher) add(msg map[string]interface{}, originalField string
 	}
 
 	if e.Config.CacheOnly {
-		go func(addr string) {
-			_, inProgress := e.cacheLookupStatus.Load(addr)
-			if !inProgress {
-				e.cacheLookupStatus.Store(addr, true)
-				e.resolveIP(addr)
-				e.cacheLookupStatus.Delete(addr)
-			}
-		}(addr)
+		e.pool.Submit("maxmind_db", addr, func() {
+			e.resolveIP(addr)
+		})
 		return msg
 	}
 
@@ -466,7 +558,7 @@ func (e *MaxmindDBEnricher) resolveIP(ip string) MaxmindDBEnricherIPData {
 	return result
 }
 
-func (e MaxmindDBEnricher) localizedName(v interface{}) string {
+func (e *MaxmindDBEnricher) localizedName(v interface{}) string {
 	names := v.(map[string]interface{})
 	if name, ok := names[e.Config.Locale]; ok {
 		if name, ok := name.(string); ok {
@@ -1,7 +1,9 @@
 package enricher_test
 
 import (
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/sapslaj/morbius/enricher"
@@ -795,7 +797,7 @@ func TestMaxmindDBEnricher(t *testing.T) {
 				t.Logf("\"%s\": skip (%s)", name, tc.skip)
 				return
 			}
-			e := enricher.NewMaxmindDBEnricher(&tc.config)
+			e := enricher.NewMaxmindDBEnricher(&tc.config, nil)
 			got := e.Process(tc.input)
 			if diff := cmp.Diff(tc.want, got); diff != "" {
 				t.Logf("\"%s\":\n%s", name, diff)
@@ -804,3 +806,38 @@ func TestMaxmindDBEnricher(t *testing.T) {
 		})
 	}
 }
+
+func TestMaxmindDBEnricher_CachePath(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "maxmind_db.json")
+	config := func() *enricher.MaxmindDBEnricherConfig {
+		return &enricher.MaxmindDBEnricherConfig{
+			EnableCache:       true,
+			CachePath:         path,
+			CacheSaveInterval: time.Hour,
+		}
+	}
+	e := enricher.NewMaxmindDBEnricher(config(), nil)
+	e.Process(map[string]interface{}{"src_addr": "192.0.2.1", "dst_addr": "2001:db8::1"})
+	if err := e.SaveCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	e = enricher.NewMaxmindDBEnricher(config(), nil)
+	var keys []string
+	for _, entry := range e.CacheEntries() {
+		keys = append(keys, entry.Key)
+	}
+	if diff := cmp.Diff([]string{"192.0.2.1", "2001:db8::1"}, keys); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+	if _, ok := e.CacheLookup("2001:db8::1"); !ok {
+		t.Error("expected 2001:db8::1 to be cached")
+	}
+	if n := e.CachePurge("192.0.2.99"); n != 0 {
+		t.Errorf("expected nothing purged, got %d", n)
+	}
+	if n := e.CachePurge(""); n != 2 {
+		t.Errorf("expected 2 entries purged, got %d", n)
+	}
+}
@@ -0,0 +1,78 @@
+package enricher
+
+import (
+	"net/netip"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapslaj/morbius/passivedns"
+)
+
+var (
+	MetricPassiveDNSLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "passive_dns_lookups",
+			Help: "Number of passive DNS enricher table lookups",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(MetricPassiveDNSLookups)
+}
+
+type PassiveDNSEnricherConfig struct {
+}
+
+// PassiveDNSEnricher adds the names that were looked up to get the addresses
+// in a message, as seen in DNS responses sampled by the sflow listener. Unlike
+// RDNSEnricher this doesn't make any queries of its own.
+type PassiveDNSEnricher struct {
+	Config *PassiveDNSEnricherConfig
+	Table  *passivedns.Table
+}
+
+func NewPassiveDNSEnricher(config *PassiveDNSEnricherConfig, table *passivedns.Table) PassiveDNSEnricher {
+	if config == nil {
+		config = &PassiveDNSEnricherConfig{}
+	}
+	if table == nil {
+		table = passivedns.NewTable(nil)
+	}
+	return PassiveDNSEnricher{
+		Config: config,
+		Table:  table,
+	}
+}
+
+func (e *PassiveDNSEnricher) Process(msg map[string]interface{}) map[string]interface{} {
+	msg = e.add(msg, "src_addr", "src_dns_name")
+	msg = e.add(msg, "dst_addr", "dst_dns_name")
+	msg = e.add(msg, "src_addr_encap", "src_dns_name_encap")
+	msg = e.add(msg, "dst_addr_encap", "dst_dns_name_encap")
+	return msg
+}
+
+func (e *PassiveDNSEnricher) add(msg map[string]interface{}, originalField string, targetField string) map[string]interface{} {
+	addrRaw, ok := msg[originalField]
+	if !ok {
+		return msg
+	}
+	addrStr, ok := addrRaw.(string)
+	if !ok {
+		return msg
+	}
+	addr, err := netip.ParseAddr(addrStr)
+	if err != nil {
+		return msg
+	}
+	name, ok := e.Table.Lookup(addr)
+	if !ok {
+		MetricPassiveDNSLookups.With(prometheus.Labels{"result": "miss"}).Inc()
+		return msg
+	}
+	MetricPassiveDNSLookups.With(prometheus.Labels{"result": "hit"}).Inc()
+	msg[targetField] = name
+	return msg
+}
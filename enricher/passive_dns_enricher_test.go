@@ -0,0 +1,64 @@
+package enricher_test
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sapslaj/morbius/enricher"
+	"github.com/sapslaj/morbius/passivedns"
+)
+
+func TestPassiveDNSEnricher(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		input map[string]interface{}
+		want  map[string]interface{}
+	}
+
+	table := passivedns.NewTable(nil)
+	table.Add(netip.MustParseAddr("192.0.2.10"), "www.example.com", time.Hour)
+	table.Add(netip.MustParseAddr("2001:db8::1"), "example.net", time.Hour)
+
+	tests := map[string]test{
+		"does not modify message if an address field is not defined": {
+			input: map[string]interface{}{"other": 69},
+			want:  map[string]interface{}{"other": 69},
+		},
+		"adds src_dns_name and dst_dns_name": {
+			input: map[string]interface{}{"src_addr": "192.0.2.10", "dst_addr": "2001:db8::1"},
+			want: map[string]interface{}{
+				"src_addr":     "192.0.2.10",
+				"src_dns_name": "www.example.com",
+				"dst_addr":     "2001:db8::1",
+				"dst_dns_name": "example.net",
+			},
+		},
+		"adds encap fields": {
+			input: map[string]interface{}{"src_addr_encap": "192.0.2.10"},
+			want:  map[string]interface{}{"src_addr_encap": "192.0.2.10", "src_dns_name_encap": "www.example.com"},
+		},
+		"omits field for unknown addresses": {
+			input: map[string]interface{}{"src_addr": "192.0.2.99"},
+			want:  map[string]interface{}{"src_addr": "192.0.2.99"},
+		},
+		"ignores invalid addresses": {
+			input: map[string]interface{}{"src_addr": "not an address"},
+			want:  map[string]interface{}{"src_addr": "not an address"},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			e := enricher.NewPassiveDNSEnricher(nil, table)
+			got := e.Process(tc.input)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package enricher
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/sapslaj/morbius/prefixtree"
+)
+
+var (
+	MetricPrefixTablePrefixes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "prefix_table_prefixes",
+			Help: "Number of prefixes loaded by the prefix table enricher",
+		},
+	)
+	MetricPrefixTableReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "prefix_table_reloads",
+			Help: "Number of times the prefix table enricher reloaded its files",
+		},
+		[]string{"status"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(MetricPrefixTablePrefixes)
+	prometheus.MustRegister(MetricPrefixTableReloads)
+}
+
+type PrefixTableEnricherConfig struct {
+	// YAML (.yaml, .yml), JSON (.json), or CSV (.csv) files of prefixes and
+	// their attributes. Later files take precedence for the same prefix.
+	Files []string `yaml:"files"`
+	// Prepended to each attribute name, after the `src_`, `dst_`, etc. target.
+	FieldPrefix string `yaml:"field_prefix"`
+	// How often to check the files for changes. Set to a negative duration to
+	// disable reloading.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type prefixTable = prefixtree.Tree[map[string]string]
+
+// PrefixTableEnricher adds attributes from the longest matching prefix in a
+// set of files. A prefix inherits the attributes of the prefixes containing
+// it unless it sets them itself.
+type PrefixTableEnricher struct {
+	Config *PrefixTableEnricherConfig
+	table  *atomic.Pointer[prefixTable]
+}
+
+func NewPrefixTableEnricher(config *PrefixTableEnricherConfig) PrefixTableEnricher {
+	if config == nil {
+		config = &PrefixTableEnricherConfig{}
+	}
+	if config.FieldPrefix == "" {
+		config.FieldPrefix = "subnet_"
+	}
+	if config.ReloadInterval == 0 {
+		config.ReloadInterval = time.Minute
+	}
+	e := PrefixTableEnricher{
+		Config: config,
+		table:  &atomic.Pointer[prefixTable]{},
+	}
+	states := statWatchedFiles(config.Files)
+	if err := e.Reload(); err != nil {
+		panic(err)
+	}
+	if config.ReloadInterval > 0 {
+		go watchFiles(config.Files, config.ReloadInterval, states, func() {
+			if err := e.Reload(); err != nil {
+				log.Printf("error reloading prefix table, keeping the previous one: %v", err)
+			}
+		})
+	}
+	return e
+}
+
+// Reload reads all of the files and replaces the table. The previous table is
+// kept if any of the files can't be loaded.
+func (e *PrefixTableEnricher) Reload() error {
+	entries := make(map[netip.Prefix]map[string]string)
+	for _, path := range e.Config.Files {
+		if err := loadPrefixTableFile(path, entries); err != nil {
+			MetricPrefixTableReloads.With(prometheus.Labels{"status": "error"}).Inc()
+			return fmt.Errorf("prefix table: %s: %w", path, err)
+		}
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for prefix := range entries {
+		prefixes = append(prefixes, prefix)
+	}
+	// Shorter prefixes go in first so the ones inside them can inherit their
+	// attributes.
+	sort.Slice(prefixes, func(i, j int) bool {
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	})
+	table := prefixtree.New[map[string]string]()
+	for _, prefix := range prefixes {
+		attrs := entries[prefix]
+		if _, parent, ok := table.Lookup(prefix.Addr()); ok {
+			merged := make(map[string]string, len(parent)+len(attrs))
+			for k, v := range parent {
+				merged[k] = v
+			}
+			for k, v := range attrs {
+				merged[k] = v
+			}
+			attrs = merged
+		}
+		table.Insert(prefix, attrs)
+	}
+
+	e.table.Store(table)
+	MetricPrefixTablePrefixes.Set(float64(table.Len()))
+	MetricPrefixTableReloads.With(prometheus.Labels{"status": "ok"}).Inc()
+	return nil
+}
+
+func loadPrefixTableFile(path string, entries map[netip.Prefix]map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rows []map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(b, &rows); err != nil {
+			return err
+		}
+	case ".json":
+		dec := json.NewDecoder(f)
+		dec.UseNumber()
+		if err := dec.Decode(&rows); err != nil {
+			return err
+		}
+	case ".csv":
+		rows, err = readPrefixTableCSV(f)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown file type, expected .yaml, .yml, .json, or .csv")
+	}
+
+	for i, row := range rows {
+		prefix, err := parsePrefixOrAddr(row["prefix"])
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		attrs, ok := entries[prefix]
+		if !ok {
+			attrs = make(map[string]string)
+			entries[prefix] = attrs
+		}
+		for k, v := range row {
+			if k == "prefix" || v == nil {
+				continue
+			}
+			attrs[k] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+func readPrefixTableCSV(r io.Reader) ([]map[string]interface{}, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	var rows []map[string]interface{}
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(record))
+		for i, value := range record {
+			if value != "" {
+				row[header[i]] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// parsePrefixOrAddr parses a CIDR prefix. Bare addresses are treated as host
+// prefixes, like the datagram filter does.
+func parsePrefixOrAddr(raw interface{}) (netip.Prefix, error) {
+	s, ok := raw.(string)
+	if !ok {
+		return netip.Prefix{}, errors.New("missing prefix")
+	}
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+func (e *PrefixTableEnricher) Process(msg map[string]interface{}) map[string]interface{} {
+	table := e.table.Load()
+	msg = e.add(msg, table, "src_addr", "src_")
+	msg = e.add(msg, table, "dst_addr", "dst_")
+	msg = e.add(msg, table, "src_addr_encap", "src_encap_")
+	msg = e.add(msg, table, "dst_addr_encap", "dst_encap_")
+	return msg
+}
+
+func (e *PrefixTableEnricher) add(msg map[string]interface{}, table *prefixTable, originalField string, targetPrefix string) map[string]interface{} {
+	addrRaw, ok := msg[originalField]
+	if !ok {
+		return msg
+	}
+	addrStr, ok := addrRaw.(string)
+	if !ok {
+		return msg
+	}
+	addr, err := netip.ParseAddr(addrStr)
+	if err != nil {
+		return msg
+	}
+	prefix, attrs, ok := table.Lookup(addr)
+	if !ok {
+		return msg
+	}
+	fieldPrefix := targetPrefix + e.Config.FieldPrefix
+	msg[fieldPrefix+"prefix"] = prefix.String()
+	for k, v := range attrs {
+		msg[fieldPrefix+k] = v
+	}
+	return msg
+}
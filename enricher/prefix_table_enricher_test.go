@@ -0,0 +1,172 @@
+package enricher_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/enricher"
+)
+
+func writePrefixTableFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPrefixTableEnricher(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		input map[string]interface{}
+		want  map[string]interface{}
+	}
+
+	dir := t.TempDir()
+	files := []string{
+		writePrefixTableFile(t, dir, "sites.yaml", `
+- prefix: 10.0.0.0/8
+  site: hq
+  environment: prod
+- prefix: 10.20.0.0/16
+  site: branch
+- prefix: 2001:db8::/32
+  site: hq
+`),
+		writePrefixTableFile(t, dir, "vlans.csv", `prefix,vlan,owner
+10.20.30.0/24,30,
+10.20.40.0/24,40,netops
+`),
+		writePrefixTableFile(t, dir, "tenants.json", `[
+  {"prefix": "10.20.40.0/24", "tenant": "acme", "owner": "sre"},
+  {"prefix": "10.20.40.5", "vlan": 45}
+]`),
+	}
+	e := enricher.NewPrefixTableEnricher(&enricher.PrefixTableEnricherConfig{
+		Files:          files,
+		ReloadInterval: -1,
+	})
+
+	tests := map[string]test{
+		"does not modify message if an address field is not defined": {
+			input: map[string]interface{}{"other": 69},
+			want:  map[string]interface{}{"other": 69},
+		},
+		"does not modify message if there is no matching prefix": {
+			input: map[string]interface{}{"src_addr": "192.0.2.1"},
+			want:  map[string]interface{}{"src_addr": "192.0.2.1"},
+		},
+		"adds attributes for src_addr": {
+			input: map[string]interface{}{"src_addr": "10.1.2.3"},
+			want: map[string]interface{}{
+				"src_addr":               "10.1.2.3",
+				"src_subnet_prefix":      "10.0.0.0/8",
+				"src_subnet_site":        "hq",
+				"src_subnet_environment": "prod",
+			},
+		},
+		"inherits attributes from containing prefixes": {
+			input: map[string]interface{}{"dst_addr": "10.20.30.1"},
+			want: map[string]interface{}{
+				"dst_addr":               "10.20.30.1",
+				"dst_subnet_prefix":      "10.20.30.0/24",
+				"dst_subnet_site":        "branch",
+				"dst_subnet_environment": "prod",
+				"dst_subnet_vlan":        "30",
+			},
+		},
+		"later files take precedence": {
+			input: map[string]interface{}{"src_addr": "10.20.40.1"},
+			want: map[string]interface{}{
+				"src_addr":               "10.20.40.1",
+				"src_subnet_prefix":      "10.20.40.0/24",
+				"src_subnet_site":        "branch",
+				"src_subnet_environment": "prod",
+				"src_subnet_vlan":        "40",
+				"src_subnet_owner":       "sre",
+				"src_subnet_tenant":      "acme",
+			},
+		},
+		"bare addresses are host prefixes": {
+			input: map[string]interface{}{"src_addr": "10.20.40.5"},
+			want: map[string]interface{}{
+				"src_addr":               "10.20.40.5",
+				"src_subnet_prefix":      "10.20.40.5/32",
+				"src_subnet_site":        "branch",
+				"src_subnet_environment": "prod",
+				"src_subnet_vlan":        "45",
+				"src_subnet_owner":       "sre",
+				"src_subnet_tenant":      "acme",
+			},
+		},
+		"adds attributes for encap addresses": {
+			input: map[string]interface{}{"src_addr_encap": "2001:db8::1", "dst_addr_encap": "10.0.0.1"},
+			want: map[string]interface{}{
+				"src_addr_encap":               "2001:db8::1",
+				"dst_addr_encap":               "10.0.0.1",
+				"src_encap_subnet_prefix":      "2001:db8::/32",
+				"src_encap_subnet_site":        "hq",
+				"dst_encap_subnet_prefix":      "10.0.0.0/8",
+				"dst_encap_subnet_site":        "hq",
+				"dst_encap_subnet_environment": "prod",
+			},
+		},
+		"does nothing on empty string for address": {
+			input: map[string]interface{}{"src_addr": ""},
+			want:  map[string]interface{}{"src_addr": ""},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := e.Process(tc.input)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
+
+func TestPrefixTableEnricher_Reload(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := writePrefixTableFile(t, dir, "sites.csv", "prefix,site\n10.0.0.0/8,hq\n")
+	e := enricher.NewPrefixTableEnricher(&enricher.PrefixTableEnricherConfig{
+		Files:          []string{path},
+		FieldPrefix:    "net_",
+		ReloadInterval: 10 * time.Millisecond,
+	})
+
+	site := func() interface{} {
+		return e.Process(map[string]interface{}{"src_addr": "10.0.0.1"})["src_net_site"]
+	}
+	waitFor := func(want interface{}) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for site() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected site %v, got %v", want, site())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("hq")
+	writePrefixTableFile(t, dir, "sites.csv", "prefix,site\n10.0.0.0/8,branch-office\n")
+	waitFor("branch-office")
+
+	// A broken file keeps the previous table.
+	writePrefixTableFile(t, dir, "sites.csv", "prefix,site\nnot-a-prefix,hq\n")
+	time.Sleep(100 * time.Millisecond)
+	if got := site(); got != "branch-office" {
+		t.Errorf("expected site to still be branch-office, got %v", got)
+	}
+}
@@ -1,9 +1,14 @@
 package enricher
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"net"
 	"sort"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/prometheus/client_golang/prometheus"
@@ -48,32 +53,122 @@ type RDNSEnricherConfig struct {
 	EnableCache bool `yaml:"enable_cache"`
 	CacheSize   int  `yaml:"cache_size"`
 	CacheOnly   bool `yaml:"cache_only"`
+	// DNS servers to query as `host:port` or `host` for port 53, tried in
+	// turn. Default is the system resolver.
+	Resolvers []string `yaml:"resolvers"`
+	// Timeout for each lookup. Default is 2s.
+	Timeout time.Duration `yaml:"timeout"`
+	// Maximum number of lookups in flight at once. Default is 0 (unlimited).
+	MaxConcurrency int `yaml:"max_concurrency"`
+	// How long names are cached for. Default is 1h.
+	PositiveTTL time.Duration `yaml:"positive_ttl"`
+	// How long addresses without names, or that failed to resolve, are cached
+	// for. Default is 5m.
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+	// Set the hostname fields to a list of all of the PTR names instead of only
+	// the first one.
+	AllNames bool `yaml:"all_names"`
+	// File to save the cache to so it's still warm after a restart. Entries
+	// keep their expiry times. Not saved if empty.
+	CachePath string `yaml:"cache_path"`
+	// How often to save the cache to CachePath. It's also saved on shutdown.
+	// Default is 1m.
+	CacheSaveInterval time.Duration `yaml:"cache_save_interval"`
+}
+
+type rdnsCacheEntry struct {
+	names   []string
+	expires time.Time
+}
+
+type rdnsSavedCacheEntry struct {
+	Addr    string    `json:"addr"`
+	Names   []string  `json:"names"`
+	Expires time.Time `json:"expires"`
 }
 
 type RDNSEnricher struct {
-	Config            *RDNSEnricherConfig
-	cache             *lru.Cache[string, string]
-	cacheLookupStatus sync.Map
+	Config   *RDNSEnricherConfig
+	cache    *lru.Cache[string, rdnsCacheEntry]
+	pool     *LookupPool
+	resolver *net.Resolver
+	sem      chan struct{}
+	saver    *cacheSaver
 }
 
-func NewRDNSEnricher(config *RDNSEnricherConfig) RDNSEnricher {
+// NewRDNSEnricher creates an RDNSEnricher. With `cache_only` lookups run on
+// pool, which is created if nil.
+func NewRDNSEnricher(config *RDNSEnricherConfig, pool *LookupPool) RDNSEnricher {
 	if config == nil {
 		config = &RDNSEnricherConfig{}
 	}
 	if config.EnableCache && config.CacheSize == 0 {
 		config.CacheSize = 128
 	}
-	var cache *lru.Cache[string, string]
+	if config.Timeout == 0 {
+		config.Timeout = 2 * time.Second
+	}
+	if config.PositiveTTL == 0 {
+		config.PositiveTTL = time.Hour
+	}
+	if config.NegativeTTL == 0 {
+		config.NegativeTTL = 5 * time.Minute
+	}
+	if config.CacheSaveInterval == 0 {
+		config.CacheSaveInterval = time.Minute
+	}
+	var cache *lru.Cache[string, rdnsCacheEntry]
 	var err error
 	if config.EnableCache {
-		cache, err = lru.New[string, string](config.CacheSize)
+		cache, err = lru.New[string, rdnsCacheEntry](config.CacheSize)
 		if err != nil {
 			panic(err)
 		}
 	}
-	return RDNSEnricher{
-		Config: config,
-		cache:  cache,
+	if config.CacheOnly && pool == nil {
+		pool = NewLookupPool(nil)
+	}
+	var sem chan struct{}
+	if config.MaxConcurrency > 0 {
+		sem = make(chan struct{}, config.MaxConcurrency)
+	}
+	e := RDNSEnricher{
+		Config:   config,
+		cache:    cache,
+		pool:     pool,
+		resolver: newRDNSResolver(config.Resolvers),
+		sem:      sem,
+	}
+	if config.EnableCache && config.CachePath != "" {
+		// A bad cache file shouldn't stop the collector from starting; the
+		// cache will just be cold.
+		if err := e.loadCache(); err != nil {
+			log.Printf("error loading RDNS cache: %v", err)
+		}
+		e.saver = startCacheSaver("RDNS", config.CacheSaveInterval, e.SaveCache)
+	}
+	return e
+}
+
+func newRDNSResolver(servers []string) *net.Resolver {
+	if len(servers) == 0 {
+		return net.DefaultResolver
+	}
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		addrs[i] = server
+	}
+	var next atomic.Uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			addr := addrs[int(next.Add(1)-1)%len(addrs)]
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
 	}
 }
 
@@ -93,61 +188,170 @@ func (e *RDNSEnricher) add(msg map[string]interface{}, originalField string, tar
 	if !ok {
 		return msg
 	}
+	// Already named by something cheaper, like LeasesEnricher.
+	if _, ok := msg[targetField]; ok {
+		return msg
+	}
 	addr := addrRaw.(string)
-	var value string
 
 	if e.Config.EnableCache {
-		value, ok := e.cache.Get(addr)
-		if ok {
+		entry, ok := e.cache.Get(addr)
+		if ok && time.Now().Before(entry.expires) {
 			MetricRDNSCacheHits.Inc()
-			if value != "" {
-				msg[targetField] = value
-			}
+			e.set(msg, targetField, entry.names)
 			return msg
 		}
 		MetricRDNSCacheMisses.Inc()
 	}
 
 	if e.Config.CacheOnly {
-		go func(addr string) {
-			_, inProgress := e.cacheLookupStatus.Load(addr)
-			if !inProgress {
-				e.cacheLookupStatus.Store(addr, true)
-				e.lookup(addr)
-				e.cacheLookupStatus.Delete(addr)
-			}
-		}(addr)
+		e.pool.Submit("rdns", addr, func() {
+			e.lookup(addr)
+		})
 		return msg
 	}
 
-	value, ok = e.lookup(addr)
-	if !ok {
-		return msg
+	e.set(msg, targetField, e.lookup(addr))
+	return msg
+}
+
+func (e *RDNSEnricher) set(msg map[string]interface{}, targetField string, names []string) {
+	if len(names) == 0 {
+		return
 	}
-	if value != "" {
-		msg[targetField] = value
+	if e.Config.AllNames {
+		msg[targetField] = names
+	} else {
+		msg[targetField] = names[0]
 	}
-	return msg
 }
 
-func (e *RDNSEnricher) lookup(addr string) (string, bool) {
-	names, err := net.LookupAddr(addr)
-	if err != nil {
+// lookup returns the sorted PTR names for addr, caching them if the cache is
+// enabled. Failed lookups are cached like addresses without names so a
+// broken resolver isn't queried for every flow.
+func (e *RDNSEnricher) lookup(addr string) []string {
+	if e.sem != nil {
+		e.sem <- struct{}{}
+		defer func() { <-e.sem }()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.Config.Timeout)
+	defer cancel()
+	names, err := e.resolver.LookupAddr(ctx, addr)
+
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		MetricRDNSLookups.With(prometheus.Labels{"status": "empty"}).Inc()
+	case err != nil:
 		MetricRDNSLookups.With(prometheus.Labels{"status": "error"}).Inc()
-		// TODO: only return ok = true on general lookup failures
-	} else if len(names) == 0 {
+	case len(names) == 0:
 		MetricRDNSLookups.With(prometheus.Labels{"status": "empty"}).Inc()
-	} else {
+	default:
 		MetricRDNSLookups.With(prometheus.Labels{"status": "success"}).Inc()
 	}
 
-	value := ""
-	if len(names) > 0 {
+	ttl := e.Config.NegativeTTL
+	if err == nil && len(names) > 0 {
 		sort.Strings(names)
-		value = names[0]
+		ttl = e.Config.PositiveTTL
+	} else {
+		names = nil
 	}
 	if e.Config.EnableCache {
-		e.cache.Add(addr, value)
+		e.cache.Add(addr, rdnsCacheEntry{names: names, expires: time.Now().Add(ttl)})
+	}
+	return names
+}
+
+// loadCache adds the unexpired entries saved by SaveCache.
+func (e *RDNSEnricher) loadCache() error {
+	var saved []rdnsSavedCacheEntry
+	if err := readCacheFile(e.Config.CachePath, &saved); err != nil {
+		return fmt.Errorf("%s: %w", e.Config.CachePath, err)
+	}
+	now := time.Now()
+	// Saved least recently used first so recency is preserved.
+	for _, entry := range saved {
+		if now.After(entry.Expires) {
+			continue
+		}
+		e.cache.Add(entry.Addr, rdnsCacheEntry{names: entry.Names, expires: entry.Expires})
+	}
+	MetricRDNSCacheSize.Set(float64(e.cache.Len()))
+	return nil
+}
+
+func (e *RDNSEnricher) SaveCache() error {
+	if e.cache == nil || e.Config.CachePath == "" {
+		return nil
+	}
+	now := time.Now()
+	saved := make([]rdnsSavedCacheEntry, 0, e.cache.Len())
+	for _, addr := range e.cache.Keys() {
+		entry, ok := e.cache.Peek(addr)
+		if !ok || now.After(entry.expires) {
+			continue
+		}
+		saved = append(saved, rdnsSavedCacheEntry{Addr: addr, Names: entry.names, Expires: entry.expires})
+	}
+	return writeCacheFile(e.Config.CachePath, saved)
+}
+
+func (e *RDNSEnricher) CloseCache() error {
+	e.saver.Stop()
+	return e.SaveCache()
+}
+
+func (e *RDNSEnricher) CacheEntries() []CacheEntry {
+	if e.cache == nil {
+		return nil
+	}
+	now := time.Now()
+	entries := make([]CacheEntry, 0, e.cache.Len())
+	for _, addr := range e.cache.Keys() {
+		entry, ok := e.cache.Peek(addr)
+		if !ok || now.After(entry.expires) {
+			continue
+		}
+		entries = append(entries, rdnsCacheEntryFor(addr, entry))
+	}
+	return entries
+}
+
+func (e *RDNSEnricher) CacheLookup(key string) (CacheEntry, bool) {
+	if e.cache == nil {
+		return CacheEntry{}, false
+	}
+	entry, ok := e.cache.Peek(key)
+	if !ok || time.Now().After(entry.expires) {
+		return CacheEntry{}, false
+	}
+	return rdnsCacheEntryFor(key, entry), true
+}
+
+func (e *RDNSEnricher) CachePurge(key string) int {
+	if e.cache == nil {
+		return 0
+	}
+	defer func() {
+		MetricRDNSCacheSize.Set(float64(e.cache.Len()))
+	}()
+	if key == "" {
+		n := e.cache.Len()
+		e.cache.Purge()
+		return n
+	}
+	if e.cache.Remove(key) {
+		return 1
+	}
+	return 0
+}
+
+func rdnsCacheEntryFor(addr string, entry rdnsCacheEntry) CacheEntry {
+	names := entry.names
+	if names == nil {
+		names = []string{}
 	}
-	return value, true
+	expires := entry.expires
+	return CacheEntry{Key: addr, Value: names, Expires: &expires}
 }
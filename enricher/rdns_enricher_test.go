@@ -1,10 +1,17 @@
 package enricher_test
 
 import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/sapslaj/morbius/enricher"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestRDNSEnricher(t *testing.T) {
@@ -48,6 +55,10 @@ func TestRDNSEnricher(t *testing.T) {
 			input: map[string]interface{}{"src_addr_encap": "1.1.1.1"},
 			want:  map[string]interface{}{"src_addr_encap": "1.1.1.1", "src_hostname_encap": "one.one.one.one."},
 		},
+		"does not look up addresses that already have a hostname": {
+			input: map[string]interface{}{"src_addr": "1.1.1.1", "src_hostname": "from-leases"},
+			want:  map[string]interface{}{"src_addr": "1.1.1.1", "src_hostname": "from-leases"},
+		},
 		"adds dst_hostname_encap when dst_addr_encap is set": {
 			input: map[string]interface{}{"dst_addr_encap": "1.1.1.1"},
 			want:  map[string]interface{}{"dst_addr_encap": "1.1.1.1", "dst_hostname_encap": "one.one.one.one."},
@@ -59,7 +70,7 @@ func TestRDNSEnricher(t *testing.T) {
 		tc := tc
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
-			pe := enricher.NewRDNSEnricher(nil)
+			pe := enricher.NewRDNSEnricher(nil, nil)
 			got := pe.Process(tc.input)
 			if diff := cmp.Diff(tc.want, got); diff != "" {
 				t.Fatalf("\"%s\":\n%s", tc.desc, diff)
@@ -67,3 +78,260 @@ func TestRDNSEnricher(t *testing.T) {
 		})
 	}
 }
+
+// fakeDNSServer answers PTR queries for names and NXDOMAIN for everything
+// else, counting the queries for each name.
+type fakeDNSServer struct {
+	addr    string
+	names   map[string][]string
+	delay   time.Duration
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+func startFakeDNSServer(t *testing.T, names map[string][]string, delay time.Duration) *fakeDNSServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := &fakeDNSServer{
+		addr:    conn.LocalAddr().String(),
+		names:   names,
+		delay:   delay,
+		queries: make(map[string]int),
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			header, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			s.mu.Lock()
+			s.queries[q.Name.String()]++
+			s.mu.Unlock()
+			ptrs, ok := s.names[q.Name.String()]
+			header.Response = true
+			header.Authoritative = true
+			if !ok {
+				header.RCode = dnsmessage.RCodeNameError
+			}
+			b := dnsmessage.NewBuilder(nil, header)
+			_ = b.StartQuestions()
+			_ = b.Question(q)
+			_ = b.StartAnswers()
+			for _, ptr := range ptrs {
+				_ = b.PTRResource(
+					dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60},
+					dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(ptr)},
+				)
+			}
+			resp, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			go func() {
+				time.Sleep(s.delay)
+				_, _ = conn.WriteTo(resp, addr)
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *fakeDNSServer) count(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[name]
+}
+
+func TestRDNSEnricher_Resolvers(t *testing.T) {
+	t.Parallel()
+	server := startFakeDNSServer(t, map[string][]string{
+		"1.2.0.192.in-addr.arpa.": {"web.example.com.", "app.example.com."},
+		"2.2.0.192.in-addr.arpa.": {"ttl.example.com."},
+	}, 0)
+
+	t.Run("first name", func(t *testing.T) {
+		t.Parallel()
+		e := enricher.NewRDNSEnricher(&enricher.RDNSEnricherConfig{Resolvers: []string{server.addr}}, nil)
+		got := e.Process(map[string]interface{}{"src_addr": "192.0.2.1"})
+		want := map[string]interface{}{"src_addr": "192.0.2.1", "src_hostname": "app.example.com."}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("all names", func(t *testing.T) {
+		t.Parallel()
+		e := enricher.NewRDNSEnricher(&enricher.RDNSEnricherConfig{Resolvers: []string{server.addr}, AllNames: true}, nil)
+		got := e.Process(map[string]interface{}{"dst_addr": "192.0.2.1"})
+		want := map[string]interface{}{"dst_addr": "192.0.2.1", "dst_hostname": []string{"app.example.com.", "web.example.com."}}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("negative results are cached for the negative TTL", func(t *testing.T) {
+		t.Parallel()
+		e := enricher.NewRDNSEnricher(&enricher.RDNSEnricherConfig{
+			Resolvers:   []string{server.addr},
+			EnableCache: true,
+			NegativeTTL: 200 * time.Millisecond,
+		}, nil)
+		for i := 0; i < 3; i++ {
+			got := e.Process(map[string]interface{}{"src_addr": "192.0.2.99"})
+			if diff := cmp.Diff(map[string]interface{}{"src_addr": "192.0.2.99"}, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+		if n := server.count("99.2.0.192.in-addr.arpa."); n != 1 {
+			t.Errorf("expected 1 query, got %d", n)
+		}
+		time.Sleep(300 * time.Millisecond)
+		e.Process(map[string]interface{}{"src_addr": "192.0.2.99"})
+		if n := server.count("99.2.0.192.in-addr.arpa."); n != 2 {
+			t.Errorf("expected 2 queries after the negative TTL, got %d", n)
+		}
+	})
+
+	t.Run("positive results are cached for the positive TTL", func(t *testing.T) {
+		t.Parallel()
+		e := enricher.NewRDNSEnricher(&enricher.RDNSEnricherConfig{
+			Resolvers:   []string{server.addr},
+			EnableCache: true,
+			PositiveTTL: 200 * time.Millisecond,
+		}, nil)
+		for i := 0; i < 3; i++ {
+			got := e.Process(map[string]interface{}{"src_addr": "192.0.2.2"})
+			want := map[string]interface{}{"src_addr": "192.0.2.2", "src_hostname": "ttl.example.com."}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+		if n := server.count("2.2.0.192.in-addr.arpa."); n != 1 {
+			t.Errorf("expected 1 query, got %d", n)
+		}
+		time.Sleep(300 * time.Millisecond)
+		e.Process(map[string]interface{}{"src_addr": "192.0.2.2"})
+		if n := server.count("2.2.0.192.in-addr.arpa."); n != 2 {
+			t.Errorf("expected 2 queries after the positive TTL, got %d", n)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+		slow := startFakeDNSServer(t, map[string][]string{
+			"3.2.0.192.in-addr.arpa.": {"slow.example.com."},
+		}, time.Second)
+		e := enricher.NewRDNSEnricher(&enricher.RDNSEnricherConfig{
+			Resolvers: []string{slow.addr},
+			Timeout:   50 * time.Millisecond,
+		}, nil)
+		start := time.Now()
+		got := e.Process(map[string]interface{}{"src_addr": "192.0.2.3"})
+		if diff := cmp.Diff(map[string]interface{}{"src_addr": "192.0.2.3"}, got); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected lookup to time out after 50ms, took %v", elapsed)
+		}
+	})
+}
+
+func TestRDNSEnricher_CachePath(t *testing.T) {
+	t.Parallel()
+
+	t.Run("saved entries are loaded on startup", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "rdns.json")
+		server := startFakeDNSServer(t, map[string][]string{
+			"10.2.0.192.in-addr.arpa.": {"saved.example.com."},
+		}, 0)
+		config := func(addr string) *enricher.RDNSEnricherConfig {
+			return &enricher.RDNSEnricherConfig{
+				Resolvers:         []string{addr},
+				EnableCache:       true,
+				CachePath:         path,
+				CacheSaveInterval: time.Hour,
+			}
+		}
+		e := enricher.NewRDNSEnricher(config(server.addr), nil)
+		e.Process(map[string]interface{}{"src_addr": "192.0.2.10", "dst_addr": "192.0.2.11"})
+		// Closing more than once is harmless.
+		for i := 0; i < 2; i++ {
+			if err := e.CloseCache(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		empty := startFakeDNSServer(t, nil, 0)
+		e = enricher.NewRDNSEnricher(config(empty.addr), nil)
+		got := e.Process(map[string]interface{}{"src_addr": "192.0.2.10", "dst_addr": "192.0.2.11"})
+		want := map[string]interface{}{"src_addr": "192.0.2.10", "src_hostname": "saved.example.com.", "dst_addr": "192.0.2.11"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+		if n := empty.count("10.2.0.192.in-addr.arpa.") + empty.count("11.2.0.192.in-addr.arpa."); n != 0 {
+			t.Errorf("expected no queries, got %d", n)
+		}
+
+		entry, ok := e.CacheLookup("192.0.2.10")
+		if !ok {
+			t.Fatal("expected 192.0.2.10 to be cached")
+		}
+		if diff := cmp.Diff([]string{"saved.example.com."}, entry.Value); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+		if n := len(e.CacheEntries()); n != 2 {
+			t.Errorf("expected 2 entries, got %d", n)
+		}
+		if n := e.CachePurge("192.0.2.10"); n != 1 {
+			t.Errorf("expected 1 entry purged, got %d", n)
+		}
+		if n := e.CachePurge(""); n != 1 {
+			t.Errorf("expected 1 entry purged, got %d", n)
+		}
+		if n := len(e.CacheEntries()); n != 0 {
+			t.Errorf("expected no entries, got %d", n)
+		}
+	})
+
+	t.Run("expired entries are not loaded", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "rdns.json")
+		content := fmt.Sprintf(`[
+			{"addr": "192.0.2.20", "names": ["old.example.com."], "expires": %q},
+			{"addr": "192.0.2.21", "names": ["new.example.com."], "expires": %q}
+		]`, time.Now().Add(-time.Minute).Format(time.RFC3339), time.Now().Add(time.Hour).Format(time.RFC3339))
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		e := enricher.NewRDNSEnricher(&enricher.RDNSEnricherConfig{
+			EnableCache:       true,
+			CachePath:         path,
+			CacheSaveInterval: time.Hour,
+		}, nil)
+		if _, ok := e.CacheLookup("192.0.2.20"); ok {
+			t.Error("expected 192.0.2.20 to have expired")
+		}
+		entry, ok := e.CacheLookup("192.0.2.21")
+		if !ok {
+			t.Fatal("expected 192.0.2.21 to be cached")
+		}
+		if diff := cmp.Diff([]string{"new.example.com."}, entry.Value); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package enricher
+
+import (
+	"net/netip"
+
+	"github.com/sapslaj/morbius/prefixtree"
+)
+
+const (
+	TrafficDirectionInbound  = "inbound"
+	TrafficDirectionOutbound = "outbound"
+	TrafficDirectionInternal = "internal"
+	TrafficDirectionTransit  = "transit"
+)
+
+type TrafficDirectionEnricherConfig struct {
+	// Prefixes of the local networks. Bare addresses are host prefixes.
+	LocalPrefixes []string `yaml:"local_prefixes"`
+	// Addresses are also local if the flow has them in one of these ASNs, as
+	// reported by the exporter in `src_as` and `dst_as`.
+	LocalASNs []int `yaml:"local_asns"`
+}
+
+// TrafficDirectionEnricher works out whether a flow is inbound, outbound,
+// internal, or transit relative to the local networks, and which side of it
+// is the remote party. Unlike `flow_direction` this doesn't depend on the
+// exporter.
+type TrafficDirectionEnricher struct {
+	Config    *TrafficDirectionEnricherConfig
+	prefixes  *prefixtree.Tree[bool]
+	localASNs map[int]bool
+}
+
+func NewTrafficDirectionEnricher(config *TrafficDirectionEnricherConfig) TrafficDirectionEnricher {
+	if config == nil {
+		config = &TrafficDirectionEnricherConfig{}
+	}
+	e := TrafficDirectionEnricher{
+		Config:    config,
+		prefixes:  prefixtree.New[bool](),
+		localASNs: make(map[int]bool),
+	}
+	for _, cidr := range config.LocalPrefixes {
+		prefix, err := parsePrefixOrAddr(cidr)
+		if err != nil {
+			panic(err)
+		}
+		e.prefixes.Insert(prefix, true)
+	}
+	for _, asn := range config.LocalASNs {
+		e.localASNs[asn] = true
+	}
+	return e
+}
+
+func (e *TrafficDirectionEnricher) Process(msg map[string]interface{}) map[string]interface{} {
+	srcLocal, ok := e.isLocal(msg, "src_addr", "src_as")
+	if !ok {
+		return msg
+	}
+	dstLocal, ok := e.isLocal(msg, "dst_addr", "dst_as")
+	if !ok {
+		return msg
+	}
+
+	var local, remote string
+	switch {
+	case srcLocal && dstLocal:
+		msg["traffic_direction"] = TrafficDirectionInternal
+		return msg
+	case !srcLocal && !dstLocal:
+		msg["traffic_direction"] = TrafficDirectionTransit
+		return msg
+	case srcLocal:
+		msg["traffic_direction"] = TrafficDirectionOutbound
+		local, remote = "src", "dst"
+	default:
+		msg["traffic_direction"] = TrafficDirectionInbound
+		local, remote = "dst", "src"
+	}
+	msg["local_addr"] = msg[local+"_addr"]
+	msg["remote_addr"] = msg[remote+"_addr"]
+	if port, ok := msg[local+"_port"]; ok {
+		msg["local_port"] = port
+	}
+	if port, ok := msg[remote+"_port"]; ok {
+		msg["remote_port"] = port
+	}
+	return msg
+}
+
+func (e *TrafficDirectionEnricher) isLocal(msg map[string]interface{}, addrField string, asField string) (bool, bool) {
+	addrStr, ok := msg[addrField].(string)
+	if !ok {
+		return false, false
+	}
+	addr, err := netip.ParseAddr(addrStr)
+	if err != nil {
+		return false, false
+	}
+	if _, _, ok := e.prefixes.Lookup(addr); ok {
+		return true, true
+	}
+	asn, _ := msg[asField].(int)
+	return e.localASNs[asn], true
+}
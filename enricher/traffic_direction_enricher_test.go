@@ -0,0 +1,112 @@
+package enricher_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/enricher"
+)
+
+func TestTrafficDirectionEnricher(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		input map[string]interface{}
+		want  map[string]interface{}
+	}
+
+	e := enricher.NewTrafficDirectionEnricher(&enricher.TrafficDirectionEnricherConfig{
+		LocalPrefixes: []string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.1"},
+		LocalASNs:     []int{64512},
+	})
+
+	tests := map[string]test{
+		"does not modify message if an address field is not defined": {
+			input: map[string]interface{}{"src_addr": "10.0.0.1"},
+			want:  map[string]interface{}{"src_addr": "10.0.0.1"},
+		},
+		"does nothing on empty string for address": {
+			input: map[string]interface{}{"src_addr": "", "dst_addr": "10.0.0.1"},
+			want:  map[string]interface{}{"src_addr": "", "dst_addr": "10.0.0.1"},
+		},
+		"outbound": {
+			input: map[string]interface{}{"src_addr": "10.0.0.1", "dst_addr": "1.1.1.1", "src_port": 50000, "dst_port": 443},
+			want: map[string]interface{}{
+				"src_addr":          "10.0.0.1",
+				"dst_addr":          "1.1.1.1",
+				"src_port":          50000,
+				"dst_port":          443,
+				"traffic_direction": "outbound",
+				"local_addr":        "10.0.0.1",
+				"remote_addr":       "1.1.1.1",
+				"local_port":        50000,
+				"remote_port":       443,
+			},
+		},
+		"inbound": {
+			input: map[string]interface{}{"src_addr": "2001:db9::1", "dst_addr": "2001:db8::1", "src_port": 50000, "dst_port": 22},
+			want: map[string]interface{}{
+				"src_addr":          "2001:db9::1",
+				"dst_addr":          "2001:db8::1",
+				"src_port":          50000,
+				"dst_port":          22,
+				"traffic_direction": "inbound",
+				"local_addr":        "2001:db8::1",
+				"remote_addr":       "2001:db9::1",
+				"local_port":        22,
+				"remote_port":       50000,
+			},
+		},
+		"inbound without ports": {
+			input: map[string]interface{}{"src_addr": "1.1.1.1", "dst_addr": "10.0.0.1"},
+			want: map[string]interface{}{
+				"src_addr":          "1.1.1.1",
+				"dst_addr":          "10.0.0.1",
+				"traffic_direction": "inbound",
+				"local_addr":        "10.0.0.1",
+				"remote_addr":       "1.1.1.1",
+			},
+		},
+		"bare address is a host prefix": {
+			input: map[string]interface{}{"src_addr": "192.0.2.2", "dst_addr": "192.0.2.1"},
+			want: map[string]interface{}{
+				"src_addr":          "192.0.2.2",
+				"dst_addr":          "192.0.2.1",
+				"traffic_direction": "inbound",
+				"local_addr":        "192.0.2.1",
+				"remote_addr":       "192.0.2.2",
+			},
+		},
+		"internal": {
+			input: map[string]interface{}{"src_addr": "10.0.0.1", "dst_addr": "10.0.0.2"},
+			want:  map[string]interface{}{"src_addr": "10.0.0.1", "dst_addr": "10.0.0.2", "traffic_direction": "internal"},
+		},
+		"transit": {
+			input: map[string]interface{}{"src_addr": "1.1.1.1", "dst_addr": "8.8.8.8"},
+			want:  map[string]interface{}{"src_addr": "1.1.1.1", "dst_addr": "8.8.8.8", "traffic_direction": "transit"},
+		},
+		"local ASN": {
+			input: map[string]interface{}{"src_addr": "1.1.1.1", "dst_addr": "8.8.8.8", "dst_as": 64512},
+			want: map[string]interface{}{
+				"src_addr":          "1.1.1.1",
+				"dst_addr":          "8.8.8.8",
+				"dst_as":            64512,
+				"traffic_direction": "inbound",
+				"local_addr":        "8.8.8.8",
+				"remote_addr":       "1.1.1.1",
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := e.Process(tc.input)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+#!/usr/bin/env python3
+# Regenerate enricher/oui_snapshot.csv, the built-in MAC vendor registry.
+#
+# The built-in snapshot is deliberately small: it only covers the assignments
+# below, which are common server, network, and virtualization vendors, so the
+# binary doesn't carry the full registries. The names are taken from the
+# current IEEE MA-L registry.
+#
+# For complete coverage, download the full registries and point the
+# `mac_vendor` enricher's `files` at them instead:
+#
+#   hack/update-oui-snapshot.py --full /var/lib/morbius
+import argparse
+import csv
+import io
+import os
+import sys
+import urllib.request
+
+MA_L = "https://standards-oui.ieee.org/oui/oui.csv"
+REGISTRIES = {
+    "oui.csv": MA_L,
+    "mam.csv": "https://standards-oui.ieee.org/oui28/mam.csv",
+    "oui36.csv": "https://standards-oui.ieee.org/oui36/oui36.csv",
+}
+
+ASSIGNMENTS = [
+    "00000C", "00005E", "0000F0", "0002C9", "000393", "0003FF", "000569", "00090F",
+    "000B86", "000C29", "000C42", "000D3A", "000D93", "001132", "00144F", "00155D",
+    "00163E", "001A11", "001B17", "001B21", "001B63", "001C14", "001C42", "001E67",
+    "002590", "0026B9", "005056", "0050C2", "0050F2", "0080C2", "00A0C9", "00AA00",
+    "00D0B7", "00E04C", "0418D6", "080027", "0CC47A", "248A07", "24A43C", "28CDC1",
+    "2CCF67", "3C22FB", "3C5AB4", "3CFDFE", "4C5E0C", "6C3B6B", "788A20", "7CFE90",
+    "90E2BA", "A0369F", "AC1F6B", "B827EB", "D4CA6D", "DCA632", "E45F01", "E48D8C",
+    "F09FC2", "F4F5D8",
+]
+
+OUTPUT = os.path.join(os.path.dirname(__file__), "..", "enricher", "oui_snapshot.csv")
+
+
+def fetch(url):
+    # The IEEE site rejects requests without a browser-ish user agent.
+    req = urllib.request.Request(url, headers={"User-Agent": "Mozilla/5.0"})
+    with urllib.request.urlopen(req) as resp:
+        return resp.read().decode("utf-8")
+
+
+def write_snapshot():
+    names = {}
+    for row in csv.DictReader(io.StringIO(fetch(MA_L))):
+        names[row["Assignment"].upper()] = row["Organization Name"].strip()
+    missing = [a for a in ASSIGNMENTS if a not in names]
+    if missing:
+        sys.exit("assignments not in the registry: " + ", ".join(missing))
+    with open(OUTPUT, "w", newline="") as f:
+        writer = csv.writer(f, lineterminator="\n")
+        writer.writerow(["Registry", "Assignment", "Organization Name"])
+        for assignment in sorted(ASSIGNMENTS):
+            writer.writerow(["MA-L", assignment, names[assignment]])
+
+
+def write_full(directory):
+    for name, url in REGISTRIES.items():
+        with open(os.path.join(directory, name), "w", encoding="utf-8") as f:
+            f.write(fetch(url))
+
+
+def main():
+    parser = argparse.ArgumentParser()
+    parser.add_argument(
+        "--full",
+        metavar="DIR",
+        help="download the full MA-L, MA-M, and MA-S registries to DIR for the `files` option instead",
+    )
+    args = parser.parse_args()
+    if args.full:
+        write_full(args.full)
+    else:
+        write_snapshot()
+
+
+if __name__ == "__main__":
+    main()
@@ -3,6 +3,9 @@ package main
 import (
 	"flag"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/kr/pretty"
 	"github.com/sapslaj/morbius/config"
@@ -19,6 +22,11 @@ func envWithDefault(key string, def string) string {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replayMain(os.Args[2:])
+		return
+	}
+
 	// Cannot use default flagset due to other packages (somewhat infuriatingly)
 	// registering their own flags.
 	f := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
@@ -50,10 +58,44 @@ func main() {
 		if server.Config.SFlow.Enable {
 			logger.Printf("sFlow:\t%s:%d", server.Config.SFlow.Addr, server.Config.SFlow.Port)
 		}
+		if server.Config.Conntrack.Enable {
+			logger.Printf("conntrack:\tnetlink")
+		}
+		if server.Config.NDJSON.Enable {
+			logger.Printf("ndjson:\t%s", server.Config.NDJSON.Path)
+		}
+		if server.Config.VPCFlowLogs.Enable {
+			logger.Printf("vpc_flow_logs:\t%s", server.Config.VPCFlowLogs.Path)
+		}
+		if server.Config.Zeek.Enable {
+			logger.Printf("zeek:\t%s", server.Config.Zeek.Path)
+		}
+		if server.Config.Probe.Enable {
+			logger.Printf("probe:\t%s%s", server.Config.Probe.Interface, server.Config.Probe.File)
+		}
 		if server.Config.HTTP.Enable {
 			logger.Printf("http:\t%s:%d", server.Config.HTTP.Addr, server.Config.HTTP.Port)
 		}
+		if server.Config.Kafka.Enable {
+			logger.Printf("kafka:\t%s", strings.Join(server.Config.Kafka.Topics, ","))
+		}
+		if server.Config.GRPC.Enable {
+			logger.Printf("grpc:\t%s:%d", server.Config.GRPC.Addr, server.Config.GRPC.Port)
+		}
 	}
 
+	// Save templates, the passive DNS table, and enricher caches before
+	// exiting so they're still warm after a restart.
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		logger.Printf("received %s, shutting down", sig)
+		if err := server.Close(); err != nil {
+			logger.Errorf("error closing server: %v", err)
+		}
+		os.Exit(0)
+	}()
+
 	server.RunAll()
 }
@@ -0,0 +1,158 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strings"
+)
+
+const (
+	DNSTypeA     uint16 = 1
+	DNSTypeCNAME uint16 = 5
+	DNSTypeAAAA  uint16 = 28
+)
+
+var ErrDNSMalformed = errors.New("packet: malformed DNS message")
+
+type DNSQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type DNSRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	// Set for A and AAAA records.
+	Addr netip.Addr
+	// Set for CNAME records.
+	Target string
+}
+
+type DNSMessage struct {
+	ID        uint16
+	Response  bool
+	RCode     uint8
+	Questions []DNSQuestion
+	Answers   []DNSRecord
+}
+
+// ParseDNS parses the header, questions, and answers of a DNS message.
+// Authority and additional records are ignored. Like Decode, partial results
+// are returned along with ErrTruncated when the message is cut short.
+func ParseDNS(payload []byte) (*DNSMessage, error) {
+	if len(payload) < 12 {
+		return nil, ErrTruncated
+	}
+	m := &DNSMessage{
+		ID:       binary.BigEndian.Uint16(payload[0:2]),
+		Response: payload[2]&0x80 != 0,
+		RCode:    payload[3] & 0x0f,
+	}
+	qdCount := int(binary.BigEndian.Uint16(payload[4:6]))
+	anCount := int(binary.BigEndian.Uint16(payload[6:8]))
+
+	offset := 12
+	for i := 0; i < qdCount; i++ {
+		name, next, err := parseDNSName(payload, offset)
+		if err != nil {
+			return m, err
+		}
+		if next+4 > len(payload) {
+			return m, ErrTruncated
+		}
+		m.Questions = append(m.Questions, DNSQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(payload[next : next+2]),
+			Class: binary.BigEndian.Uint16(payload[next+2 : next+4]),
+		})
+		offset = next + 4
+	}
+
+	for i := 0; i < anCount; i++ {
+		name, next, err := parseDNSName(payload, offset)
+		if err != nil {
+			return m, err
+		}
+		if next+10 > len(payload) {
+			return m, ErrTruncated
+		}
+		r := DNSRecord{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(payload[next : next+2]),
+			Class: binary.BigEndian.Uint16(payload[next+2 : next+4]),
+			TTL:   binary.BigEndian.Uint32(payload[next+4 : next+8]),
+		}
+		rdLen := int(binary.BigEndian.Uint16(payload[next+8 : next+10]))
+		rdStart := next + 10
+		if rdStart+rdLen > len(payload) {
+			return m, ErrTruncated
+		}
+		rdata := payload[rdStart : rdStart+rdLen]
+		switch r.Type {
+		case DNSTypeA, DNSTypeAAAA:
+			addr, ok := netip.AddrFromSlice(rdata)
+			if !ok || (r.Type == DNSTypeA) != addr.Is4() {
+				return m, ErrDNSMalformed
+			}
+			r.Addr = addr
+		case DNSTypeCNAME:
+			target, _, err := parseDNSName(payload, rdStart)
+			if err != nil {
+				return m, err
+			}
+			r.Target = target
+		}
+		m.Answers = append(m.Answers, r)
+		offset = rdStart + rdLen
+	}
+	return m, nil
+}
+
+// Returns the name starting at offset and the offset just past it, following
+// compression pointers.
+func parseDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	nameLen := 0
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, ErrTruncated
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if offset+2 > len(msg) {
+				return "", 0, ErrTruncated
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			jumps++
+			if jumps > 32 {
+				return "", 0, ErrDNSMalformed
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:offset+2]) & 0x3fff)
+		case length&0xc0 != 0:
+			return "", 0, ErrDNSMalformed
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, ErrTruncated
+			}
+			nameLen += length + 1
+			if nameLen > 255 {
+				return "", 0, ErrDNSMalformed
+			}
+			labels = append(labels, strings.ToLower(string(msg[offset+1:offset+1+length])))
+			offset += 1 + length
+		}
+	}
+}
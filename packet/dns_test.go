@@ -0,0 +1,73 @@
+package packet_test
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/packet"
+)
+
+func TestParseDNS(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		payload []byte
+		want    *packet.DNSMessage
+		wantErr error
+	}
+
+	response := mustHex("1234 8180 0001 0002 0000 0000" +
+		"076578616d706c6503636f6d00 0001 0001" +
+		"c00c 0005 0001 0000012c 0006 03777777c00c" +
+		"c029 0001 0001 0000003c 0004 5db8d822")
+	question := packet.DNSQuestion{Name: "example.com", Type: packet.DNSTypeA, Class: 1}
+
+	tests := map[string]test{
+		"response with CNAME chain": {
+			payload: response,
+			want: &packet.DNSMessage{
+				ID:        0x1234,
+				Response:  true,
+				Questions: []packet.DNSQuestion{question},
+				Answers: []packet.DNSRecord{
+					{Name: "example.com", Type: packet.DNSTypeCNAME, Class: 1, TTL: 300, Target: "www.example.com"},
+					{Name: "www.example.com", Type: packet.DNSTypeA, Class: 1, TTL: 60, Addr: netip.MustParseAddr("93.184.216.34")},
+				},
+			},
+		},
+		"truncated answers": {
+			payload: response[:len(response)-6],
+			want: &packet.DNSMessage{
+				ID:        0x1234,
+				Response:  true,
+				Questions: []packet.DNSQuestion{question},
+				Answers: []packet.DNSRecord{
+					{Name: "example.com", Type: packet.DNSTypeCNAME, Class: 1, TTL: 300, Target: "www.example.com"},
+				},
+			},
+			wantErr: packet.ErrTruncated,
+		},
+		"compression loop": {
+			payload: mustHex("1234 0100 0001 0000 0000 0000 c00c 0001 0001"),
+			want:    &packet.DNSMessage{ID: 0x1234},
+			wantErr: packet.ErrDNSMalformed,
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got, err := packet.ParseDNS(tc.payload)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("\"%s\": got err %v, want %v", name, err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+				t.Errorf("\"%s\": ParseDNS() mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("HEAD "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("PATCH "),
+	[]byte("CONNECT "),
+}
+
+// ParseHTTPHost returns the Host header of an HTTP/1.x request. The header
+// line has to be complete, so a host cut off by the capture length isn't
+// returned.
+func ParseHTTPHost(payload []byte) (string, bool) {
+	isRequest := false
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(payload, method) {
+			isRequest = true
+			break
+		}
+	}
+	if !isRequest {
+		return "", false
+	}
+	for {
+		i := bytes.IndexByte(payload, '\n')
+		if i < 0 {
+			return "", false
+		}
+		line := bytes.TrimRight(payload[:i], "\r")
+		payload = payload[i+1:]
+		if len(line) == 0 {
+			// End of headers.
+			return "", false
+		}
+		if len(line) > 5 && bytes.EqualFold(line[:5], []byte("host:")) {
+			host := string(bytes.TrimSpace(line[5:]))
+			return host, host != ""
+		}
+	}
+}
+
+// ParseTLSServerName returns the server name indication from a TLS
+// ClientHello.
+func ParseTLSServerName(payload []byte) (string, bool) {
+	// Record header: content type 22 (handshake) and a 3.x version.
+	if len(payload) < 5 || payload[0] != 0x16 || payload[1] != 0x03 {
+		return "", false
+	}
+	b := payload[5:]
+	// Handshake header: type 1 (ClientHello) and a 3 byte length.
+	if len(b) < 4 || b[0] != 0x01 {
+		return "", false
+	}
+	b = b[4:]
+
+	// Client version and random.
+	if len(b) < 34 {
+		return "", false
+	}
+	b = b[34:]
+	skip := func(lengthBytes int) bool {
+		if len(b) < lengthBytes {
+			return false
+		}
+		var n int
+		for _, c := range b[:lengthBytes] {
+			n = n<<8 | int(c)
+		}
+		if len(b) < lengthBytes+n {
+			return false
+		}
+		b = b[lengthBytes+n:]
+		return true
+	}
+	// Session ID, cipher suites, and compression methods.
+	if !skip(1) || !skip(2) || !skip(1) {
+		return "", false
+	}
+
+	if len(b) < 2 {
+		return "", false
+	}
+	extLen := int(binary.BigEndian.Uint16(b[0:2]))
+	b = b[2:]
+	if len(b) > extLen {
+		b = b[:extLen]
+	}
+	for len(b) >= 4 {
+		extType := binary.BigEndian.Uint16(b[0:2])
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		b = b[4:]
+		if len(b) < length {
+			return "", false
+		}
+		ext := b[:length]
+		b = b[length:]
+		if extType != 0 {
+			continue
+		}
+		// server_name extension: a list of (type, name) entries where type 0
+		// is a host name.
+		if len(ext) < 2 {
+			return "", false
+		}
+		ext = ext[2:]
+		for len(ext) >= 3 {
+			nameType := ext[0]
+			nameLen := int(binary.BigEndian.Uint16(ext[1:3]))
+			ext = ext[3:]
+			if len(ext) < nameLen {
+				return "", false
+			}
+			if nameType == 0 && nameLen > 0 {
+				return string(ext[:nameLen]), true
+			}
+			ext = ext[nameLen:]
+		}
+		return "", false
+	}
+	return "", false
+}
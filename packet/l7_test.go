@@ -0,0 +1,112 @@
+package packet_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/sapslaj/morbius/packet"
+)
+
+func tlsClientHello(serverName string) []byte {
+	sni := []byte{0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(sni[2:4], uint16(5+len(serverName)))
+	binary.BigEndian.PutUint16(sni[4:6], uint16(3+len(serverName)))
+	sni = append(sni[:7], 0, 0)
+	binary.BigEndian.PutUint16(sni[7:9], uint16(len(serverName)))
+	sni = append(sni, serverName...)
+
+	// An unrelated extension before server_name.
+	extensions := append([]byte{0, 0x0b, 0, 2, 1, 0}, sni...)
+
+	hello := []byte{0x03, 0x03}
+	hello = append(hello, make([]byte, 32)...) // random
+	hello = append(hello, 0)                   // session ID
+	hello = append(hello, 0, 2, 0x13, 0x01)    // cipher suites
+	hello = append(hello, 1, 0)                // compression methods
+	hello = append(hello, byte(len(extensions)>>8), byte(len(extensions)))
+	hello = append(hello, extensions...)
+
+	handshake := []byte{0x01, 0, byte(len(hello) >> 8), byte(len(hello))}
+	handshake = append(handshake, hello...)
+	record := []byte{0x16, 0x03, 0x01, byte(len(handshake) >> 8), byte(len(handshake))}
+	return append(record, handshake...)
+}
+
+func TestParseTLSServerName(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		payload []byte
+		want    string
+		wantOk  bool
+	}
+
+	hello := tlsClientHello("www.example.com")
+	tests := map[string]test{
+		"ClientHello": {
+			payload: hello,
+			want:    "www.example.com",
+			wantOk:  true,
+		},
+		"truncated ClientHello": {
+			payload: hello[:len(hello)-4],
+		},
+		"not TLS": {
+			payload: []byte("GET / HTTP/1.1\r\n"),
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := packet.ParseTLSServerName(tc.payload)
+			if got != tc.want || ok != tc.wantOk {
+				t.Errorf("\"%s\": got (%q, %v), want (%q, %v)", name, got, ok, tc.want, tc.wantOk)
+			}
+		})
+	}
+}
+
+func TestParseHTTPHost(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		payload string
+		want    string
+		wantOk  bool
+	}
+
+	tests := map[string]test{
+		"GET request": {
+			payload: "GET / HTTP/1.1\r\nUser-Agent: curl\r\nHost: example.com\r\nAccept: */*\r\n\r\n",
+			want:    "example.com",
+			wantOk:  true,
+		},
+		"header names are case insensitive": {
+			payload: "POST /api HTTP/1.1\nhOsT:   api.example.com:8080  \n\n",
+			want:    "api.example.com:8080",
+			wantOk:  true,
+		},
+		"truncated host line": {
+			payload: "GET / HTTP/1.1\r\nHost: exam",
+		},
+		"no host before end of headers": {
+			payload: "GET / HTTP/1.0\r\n\r\nHost: example.com\r\n",
+		},
+		"response": {
+			payload: "HTTP/1.1 200 OK\r\nHost: example.com\r\n",
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := packet.ParseHTTPHost([]byte(tc.payload))
+			if got != tc.want || ok != tc.wantOk {
+				t.Errorf("\"%s\": got (%q, %v), want (%q, %v)", name, got, ok, tc.want, tc.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+// Package packet is a minimal L2-L4 frame decoder. It only understands enough
+// of each header to pull out the fields morbius puts in flow messages.
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// Link types as defined by https://www.tcpdump.org/linktypes.html
+const (
+	LinkTypeNull     uint32 = 0
+	LinkTypeEthernet uint32 = 1
+	LinkTypeRaw      uint32 = 101
+	LinkTypeLinuxSLL uint32 = 113
+	LinkTypeIPv4     uint32 = 228
+	LinkTypeIPv6     uint32 = 229
+)
+
+const (
+	EtherTypeIPv4  uint16 = 0x0800
+	EtherTypeIPv6  uint16 = 0x86dd
+	EtherTypeVLAN  uint16 = 0x8100
+	EtherTypeQinQ  uint16 = 0x88a8
+	EtherTypeMPLSU uint16 = 0x8847
+)
+
+const (
+	ProtoICMP   uint8 = 1
+	ProtoTCP    uint8 = 6
+	ProtoUDP    uint8 = 17
+	ProtoICMPv6 uint8 = 58
+)
+
+var (
+	ErrTruncated        = errors.New("packet: truncated")
+	ErrUnsupportedLink  = errors.New("packet: unsupported link type")
+	ErrUnsupportedLayer = errors.New("packet: unsupported network layer")
+)
+
+type Packet struct {
+	SrcMAC  net.HardwareAddr
+	DstMAC  net.HardwareAddr
+	VlanID  uint16
+	Etype   uint16
+	SrcAddr netip.Addr
+	DstAddr netip.Addr
+	// Length of the IP packet as given by the IP header, not the captured
+	// length.
+	IPLength       int
+	Proto          uint8
+	IPTos          uint8
+	IPTTL          uint8
+	IPv6FlowLabel  uint32
+	FragmentID     uint32
+	FragmentOffset uint16
+	SrcPort        uint16
+	DstPort        uint16
+	TCPFlags       uint8
+	IcmpType       uint8
+	IcmpCode       uint8
+	// Transport layer payload, possibly truncated by the capture length.
+	Payload []byte
+}
+
+// Decode parses a captured frame of the given link type. Partial results are
+// returned along with ErrTruncated when the capture ends early, which is
+// common for sampled headers.
+func Decode(linkType uint32, data []byte) (*Packet, error) {
+	p := &Packet{}
+	switch linkType {
+	case LinkTypeEthernet:
+		return p, p.decodeEthernet(data)
+	case LinkTypeRaw:
+		if len(data) == 0 {
+			return p, ErrTruncated
+		}
+		switch data[0] >> 4 {
+		case 4:
+			p.Etype = EtherTypeIPv4
+		case 6:
+			p.Etype = EtherTypeIPv6
+		default:
+			return p, ErrUnsupportedLayer
+		}
+		return p, p.decodeNetwork(data)
+	case LinkTypeIPv4:
+		p.Etype = EtherTypeIPv4
+		return p, p.decodeNetwork(data)
+	case LinkTypeIPv6:
+		p.Etype = EtherTypeIPv6
+		return p, p.decodeNetwork(data)
+	case LinkTypeNull:
+		if len(data) < 4 {
+			return p, ErrTruncated
+		}
+		// BSD loopback encapsulation uses the host byte order AF_ value.
+		family := binary.LittleEndian.Uint32(data[0:4])
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(data[0:4])
+		}
+		switch family {
+		case 2:
+			p.Etype = EtherTypeIPv4
+		case 10, 24, 28, 30:
+			p.Etype = EtherTypeIPv6
+		default:
+			return p, ErrUnsupportedLayer
+		}
+		return p, p.decodeNetwork(data[4:])
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return p, ErrTruncated
+		}
+		if addrLen := int(binary.BigEndian.Uint16(data[4:6])); addrLen == 6 {
+			p.SrcMAC = net.HardwareAddr(append([]byte(nil), data[6:12]...))
+		}
+		p.Etype = binary.BigEndian.Uint16(data[14:16])
+		return p, p.decodeEtherPayload(data[16:])
+	}
+	return p, ErrUnsupportedLink
+}
+
+func (p *Packet) decodeEthernet(data []byte) error {
+	if len(data) < 14 {
+		return ErrTruncated
+	}
+	p.DstMAC = net.HardwareAddr(append([]byte(nil), data[0:6]...))
+	p.SrcMAC = net.HardwareAddr(append([]byte(nil), data[6:12]...))
+	p.Etype = binary.BigEndian.Uint16(data[12:14])
+	return p.decodeEtherPayload(data[14:])
+}
+
+func (p *Packet) decodeEtherPayload(data []byte) error {
+	for p.Etype == EtherTypeVLAN || p.Etype == EtherTypeQinQ {
+		if len(data) < 4 {
+			return ErrTruncated
+		}
+		if p.VlanID == 0 {
+			p.VlanID = binary.BigEndian.Uint16(data[0:2]) & 0x0fff
+		}
+		p.Etype = binary.BigEndian.Uint16(data[2:4])
+		data = data[4:]
+	}
+	if p.Etype == EtherTypeMPLSU {
+		for {
+			if len(data) < 4 {
+				return ErrTruncated
+			}
+			bottom := data[2]&0x01 != 0
+			data = data[4:]
+			if bottom {
+				break
+			}
+		}
+		if len(data) == 0 {
+			return ErrTruncated
+		}
+		switch data[0] >> 4 {
+		case 4:
+			p.Etype = EtherTypeIPv4
+		case 6:
+			p.Etype = EtherTypeIPv6
+		}
+	}
+	return p.decodeNetwork(data)
+}
+
+func (p *Packet) decodeNetwork(data []byte) error {
+	switch p.Etype {
+	case EtherTypeIPv4:
+		return p.decodeIPv4(data)
+	case EtherTypeIPv6:
+		return p.decodeIPv6(data)
+	}
+	return ErrUnsupportedLayer
+}
+
+func (p *Packet) decodeIPv4(data []byte) error {
+	if len(data) < 20 {
+		return ErrTruncated
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if ihl < 20 {
+		return ErrUnsupportedLayer
+	}
+	p.IPTos = data[1]
+	p.IPLength = int(binary.BigEndian.Uint16(data[2:4]))
+	p.FragmentID = uint32(binary.BigEndian.Uint16(data[4:6]))
+	p.FragmentOffset = binary.BigEndian.Uint16(data[6:8]) & 0x1fff
+	p.IPTTL = data[8]
+	p.Proto = data[9]
+	p.SrcAddr = netip.AddrFrom4([4]byte(data[12:16]))
+	p.DstAddr = netip.AddrFrom4([4]byte(data[16:20]))
+	if len(data) < ihl {
+		return ErrTruncated
+	}
+	if p.FragmentOffset != 0 {
+		// Non-first fragments don't carry transport headers.
+		return nil
+	}
+	return p.decodeTransport(data[ihl:])
+}
+
+func (p *Packet) decodeIPv6(data []byte) error {
+	if len(data) < 40 {
+		return ErrTruncated
+	}
+	p.IPTos = uint8(binary.BigEndian.Uint16(data[0:2]) >> 4)
+	p.IPv6FlowLabel = binary.BigEndian.Uint32(data[0:4]) & 0x000fffff
+	p.IPLength = int(binary.BigEndian.Uint16(data[4:6])) + 40
+	p.Proto = data[6]
+	p.IPTTL = data[7]
+	p.SrcAddr = netip.AddrFrom16([16]byte(data[8:24]))
+	p.DstAddr = netip.AddrFrom16([16]byte(data[24:40]))
+	data = data[40:]
+
+	// Skip over extension headers to find the transport header.
+	for {
+		switch p.Proto {
+		case 0, 43, 60:
+			if len(data) < 8 {
+				return ErrTruncated
+			}
+			extLen := (int(data[1]) + 1) * 8
+			if len(data) < extLen {
+				return ErrTruncated
+			}
+			p.Proto = data[0]
+			data = data[extLen:]
+		case 44:
+			if len(data) < 8 {
+				return ErrTruncated
+			}
+			p.Proto = data[0]
+			p.FragmentOffset = binary.BigEndian.Uint16(data[2:4]) >> 3
+			p.FragmentID = binary.BigEndian.Uint32(data[4:8])
+			data = data[8:]
+			if p.FragmentOffset != 0 {
+				return nil
+			}
+		default:
+			return p.decodeTransport(data)
+		}
+	}
+}
+
+func (p *Packet) decodeTransport(data []byte) error {
+	switch p.Proto {
+	case ProtoTCP:
+		if len(data) < 14 {
+			return ErrTruncated
+		}
+		p.SrcPort = binary.BigEndian.Uint16(data[0:2])
+		p.DstPort = binary.BigEndian.Uint16(data[2:4])
+		p.TCPFlags = data[13]
+		offset := int(data[12]>>4) * 4
+		if offset < 20 || len(data) < offset {
+			return ErrTruncated
+		}
+		p.Payload = data[offset:]
+	case ProtoUDP:
+		if len(data) < 8 {
+			return ErrTruncated
+		}
+		p.SrcPort = binary.BigEndian.Uint16(data[0:2])
+		p.DstPort = binary.BigEndian.Uint16(data[2:4])
+		p.Payload = data[8:]
+		if udpLen := int(binary.BigEndian.Uint16(data[4:6])); udpLen >= 8 && udpLen-8 < len(p.Payload) {
+			// Trim Ethernet padding.
+			p.Payload = p.Payload[:udpLen-8]
+		}
+	case ProtoICMP, ProtoICMPv6:
+		if len(data) < 2 {
+			return ErrTruncated
+		}
+		p.IcmpType = data[0]
+		p.IcmpCode = data[1]
+		p.Payload = data[2:]
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package packet_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/sapslaj/morbius/packet"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		linkType uint32
+		data     []byte
+		wantErr  error
+		check    func(t *testing.T, p *packet.Packet)
+	}
+
+	tests := map[string]test{
+		"IPv4 TCP over 802.1Q Ethernet": {
+			linkType: packet.LinkTypeEthernet,
+			data: mustHex("001122334455 66778899aabb 8100 0045 0800" +
+				"45b8002c1234400040060000 c0000201 c0000202" +
+				"c35001bb0000000100000000 5012ffff00000000" +
+				"6869"),
+			check: func(t *testing.T, p *packet.Packet) {
+				if p.VlanID != 69 {
+					t.Errorf("expected VLAN 69, got %d", p.VlanID)
+				}
+				if p.SrcMAC.String() != "66:77:88:99:aa:bb" {
+					t.Errorf("unexpected src mac %s", p.SrcMAC)
+				}
+				if p.SrcAddr != netip.MustParseAddr("192.0.2.1") || p.DstAddr != netip.MustParseAddr("192.0.2.2") {
+					t.Errorf("unexpected addresses %s -> %s", p.SrcAddr, p.DstAddr)
+				}
+				if p.Proto != packet.ProtoTCP || p.SrcPort != 50000 || p.DstPort != 443 {
+					t.Errorf("unexpected transport %d %d -> %d", p.Proto, p.SrcPort, p.DstPort)
+				}
+				if p.TCPFlags != 0x12 {
+					t.Errorf("expected SYN+ACK flags, got %#x", p.TCPFlags)
+				}
+				if p.IPTos != 0xb8 || p.IPTTL != 64 || p.IPLength != 44 {
+					t.Errorf("unexpected IP header fields tos=%#x ttl=%d len=%d", p.IPTos, p.IPTTL, p.IPLength)
+				}
+				if string(p.Payload) != "hi" {
+					t.Errorf("unexpected payload %q", p.Payload)
+				}
+			},
+		},
+		"IPv6 UDP raw": {
+			linkType: packet.LinkTypeRaw,
+			data: mustHex("60012345000a1140" +
+				"20010db8000000000000000000000001" +
+				"20010db8000000000000000000000002" +
+				"d43100350000000000aa"),
+			check: func(t *testing.T, p *packet.Packet) {
+				if p.Etype != packet.EtherTypeIPv6 {
+					t.Errorf("expected IPv6 etype, got %#x", p.Etype)
+				}
+				if p.IPv6FlowLabel != 0x12345 {
+					t.Errorf("unexpected flow label %#x", p.IPv6FlowLabel)
+				}
+				if p.SrcAddr != netip.MustParseAddr("2001:db8::1") {
+					t.Errorf("unexpected src addr %s", p.SrcAddr)
+				}
+				if p.Proto != packet.ProtoUDP || p.SrcPort != 54321 || p.DstPort != 53 {
+					t.Errorf("unexpected transport %d %d -> %d", p.Proto, p.SrcPort, p.DstPort)
+				}
+				if len(p.Payload) != 2 {
+					t.Errorf("unexpected payload %x", p.Payload)
+				}
+			},
+		},
+		"ICMP type and code": {
+			linkType: packet.LinkTypeIPv4,
+			data:     mustHex("450000540000000040010000c0000201c00002020800"),
+			check: func(t *testing.T, p *packet.Packet) {
+				if p.Proto != packet.ProtoICMP || p.IcmpType != 8 || p.IcmpCode != 0 {
+					t.Errorf("unexpected ICMP %d %d/%d", p.Proto, p.IcmpType, p.IcmpCode)
+				}
+			},
+		},
+		"truncated transport header returns partial result": {
+			linkType: packet.LinkTypeIPv4,
+			data:     mustHex("45000054000000004006 0000 c0000201 c0000202 c350"),
+			wantErr:  packet.ErrTruncated,
+			check: func(t *testing.T, p *packet.Packet) {
+				if p.SrcAddr != netip.MustParseAddr("192.0.2.1") {
+					t.Errorf("expected network layer to be decoded, got %s", p.SrcAddr)
+				}
+			},
+		},
+		"unsupported link type": {
+			linkType: 9000,
+			data:     []byte{0},
+			wantErr:  packet.ErrUnsupportedLink,
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			p, err := packet.Decode(tc.linkType, tc.data)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expected err %v, got %v", tc.wantErr, err)
+			}
+			if tc.check != nil {
+				tc.check(t, p)
+			}
+		})
+	}
+}
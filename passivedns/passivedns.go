@@ -0,0 +1,208 @@
+package passivedns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapslaj/morbius/atomicfile"
+	"github.com/sapslaj/morbius/packet"
+)
+
+var (
+	MetricTableSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "passive_dns_table_size",
+			Help: "Number of addresses in the passive DNS table",
+		},
+	)
+	MetricAnswers = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "passive_dns_answers",
+			Help: "Number of A and AAAA answers added to the passive DNS table",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(MetricTableSize)
+	prometheus.MustRegister(MetricAnswers)
+}
+
+type TableConfig struct {
+	// Maximum number of addresses to keep. The least recently seen addresses
+	// are evicted first. Default is 100000.
+	MaxEntries int `yaml:"max_entries"`
+	// Answer TTLs are clamped to this range. CDNs commonly hand out TTLs of a
+	// few seconds while the flows to those addresses last much longer, so the
+	// minimum is fairly generous. Defaults are 5m and 24h.
+	MinTTL time.Duration `yaml:"min_ttl"`
+	MaxTTL time.Duration `yaml:"max_ttl"`
+	// File to persist the table to so it survives restarts. Not persisted if
+	// empty.
+	Path string `yaml:"path"`
+	// How often to save the table to Path. Default is 1m.
+	SaveInterval time.Duration `yaml:"save_interval"`
+}
+
+type entry struct {
+	Name    string    `json:"name"`
+	Expires time.Time `json:"expires"`
+}
+
+type savedEntry struct {
+	Addr netip.Addr `json:"addr"`
+	entry
+}
+
+// Table maps addresses to the names that were queried to get them.
+type Table struct {
+	Config  *TableConfig
+	entries *lru.Cache[netip.Addr, entry]
+	// Serializes Save and Load; the cache does its own locking.
+	mu sync.Mutex
+}
+
+func NewTable(config *TableConfig) *Table {
+	if config == nil {
+		config = &TableConfig{}
+	}
+	if config.MaxEntries == 0 {
+		config.MaxEntries = 100000
+	}
+	if config.MinTTL == 0 {
+		config.MinTTL = 5 * time.Minute
+	}
+	if config.MaxTTL == 0 {
+		config.MaxTTL = 24 * time.Hour
+	}
+	if config.MinTTL > config.MaxTTL {
+		panic(fmt.Errorf("passivedns: min_ttl %s is greater than max_ttl %s", config.MinTTL, config.MaxTTL))
+	}
+	if config.SaveInterval == 0 {
+		config.SaveInterval = time.Minute
+	}
+	entries, err := lru.New[netip.Addr, entry](config.MaxEntries)
+	if err != nil {
+		panic(err)
+	}
+	return &Table{
+		Config:  config,
+		entries: entries,
+	}
+}
+
+// Add records that addr was an answer for name, valid for ttl.
+func (t *Table) Add(addr netip.Addr, name string, ttl time.Duration) {
+	if ttl < t.Config.MinTTL {
+		ttl = t.Config.MinTTL
+	}
+	if ttl > t.Config.MaxTTL {
+		ttl = t.Config.MaxTTL
+	}
+	t.entries.Add(addr.Unmap(), entry{Name: name, Expires: time.Now().Add(ttl)})
+	MetricTableSize.Set(float64(t.entries.Len()))
+}
+
+// AddMessage adds the A and AAAA answers of a successful DNS response. The
+// addresses are mapped to the name in the question rather than the owner name
+// of the record, since the end of a CNAME chain is usually a CDN name nobody
+// asked for.
+func (t *Table) AddMessage(m *packet.DNSMessage) {
+	if m == nil || !m.Response || m.RCode != 0 {
+		return
+	}
+	for _, answer := range m.Answers {
+		if answer.Type != packet.DNSTypeA && answer.Type != packet.DNSTypeAAAA {
+			continue
+		}
+		name := answer.Name
+		if len(m.Questions) > 0 {
+			name = m.Questions[0].Name
+		}
+		if name == "" {
+			continue
+		}
+		t.Add(answer.Addr, name, time.Duration(answer.TTL)*time.Second)
+		MetricAnswers.Inc()
+	}
+}
+
+// Lookup returns the queried name for addr if there is an unexpired entry.
+func (t *Table) Lookup(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	e, ok := t.entries.Get(addr)
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(e.Expires) {
+		t.entries.Remove(addr)
+		MetricTableSize.Set(float64(t.entries.Len()))
+		return "", false
+	}
+	return e.Name, true
+}
+
+func (t *Table) Len() int {
+	return t.entries.Len()
+}
+
+// Load reads a table saved by Save. A missing file is not an error.
+func (t *Table) Load() error {
+	if t.Config.Path == "" {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, err := os.ReadFile(t.Config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []savedEntry
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("passivedns: error parsing %s: %w", t.Config.Path, err)
+	}
+	now := time.Now()
+	// Saved oldest first so recency is preserved.
+	for _, e := range saved {
+		if now.After(e.Expires) {
+			continue
+		}
+		t.entries.Add(e.Addr, e.entry)
+	}
+	MetricTableSize.Set(float64(t.entries.Len()))
+	return nil
+}
+
+// Save writes the unexpired entries to Config.Path.
+func (t *Table) Save() error {
+	if t.Config.Path == "" {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	saved := make([]savedEntry, 0, t.entries.Len())
+	for _, addr := range t.entries.Keys() {
+		e, ok := t.entries.Peek(addr)
+		if !ok || now.After(e.Expires) {
+			continue
+		}
+		saved = append(saved, savedEntry{Addr: addr, entry: e})
+	}
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(t.Config.Path, b)
+}
@@ -0,0 +1,142 @@
+package passivedns_test
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sapslaj/morbius/packet"
+	"github.com/sapslaj/morbius/passivedns"
+)
+
+func TestTable(t *testing.T) {
+	t.Parallel()
+	type lookup struct {
+		addr string
+		name string
+		ok   bool
+	}
+	type test struct {
+		config  *passivedns.TableConfig
+		message *packet.DNSMessage
+		wait    time.Duration
+		want    []lookup
+	}
+
+	cnameResponse := &packet.DNSMessage{
+		Response:  true,
+		Questions: []packet.DNSQuestion{{Name: "www.example.com", Type: packet.DNSTypeA, Class: 1}},
+		Answers: []packet.DNSRecord{
+			{Name: "www.example.com", Type: packet.DNSTypeCNAME, Class: 1, TTL: 300, Target: "edge.cdn.example"},
+			{Name: "edge.cdn.example", Type: packet.DNSTypeA, Class: 1, TTL: 20, Addr: netip.MustParseAddr("192.0.2.10")},
+			{Name: "edge.cdn.example", Type: packet.DNSTypeA, Class: 1, TTL: 20, Addr: netip.MustParseAddr("192.0.2.11")},
+		},
+	}
+
+	tests := map[string]test{
+		"maps answers to the queried name": {
+			message: cnameResponse,
+			want: []lookup{
+				{addr: "192.0.2.10", name: "www.example.com", ok: true},
+				{addr: "192.0.2.11", name: "www.example.com", ok: true},
+				{addr: "::ffff:192.0.2.11", name: "www.example.com", ok: true},
+				{addr: "192.0.2.12"},
+			},
+		},
+		"maps AAAA answers": {
+			message: &packet.DNSMessage{
+				Response:  true,
+				Questions: []packet.DNSQuestion{{Name: "example.net", Type: packet.DNSTypeAAAA, Class: 1}},
+				Answers: []packet.DNSRecord{
+					{Name: "example.net", Type: packet.DNSTypeAAAA, Class: 1, TTL: 60, Addr: netip.MustParseAddr("2001:db8::1")},
+				},
+			},
+			want: []lookup{
+				{addr: "2001:db8::1", name: "example.net", ok: true},
+			},
+		},
+		"ignores queries": {
+			message: &packet.DNSMessage{
+				Questions: cnameResponse.Questions,
+				Answers:   cnameResponse.Answers,
+			},
+			want: []lookup{
+				{addr: "192.0.2.10"},
+			},
+		},
+		"ignores error responses": {
+			message: &packet.DNSMessage{
+				Response:  true,
+				RCode:     2,
+				Questions: cnameResponse.Questions,
+				Answers:   cnameResponse.Answers,
+			},
+			want: []lookup{
+				{addr: "192.0.2.10"},
+			},
+		},
+		"entries expire after max_ttl": {
+			config:  &passivedns.TableConfig{MinTTL: time.Millisecond, MaxTTL: 10 * time.Millisecond},
+			message: cnameResponse,
+			wait:    50 * time.Millisecond,
+			want: []lookup{
+				{addr: "192.0.2.10"},
+			},
+		},
+		"least recently seen entries are evicted": {
+			config:  &passivedns.TableConfig{MaxEntries: 1},
+			message: cnameResponse,
+			want: []lookup{
+				{addr: "192.0.2.10"},
+				{addr: "192.0.2.11", name: "www.example.com", ok: true},
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			table := passivedns.NewTable(tc.config)
+			table.AddMessage(tc.message)
+			time.Sleep(tc.wait)
+			for _, l := range tc.want {
+				got, ok := table.Lookup(netip.MustParseAddr(l.addr))
+				if ok != l.ok || got != l.name {
+					t.Errorf("\"%s\": Lookup(%s) = %q, %v; want %q, %v", name, l.addr, got, ok, l.name, l.ok)
+				}
+			}
+		})
+	}
+}
+
+func TestTablePersistence(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "passive_dns.json")
+
+	table := passivedns.NewTable(&passivedns.TableConfig{Path: path})
+	if err := table.Load(); err != nil {
+		t.Fatalf("Load of missing file returned err: %v", err)
+	}
+	table.Add(netip.MustParseAddr("192.0.2.10"), "www.example.com", time.Hour)
+	table.Add(netip.MustParseAddr("2001:db8::1"), "example.net", time.Hour)
+	if err := table.Save(); err != nil {
+		t.Fatalf("Save returned err: %v", err)
+	}
+
+	loaded := passivedns.NewTable(&passivedns.TableConfig{Path: path})
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Load returned err: %v", err)
+	}
+	if loaded.Len() != 2 {
+		t.Errorf("expected 2 entries after Load, got %d", loaded.Len())
+	}
+	for addr, want := range map[string]string{"192.0.2.10": "www.example.com", "2001:db8::1": "example.net"} {
+		got, ok := loaded.Lookup(netip.MustParseAddr(addr))
+		if !ok || got != want {
+			t.Errorf("Lookup(%s) after Load = %q, %v; want %q, true", addr, got, ok, want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Package prefixtree implements a path-compressed binary radix tree of IP
+// prefixes for longest-prefix-match lookups.
+package prefixtree
+
+import (
+	"math/bits"
+	"net/netip"
+)
+
+type key [16]byte
+
+func (k key) bit(i int) int {
+	return int(k[i/8]>>(7-i%8)) & 1
+}
+
+// Returns k with all but the first n bits cleared.
+func (k key) mask(n int) key {
+	var m key
+	copy(m[:], k[:n/8])
+	if n%8 != 0 {
+		m[n/8] = k[n/8] & ^byte(0xff>>(n%8))
+	}
+	return m
+}
+
+// Number of leading bits a and b have in common, up to max.
+func commonBits(a, b key, max int) int {
+	n := 0
+	for i := 0; i < 16 && n < max; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			n += bits.LeadingZeros8(x)
+			break
+		}
+		n += 8
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+func addrKey(addr netip.Addr) key {
+	var k key
+	if addr.Is4() {
+		a := addr.As4()
+		copy(k[:], a[:])
+	} else {
+		k = addr.As16()
+	}
+	return k
+}
+
+type node[V any] struct {
+	key      key
+	bits     int
+	value    V
+	hasValue bool
+	children [2]*node[V]
+}
+
+// Tree maps prefixes to values. IPv4 and IPv6 prefixes are kept apart, so an
+// IPv4-mapped IPv6 address only matches IPv6 prefixes. A Tree isn't safe for
+// concurrent use while it's being modified.
+type Tree[V any] struct {
+	v4, v6 *node[V]
+	len    int
+}
+
+func New[V any]() *Tree[V] {
+	return &Tree[V]{}
+}
+
+func (t *Tree[V]) root(addr netip.Addr) **node[V] {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// Insert sets the value for prefix, replacing any existing value. Host bits
+// in prefix are ignored.
+func (t *Tree[V]) Insert(prefix netip.Prefix, value V) {
+	prefix = prefix.Masked()
+	k := addrKey(prefix.Addr())
+	plen := prefix.Bits()
+	n := t.root(prefix.Addr())
+	for {
+		cur := *n
+		if cur == nil {
+			*n = &node[V]{key: k, bits: plen, value: value, hasValue: true}
+			t.len++
+			return
+		}
+		common := commonBits(cur.key, k, min(cur.bits, plen))
+		switch {
+		case common == cur.bits && common == plen:
+			if !cur.hasValue {
+				t.len++
+			}
+			cur.value = value
+			cur.hasValue = true
+			return
+		case common == cur.bits:
+			n = &cur.children[k.bit(cur.bits)]
+			continue
+		case common == plen:
+			leaf := &node[V]{key: k, bits: plen, value: value, hasValue: true}
+			leaf.children[cur.key.bit(plen)] = cur
+			*n = leaf
+		default:
+			leaf := &node[V]{key: k, bits: plen, value: value, hasValue: true}
+			branch := &node[V]{key: k.mask(common), bits: common}
+			branch.children[k.bit(common)] = leaf
+			branch.children[cur.key.bit(common)] = cur
+			*n = branch
+		}
+		t.len++
+		return
+	}
+}
+
+// Lookup returns the longest prefix containing addr and its value.
+func (t *Tree[V]) Lookup(addr netip.Addr) (netip.Prefix, V, bool) {
+	k := addrKey(addr)
+	maxBits := addr.BitLen()
+	var best *node[V]
+	for n := *t.root(addr); n != nil; n = n.children[k.bit(n.bits)] {
+		if commonBits(n.key, k, n.bits) < n.bits {
+			break
+		}
+		if n.hasValue {
+			best = n
+		}
+		if n.bits >= maxBits {
+			break
+		}
+	}
+	if best == nil {
+		var zero V
+		return netip.Prefix{}, zero, false
+	}
+	prefix, _ := addr.Prefix(best.bits)
+	return prefix, best.value, true
+}
+
+// Len returns the number of prefixes in the tree.
+func (t *Tree[V]) Len() int {
+	return t.len
+}
@@ -0,0 +1,143 @@
+package prefixtree_test
+
+import (
+	"math/rand"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/prefixtree"
+)
+
+func TestTree_Lookup(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		addr       string
+		wantPrefix string
+		wantValue  string
+	}
+
+	tree := prefixtree.New[string]()
+	for _, p := range []struct{ prefix, value string }{
+		{"10.0.0.0/8", "ten"},
+		{"10.1.0.0/16", "ten-one"},
+		{"10.1.2.0/24", "ten-one-two"},
+		{"10.1.2.3/32", "host"},
+		{"10.128.0.0/9", "ten-upper"},
+		{"0.0.0.0/0", "default"},
+		{"2001:db8::/32", "documentation"},
+		{"2001:db8:1::/48", "site"},
+		{"::ffff:0:0/96", "mapped"},
+		// Host bits are ignored.
+		{"192.0.2.77/24", "test-net"},
+	} {
+		tree.Insert(netip.MustParsePrefix(p.prefix), p.value)
+	}
+
+	tests := map[string]test{
+		"longest match wins": {
+			addr:       "10.1.2.4",
+			wantPrefix: "10.1.2.0/24",
+			wantValue:  "ten-one-two",
+		},
+		"host route": {
+			addr:       "10.1.2.3",
+			wantPrefix: "10.1.2.3/32",
+			wantValue:  "host",
+		},
+		"sibling branch": {
+			addr:       "10.200.0.1",
+			wantPrefix: "10.128.0.0/9",
+			wantValue:  "ten-upper",
+		},
+		"falls back to shorter prefix": {
+			addr:       "10.2.0.1",
+			wantPrefix: "10.0.0.0/8",
+			wantValue:  "ten",
+		},
+		"default route": {
+			addr:       "198.51.100.1",
+			wantPrefix: "0.0.0.0/0",
+			wantValue:  "default",
+		},
+		"masked insert": {
+			addr:       "192.0.2.1",
+			wantPrefix: "192.0.2.0/24",
+			wantValue:  "test-net",
+		},
+		"ipv6": {
+			addr:       "2001:db8:1::1",
+			wantPrefix: "2001:db8:1::/48",
+			wantValue:  "site",
+		},
+		"ipv6 without a match": {
+			addr: "2001:db9::1",
+		},
+		"ipv4-mapped addresses only match ipv6 prefixes": {
+			addr:       "::ffff:10.1.2.3",
+			wantPrefix: "::ffff:0.0.0.0/96",
+			wantValue:  "mapped",
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			prefix, value, ok := tree.Lookup(netip.MustParseAddr(tc.addr))
+			if ok != (tc.wantPrefix != "") {
+				t.Fatalf("\"%s\": expected found %v, got %v", name, tc.wantPrefix != "", ok)
+			}
+			if !ok {
+				return
+			}
+			if diff := cmp.Diff(tc.wantPrefix, prefix.String()); diff != "" {
+				t.Errorf("\"%s\": prefix mismatch (-want +got):\n%s", name, diff)
+			}
+			if diff := cmp.Diff(tc.wantValue, value); diff != "" {
+				t.Errorf("\"%s\": value mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+
+	if tree.Len() != 10 {
+		t.Errorf("expected 10 prefixes, got %d", tree.Len())
+	}
+}
+
+func TestTree_MatchesLinearScan(t *testing.T) {
+	t.Parallel()
+	rnd := rand.New(rand.NewSource(1))
+	randAddr := func() netip.Addr {
+		// Keep addresses close together so prefixes overlap.
+		return netip.AddrFrom4([4]byte{10, byte(rnd.Intn(4)), byte(rnd.Intn(256)), byte(rnd.Intn(256))})
+	}
+
+	tree := prefixtree.New[int]()
+	prefixes := make(map[netip.Prefix]int)
+	for i := 0; i < 2000; i++ {
+		prefix, _ := randAddr().Prefix(8 + rnd.Intn(25))
+		tree.Insert(prefix, i)
+		prefixes[prefix] = i
+	}
+	if tree.Len() != len(prefixes) {
+		t.Errorf("expected %d prefixes, got %d", len(prefixes), tree.Len())
+	}
+
+	for i := 0; i < 10000; i++ {
+		addr := randAddr()
+		var wantPrefix netip.Prefix
+		wantValue, wantOK := 0, false
+		for prefix, value := range prefixes {
+			if prefix.Contains(addr) && (!wantOK || prefix.Bits() > wantPrefix.Bits()) {
+				wantPrefix, wantValue, wantOK = prefix, value, true
+			}
+		}
+		prefix, value, ok := tree.Lookup(addr)
+		if ok != wantOK || prefix != wantPrefix || value != wantValue {
+			t.Fatalf("%s: expected %s=%d (%v), got %s=%d (%v)", addr, wantPrefix, wantValue, wantOK, prefix, value, ok)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/sapslaj/morbius/config"
+	"github.com/sapslaj/morbius/server"
+)
+
+func replayMain(args []string) {
+	f := flag.NewFlagSet(os.Args[0]+" replay", flag.ExitOnError)
+	configFile := f.String("config-file", envWithDefault("MORBIUS_CONFIG_FILE", "config.yaml"), "Path to the config file")
+	speed := f.Float64("speed", 1, "Playback speed relative to the capture. 1 is real-time, 0 is as fast as possible")
+	listener := f.String("listener", "", "Decode datagrams as this listener type (netflowv5, netflowv9, sflow). Defaults to the type recorded in the capture, or matching by destination port for pcap files")
+	f.Usage = func() {
+		f.Output().Write([]byte("Usage: " + os.Args[0] + " replay [flags] <capture or pcap file>...\n"))
+		f.PrintDefaults()
+	}
+	f.Parse(args)
+
+	if f.NArg() == 0 {
+		f.Usage()
+		os.Exit(2)
+	}
+
+	c := config.NewFromFile(*configFile)
+	c.ReadOnlyState()
+	s := c.BuildServer()
+	logger := s.Config.Logger
+
+	for _, path := range f.Args() {
+		stats, err := s.Replay(path, server.ReplayOptions{
+			Speed:    *speed,
+			Listener: *listener,
+		})
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+		logger.Printf("%s: replayed %d datagrams (%d decode errors, %d skipped)", path, stats.Datagrams, stats.Errors, stats.Skipped)
+	}
+
+	if err := s.Close(); err != nil {
+		logger.Errorf("error closing server: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/sapslaj/morbius/enricher"
+)
+
+type AdminConfig struct {
+	// Require an `Authorization: Bearer <token>` header for the admin
+	// endpoints. Without a token they're read-only. BearerTokenFile takes
+	// precedence if both are set.
+	BearerToken     string `yaml:"bearer_token"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+}
+
+type cachesResponse struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+}
+
+type cachePurgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+// CachesHandler serves the enricher caches for debugging:
+//
+//	GET    /caches              names and sizes of the caches
+//	GET    /caches/{name}       every entry in a cache
+//	GET    /caches/{name}/{key} one entry, or 404 if it isn't cached
+//	DELETE /caches/{name}       purge a cache
+//	DELETE /caches/{name}/{key} purge one entry
+//
+// All of them require the admin bearer token if one is set. Purging is refused
+// if there isn't one.
+func CachesHandler(caches map[string]enricher.Cache, config *AdminConfig) (http.Handler, error) {
+	if config == nil {
+		config = &AdminConfig{}
+	}
+	token, err := loadBearerToken(config.BearerToken, config.BearerTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /caches", func(w http.ResponseWriter, r *http.Request) {
+		names := make([]string, 0, len(caches))
+		for name := range caches {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		resp := make([]cachesResponse, len(names))
+		for i, name := range names {
+			resp[i] = cachesResponse{Name: name, Entries: len(caches[name].CacheEntries())}
+		}
+		writeCachesJSON(w, resp)
+	})
+	mux.HandleFunc("GET /caches/{name}", func(w http.ResponseWriter, r *http.Request) {
+		cache, ok := caches[r.PathValue("name")]
+		if !ok {
+			http.Error(w, "unknown cache", http.StatusNotFound)
+			return
+		}
+		entries := cache.CacheEntries()
+		if entries == nil {
+			entries = []enricher.CacheEntry{}
+		}
+		writeCachesJSON(w, entries)
+	})
+	mux.HandleFunc("GET /caches/{name}/{key}", func(w http.ResponseWriter, r *http.Request) {
+		cache, ok := caches[r.PathValue("name")]
+		if !ok {
+			http.Error(w, "unknown cache", http.StatusNotFound)
+			return
+		}
+		entry, ok := cache.CacheLookup(r.PathValue("key"))
+		if !ok {
+			http.Error(w, "not cached", http.StatusNotFound)
+			return
+		}
+		writeCachesJSON(w, entry)
+	})
+	purge := func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "purging requires an admin bearer token", http.StatusForbidden)
+			return
+		}
+		cache, ok := caches[r.PathValue("name")]
+		if !ok {
+			http.Error(w, "unknown cache", http.StatusNotFound)
+			return
+		}
+		writeCachesJSON(w, cachePurgeResponse{Purged: cache.CachePurge(r.PathValue("key"))})
+	}
+	mux.HandleFunc("DELETE /caches/{name}", purge)
+	mux.HandleFunc("DELETE /caches/{name}/{key}", purge)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bearerAuthorized(r.Header.Get("Authorization"), token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}), nil
+}
+
+func writeCachesJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,192 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/enricher"
+	"github.com/sapslaj/morbius/server"
+)
+
+type fakeCache struct {
+	entries []enricher.CacheEntry
+}
+
+func (c *fakeCache) CacheEntries() []enricher.CacheEntry {
+	return c.entries
+}
+
+func (c *fakeCache) CacheLookup(key string) (enricher.CacheEntry, bool) {
+	for _, entry := range c.entries {
+		if entry.Key == key {
+			return entry, true
+		}
+	}
+	return enricher.CacheEntry{}, false
+}
+
+func (c *fakeCache) CachePurge(key string) int {
+	if key == "" {
+		n := len(c.entries)
+		c.entries = nil
+		return n
+	}
+	for i, entry := range c.entries {
+		if entry.Key == key {
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			return 1
+		}
+	}
+	return 0
+}
+
+func (c *fakeCache) CloseCache() error {
+	return nil
+}
+
+func TestCachesHandler(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		config      server.AdminConfig
+		token       string
+		method      string
+		path        string
+		wantStatus  int
+		wantBody    string
+		wantEntries []string
+	}
+
+	tests := map[string]test{
+		"lists caches": {
+			path:       "/caches",
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"name":"empty","entries":0},{"name":"rdns","entries":2}]`,
+		},
+		"dumps a cache": {
+			path:       "/caches/rdns",
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"key":"192.0.2.1","value":["one.example.com."]},{"key":"2001:db8::1","value":[]}]`,
+		},
+		"dumps an empty cache": {
+			path:       "/caches/empty",
+			wantStatus: http.StatusOK,
+			wantBody:   `[]`,
+		},
+		"unknown cache": {
+			path:       "/caches/nope",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "unknown cache",
+		},
+		"looks up an entry": {
+			path:       "/caches/rdns/2001:db8::1",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"key":"2001:db8::1","value":[]}`,
+		},
+		"entry that isn't cached": {
+			path:       "/caches/rdns/192.0.2.99",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "not cached",
+		},
+		"purges an entry": {
+			config:      server.AdminConfig{BearerToken: "hunter2"},
+			token:       "hunter2",
+			method:      http.MethodDelete,
+			path:        "/caches/rdns/192.0.2.1",
+			wantStatus:  http.StatusOK,
+			wantBody:    `{"purged":1}`,
+			wantEntries: []string{"2001:db8::1"},
+		},
+		"purges a cache": {
+			config:     server.AdminConfig{BearerToken: "hunter2"},
+			token:      "hunter2",
+			method:     http.MethodDelete,
+			path:       "/caches/rdns",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"purged":2}`,
+		},
+		"refuses to purge without an admin token configured": {
+			method:      http.MethodDelete,
+			path:        "/caches/rdns",
+			wantStatus:  http.StatusForbidden,
+			wantBody:    "purging requires an admin bearer token",
+			wantEntries: []string{"192.0.2.1", "2001:db8::1"},
+		},
+		"refuses to purge with the wrong token": {
+			config:      server.AdminConfig{BearerToken: "hunter2"},
+			token:       "hunter3",
+			method:      http.MethodDelete,
+			path:        "/caches/rdns",
+			wantStatus:  http.StatusUnauthorized,
+			wantBody:    "unauthorized",
+			wantEntries: []string{"192.0.2.1", "2001:db8::1"},
+		},
+		"requires the token to read when one is configured": {
+			config:     server.AdminConfig{BearerToken: "hunter2"},
+			path:       "/caches/rdns",
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "unauthorized",
+		},
+		"reads with the token": {
+			config:     server.AdminConfig{BearerToken: "hunter2"},
+			token:      "hunter2",
+			path:       "/caches",
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"name":"empty","entries":0},{"name":"rdns","entries":2}]`,
+		},
+		"rejects other methods": {
+			method:     http.MethodPost,
+			path:       "/caches/rdns",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			rdns := &fakeCache{entries: []enricher.CacheEntry{
+				{Key: "192.0.2.1", Value: []string{"one.example.com."}},
+				{Key: "2001:db8::1", Value: []string{}},
+			}}
+			h, err := server.CachesHandler(map[string]enricher.Cache{
+				"rdns":  rdns,
+				"empty": &fakeCache{},
+			}, &tc.config)
+			if err != nil {
+				t.Fatalf("\"%s\": CachesHandler returned err: %v", name, err)
+			}
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tc.path, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.wantStatus {
+				t.Errorf("\"%s\": expected status %d, got %d", name, tc.wantStatus, rec.Code)
+			}
+			if tc.wantBody != "" {
+				if diff := cmp.Diff(tc.wantBody, strings.TrimSpace(rec.Body.String())); diff != "" {
+					t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+				}
+			}
+			if tc.method == http.MethodDelete {
+				var keys []string
+				for _, entry := range rdns.entries {
+					keys = append(keys, entry.Key)
+				}
+				if diff := cmp.Diff(tc.wantEntries, keys); diff != "" {
+					t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+				}
+			}
+		})
+	}
+}
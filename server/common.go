@@ -21,3 +21,9 @@ type Transport interface {
 	Publish([]*goflowpb.FlowMessage)
 	PublishMessage(msg map[string]interface{})
 }
+
+// Implemented by transports that can attach extra fields (such as custom
+// NetFlow/IPFIX elements) to the messages built from flow messages.
+type fieldsPublisher interface {
+	PublishWithFields(fmsgs []*goflowpb.FlowMessage, fields []map[string]interface{})
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapslaj/morbius/packet"
+)
+
+// Message type for conntrack flows.
+const ConntrackMessageType = "CONNTRACK"
+
+var MetricConntrackEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "conntrack_events",
+		Help: "Number of conntrack destroy events received",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(MetricConntrackEvents)
+}
+
+type ConntrackConfig struct {
+	Enable bool `yaml:"enable"`
+	// Turn on the net.netfilter.nf_conntrack_acct and nf_conntrack_timestamp
+	// sysctls on start. Without them messages don't have byte and packet
+	// counts or flow start and end times.
+	EnableAccounting bool `yaml:"enable_accounting"`
+	// Netlink socket receive buffer size. Events are dropped by the kernel
+	// when it fills up. Default is 4MiB.
+	ReadBuffer int `yaml:"read_buffer"`
+	// Value of `sampler_address` in the flow messages. Default is 0.0.0.0.
+	SamplerAddress string `yaml:"sampler_address"`
+}
+
+func mergeDefaultConntrackConfig(in *ConntrackConfig) *ConntrackConfig {
+	if in == nil {
+		in = &ConntrackConfig{}
+	}
+	if in.ReadBuffer == 0 {
+		in.ReadBuffer = 4 * 1024 * 1024
+	}
+	if in.SamplerAddress == "" {
+		in.SamplerAddress = "0.0.0.0"
+	}
+	return in
+}
+
+type ConntrackTuple struct {
+	SrcAddr  netip.Addr
+	DstAddr  netip.Addr
+	Proto    uint8
+	SrcPort  uint16
+	DstPort  uint16
+	IcmpType uint8
+	IcmpCode uint8
+}
+
+type ConntrackCounters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// ConntrackFlow is a connection from a conntrack destroy event. Reply is the
+// tuple of the return traffic, so it differs from the reverse of Orig when the
+// connection was NATed.
+type ConntrackFlow struct {
+	ID            uint32
+	Mark          uint32
+	Zone          uint16
+	Orig          ConntrackTuple
+	Reply         ConntrackTuple
+	OrigCounters  ConntrackCounters
+	ReplyCounters ConntrackCounters
+	// Only set with nf_conntrack_timestamp enabled.
+	Start time.Time
+	Stop  time.Time
+}
+
+var ErrConntrackMalformed = errors.New("conntrack: malformed netlink message")
+
+// Returned when the kernel dropped events because the socket buffer was full.
+var errConntrackOverrun = errors.New("conntrack: netlink socket overrun")
+
+// From linux/netlink.h, linux/netfilter/nfnetlink.h, and
+// linux/netfilter/nfnetlink_conntrack.h
+const (
+	nlmsgHdrLen          = 16
+	nlmsgDone            = 3
+	nlaTypeMask          = 0x3fff
+	nfgenmsgLen          = 4
+	ctnlMsgTypeDelete    = 1<<8 | 2
+	ctaTupleOrig         = 1
+	ctaTupleReply        = 2
+	ctaMark              = 8
+	ctaCountersOrig      = 9
+	ctaCountersReply     = 10
+	ctaID                = 12
+	ctaZone              = 18
+	ctaTimestamp         = 20
+	ctaTupleIP           = 1
+	ctaTupleProto        = 2
+	ctaIPv4Src           = 1
+	ctaIPv4Dst           = 2
+	ctaIPv6Src           = 3
+	ctaIPv6Dst           = 4
+	ctaProtoNum          = 1
+	ctaProtoSrcPort      = 2
+	ctaProtoDstPort      = 3
+	ctaProtoICMPType     = 5
+	ctaProtoICMPCode     = 6
+	ctaProtoICMPv6Type   = 8
+	ctaProtoICMPv6Code   = 9
+	ctaCountersPackets   = 1
+	ctaCountersBytes     = 2
+	ctaCounters32Packets = 3
+	ctaCounters32Bytes   = 4
+	ctaTimestampStart    = 1
+	ctaTimestampStop     = 2
+)
+
+// Calls fn for each netlink attribute in b.
+func walkNetlinkAttrs(b []byte, fn func(attrType uint16, value []byte) error) error {
+	for len(b) >= 4 {
+		length := int(binary.NativeEndian.Uint16(b[0:2]))
+		attrType := binary.NativeEndian.Uint16(b[2:4]) & nlaTypeMask
+		if length < 4 || length > len(b) {
+			return ErrConntrackMalformed
+		}
+		if err := fn(attrType, b[4:length]); err != nil {
+			return err
+		}
+		// Attributes are padded to 4 bytes.
+		aligned := (length + 3) &^ 3
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return nil
+}
+
+func decodeConntrackTuple(b []byte) (ConntrackTuple, error) {
+	var t ConntrackTuple
+	err := walkNetlinkAttrs(b, func(attrType uint16, value []byte) error {
+		switch attrType {
+		case ctaTupleIP:
+			return walkNetlinkAttrs(value, func(attrType uint16, value []byte) error {
+				addr, ok := netip.AddrFromSlice(value)
+				if !ok {
+					return ErrConntrackMalformed
+				}
+				switch attrType {
+				case ctaIPv4Src, ctaIPv6Src:
+					t.SrcAddr = addr
+				case ctaIPv4Dst, ctaIPv6Dst:
+					t.DstAddr = addr
+				}
+				return nil
+			})
+		case ctaTupleProto:
+			return walkNetlinkAttrs(value, func(attrType uint16, value []byte) error {
+				switch attrType {
+				case ctaProtoNum, ctaProtoICMPType, ctaProtoICMPCode, ctaProtoICMPv6Type, ctaProtoICMPv6Code:
+					if len(value) < 1 {
+						return ErrConntrackMalformed
+					}
+				case ctaProtoSrcPort, ctaProtoDstPort:
+					if len(value) < 2 {
+						return ErrConntrackMalformed
+					}
+				}
+				switch attrType {
+				case ctaProtoNum:
+					t.Proto = value[0]
+				case ctaProtoSrcPort:
+					t.SrcPort = binary.BigEndian.Uint16(value)
+				case ctaProtoDstPort:
+					t.DstPort = binary.BigEndian.Uint16(value)
+				case ctaProtoICMPType, ctaProtoICMPv6Type:
+					t.IcmpType = value[0]
+				case ctaProtoICMPCode, ctaProtoICMPv6Code:
+					t.IcmpCode = value[0]
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return t, err
+}
+
+func decodeConntrackCounters(b []byte) (ConntrackCounters, error) {
+	var c ConntrackCounters
+	err := walkNetlinkAttrs(b, func(attrType uint16, value []byte) error {
+		var v uint64
+		switch len(value) {
+		case 4:
+			v = uint64(binary.BigEndian.Uint32(value))
+		case 8:
+			v = binary.BigEndian.Uint64(value)
+		default:
+			return ErrConntrackMalformed
+		}
+		switch attrType {
+		case ctaCountersPackets, ctaCounters32Packets:
+			c.Packets = v
+		case ctaCountersBytes, ctaCounters32Bytes:
+			c.Bytes = v
+		}
+		return nil
+	})
+	return c, err
+}
+
+func decodeConntrackFlow(b []byte) (ConntrackFlow, error) {
+	var f ConntrackFlow
+	u32 := func(value []byte) (uint32, error) {
+		if len(value) < 4 {
+			return 0, ErrConntrackMalformed
+		}
+		return binary.BigEndian.Uint32(value), nil
+	}
+	err := walkNetlinkAttrs(b, func(attrType uint16, value []byte) error {
+		var err error
+		switch attrType {
+		case ctaTupleOrig:
+			f.Orig, err = decodeConntrackTuple(value)
+		case ctaTupleReply:
+			f.Reply, err = decodeConntrackTuple(value)
+		case ctaCountersOrig:
+			f.OrigCounters, err = decodeConntrackCounters(value)
+		case ctaCountersReply:
+			f.ReplyCounters, err = decodeConntrackCounters(value)
+		case ctaMark:
+			f.Mark, err = u32(value)
+		case ctaID:
+			f.ID, err = u32(value)
+		case ctaZone:
+			if len(value) < 2 {
+				return ErrConntrackMalformed
+			}
+			f.Zone = binary.BigEndian.Uint16(value)
+		case ctaTimestamp:
+			err = walkNetlinkAttrs(value, func(attrType uint16, value []byte) error {
+				if len(value) < 8 {
+					return ErrConntrackMalformed
+				}
+				ts := time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+				switch attrType {
+				case ctaTimestampStart:
+					f.Start = ts
+				case ctaTimestampStop:
+					f.Stop = ts
+				}
+				return nil
+			})
+		}
+		return err
+	})
+	return f, err
+}
+
+// DecodeConntrackMessages decodes the conntrack destroy events in a datagram
+// read from a netfilter netlink socket. Other message types are skipped.
+func DecodeConntrackMessages(b []byte) ([]ConntrackFlow, error) {
+	var flows []ConntrackFlow
+	for len(b) >= nlmsgHdrLen {
+		length := int(binary.NativeEndian.Uint32(b[0:4]))
+		msgType := binary.NativeEndian.Uint16(b[4:6])
+		if length < nlmsgHdrLen || length > len(b) {
+			return flows, ErrConntrackMalformed
+		}
+		if msgType == nlmsgDone {
+			break
+		}
+		if msgType == ctnlMsgTypeDelete {
+			if length < nlmsgHdrLen+nfgenmsgLen {
+				return flows, ErrConntrackMalformed
+			}
+			f, err := decodeConntrackFlow(b[nlmsgHdrLen+nfgenmsgLen : length])
+			if err != nil {
+				return flows, err
+			}
+			flows = append(flows, f)
+		}
+		aligned := (length + 3) &^ 3
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return flows, nil
+}
+
+func addrEtype(addr netip.Addr) int {
+	if addr.Is4() {
+		return int(packet.EtherTypeIPv4)
+	}
+	return int(packet.EtherTypeIPv6)
+}
+
+// FormatConntrackFlow builds a message for a conntrack flow. The original
+// tuple and counters use the same fields as FormatFlowMessage, the reply
+// tuple and counters are added as `reply_*` fields.
+func FormatConntrackFlow(samplerAddress string, timeReceived uint64, f ConntrackFlow) map[string]interface{} {
+	start, end := int(timeReceived), int(timeReceived)
+	if !f.Start.IsZero() {
+		start = int(f.Start.Unix())
+	}
+	if !f.Stop.IsZero() {
+		end = int(f.Stop.Unix())
+	}
+	msg := map[string]interface{}{
+		"type":            ConntrackMessageType,
+		"time_received":   int(timeReceived),
+		"sampling_rate":   1,
+		"sampler_address": samplerAddress,
+		"time_flow_start": start,
+		"time_flow_end":   end,
+		"bytes":           int(f.OrigCounters.Bytes),
+		"packets":         int(f.OrigCounters.Packets),
+		"src_addr":        f.Orig.SrcAddr.String(),
+		"dst_addr":        f.Orig.DstAddr.String(),
+		"ethernet_type":   addrEtype(f.Orig.SrcAddr),
+		"proto":           int(f.Orig.Proto),
+		"src_port":        int(f.Orig.SrcPort),
+		"dst_port":        int(f.Orig.DstPort),
+		"reply_bytes":     int(f.ReplyCounters.Bytes),
+		"reply_packets":   int(f.ReplyCounters.Packets),
+		"reply_src_addr":  f.Reply.SrcAddr.String(),
+		"reply_dst_addr":  f.Reply.DstAddr.String(),
+		"reply_src_port":  int(f.Reply.SrcPort),
+		"reply_dst_port":  int(f.Reply.DstPort),
+		"conntrack_id":    int(f.ID),
+		"conntrack_mark":  int(f.Mark),
+		"conntrack_zone":  int(f.Zone),
+	}
+	switch f.Orig.Proto {
+	case packet.ProtoICMP, packet.ProtoICMPv6:
+		msg["icmp_types"] = int(f.Orig.IcmpType)
+		msg["icmp_code"] = int(f.Orig.IcmpCode)
+	}
+	return msg
+}
+
+// RunConntrack publishes a message for each connection destroyed by
+// netfilter conntrack. Only supported on Linux.
+func (s *Server) RunConntrack() error {
+	config := s.Config.Conntrack
+	if config.EnableAccounting {
+		if err := enableConntrackAccounting(); err != nil {
+			s.Config.Logger.Errorf("conntrack: error enabling accounting: %v", err)
+		}
+	}
+	sock, err := newConntrackSocket(config.ReadBuffer)
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+	for {
+		b, err := sock.read()
+		if errors.Is(err, errConntrackOverrun) {
+			MetricConntrackEvents.With(prometheus.Labels{"status": "overrun"}).Inc()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		ts := uint64(time.Now().UTC().Unix())
+		flows, err := DecodeConntrackMessages(b)
+		if err != nil {
+			MetricConntrackEvents.With(prometheus.Labels{"status": "error"}).Inc()
+			s.Config.Logger.Debugf("conntrack: error decoding message: %v", err)
+		}
+		for _, f := range flows {
+			MetricConntrackEvents.With(prometheus.Labels{"status": "decoded"}).Inc()
+			s.Config.Transport.PublishMessage(FormatConntrackFlow(config.SamplerAddress, ts, f))
+		}
+	}
+}
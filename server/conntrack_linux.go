@@ -0,0 +1,81 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// From linux/netlink.h and linux/netfilter/nfnetlink.h
+const (
+	netlinkNetfilter        = 12
+	nfnlgrpConntrackDestroy = 3
+)
+
+// Large enough for any netlink datagram the kernel sends.
+const conntrackReadBufferBytes = 64 * 1024
+
+var conntrackSysctls = []string{
+	"/proc/sys/net/netfilter/nf_conntrack_acct",
+	"/proc/sys/net/netfilter/nf_conntrack_timestamp",
+}
+
+func enableConntrackAccounting() error {
+	for _, path := range conntrackSysctls {
+		if err := os.WriteFile(path, []byte("1\n"), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type conntrackSocket struct {
+	fd  int
+	buf []byte
+}
+
+func newConntrackSocket(readBuffer int) (*conntrackSocket, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkNetfilter)
+	if err != nil {
+		return nil, err
+	}
+	// SO_RCVBUFFORCE ignores rmem_max but needs CAP_NET_ADMIN, which is
+	// usually there since subscribing to conntrack events needs it too.
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, readBuffer); err != nil {
+		syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, readBuffer)
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: 1 << (nfnlgrpConntrackDestroy - 1),
+	})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &conntrackSocket{
+		fd:  fd,
+		buf: make([]byte, conntrackReadBufferBytes),
+	}, nil
+}
+
+func (s *conntrackSocket) read() ([]byte, error) {
+	for {
+		n, _, err := syscall.Recvfrom(s.fd, s.buf, 0)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if errors.Is(err, syscall.ENOBUFS) {
+			return nil, errConntrackOverrun
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s.buf[:n], nil
+	}
+}
+
+func (s *conntrackSocket) Close() error {
+	return syscall.Close(s.fd)
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+)
+
+type conntrackSocket struct{}
+
+func enableConntrackAccounting() error {
+	return errors.New("conntrack is only supported on Linux")
+}
+
+func newConntrackSocket(readBuffer int) (*conntrackSocket, error) {
+	return nil, errors.New("conntrack is only supported on Linux")
+}
+
+func (s *conntrackSocket) read() ([]byte, error) {
+	return nil, errors.New("conntrack is only supported on Linux")
+}
+
+func (s *conntrackSocket) Close() error {
+	return nil
+}
@@ -0,0 +1,157 @@
+package server_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/server"
+)
+
+func netlinkAttr(attrType uint16, value []byte) []byte {
+	b := make([]byte, 4, 4+len(value)+3)
+	binary.NativeEndian.PutUint16(b[0:2], uint16(4+len(value)))
+	binary.NativeEndian.PutUint16(b[2:4], attrType)
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func netlinkNested(attrType uint16, attrs ...[]byte) []byte {
+	var value []byte
+	for _, attr := range attrs {
+		value = append(value, attr...)
+	}
+	// NLA_F_NESTED
+	return netlinkAttr(attrType|0x8000, value)
+}
+
+func be16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func be32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func be64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+func conntrackTupleAttr(attrType uint16, src, dst [4]byte, proto uint8, srcPort, dstPort uint16) []byte {
+	return netlinkNested(attrType,
+		netlinkNested(1, netlinkAttr(1, src[:]), netlinkAttr(2, dst[:])),
+		netlinkNested(2, netlinkAttr(1, []byte{proto}), netlinkAttr(2, be16(srcPort)), netlinkAttr(3, be16(dstPort))),
+	)
+}
+
+func netlinkMessage(msgType uint16, attrs ...[]byte) []byte {
+	b := make([]byte, 16+4)
+	binary.NativeEndian.PutUint16(b[4:6], msgType)
+	// nfgenmsg: AF_INET, version 0, res_id 0
+	b[16] = 2
+	for _, attr := range attrs {
+		b = append(b, attr...)
+	}
+	binary.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	return b
+}
+
+func TestDecodeConntrackMessages(t *testing.T) {
+	t.Parallel()
+	natted := netlinkMessage(0x0102,
+		conntrackTupleAttr(1, [4]byte{192, 168, 1, 10}, [4]byte{198, 51, 100, 7}, 6, 50000, 443),
+		conntrackTupleAttr(2, [4]byte{198, 51, 100, 7}, [4]byte{203, 0, 113, 5}, 6, 443, 61000),
+		netlinkAttr(8, be32(7)),
+		netlinkNested(9, netlinkAttr(1, be64(10)), netlinkAttr(2, be64(1200))),
+		netlinkNested(10, netlinkAttr(1, be64(8)), netlinkAttr(2, be64(9000))),
+		netlinkAttr(12, be32(4242)),
+		netlinkNested(20, netlinkAttr(1, be64(1666000000_000000000)), netlinkAttr(2, be64(1666000030_500000000))),
+	)
+	// IPCTNL_MSG_CT_NEW, which isn't subscribed to but shouldn't break
+	// anything either.
+	created := netlinkMessage(0x0100,
+		conntrackTupleAttr(1, [4]byte{192, 168, 1, 11}, [4]byte{198, 51, 100, 8}, 17, 5353, 53),
+	)
+
+	type test struct {
+		input   []byte
+		want    []map[string]interface{}
+		wantErr error
+	}
+
+	tests := map[string]test{
+		"NATed TCP connection": {
+			input: natted,
+			want: []map[string]interface{}{
+				{
+					"type":            server.ConntrackMessageType,
+					"time_received":   1666000031,
+					"sampling_rate":   1,
+					"sampler_address": "0.0.0.0",
+					"time_flow_start": 1666000000,
+					"time_flow_end":   1666000030,
+					"bytes":           1200,
+					"packets":         10,
+					"src_addr":        "192.168.1.10",
+					"dst_addr":        "198.51.100.7",
+					"ethernet_type":   0x0800,
+					"proto":           6,
+					"src_port":        50000,
+					"dst_port":        443,
+					"reply_bytes":     9000,
+					"reply_packets":   8,
+					"reply_src_addr":  "198.51.100.7",
+					"reply_dst_addr":  "203.0.113.5",
+					"reply_src_port":  443,
+					"reply_dst_port":  61000,
+					"conntrack_id":    4242,
+					"conntrack_mark":  7,
+					"conntrack_zone":  0,
+				},
+			},
+		},
+		"skips other message types": {
+			input: append(append([]byte{}, created...), natted...),
+			want: []map[string]interface{}{
+				{"src_addr": "192.168.1.10", "reply_dst_addr": "203.0.113.5"},
+			},
+		},
+		"truncated message": {
+			input:   natted[:len(natted)-4],
+			wantErr: server.ErrConntrackMalformed,
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			flows, err := server.DecodeConntrackMessages(tc.input)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("\"%s\": expected err %v, got %v", name, tc.wantErr, err)
+			}
+			var got []map[string]interface{}
+			for i, f := range flows {
+				msg := server.FormatConntrackFlow("0.0.0.0", 1666000031, f)
+				if i < len(tc.want) && len(tc.want[i]) < len(msg) {
+					// Only compare the fields the test case cares about.
+					for k := range msg {
+						if _, ok := tc.want[i][k]; !ok {
+							delete(msg, k)
+						}
+					}
+				}
+				got = append(got, msg)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	MetricListenerDatagramsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "listener_datagrams_rejected",
+			Help: "Number of datagrams dropped by a listener before decoding",
+		},
+		[]string{"type", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(MetricListenerDatagramsRejected)
+}
+
+const (
+	DatagramFilterReasonDenied      = "denied"
+	DatagramFilterReasonNotAllowed  = "not_allowed"
+	DatagramFilterReasonRateLimited = "rate_limited"
+
+	ListenerRejectReasonDecodeQueueFull = "decode_queue_full"
+)
+
+// How long a source can go without sending anything before its rate limit
+// bucket is forgotten.
+const datagramFilterBucketIdle = 5 * time.Minute
+
+type DatagramFilterConfig struct {
+	AllowCIDRs     []string `yaml:"allow_cidrs"`
+	DenyCIDRs      []string `yaml:"deny_cidrs"`
+	RateLimit      float64  `yaml:"rate_limit"`
+	RateLimitBurst int      `yaml:"rate_limit_burst"`
+}
+
+type datagramFilterBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// DatagramFilter decides whether a datagram received on a listener should be
+// handed to the decoder based on the exporter source address. Deny rules are
+// checked first, then allow rules (if any are configured), then the
+// per-source rate limit.
+type DatagramFilter struct {
+	allow     []netip.Prefix
+	deny      []netip.Prefix
+	rateLimit float64
+	burst     float64
+
+	mu        sync.Mutex
+	buckets   map[netip.Addr]*datagramFilterBucket
+	lastSweep time.Time
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			// Allow bare addresses as a shorthand for a single host prefix.
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR `%s`: %w", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func NewDatagramFilter(config *DatagramFilterConfig) (*DatagramFilter, error) {
+	allow, err := parsePrefixes(config.AllowCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("NewDatagramFilter: allow_cidrs: %w", err)
+	}
+	deny, err := parsePrefixes(config.DenyCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("NewDatagramFilter: deny_cidrs: %w", err)
+	}
+	burst := float64(config.RateLimitBurst)
+	if burst <= 0 {
+		burst = config.RateLimit
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &DatagramFilter{
+		allow:     allow,
+		deny:      deny,
+		rateLimit: config.RateLimit,
+		burst:     burst,
+		buckets:   make(map[netip.Addr]*datagramFilterBucket),
+	}, nil
+}
+
+// IsNoop returns true if the filter would accept every datagram.
+func (f *DatagramFilter) IsNoop() bool {
+	return len(f.allow) == 0 && len(f.deny) == 0 && f.rateLimit <= 0
+}
+
+// Allow reports whether a datagram from src received at now should be
+// accepted. When it is rejected the returned reason is one of the
+// DatagramFilterReason constants.
+func (f *DatagramFilter) Allow(src netip.Addr, now time.Time) (bool, string) {
+	src = src.Unmap()
+	for _, p := range f.deny {
+		if p.Contains(src) {
+			return false, DatagramFilterReasonDenied
+		}
+	}
+	if len(f.allow) > 0 {
+		allowed := false
+		for _, p := range f.allow {
+			if p.Contains(src) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false, DatagramFilterReasonNotAllowed
+		}
+	}
+	if f.rateLimit > 0 && !f.take(src, now) {
+		return false, DatagramFilterReasonRateLimited
+	}
+	return true, ""
+}
+
+func (f *DatagramFilter) take(src netip.Addr, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now.Sub(f.lastSweep) > datagramFilterBucketIdle {
+		for addr, b := range f.buckets {
+			if now.Sub(b.lastSeen) > datagramFilterBucketIdle {
+				delete(f.buckets, addr)
+			}
+		}
+		f.lastSweep = now
+	}
+
+	b, ok := f.buckets[src]
+	if !ok {
+		b = &datagramFilterBucket{
+			tokens:   f.burst,
+			lastSeen: now,
+		}
+		f.buckets[src] = b
+	}
+	b.tokens += now.Sub(b.lastSeen).Seconds() * f.rateLimit
+	if b.tokens > f.burst {
+		b.tokens = f.burst
+	}
+	b.lastSeen = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,120 @@
+package server_test
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/sapslaj/morbius/server"
+)
+
+func TestDatagramFilter(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		config     server.DatagramFilterConfig
+		src        string
+		wantOK     bool
+		wantReason string
+	}
+
+	tests := map[string]test{
+		"accepts everything with empty config": {
+			config: server.DatagramFilterConfig{},
+			src:    "192.0.2.1",
+			wantOK: true,
+		},
+		"accepts source in allow list": {
+			config: server.DatagramFilterConfig{AllowCIDRs: []string{"192.0.2.0/24"}},
+			src:    "192.0.2.1",
+			wantOK: true,
+		},
+		"rejects source not in allow list": {
+			config:     server.DatagramFilterConfig{AllowCIDRs: []string{"192.0.2.0/24"}},
+			src:        "198.51.100.1",
+			wantOK:     false,
+			wantReason: server.DatagramFilterReasonNotAllowed,
+		},
+		"rejects source in deny list": {
+			config:     server.DatagramFilterConfig{DenyCIDRs: []string{"192.0.2.0/24"}},
+			src:        "192.0.2.1",
+			wantOK:     false,
+			wantReason: server.DatagramFilterReasonDenied,
+		},
+		"deny takes precedence over allow": {
+			config: server.DatagramFilterConfig{
+				AllowCIDRs: []string{"192.0.2.0/24"},
+				DenyCIDRs:  []string{"192.0.2.69"},
+			},
+			src:        "192.0.2.69",
+			wantOK:     false,
+			wantReason: server.DatagramFilterReasonDenied,
+		},
+		"matches IPv4-mapped IPv6 sources against IPv4 prefixes": {
+			config: server.DatagramFilterConfig{AllowCIDRs: []string{"192.0.2.0/24"}},
+			src:    "::ffff:192.0.2.1",
+			wantOK: true,
+		},
+		"accepts IPv6 source in allow list": {
+			config: server.DatagramFilterConfig{AllowCIDRs: []string{"2001:db8::/32"}},
+			src:    "2001:db8::1",
+			wantOK: true,
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			f, err := server.NewDatagramFilter(&tc.config)
+			if err != nil {
+				t.Fatalf("NewDatagramFilter returned err: %v", err)
+			}
+			ok, reason := f.Allow(netip.MustParseAddr(tc.src), time.Now())
+			if ok != tc.wantOK || reason != tc.wantReason {
+				t.Errorf("\"%s\": got (%v, %q), want (%v, %q)", name, ok, reason, tc.wantOK, tc.wantReason)
+			}
+		})
+	}
+}
+
+func TestDatagramFilter_InvalidCIDR(t *testing.T) {
+	t.Parallel()
+	_, err := server.NewDatagramFilter(&server.DatagramFilterConfig{AllowCIDRs: []string{"not-a-cidr"}})
+	if err == nil {
+		t.Fatal("expected error for invalid CIDR")
+	}
+}
+
+func TestDatagramFilter_RateLimit(t *testing.T) {
+	t.Parallel()
+	f, err := server.NewDatagramFilter(&server.DatagramFilterConfig{
+		RateLimit:      10,
+		RateLimitBurst: 2,
+	})
+	if err != nil {
+		t.Fatalf("NewDatagramFilter returned err: %v", err)
+	}
+	now := time.Now()
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("192.0.2.2")
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := f.Allow(a, now); !ok {
+			t.Fatalf("datagram %d within burst was rejected", i)
+		}
+	}
+	if ok, reason := f.Allow(a, now); ok || reason != server.DatagramFilterReasonRateLimited {
+		t.Fatalf("datagram over burst got (%v, %q)", ok, reason)
+	}
+
+	// Limits are tracked per source.
+	if ok, _ := f.Allow(b, now); !ok {
+		t.Fatal("datagram from other source was rejected")
+	}
+
+	// 10pps refills one token every 100ms.
+	if ok, _ := f.Allow(a, now.Add(100*time.Millisecond)); !ok {
+		t.Fatal("datagram after refill was rejected")
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var MetricIngestMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ingest_messages",
+		Help: "Number of messages pushed to the HTTP and gRPC ingest endpoints",
+	},
+	[]string{"type", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(MetricIngestMessages)
+}
+
+type IngestConfig struct {
+	Enable bool `yaml:"enable"`
+	// Require an `Authorization: Bearer <token>` header (or gRPC metadata)
+	// with this token. BearerTokenFile takes precedence if both are set.
+	BearerToken     string `yaml:"bearer_token"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+	// Maximum number of requests or streams handled at once. HTTP requests
+	// over the limit get a 503 so clients back off while the transport is
+	// busy. Default is 4.
+	MaxInFlight int `yaml:"max_in_flight"`
+	// Maximum size of an HTTP request body after decompression. Default is
+	// 16MiB.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+}
+
+func mergeDefaultIngestConfig(in *IngestConfig) *IngestConfig {
+	if in == nil {
+		in = &IngestConfig{}
+	}
+	if in.MaxInFlight == 0 {
+		in.MaxInFlight = 4
+	}
+	if in.MaxBodyBytes == 0 {
+		in.MaxBodyBytes = 16 * 1024 * 1024
+	}
+	return in
+}
+
+// Shared by the HTTP and gRPC ingest endpoints.
+type ingestGate struct {
+	token    string
+	inFlight chan struct{}
+}
+
+func newIngestGate(config *IngestConfig) (*ingestGate, error) {
+	token, err := loadBearerToken(config.BearerToken, config.BearerTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return &ingestGate{
+		token:    token,
+		inFlight: make(chan struct{}, config.MaxInFlight),
+	}, nil
+}
+
+// loadBearerToken returns the contents of file if it's set, otherwise token.
+func loadBearerToken(token string, file string) (string, error) {
+	if file == "" {
+		return token, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// bearerAuthorized reports whether an Authorization header has token. Any
+// header is accepted if token is empty.
+func bearerAuthorized(header string, token string) bool {
+	if token == "" {
+		return true
+	}
+	got, ok := strings.CutPrefix(header, "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func (g *ingestGate) authorized(header string) bool {
+	return bearerAuthorized(header, g.token)
+}
+
+func (g *ingestGate) acquire() bool {
+	select {
+	case g.inFlight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *ingestGate) release() {
+	<-g.inFlight
+}
+
+type ingestResponse struct {
+	Accepted int      `json:"accepted"`
+	Rejected int      `json:"rejected"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+type ingestHandler struct {
+	s      *Server
+	config *IngestConfig
+	gate   *ingestGate
+}
+
+// IngestHandler accepts POSTed newline-delimited JSON messages and publishes
+// them like the NDJSON input does. The response reports how many lines were
+// accepted and rejected.
+func (s *Server) IngestHandler(config *IngestConfig) (http.Handler, error) {
+	config = mergeDefaultIngestConfig(config)
+	gate, err := newIngestGate(config)
+	if err != nil {
+		return nil, err
+	}
+	return &ingestHandler{s: s, config: config, gate: gate}, nil
+}
+
+func (h *ingestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.gate.authorized(r.Header.Get("Authorization")) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !h.gate.acquire() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many requests in flight", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.gate.release()
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	// The whole body is read before anything is published so a request that
+	// turns out to be too large is rejected without a partial batch having
+	// been sent, which a client splitting and retrying would duplicate.
+	b, err := io.ReadAll(io.LimitReader(body, h.config.MaxBodyBytes+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(b)) > h.config.MaxBodyBytes {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var resp ingestResponse
+	for i, line := range bytes.Split(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		msg, decodeErr := decodeNDJSONLine(line)
+		switch {
+		case decodeErr != nil:
+			resp.Rejected++
+			// Enough to debug a client without echoing a huge batch back.
+			if len(resp.Errors) < 10 {
+				resp.Errors = append(resp.Errors, fmt.Sprintf("line %d: %v", i+1, decodeErr))
+			}
+			MetricIngestMessages.With(prometheus.Labels{"type": "http", "status": "rejected"}).Inc()
+		case msg != nil:
+			resp.Accepted++
+			MetricIngestMessages.With(prometheus.Labels{"type": "http", "status": "accepted"}).Inc()
+			h.s.Config.Transport.PublishMessage(msg)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Accepted == 0 && resp.Rejected > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
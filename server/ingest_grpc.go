@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	goflowpb "github.com/cloudflare/goflow/v3/pb"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Hand-written equivalent of what protoc-gen-go-grpc generates for the
+// FlowIngest service in ingest.proto.
+
+const flowIngestPushMethod = "/morbius.FlowIngest/Push"
+
+// FlowIngestServer receives streams of goflow FlowMessages.
+type FlowIngestServer interface {
+	Push(FlowIngest_PushServer) error
+}
+
+type FlowIngest_PushServer interface {
+	SendAndClose(*emptypb.Empty) error
+	Recv() (*goflowpb.FlowMessage, error)
+	grpc.ServerStream
+}
+
+type flowIngestPushServer struct {
+	grpc.ServerStream
+}
+
+func (x *flowIngestPushServer) SendAndClose(m *emptypb.Empty) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *flowIngestPushServer) Recv() (*goflowpb.FlowMessage, error) {
+	m := new(goflowpb.FlowMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func flowIngestPushHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FlowIngestServer).Push(&flowIngestPushServer{stream})
+}
+
+var flowIngestServiceDesc = grpc.ServiceDesc{
+	ServiceName: "morbius.FlowIngest",
+	HandlerType: (*FlowIngestServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Push",
+			Handler:       flowIngestPushHandler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "server/ingest.proto",
+}
+
+func RegisterFlowIngestServer(s *grpc.Server, srv FlowIngestServer) {
+	s.RegisterService(&flowIngestServiceDesc, srv)
+}
+
+// FlowIngestClient pushes streams of goflow FlowMessages to morbius.
+type FlowIngestClient interface {
+	Push(ctx context.Context, opts ...grpc.CallOption) (FlowIngest_PushClient, error)
+}
+
+type FlowIngest_PushClient interface {
+	Send(*goflowpb.FlowMessage) error
+	CloseAndRecv() (*emptypb.Empty, error)
+	grpc.ClientStream
+}
+
+type flowIngestClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFlowIngestClient(cc grpc.ClientConnInterface) FlowIngestClient {
+	return &flowIngestClient{cc}
+}
+
+func (c *flowIngestClient) Push(ctx context.Context, opts ...grpc.CallOption) (FlowIngest_PushClient, error) {
+	stream, err := c.cc.NewStream(ctx, &flowIngestServiceDesc.Streams[0], flowIngestPushMethod, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &flowIngestPushClient{stream}, nil
+}
+
+type flowIngestPushClient struct {
+	grpc.ClientStream
+}
+
+func (x *flowIngestPushClient) Send(m *goflowpb.FlowMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *flowIngestPushClient) CloseAndRecv() (*emptypb.Empty, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(emptypb.Empty)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type flowIngestService struct {
+	s    *Server
+	gate *ingestGate
+}
+
+// Publishes each message as it arrives. Publish blocks while the transport
+// queue is full, which stops reading from the stream and lets HTTP/2 flow
+// control push back on the client.
+func (svc *flowIngestService) Push(stream FlowIngest_PushServer) error {
+	if !svc.gate.acquire() {
+		return status.Error(codes.ResourceExhausted, "too many streams in flight")
+	}
+	defer svc.gate.release()
+	for {
+		fmsg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&emptypb.Empty{})
+		}
+		if err != nil {
+			return err
+		}
+		MetricIngestMessages.With(prometheus.Labels{"type": "grpc", "status": "accepted"}).Inc()
+		svc.s.Config.Transport.Publish([]*goflowpb.FlowMessage{fmsg})
+	}
+}
+
+func (g *ingestGate) grpcAuth(ctx context.Context) error {
+	if g.token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if g.authorized(value) {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid bearer token")
+}
+
+// NewGRPCServer returns a gRPC server with the FlowIngest service registered.
+func (s *Server) NewGRPCServer(config *IngestConfig) (*grpc.Server, error) {
+	config = mergeDefaultIngestConfig(config)
+	gate, err := newIngestGate(config)
+	if err != nil {
+		return nil, err
+	}
+	gs := grpc.NewServer(
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := gate.grpcAuth(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	RegisterFlowIngestServer(gs, &flowIngestService{s: s, gate: gate})
+	return gs, nil
+}
+
+func (s *Server) RunGRPC() error {
+	gs, err := s.NewGRPCServer(s.Config.GRPC.Ingest)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.Config.GRPC.Addr, s.Config.GRPC.Port))
+	if err != nil {
+		return err
+	}
+	return gs.Serve(l)
+}
@@ -0,0 +1,212 @@
+package server_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	goflowpb "github.com/cloudflare/goflow/v3/pb"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/sapslaj/morbius/server"
+)
+
+func gzipBody(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(s))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestServer_IngestHandler(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		config     server.IngestConfig
+		method     string
+		headers    map[string]string
+		body       []byte
+		wantStatus int
+		wantBody   string
+		want       []map[string]interface{}
+	}
+
+	tests := map[string]test{
+		"accepts messages without a token configured": {
+			body:       []byte(`{"type":"NETFLOW_V5","bytes":1500}` + "\n\n" + `{"type":"SFLOW_5"}`),
+			wantStatus: http.StatusOK,
+			wantBody:   `{"accepted":2,"rejected":0}`,
+			want: []map[string]interface{}{
+				{"type": "NETFLOW_V5", "bytes": 1500},
+				{"type": "SFLOW_5"},
+			},
+		},
+		"reports rejected lines": {
+			body:       []byte(`{"type":"NETFLOW_V5"}` + "\nnope\n[1]\n"),
+			wantStatus: http.StatusOK,
+			wantBody:   `{"accepted":1,"rejected":2,"errors":["line 2: invalid character 'o' in literal null (expecting 'u')","line 3: json: cannot unmarshal array into Go value of type map[string]interface {}"]}`,
+			want: []map[string]interface{}{
+				{"type": "NETFLOW_V5"},
+			},
+		},
+		"all lines rejected": {
+			body:       []byte("nope\n"),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"accepted":0,"rejected":1,"errors":["line 1: invalid character 'o' in literal null (expecting 'u')"]}`,
+		},
+		"gzip body": {
+			headers:    map[string]string{"Content-Encoding": "gzip"},
+			body:       gzipBody(t, `{"type":"NETFLOW_V5"}`+"\n"),
+			wantStatus: http.StatusOK,
+			wantBody:   `{"accepted":1,"rejected":0}`,
+			want: []map[string]interface{}{
+				{"type": "NETFLOW_V5"},
+			},
+		},
+		"valid bearer token": {
+			config:     server.IngestConfig{BearerToken: "hunter2"},
+			headers:    map[string]string{"Authorization": "Bearer hunter2"},
+			body:       []byte(`{"type":"NETFLOW_V5"}` + "\n"),
+			wantStatus: http.StatusOK,
+			wantBody:   `{"accepted":1,"rejected":0}`,
+			want: []map[string]interface{}{
+				{"type": "NETFLOW_V5"},
+			},
+		},
+		"missing bearer token": {
+			config:     server.IngestConfig{BearerToken: "hunter2"},
+			body:       []byte(`{"type":"NETFLOW_V5"}` + "\n"),
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "unauthorized",
+		},
+		"wrong bearer token": {
+			config:     server.IngestConfig{BearerToken: "hunter2"},
+			headers:    map[string]string{"Authorization": "Bearer hunter3"},
+			body:       []byte(`{"type":"NETFLOW_V5"}` + "\n"),
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "unauthorized",
+		},
+		"body too large": {
+			config:     server.IngestConfig{MaxBodyBytes: 16},
+			body:       []byte(`{"type":"NETFLOW_V5"}` + "\n"),
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantBody:   "request body too large",
+		},
+		"nothing is published when the body is too large": {
+			config:     server.IngestConfig{MaxBodyBytes: 32},
+			body:       []byte(`{"type":"NETFLOW_V5"}` + "\n" + `{"type":"SFLOW_5"}` + "\n"),
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantBody:   "request body too large",
+		},
+		"GET not allowed": {
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+			wantBody:   "method not allowed",
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			transport := &recordingTransport{}
+			s := server.NewServerWithTransportAndLogger(server.ServerConfig{}, transport, nil)
+			handler, err := s.IngestHandler(&tc.config)
+			if err != nil {
+				t.Fatalf("\"%s\": IngestHandler returned err: %v", name, err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, "/ingest", bytes.NewReader(tc.body))
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("\"%s\": expected status %d, got %d", name, tc.wantStatus, rec.Code)
+			}
+			if diff := cmp.Diff(tc.wantBody, strings.TrimSpace(rec.Body.String())); diff != "" {
+				t.Errorf("\"%s\": body mismatch (-want +got):\n%s", name, diff)
+			}
+			if diff := cmp.Diff(tc.want, transport.msgs); diff != "" {
+				t.Errorf("\"%s\": messages mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
+
+func TestServer_NewGRPCServer(t *testing.T) {
+	t.Parallel()
+	transport := &recordingTransport{}
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{}, transport, nil)
+	gs, err := s.NewGRPCServer(&server.IngestConfig{BearerToken: "hunter2"})
+	if err != nil {
+		t.Fatalf("NewGRPCServer returned err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gs.Serve(l)
+	defer gs.Stop()
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := server.NewFlowIngestClient(conn)
+
+	push := func(ctx context.Context, fmsgs ...*goflowpb.FlowMessage) error {
+		stream, err := client.Push(ctx)
+		if err != nil {
+			return err
+		}
+		for _, fmsg := range fmsgs {
+			if err := stream.Send(fmsg); err != nil {
+				break
+			}
+		}
+		_, err = stream.CloseAndRecv()
+		return err
+	}
+
+	err = push(context.Background(), &goflowpb.FlowMessage{Bytes: 1})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated without a token, got %v", err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer hunter2")
+	err = push(ctx, &goflowpb.FlowMessage{Bytes: 1500, Packets: 1}, &goflowpb.FlowMessage{Bytes: 40, Packets: 1})
+	if err != nil {
+		t.Fatalf("Push returned err: %v", err)
+	}
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	var got []uint64
+	for _, fmsg := range transport.flows {
+		got = append(got, fmsg.Bytes)
+	}
+	if diff := cmp.Diff([]uint64{1500, 40}, got); diff != "" {
+		t.Errorf("flows mismatch (-want +got):\n%s", diff)
+	}
+}
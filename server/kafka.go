@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	goflowpb "github.com/cloudflare/goflow/v3/pb"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+var MetricKafkaRecords = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kafka_records",
+		Help: "Number of records consumed by the Kafka input",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(MetricKafkaRecords)
+}
+
+type KafkaConfig struct {
+	Enable   bool     `yaml:"enable"`
+	Brokers  []string `yaml:"brokers"`
+	Topics   []string `yaml:"topics"`
+	Group    string   `yaml:"group"`
+	ClientID string   `yaml:"client_id"`
+	TLS      bool     `yaml:"tls"`
+	// `json` (default) for messages like the ones the stdout destination
+	// writes, or `protobuf` for goflow FlowMessages.
+	Encoding string `yaml:"encoding"`
+	// Protobuf messages are prefixed with their varint encoded length, like
+	// goflow does with -kafka.fixedlen.
+	FixedLength bool `yaml:"fixed_length"`
+}
+
+func mergeDefaultKafkaConfig(in *KafkaConfig) *KafkaConfig {
+	if in == nil {
+		in = &KafkaConfig{}
+	}
+	if len(in.Brokers) == 0 {
+		in.Brokers = []string{"localhost:9092"}
+	}
+	if len(in.Topics) == 0 {
+		in.Topics = []string{"flows"}
+	}
+	if in.Group == "" {
+		in.Group = "morbius"
+	}
+	if in.ClientID == "" {
+		in.ClientID = "morbius"
+	}
+	if in.Encoding == "" {
+		in.Encoding = "json"
+	}
+	return in
+}
+
+func decodeKafkaFlowMessage(value []byte, fixedLength bool) (*goflowpb.FlowMessage, error) {
+	fmsg := &goflowpb.FlowMessage{}
+	if fixedLength {
+		return fmsg, proto.NewBuffer(value).DecodeMessage(fmsg)
+	}
+	return fmsg, proto.Unmarshal(value, fmsg)
+}
+
+// RunKafka consumes records from Kafka as a member of a consumer group and
+// publishes them. Publishing blocks while the transport is busy, so
+// consumption slows down to match.
+func (s *Server) RunKafka() error {
+	config := s.Config.Kafka
+	switch config.Encoding {
+	case "json", "protobuf":
+	default:
+		return fmt.Errorf("kafka: unknown encoding %q", config.Encoding)
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.ClientID(config.ClientID),
+		kgo.ConsumerGroup(config.Group),
+		kgo.ConsumeTopics(config.Topics...),
+	}
+	if config.TLS {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{}))
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for {
+		fetches := client.PollFetches(context.Background())
+		if fetches.IsClientClosed() {
+			return nil
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			s.Config.Logger.Errorf("kafka: error fetching %s/%d: %v", topic, partition, err)
+		})
+		var fmsgs []*goflowpb.FlowMessage
+		fetches.EachRecord(func(record *kgo.Record) {
+			if config.Encoding == "protobuf" {
+				fmsg, err := decodeKafkaFlowMessage(record.Value, config.FixedLength)
+				if err != nil {
+					MetricKafkaRecords.With(prometheus.Labels{"status": "error"}).Inc()
+					s.Config.Logger.Debugf("kafka: error decoding record: %v", err)
+					return
+				}
+				MetricKafkaRecords.With(prometheus.Labels{"status": "published"}).Inc()
+				fmsgs = append(fmsgs, fmsg)
+				return
+			}
+			msg, err := decodeNDJSONLine(record.Value)
+			if err != nil || msg == nil {
+				MetricKafkaRecords.With(prometheus.Labels{"status": "error"}).Inc()
+				s.Config.Logger.Debugf("kafka: error decoding record: %v", err)
+				return
+			}
+			MetricKafkaRecords.With(prometheus.Labels{"status": "published"}).Inc()
+			s.Config.Transport.PublishMessage(msg)
+		})
+		if len(fmsgs) > 0 {
+			s.Config.Transport.Publish(fmsgs)
+		}
+	}
+}
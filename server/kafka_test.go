@@ -0,0 +1,116 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	goflowpb "github.com/cloudflare/goflow/v3/pb"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/sapslaj/morbius/server"
+)
+
+func TestServer_RunKafka(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		config    server.KafkaConfig
+		values    [][]byte
+		wantMsgs  []map[string]interface{}
+		wantBytes []uint64
+	}
+
+	fmsg := func(bytes uint64) []byte {
+		b, err := proto.Marshal(&goflowpb.FlowMessage{Type: goflowpb.FlowMessage_SFLOW_5, Bytes: bytes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	fixedLength := func(b []byte) []byte {
+		return append(proto.EncodeVarint(uint64(len(b))), b...)
+	}
+
+	tests := map[string]test{
+		"json": {
+			values: [][]byte{
+				[]byte(`{"type":"SFLOW_5","bytes":1500}`),
+				[]byte(`not json`),
+				[]byte(`{"type":"SFLOW_5","bytes":40}`),
+			},
+			wantMsgs: []map[string]interface{}{
+				{"type": "SFLOW_5", "bytes": 1500},
+				{"type": "SFLOW_5", "bytes": 40},
+			},
+		},
+		"protobuf": {
+			config:    server.KafkaConfig{Encoding: "protobuf"},
+			values:    [][]byte{fmsg(1500), fmsg(40)},
+			wantBytes: []uint64{1500, 40},
+		},
+		"protobuf with length prefix": {
+			config:    server.KafkaConfig{Encoding: "protobuf", FixedLength: true},
+			values:    [][]byte{fixedLength(fmsg(1500)), fixedLength(fmsg(40))},
+			wantBytes: []uint64{1500, 40},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(1, "flows"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cluster.Close()
+
+			producer, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...), kgo.DefaultProduceTopic("flows"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, value := range tc.values {
+				if err := producer.ProduceSync(context.Background(), &kgo.Record{Value: value}).FirstErr(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			producer.Close()
+
+			config := tc.config
+			config.Enable = true
+			config.Brokers = cluster.ListenAddrs()
+			transport := &recordingTransport{}
+			s := server.NewServerWithTransportAndLogger(server.ServerConfig{Kafka: &config}, transport, nil)
+			go s.RunKafka()
+
+			want := len(tc.wantMsgs) + len(tc.wantBytes)
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				transport.mu.Lock()
+				n := len(transport.msgs) + len(transport.flows)
+				transport.mu.Unlock()
+				if n >= want || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			transport.mu.Lock()
+			defer transport.mu.Unlock()
+			if diff := cmp.Diff(tc.wantMsgs, transport.msgs); diff != "" {
+				t.Errorf("\"%s\": messages mismatch (-want +got):\n%s", name, diff)
+			}
+			var gotBytes []uint64
+			for _, fmsg := range transport.flows {
+				gotBytes = append(gotBytes, fmsg.Bytes)
+			}
+			if diff := cmp.Diff(tc.wantBytes, gotBytes); diff != "" {
+				t.Errorf("\"%s\": flows mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
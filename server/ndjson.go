@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var MetricNDJSONMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ndjson_messages",
+		Help: "Number of lines read by the NDJSON input",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(MetricNDJSONMessages)
+}
+
+type NDJSONConfig struct {
+	Enable bool `yaml:"enable"`
+	// File or directory to read newline-delimited JSON messages from, or `-`
+	// for stdin.
+	Path string `yaml:"path"`
+	// Only read files in the directory matching this glob. Default is `*`.
+	Pattern string `yaml:"pattern"`
+	// Keep reading files as they are appended to, like `tail -f`. Otherwise
+	// files are read once, so files should be moved into a watched directory
+	// only once they are complete.
+	Follow bool `yaml:"follow"`
+	// How often to check for new files and new data when following. Default
+	// is 1s.
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Maximum number of messages per second. Unlimited if 0.
+	RateLimit float64 `yaml:"rate_limit"`
+}
+
+func mergeDefaultNDJSONConfig(in *NDJSONConfig) *NDJSONConfig {
+	if in == nil {
+		in = &NDJSONConfig{}
+	}
+	if in.Pattern == "" {
+		in.Pattern = "*"
+	}
+	if in.PollInterval == 0 {
+		in.PollInterval = time.Second
+	}
+	return in
+}
+
+// Spaces out calls to wait so they don't exceed rate per second.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+func (l *rateLimiter) wait() {
+	if l.interval == 0 {
+		return
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		// Don't let idle time turn into a burst.
+		l.next = now
+	}
+	time.Sleep(l.next.Sub(now))
+	l.next = l.next.Add(l.interval)
+}
+
+// Converts json.Numbers into ints where possible so messages look like the
+// ones FormatFlowMessage builds.
+func normalizeJSONNumbers(v interface{}) interface{} {
+	switch value := v.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range value {
+			value[k] = normalizeJSONNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = normalizeJSONNumbers(item)
+		}
+	}
+	return v
+}
+
+// Decodes a single NDJSON line. Blank lines return a nil message and no
+// error.
+func decodeNDJSONLine(line []byte) (map[string]interface{}, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(line))
+	d.UseNumber()
+	var msg map[string]interface{}
+	if err := d.Decode(&msg); err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, errors.New("not a JSON object")
+	}
+	return normalizeJSONNumbers(msg).(map[string]interface{}), nil
+}
+
+type ndjsonReader struct {
+	s       *Server
+	limiter *rateLimiter
+}
+
+func (r *ndjsonReader) publishLine(line []byte) {
+	msg, err := decodeNDJSONLine(line)
+	if err != nil {
+		MetricNDJSONMessages.With(prometheus.Labels{"status": "error"}).Inc()
+		r.s.Config.Logger.Debugf("ndjson: error decoding line: %v", err)
+		return
+	}
+	if msg == nil {
+		return
+	}
+	r.limiter.wait()
+	MetricNDJSONMessages.With(prometheus.Labels{"status": "published"}).Inc()
+	r.s.Config.Transport.PublishMessage(msg)
+}
+
+// Publishes the complete lines in rd and returns how many bytes were
+// consumed. A trailing line without a newline is only published at EOF if
+// partial is true.
+func (r *ndjsonReader) publishLines(rd io.Reader, partial bool) (int64, error) {
+	br := bufio.NewReader(rd)
+	var consumed int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == nil {
+			consumed += int64(len(line))
+			r.publishLine(line)
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			if partial && len(line) > 0 {
+				consumed += int64(len(line))
+				r.publishLine(line)
+			}
+			return consumed, nil
+		}
+		return consumed, err
+	}
+}
+
+// Reads new data from path starting at offset and returns the new offset.
+func (r *ndjsonReader) readFileFrom(path string, offset int64, partial bool) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return offset, err
+	}
+	if info.Size() < offset {
+		// Truncated or replaced, start over.
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	n, err := r.publishLines(f, partial)
+	return offset + n, err
+}
+
+func (r *ndjsonReader) watchDir(config *NDJSONConfig) error {
+	offsets := make(map[string]int64)
+	for {
+		paths, err := filepath.Glob(filepath.Join(config.Path, config.Pattern))
+		if err != nil {
+			return err
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			offset, seen := offsets[path]
+			if seen && !config.Follow {
+				continue
+			}
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				continue
+			}
+			offset, err := r.readFileFrom(path, offset, !config.Follow)
+			if err != nil {
+				r.s.Config.Logger.Errorf("ndjson: error reading %s: %v", path, err)
+			}
+			offsets[path] = offset
+		}
+		// Forget files that were removed or moved away so offsets doesn't grow
+		// forever, and so a new file with the same name is read from the start.
+		matched := make(map[string]bool, len(paths))
+		for _, path := range paths {
+			matched[path] = true
+		}
+		for path := range offsets {
+			if !matched[path] {
+				delete(offsets, path)
+			}
+		}
+		time.Sleep(config.PollInterval)
+	}
+}
+
+// RunNDJSON publishes newline-delimited JSON messages from stdin, a file, or
+// a directory. Reading stdin or a file that isn't followed returns nil at EOF;
+// directories are watched for new files until an error occurs.
+func (s *Server) RunNDJSON() error {
+	config := s.Config.NDJSON
+	r := &ndjsonReader{
+		s:       s,
+		limiter: newRateLimiter(config.RateLimit),
+	}
+	if config.Path == "" {
+		return errors.New("ndjson: path is required")
+	}
+	if config.Path == "-" {
+		_, err := r.publishLines(os.Stdin, true)
+		return err
+	}
+	info, err := os.Stat(config.Path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return r.watchDir(config)
+	}
+	if !config.Follow {
+		_, err := r.readFileFrom(config.Path, 0, true)
+		return err
+	}
+	var offset int64
+	for {
+		offset, err = r.readFileFrom(config.Path, offset, false)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("ndjson: %w", err)
+		}
+		time.Sleep(config.PollInterval)
+	}
+}
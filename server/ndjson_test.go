@@ -0,0 +1,142 @@
+package server_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/server"
+)
+
+func TestServer_RunNDJSON(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		input   string
+		config  server.NDJSONConfig
+		want    []map[string]interface{}
+		minTime time.Duration
+	}
+
+	tests := map[string]test{
+		"numbers are converted to ints where possible": {
+			input: `{"type":"NETFLOW_V5","bytes":1500,"src_addr":"192.0.2.1","ratio":0.5,"tags":{"n":1},"list":[2]}` + "\n",
+			want: []map[string]interface{}{
+				{
+					"type":     "NETFLOW_V5",
+					"bytes":    1500,
+					"src_addr": "192.0.2.1",
+					"ratio":    0.5,
+					"tags":     map[string]interface{}{"n": 1},
+					"list":     []interface{}{2},
+				},
+			},
+		},
+		"skips blank and invalid lines": {
+			input: "{\"proto\":6}\n\nnot json\n{\"proto\":17}\n",
+			want: []map[string]interface{}{
+				{"proto": 6},
+				{"proto": 17},
+			},
+		},
+		"reads a final line without a newline": {
+			input: "{\"proto\":6}\n{\"proto\":17}",
+			want: []map[string]interface{}{
+				{"proto": 6},
+				{"proto": 17},
+			},
+		},
+		"rate limit spaces out messages": {
+			input:  strings.Repeat("{\"proto\":6}\n", 5),
+			config: server.NDJSONConfig{RateLimit: 50},
+			want: []map[string]interface{}{
+				{"proto": 6}, {"proto": 6}, {"proto": 6}, {"proto": 6}, {"proto": 6},
+			},
+			minTime: 80 * time.Millisecond,
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "flows.ndjson")
+			if err := os.WriteFile(path, []byte(tc.input), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			config := tc.config
+			config.Enable = true
+			config.Path = path
+			transport := &recordingTransport{}
+			s := server.NewServerWithTransportAndLogger(server.ServerConfig{NDJSON: &config}, transport, nil)
+
+			start := time.Now()
+			if err := s.RunNDJSON(); err != nil {
+				t.Fatalf("\"%s\": RunNDJSON returned err: %v", name, err)
+			}
+			if elapsed := time.Since(start); elapsed < tc.minTime {
+				t.Errorf("\"%s\": expected to take at least %s, took %s", name, tc.minTime, elapsed)
+			}
+			if diff := cmp.Diff(tc.want, transport.msgs); diff != "" {
+				t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
+
+func TestServer_RunNDJSON_Dir(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	transport := &recordingTransport{}
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{
+		NDJSON: &server.NDJSONConfig{
+			Enable:       true,
+			Path:         dir,
+			PollInterval: 10 * time.Millisecond,
+		},
+	}, transport, nil)
+	go s.RunNDJSON()
+
+	waitForMsgs := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			transport.mu.Lock()
+			got := len(transport.msgs)
+			transport.mu.Unlock()
+			if got >= n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %d messages", n)
+	}
+
+	path := filepath.Join(dir, "batch.ndjson")
+	if err := os.WriteFile(path, []byte("{\"proto\":6}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForMsgs(1)
+
+	// A file that's removed and then replaced by one with the same name is
+	// read again rather than skipped as already seen.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(path, []byte("{\"proto\":17}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForMsgs(2)
+
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	want := []map[string]interface{}{{"proto": 6}, {"proto": 17}}
+	if diff := cmp.Diff(want, transport.msgs); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
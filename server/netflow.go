@@ -0,0 +1,328 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/goflow/v3/utils"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapslaj/morbius/atomicfile"
+)
+
+const (
+	NetFlowTemplateTypeTemplate     = "template"
+	NetFlowTemplateTypeNFv9Options  = "nfv9_options"
+	NetFlowTemplateTypeIPFIXOptions = "ipfix_options"
+)
+
+type NetFlowTemplateStoreConfig struct {
+	// File learned templates are saved to and loaded from on startup. Templates
+	// are only kept in memory if this is empty.
+	Path string `yaml:"path"`
+	// How often to save templates to Path if any have changed.
+	SaveInterval time.Duration `yaml:"save_interval"`
+}
+
+type NetFlowTemplateField struct {
+	// Information element ID, without the IPFIX enterprise bit.
+	Type   uint16 `json:"type"`
+	Length uint16 `json:"length"`
+	// IPFIX private enterprise number. 0 for IANA elements and NetFlow v9.
+	EnterpriseNumber uint32 `json:"enterprise_number,omitempty"`
+}
+
+// Length used by IPFIX for variable length fields.
+const netFlowVariableLength = 0xffff
+
+// NetFlowTemplate is a template or options template learned from an exporter.
+type NetFlowTemplate struct {
+	Version     uint16                 `json:"version"`
+	ObsDomainID uint32                 `json:"obs_domain_id"`
+	TemplateID  uint16                 `json:"template_id"`
+	Type        string                 `json:"type"`
+	Fields      []NetFlowTemplateField `json:"fields,omitempty"`
+	Scopes      []NetFlowTemplateField `json:"scopes,omitempty"`
+	Options     []NetFlowTemplateField `json:"options,omitempty"`
+}
+
+// NetFlowMissingTemplate counts data sets that referenced a template before it
+// was known. The number of records in those sets can't be determined without
+// the template, so this is a count of sets rather than records.
+type NetFlowMissingTemplate struct {
+	Version     uint16 `json:"version"`
+	ObsDomainID uint32 `json:"obs_domain_id"`
+	TemplateID  uint16 `json:"template_id"`
+	Count       uint64 `json:"count"`
+}
+
+type NetFlowExporterTemplates struct {
+	Templates []NetFlowTemplate        `json:"templates"`
+	Missing   []NetFlowMissingTemplate `json:"missing,omitempty"`
+}
+
+func validNetFlowTemplateType(t string) bool {
+	switch t {
+	case NetFlowTemplateTypeTemplate, NetFlowTemplateTypeNFv9Options, NetFlowTemplateTypeIPFIXOptions:
+		return true
+	}
+	return false
+}
+
+type netFlowTemplateKey struct {
+	version     uint16
+	obsDomainID uint32
+	templateID  uint16
+}
+
+// Templates learned from a single exporter.
+type netFlowExporterTemplateSystem struct {
+	key   string
+	store *NetFlowTemplateStore
+
+	mu        sync.RWMutex
+	templates map[netFlowTemplateKey]NetFlowTemplate
+	missing   map[netFlowTemplateKey]uint64
+}
+
+func (ts *netFlowExporterTemplateSystem) addTemplate(t NetFlowTemplate) bool {
+	k := netFlowTemplateKey{t.Version, t.ObsDomainID, t.TemplateID}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if existing, ok := ts.templates[k]; ok && reflect.DeepEqual(existing, t) {
+		return false
+	}
+	ts.templates[k] = t
+	return true
+}
+
+func (ts *netFlowExporterTemplateSystem) learnTemplate(t NetFlowTemplate) {
+	// Exporters resend their templates constantly, so only mark the store
+	// dirty when something actually changed.
+	if ts.addTemplate(t) {
+		ts.store.markDirty()
+	}
+
+	typeStr := "options_template"
+	if t.Type == NetFlowTemplateTypeTemplate {
+		typeStr = "template"
+	}
+	utils.NetFlowTemplatesStats.With(
+		prometheus.Labels{
+			"router":        ts.key,
+			"version":       strconv.Itoa(int(t.Version)),
+			"obs_domain_id": strconv.Itoa(int(t.ObsDomainID)),
+			"template_id":   strconv.Itoa(int(t.TemplateID)),
+			"type":          typeStr,
+		}).
+		Inc()
+}
+
+func (ts *netFlowExporterTemplateSystem) getTemplate(version uint16, obsDomainID uint32, templateID uint16) (NetFlowTemplate, bool) {
+	k := netFlowTemplateKey{version, obsDomainID, templateID}
+	ts.mu.RLock()
+	t, ok := ts.templates[k]
+	ts.mu.RUnlock()
+	if !ok {
+		ts.mu.Lock()
+		ts.missing[k]++
+		ts.mu.Unlock()
+	}
+	return t, ok
+}
+
+func lessNetFlowTemplateKey(a, b netFlowTemplateKey) bool {
+	if a.version != b.version {
+		return a.version < b.version
+	}
+	if a.obsDomainID != b.obsDomainID {
+		return a.obsDomainID < b.obsDomainID
+	}
+	return a.templateID < b.templateID
+}
+
+func (ts *netFlowExporterTemplateSystem) list() NetFlowExporterTemplates {
+	var out NetFlowExporterTemplates
+	ts.mu.RLock()
+	for _, t := range ts.templates {
+		out.Templates = append(out.Templates, t)
+	}
+	for k, count := range ts.missing {
+		out.Missing = append(out.Missing, NetFlowMissingTemplate{
+			Version:     k.version,
+			ObsDomainID: k.obsDomainID,
+			TemplateID:  k.templateID,
+			Count:       count,
+		})
+	}
+	ts.mu.RUnlock()
+
+	sort.Slice(out.Templates, func(i, j int) bool {
+		a, b := out.Templates[i], out.Templates[j]
+		return lessNetFlowTemplateKey(
+			netFlowTemplateKey{a.Version, a.ObsDomainID, a.TemplateID},
+			netFlowTemplateKey{b.Version, b.ObsDomainID, b.TemplateID},
+		)
+	})
+	sort.Slice(out.Missing, func(i, j int) bool {
+		a, b := out.Missing[i], out.Missing[j]
+		return lessNetFlowTemplateKey(
+			netFlowTemplateKey{a.Version, a.ObsDomainID, a.TemplateID},
+			netFlowTemplateKey{b.Version, b.ObsDomainID, b.TemplateID},
+		)
+	})
+	return out
+}
+
+// NetFlowTemplateStore keeps the NetFlow v9 and IPFIX templates learned from
+// each exporter so they can be saved to disk and inspected over HTTP. Without
+// this, data from an exporter can't be decoded after a restart until it next
+// resends its templates, which can take several minutes on some devices.
+type NetFlowTemplateStore struct {
+	Config *NetFlowTemplateStoreConfig
+
+	mu        sync.RWMutex
+	exporters map[string]*netFlowExporterTemplateSystem
+	dirty     bool
+}
+
+func NewNetFlowTemplateStore(config *NetFlowTemplateStoreConfig) *NetFlowTemplateStore {
+	if config == nil {
+		config = &NetFlowTemplateStoreConfig{}
+	}
+	if config.SaveInterval == 0 {
+		config.SaveInterval = 30 * time.Second
+	}
+	return &NetFlowTemplateStore{
+		Config:    config,
+		exporters: make(map[string]*netFlowExporterTemplateSystem),
+	}
+}
+
+func (s *NetFlowTemplateStore) markDirty() {
+	s.mu.Lock()
+	s.dirty = true
+	s.mu.Unlock()
+}
+
+func (s *NetFlowTemplateStore) exporter(key string) *netFlowExporterTemplateSystem {
+	s.mu.RLock()
+	ts, ok := s.exporters[key]
+	s.mu.RUnlock()
+	if ok {
+		return ts
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ts, ok := s.exporters[key]; ok {
+		return ts
+	}
+	ts = &netFlowExporterTemplateSystem{
+		key:       key,
+		store:     s,
+		templates: make(map[netFlowTemplateKey]NetFlowTemplate),
+		missing:   make(map[netFlowTemplateKey]uint64),
+	}
+	s.exporters[key] = ts
+	return ts
+}
+
+// Exporters returns the templates currently known for each exporter along
+// with counts of data sets that arrived before their template.
+func (s *NetFlowTemplateStore) Exporters() map[string]NetFlowExporterTemplates {
+	s.mu.RLock()
+	exporters := make([]*netFlowExporterTemplateSystem, 0, len(s.exporters))
+	for _, ts := range s.exporters {
+		exporters = append(exporters, ts)
+	}
+	s.mu.RUnlock()
+
+	out := make(map[string]NetFlowExporterTemplates, len(exporters))
+	for _, ts := range exporters {
+		out[ts.key] = ts.list()
+	}
+	return out
+}
+
+// Load reads previously saved templates from Config.Path. A missing file is
+// not an error.
+func (s *NetFlowTemplateStore) Load() error {
+	if s.Config.Path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.Config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved map[string]NetFlowExporterTemplates
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("error parsing %s: %w", s.Config.Path, err)
+	}
+	for key, exporter := range saved {
+		ts := s.exporter(key)
+		for _, t := range exporter.Templates {
+			if !validNetFlowTemplateType(t.Type) {
+				return fmt.Errorf("error parsing %s: %s: unknown template type `%s`", s.Config.Path, key, t.Type)
+			}
+			ts.addTemplate(t)
+		}
+	}
+	return nil
+}
+
+// Save writes the known templates to Config.Path if any have changed since
+// the last save.
+func (s *NetFlowTemplateStore) Save() error {
+	if s.Config.Path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = false
+	s.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	saved := s.Exporters()
+	for key, exporter := range saved {
+		exporter.Missing = nil
+		saved[key] = exporter
+	}
+	data, err := json.Marshal(saved)
+	if err == nil {
+		err = atomicfile.WriteFile(s.Config.Path, data)
+	}
+	if err != nil {
+		s.markDirty()
+		return err
+	}
+	return nil
+}
+
+func (s *NetFlowTemplateStore) runSaver(logger Logger) {
+	if s.Config.Path == "" {
+		return
+	}
+	for range time.Tick(s.Config.SaveInterval) {
+		if err := s.Save(); err != nil {
+			logger.Errorf("error saving NetFlow templates: %v", err)
+		}
+	}
+}
+
+func (s *NetFlowTemplateStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Exporters())
+}
@@ -0,0 +1,525 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/goflow/v3/decoders/netflow"
+	goflowpb "github.com/cloudflare/goflow/v3/pb"
+	"github.com/cloudflare/goflow/v3/producer"
+	"github.com/cloudflare/goflow/v3/utils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	NetFlowFieldTypeInt    = "int"
+	NetFlowFieldTypeIP     = "ip"
+	NetFlowFieldTypeString = "string"
+	NetFlowFieldTypeMAC    = "mac"
+	NetFlowFieldTypeBytes  = "bytes"
+)
+
+// NetFlowFieldConfig maps a NetFlow v9 or IPFIX information element that
+// goflow doesn't know about to a message field.
+type NetFlowFieldConfig struct {
+	// Message field name.
+	Name string `yaml:"name"`
+	// IPFIX private enterprise number. 0 (the default) is for IANA elements and
+	// NetFlow v9 field types.
+	EnterpriseNumber uint32 `yaml:"enterprise_number"`
+	ElementID        uint16 `yaml:"element_id"`
+	// How to format the value. One of int, ip, string, mac, or bytes (hex
+	// encoded). Defaults to bytes.
+	Type string `yaml:"type"`
+}
+
+type netFlowFieldKey struct {
+	enterpriseNumber uint32
+	elementID        uint16
+}
+
+func newNetFlowFieldMap(configs []*NetFlowFieldConfig) (map[netFlowFieldKey][]*NetFlowFieldConfig, error) {
+	fields := make(map[netFlowFieldKey][]*NetFlowFieldConfig)
+	for _, config := range configs {
+		if config.Name == "" {
+			return nil, fmt.Errorf("field for element %d/%d is missing a name", config.EnterpriseNumber, config.ElementID)
+		}
+		if config.Type == "" {
+			config.Type = NetFlowFieldTypeBytes
+		}
+		switch config.Type {
+		case NetFlowFieldTypeInt, NetFlowFieldTypeIP, NetFlowFieldTypeString, NetFlowFieldTypeMAC, NetFlowFieldTypeBytes:
+		default:
+			return nil, fmt.Errorf("field `%s` has unknown type `%s`", config.Name, config.Type)
+		}
+		k := netFlowFieldKey{config.EnterpriseNumber, config.ElementID}
+		fields[k] = append(fields[k], config)
+	}
+	return fields, nil
+}
+
+func formatNetFlowField(fieldType string, value []byte) (interface{}, bool) {
+	switch fieldType {
+	case NetFlowFieldTypeInt:
+		if len(value) == 0 || len(value) > 8 {
+			return nil, false
+		}
+		var n uint64
+		for _, b := range value {
+			n = n<<8 | uint64(b)
+		}
+		return int(n), true
+	case NetFlowFieldTypeIP:
+		addr, ok := netip.AddrFromSlice(value)
+		if !ok {
+			return nil, false
+		}
+		return addr.Unmap().String(), true
+	case NetFlowFieldTypeString:
+		return strings.TrimRight(string(value), "\x00"), true
+	case NetFlowFieldTypeMAC:
+		if len(value) != 6 {
+			return nil, false
+		}
+		return net.HardwareAddr(value).String(), true
+	case NetFlowFieldTypeBytes:
+		return hex.EncodeToString(value), true
+	}
+	return nil, false
+}
+
+type netFlowSetStat struct {
+	typeStr string
+	records int
+}
+
+type netFlowDecodedMessage struct {
+	// netflow.NFv9Packet or netflow.IPFIXPacket so it can be handed to the
+	// goflow producer.
+	packet  interface{}
+	version string
+	sets    []netFlowSetStat
+	// Custom fields for each data record, in the same order the goflow
+	// producer turns records into flow messages.
+	fields []map[string]interface{}
+}
+
+func errNetFlowTruncated(what string) error {
+	return netflow.NewErrorDecodingNetFlow(fmt.Sprintf("Error decoding %s: truncated.", what))
+}
+
+func decodeNetFlowTemplateFields(b []byte, count int, enterprise bool) ([]NetFlowTemplateField, []byte, error) {
+	fields := make([]NetFlowTemplateField, count)
+	for i := range fields {
+		if len(b) < 4 {
+			return nil, nil, errNetFlowTruncated("template")
+		}
+		f := NetFlowTemplateField{
+			Type:   binary.BigEndian.Uint16(b[0:2]),
+			Length: binary.BigEndian.Uint16(b[2:4]),
+		}
+		b = b[4:]
+		if enterprise && f.Type&0x8000 != 0 {
+			if len(b) < 4 {
+				return nil, nil, errNetFlowTruncated("template")
+			}
+			f.Type &= 0x7fff
+			f.EnterpriseNumber = binary.BigEndian.Uint32(b[0:4])
+			b = b[4:]
+		}
+		fields[i] = f
+	}
+	return fields, b, nil
+}
+
+func decodeNetFlowTemplateSet(version uint16, obsDomainID uint32, setID uint16, b []byte) ([]NetFlowTemplate, error) {
+	var templates []NetFlowTemplate
+	var err error
+	enterprise := version == 10
+	for {
+		t := NetFlowTemplate{
+			Version:     version,
+			ObsDomainID: obsDomainID,
+		}
+		switch {
+		case setID == 0 || setID == 2:
+			if len(b) < 4 {
+				return templates, nil
+			}
+			t.Type = NetFlowTemplateTypeTemplate
+			t.TemplateID = binary.BigEndian.Uint16(b[0:2])
+			count := int(binary.BigEndian.Uint16(b[2:4]))
+			if count == 0 {
+				// Either padding or an IPFIX template withdrawal, neither of
+				// which we need to act on.
+				return templates, nil
+			}
+			t.Fields, b, err = decodeNetFlowTemplateFields(b[4:], count, enterprise)
+		case setID == 1:
+			if len(b) < 6 {
+				return templates, nil
+			}
+			t.Type = NetFlowTemplateTypeNFv9Options
+			t.TemplateID = binary.BigEndian.Uint16(b[0:2])
+			scopeCount := int(binary.BigEndian.Uint16(b[2:4])) / 4
+			optionCount := int(binary.BigEndian.Uint16(b[4:6])) / 4
+			if scopeCount+optionCount == 0 {
+				return templates, nil
+			}
+			t.Scopes, b, err = decodeNetFlowTemplateFields(b[6:], scopeCount, false)
+			if err == nil {
+				t.Options, b, err = decodeNetFlowTemplateFields(b, optionCount, false)
+			}
+		case setID == 3:
+			if len(b) < 6 {
+				return templates, nil
+			}
+			t.Type = NetFlowTemplateTypeIPFIXOptions
+			t.TemplateID = binary.BigEndian.Uint16(b[0:2])
+			count := int(binary.BigEndian.Uint16(b[2:4]))
+			scopeCount := int(binary.BigEndian.Uint16(b[4:6]))
+			if count == 0 {
+				return templates, nil
+			}
+			if scopeCount > count {
+				return templates, netflow.NewErrorDecodingNetFlow("Error decoding OptionsTemplateSet: negative length.")
+			}
+			t.Scopes, b, err = decodeNetFlowTemplateFields(b[6:], scopeCount, enterprise)
+			if err == nil {
+				t.Options, b, err = decodeNetFlowTemplateFields(b, count-scopeCount, enterprise)
+			}
+		}
+		if err != nil {
+			return templates, err
+		}
+		templates = append(templates, t)
+	}
+}
+
+func netFlowRecordMinLength(fields []NetFlowTemplateField) int {
+	n := 0
+	for _, f := range fields {
+		if f.Length == netFlowVariableLength {
+			n++
+		} else {
+			n += int(f.Length)
+		}
+	}
+	return n
+}
+
+// Decodes a single record. Fields that don't fit in b mean the rest of the set
+// is padding.
+func decodeNetFlowRecord(b []byte, fields []NetFlowTemplateField, fieldMap map[netFlowFieldKey][]*NetFlowFieldConfig, extra map[string]interface{}) ([]netflow.DataField, []byte, bool) {
+	values := make([]netflow.DataField, len(fields))
+	for i, f := range fields {
+		length := int(f.Length)
+		if f.Length == netFlowVariableLength {
+			if len(b) < 1 {
+				return nil, nil, false
+			}
+			length = int(b[0])
+			b = b[1:]
+			if length == 255 {
+				if len(b) < 2 {
+					return nil, nil, false
+				}
+				length = int(binary.BigEndian.Uint16(b[0:2]))
+				b = b[2:]
+			}
+		}
+		if len(b) < length {
+			return nil, nil, false
+		}
+		value := b[:length]
+		b = b[length:]
+
+		// Enterprise elements are given type 0 so the goflow producer doesn't
+		// mistake them for the IANA element with the same ID.
+		values[i] = netflow.DataField{Value: value}
+		if f.EnterpriseNumber == 0 {
+			values[i].Type = f.Type
+		}
+
+		if extra != nil {
+			for _, config := range fieldMap[netFlowFieldKey{f.EnterpriseNumber, f.Type}] {
+				if v, ok := formatNetFlowField(config.Type, value); ok {
+					extra[config.Name] = v
+				}
+			}
+		}
+	}
+	return values, b, true
+}
+
+// Our own NetFlow v9 and IPFIX decoder. It produces the same packet
+// structures as netflow.DecodeMessage so the goflow producer can still build
+// the flow messages, but it also understands IPFIX enterprise and variable
+// length elements and pulls out any custom fields along the way.
+func decodeNetFlowMessage(payload []byte, templates *netFlowExporterTemplateSystem, fieldMap map[netFlowFieldKey][]*NetFlowFieldConfig) (*netFlowDecodedMessage, error) {
+	if len(payload) < 2 {
+		return nil, errNetFlowTruncated("header")
+	}
+	version := binary.BigEndian.Uint16(payload[0:2])
+	dec := &netFlowDecodedMessage{}
+	var obsDomainID uint32
+	var b []byte
+	switch version {
+	case 9:
+		if len(payload) < 20 {
+			return nil, errNetFlowTruncated("header")
+		}
+		obsDomainID = binary.BigEndian.Uint32(payload[16:20])
+		dec.version = "9"
+		dec.packet = netflow.NFv9Packet{
+			Version:        version,
+			Count:          binary.BigEndian.Uint16(payload[2:4]),
+			SystemUptime:   binary.BigEndian.Uint32(payload[4:8]),
+			UnixSeconds:    binary.BigEndian.Uint32(payload[8:12]),
+			SequenceNumber: binary.BigEndian.Uint32(payload[12:16]),
+			SourceId:       obsDomainID,
+		}
+		b = payload[20:]
+	case 10:
+		if len(payload) < 16 {
+			return nil, errNetFlowTruncated("header")
+		}
+		obsDomainID = binary.BigEndian.Uint32(payload[12:16])
+		dec.version = "10"
+		dec.packet = netflow.IPFIXPacket{
+			Version:             version,
+			Length:              binary.BigEndian.Uint16(payload[2:4]),
+			ExportTime:          binary.BigEndian.Uint32(payload[4:8]),
+			SequenceNumber:      binary.BigEndian.Uint32(payload[8:12]),
+			ObservationDomainId: obsDomainID,
+		}
+		b = payload[16:]
+	default:
+		return nil, netflow.NewErrorVersion(version)
+	}
+
+	var flowSets []interface{}
+	for len(b) >= 4 {
+		header := netflow.FlowSetHeader{
+			Id:     binary.BigEndian.Uint16(b[0:2]),
+			Length: binary.BigEndian.Uint16(b[2:4]),
+		}
+		if header.Length < 4 || int(header.Length) > len(b) {
+			return nil, netflow.NewErrorDecodingNetFlow("Error decoding packet: non-terminated stream.")
+		}
+		body := b[4:header.Length]
+		b = b[header.Length:]
+
+		switch {
+		case version == 9 && (header.Id == 0 || header.Id == 1), version == 10 && (header.Id == 2 || header.Id == 3):
+			learned, err := decodeNetFlowTemplateSet(version, obsDomainID, header.Id, body)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range learned {
+				templates.learnTemplate(t)
+			}
+			typeStr := "TemplateFlowSet"
+			if header.Id == 1 || header.Id == 3 {
+				typeStr = "OptionsTemplateFlowSet"
+			}
+			dec.sets = append(dec.sets, netFlowSetStat{typeStr, len(learned)})
+
+		case header.Id >= 256:
+			t, ok := templates.getTemplate(version, obsDomainID, header.Id)
+			if !ok {
+				return nil, netflow.NewErrorTemplateNotFound(version, obsDomainID, header.Id, "info")
+			}
+			if t.Type == NetFlowTemplateTypeTemplate {
+				minLength := netFlowRecordMinLength(t.Fields)
+				set := netflow.DataFlowSet{FlowSetHeader: header}
+				for minLength > 0 && len(body) >= minLength {
+					var extra map[string]interface{}
+					if len(fieldMap) > 0 {
+						extra = make(map[string]interface{})
+					}
+					values, rest, ok := decodeNetFlowRecord(body, t.Fields, fieldMap, extra)
+					if !ok {
+						break
+					}
+					body = rest
+					set.Records = append(set.Records, netflow.DataRecord{Values: values})
+					if extra != nil {
+						dec.fields = append(dec.fields, extra)
+					}
+				}
+				flowSets = append(flowSets, set)
+				dec.sets = append(dec.sets, netFlowSetStat{"DataFlowSet", len(set.Records)})
+			} else {
+				scopeLength := netFlowRecordMinLength(t.Scopes)
+				minLength := scopeLength + netFlowRecordMinLength(t.Options)
+				set := netflow.OptionsDataFlowSet{FlowSetHeader: header}
+				for minLength > 0 && len(body) >= minLength {
+					scopes, rest, ok := decodeNetFlowRecord(body, t.Scopes, nil, nil)
+					if !ok {
+						break
+					}
+					options, rest, ok := decodeNetFlowRecord(rest, t.Options, nil, nil)
+					if !ok {
+						break
+					}
+					body = rest
+					set.Records = append(set.Records, netflow.OptionsDataRecord{
+						ScopesValues:  scopes,
+						OptionsValues: options,
+					})
+				}
+				flowSets = append(flowSets, set)
+				dec.sets = append(dec.sets, netFlowSetStat{"OptionsDataFlowSet", len(set.Records)})
+			}
+
+		default:
+			return nil, netflow.NewErrorFlowId(header.Id)
+		}
+	}
+
+	switch packet := dec.packet.(type) {
+	case netflow.NFv9Packet:
+		packet.FlowSets = flowSets
+		dec.packet = packet
+	case netflow.IPFIXPacket:
+		packet.FlowSets = flowSets
+		dec.packet = packet
+	}
+	return dec, nil
+}
+
+// Replacement for github.com/cloudflare/goflow/v3/utils.StateNetFlow that
+// keeps templates in a NetFlowTemplateStore instead of goflow's private map
+// and decodes with decodeNetFlowMessage.
+type netFlowState struct {
+	transport Transport
+	templates *NetFlowTemplateStore
+	fieldMap  map[netFlowFieldKey][]*NetFlowFieldConfig
+
+	samplinglock sync.RWMutex
+	sampling     map[string]producer.SamplingRateSystem
+}
+
+func newNetFlowState(transport Transport, templates *NetFlowTemplateStore, fields []*NetFlowFieldConfig) (*netFlowState, error) {
+	fieldMap, err := newNetFlowFieldMap(fields)
+	if err != nil {
+		return nil, err
+	}
+	return &netFlowState{
+		transport: transport,
+		templates: templates,
+		fieldMap:  fieldMap,
+		sampling:  make(map[string]producer.SamplingRateSystem),
+	}, nil
+}
+
+func (s *netFlowState) samplingSystem(key string) producer.SamplingRateSystem {
+	s.samplinglock.RLock()
+	sampling, ok := s.sampling[key]
+	s.samplinglock.RUnlock()
+	if ok {
+		return sampling
+	}
+	s.samplinglock.Lock()
+	defer s.samplinglock.Unlock()
+	if sampling, ok := s.sampling[key]; ok {
+		return sampling
+	}
+	sampling = producer.CreateSamplingSystem()
+	s.sampling[key] = sampling
+	return sampling
+}
+
+func (s *netFlowState) DecodeFlow(msg interface{}) error {
+	pkt := msg.(utils.BaseMessage)
+
+	key := pkt.Src.String()
+	samplerAddress := pkt.Src
+	if samplerAddress.To4() != nil {
+		samplerAddress = samplerAddress.To4()
+	}
+
+	templates := s.templates.exporter(key)
+	sampling := s.samplingSystem(key)
+
+	ts := uint64(time.Now().UTC().Unix())
+	if pkt.SetTime {
+		ts = uint64(pkt.RecvTime.UTC().Unix())
+	}
+
+	timeTrackStart := time.Now()
+	dec, err := decodeNetFlowMessage(pkt.Payload, templates, s.fieldMap)
+	if err != nil {
+		errStr := "error_decoding"
+		switch err.(type) {
+		case *netflow.ErrorVersion:
+			errStr = "error_version"
+		case *netflow.ErrorFlowId:
+			errStr = "error_flow_id"
+		case *netflow.ErrorTemplateNotFound:
+			errStr = "template_not_found"
+		}
+		utils.NetFlowErrors.With(
+			prometheus.Labels{
+				"router": key,
+				"error":  errStr,
+			}).
+			Inc()
+		return err
+	}
+
+	utils.NetFlowStats.With(
+		prometheus.Labels{
+			"router":  key,
+			"version": dec.version,
+		}).
+		Inc()
+	for _, set := range dec.sets {
+		labels := prometheus.Labels{
+			"router":  key,
+			"version": dec.version,
+			"type":    set.typeStr,
+		}
+		utils.NetFlowSetStatsSum.With(labels).Inc()
+		utils.NetFlowSetRecordsStatsSum.With(labels).Add(float64(set.records))
+	}
+
+	var flowMessageSet []*goflowpb.FlowMessage
+	flowMessageSet, _ = producer.ProcessMessageNetFlow(dec.packet, sampling)
+
+	for _, fmsg := range flowMessageSet {
+		fmsg.TimeReceived = ts
+		fmsg.SamplerAddress = samplerAddress
+		timeDiff := fmsg.TimeReceived - fmsg.TimeFlowEnd
+		utils.NetFlowTimeStatsSum.With(
+			prometheus.Labels{
+				"router":  key,
+				"version": dec.version,
+			}).
+			Observe(float64(timeDiff))
+	}
+
+	utils.DecoderTime.With(
+		prometheus.Labels{
+			"name": "NetFlow",
+		}).
+		Observe(float64((time.Since(timeTrackStart)).Nanoseconds()) / 1000)
+
+	if s.transport == nil {
+		return nil
+	}
+	if publisher, ok := s.transport.(fieldsPublisher); ok && len(dec.fields) > 0 {
+		publisher.PublishWithFields(flowMessageSet, dec.fields)
+		return nil
+	}
+	s.transport.Publish(flowMessageSet)
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package server_test
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/capture"
+	"github.com/sapslaj/morbius/server"
+)
+
+var netflowV9TestFields = []server.NetFlowTemplateField{
+	{Type: 8, Length: 4},  // IPV4_SRC_ADDR
+	{Type: 12, Length: 4}, // IPV4_DST_ADDR
+	{Type: 1, Length: 4},  // IN_BYTES
+	{Type: 11, Length: 2}, // L4_DST_PORT
+}
+
+func netflowV9Datagram(flowSets ...[]byte) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b[0:2], 9)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(flowSets)))
+	binary.BigEndian.PutUint32(b[8:12], 1666000000)
+	binary.BigEndian.PutUint32(b[16:20], 1)
+	for _, fs := range flowSets {
+		b = append(b, fs...)
+	}
+	return b
+}
+
+func netflowV9TemplateFlowSet(templateID uint16, fields []server.NetFlowTemplateField) []byte {
+	b := make([]byte, 8+4*len(fields))
+	binary.BigEndian.PutUint16(b[0:2], 0)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[4:6], templateID)
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(fields)))
+	for i, f := range fields {
+		binary.BigEndian.PutUint16(b[8+4*i:], f.Type)
+		binary.BigEndian.PutUint16(b[10+4*i:], f.Length)
+	}
+	return b
+}
+
+func netflowV9DataFlowSet(templateID uint16, record []byte) []byte {
+	length := 4 + len(record)
+	length += (4 - length%4) % 4
+	b := make([]byte, length)
+	binary.BigEndian.PutUint16(b[0:2], templateID)
+	binary.BigEndian.PutUint16(b[2:4], uint16(length))
+	copy(b[4:], record)
+	return b
+}
+
+func netflowV9TestRecord() []byte {
+	r := make([]byte, 14)
+	copy(r[0:4], net.IPv4(10, 0, 0, 1).To4())
+	copy(r[4:8], net.IPv4(10, 0, 0, 2).To4())
+	binary.BigEndian.PutUint32(r[8:12], 1500)
+	binary.BigEndian.PutUint16(r[12:14], 443)
+	return r
+}
+
+func writeTestCapture(t *testing.T, path string, listener string, payloads ...[]byte) {
+	t.Helper()
+	w, err := capture.NewWriter(&capture.WriterConfig{Path: path}, listener)
+	if err != nil {
+		t.Fatalf("NewWriter returned err: %v", err)
+	}
+	for i, payload := range payloads {
+		err := w.Write(capture.Datagram{
+			Src:      netip.MustParseAddrPort("192.0.2.1:50000"),
+			RecvTime: time.Unix(1666000000, int64(i)),
+			Payload:  payload,
+		})
+		if err != nil {
+			t.Fatalf("Write returned err: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNetFlowTemplateStore(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	templatePath := filepath.Join(dir, "templates.json")
+
+	firstCapture := filepath.Join(dir, "first.cap")
+	writeTestCapture(
+		t,
+		firstCapture,
+		server.ListenerNetFlowV9,
+		netflowV9Datagram(netflowV9DataFlowSet(256, netflowV9TestRecord())),
+		netflowV9Datagram(netflowV9TemplateFlowSet(256, netflowV9TestFields)),
+		netflowV9Datagram(netflowV9DataFlowSet(256, netflowV9TestRecord())),
+	)
+
+	transport := &recordingTransport{}
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{
+		NetFlowV9: &server.ServerPortConfig{
+			Templates: &server.NetFlowTemplateStoreConfig{Path: templatePath},
+		},
+	}, transport, nil)
+	stats, err := s.Replay(firstCapture, server.ReplayOptions{Speed: 0})
+	if err != nil {
+		t.Fatalf("Replay returned err: %v", err)
+	}
+	if stats.Errors != 1 {
+		t.Errorf("expected the data set before the template to fail, got stats %+v", stats)
+	}
+	if len(transport.flows) != 1 {
+		t.Fatalf("expected 1 flow, got %d", len(transport.flows))
+	}
+
+	want := map[string]server.NetFlowExporterTemplates{
+		"192.0.2.1": {
+			Templates: []server.NetFlowTemplate{
+				{
+					Version:     9,
+					ObsDomainID: 1,
+					TemplateID:  256,
+					Type:        server.NetFlowTemplateTypeTemplate,
+					Fields:      netflowV9TestFields,
+				},
+			},
+			Missing: []server.NetFlowMissingTemplate{
+				{Version: 9, ObsDomainID: 1, TemplateID: 256, Count: 1},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, s.NetFlowTemplates.Exporters()); diff != "" {
+		t.Errorf("Exporters() mismatch (-want +got):\n%s", diff)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new server should be able to decode data straight away using the
+	// saved templates.
+	secondCapture := filepath.Join(dir, "second.cap")
+	writeTestCapture(
+		t,
+		secondCapture,
+		server.ListenerNetFlowV9,
+		netflowV9Datagram(netflowV9DataFlowSet(256, netflowV9TestRecord())),
+	)
+	transport = &recordingTransport{}
+	s = server.NewServerWithTransportAndLogger(server.ServerConfig{
+		NetFlowV9: &server.ServerPortConfig{
+			Templates: &server.NetFlowTemplateStoreConfig{Path: templatePath},
+		},
+	}, transport, nil)
+	stats, err = s.Replay(secondCapture, server.ReplayOptions{Speed: 0})
+	if err != nil {
+		t.Fatalf("Replay returned err: %v", err)
+	}
+	if stats.Errors != 0 || len(transport.flows) != 1 {
+		t.Fatalf("expected preloaded template to decode data, got stats %+v and %d flows", stats, len(transport.flows))
+	}
+	fmsg := transport.flows[0]
+	if net.IP(fmsg.SrcAddr).String() != "10.0.0.1" || fmsg.DstPort != 443 || fmsg.Bytes != 1500 {
+		t.Errorf("unexpected flow %+v", fmsg)
+	}
+}
+
+func TestNetFlowTemplateStore_ReadOnlyState(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	templatePath := filepath.Join(dir, "templates.json")
+	capturePath := filepath.Join(dir, "replay.cap")
+	writeTestCapture(
+		t,
+		capturePath,
+		server.ListenerNetFlowV9,
+		netflowV9Datagram(netflowV9TemplateFlowSet(256, netflowV9TestFields)),
+		netflowV9Datagram(netflowV9DataFlowSet(256, netflowV9TestRecord())),
+	)
+
+	transport := &recordingTransport{}
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{
+		ReadOnlyState: true,
+		NetFlowV9: &server.ServerPortConfig{
+			Templates: &server.NetFlowTemplateStoreConfig{Path: templatePath},
+		},
+	}, transport, nil)
+	if _, err := s.Replay(capturePath, server.ReplayOptions{Speed: 0}); err != nil {
+		t.Fatalf("Replay returned err: %v", err)
+	}
+	if len(transport.flows) != 1 {
+		t.Fatalf("expected 1 flow, got %d", len(transport.flows))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(templatePath); !os.IsNotExist(err) {
+		t.Errorf("expected templates not to be saved, got %v", err)
+	}
+}
+
+func ipfixDatagram(sets ...[]byte) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint16(b[0:2], 10)
+	binary.BigEndian.PutUint32(b[4:8], 1666000000)
+	binary.BigEndian.PutUint32(b[12:16], 7)
+	for _, set := range sets {
+		b = append(b, set...)
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b
+}
+
+func TestNetFlowFields(t *testing.T) {
+	t.Parallel()
+
+	// Template 300: sourceIPv4Address, postNATSourceIPv4Address,
+	// ingressInterface (4 bytes), and Palo Alto's variable length user ID.
+	template := []byte{
+		0, 2, 0, 28, // set header
+		0x01, 0x2c, 0, 4, // template 300, 4 fields
+		0, 8, 0, 4,
+		0, 225, 0, 4,
+		0, 10, 0, 4,
+		0x80, 56, 0xff, 0xff, 0, 0, 0x63, 0x75, // PEN 25461, element 56
+	}
+	record := []byte{
+		10, 0, 0, 1,
+		203, 0, 113, 9,
+		0, 0, 0, 42,
+		5, 'a', 'l', 'i', 'c', 'e',
+	}
+	data := append([]byte{1, 44, 0, byte(4 + len(record) + 2)}, record...)
+	data = append(data, 0, 0) // padding
+
+	path := filepath.Join(t.TempDir(), "ipfix.cap")
+	writeTestCapture(t, path, server.ListenerNetFlowV9, ipfixDatagram(template, data))
+
+	transport := &recordingTransport{}
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{
+		NetFlowV9: &server.ServerPortConfig{
+			Fields: []*server.NetFlowFieldConfig{
+				{Name: "post_nat_src_addr", ElementID: 225, Type: server.NetFlowFieldTypeIP},
+				{Name: "in_interface_raw", ElementID: 10, Type: server.NetFlowFieldTypeInt},
+				{Name: "pan_user_id", EnterpriseNumber: 25461, ElementID: 56, Type: server.NetFlowFieldTypeString},
+				{Name: "pan_user_id_raw", EnterpriseNumber: 25461, ElementID: 56},
+			},
+		},
+	}, transport, nil)
+	stats, err := s.Replay(path, server.ReplayOptions{Speed: 0})
+	if err != nil {
+		t.Fatalf("Replay returned err: %v", err)
+	}
+	if stats.Errors != 0 || len(transport.flows) != 1 {
+		t.Fatalf("expected 1 flow and no errors, got stats %+v and %d flows", stats, len(transport.flows))
+	}
+	fmsg := transport.flows[0]
+	if net.IP(fmsg.SrcAddr).String() != "10.0.0.1" || fmsg.InIf != 42 {
+		t.Errorf("unexpected flow %+v", fmsg)
+	}
+	want := []map[string]interface{}{
+		{
+			"post_nat_src_addr": "203.0.113.9",
+			"in_interface_raw":  42,
+			"pan_user_id":       "alice",
+			"pan_user_id_raw":   "616c696365",
+		},
+	}
+	if diff := cmp.Diff(want, transport.fields); diff != "" {
+		t.Errorf("fields mismatch (-want +got):\n%s", diff)
+	}
+
+	got := s.NetFlowTemplates.Exporters()["192.0.2.1"].Templates
+	wantFields := []server.NetFlowTemplateField{
+		{Type: 8, Length: 4},
+		{Type: 225, Length: 4},
+		{Type: 10, Length: 4},
+		{Type: 56, Length: 0xffff, EnterpriseNumber: 25461},
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 template, got %+v", got)
+	}
+	if diff := cmp.Diff(wantFields, got[0].Fields); diff != "" {
+		t.Errorf("template fields mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestServer_RunNetFlowV9_InvalidField(t *testing.T) {
+	t.Parallel()
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{
+		NetFlowV9: &server.ServerPortConfig{
+			Fields: []*server.NetFlowFieldConfig{
+				{Name: "pan_user_id", EnterpriseNumber: 25461, ElementID: 56, Type: "bogus"},
+			},
+		},
+	}, &recordingTransport{}, nil)
+	err := s.RunNetFlowV9()
+	if err == nil || !strings.Contains(err.Error(), "unknown type `bogus`") {
+		t.Fatalf("expected unknown type error, got %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapslaj/morbius/capture"
+	"github.com/sapslaj/morbius/packet"
+)
+
+// Message type for flows generated by the probe. Otherwise the messages use
+// the same fields as FormatFlowMessage.
+const ProbeMessageType = "PROBE"
+
+var (
+	MetricProbePackets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_packets",
+			Help: "Number of packets read by the probe",
+		},
+		[]string{"status"},
+	)
+	MetricProbeFlowsActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "probe_flows_active",
+			Help: "Number of flows in the probe flow cache",
+		},
+	)
+	MetricProbeFlowsExported = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_flows_exported",
+			Help: "Number of flows expired from the probe flow cache",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(MetricProbePackets)
+	prometheus.MustRegister(MetricProbeFlowsActive)
+	prometheus.MustRegister(MetricProbeFlowsExported)
+}
+
+type ProbeConfig struct {
+	Enable bool `yaml:"enable"`
+	// Read packets from this pcap file. Flows are timed by the packet
+	// timestamps and the remaining flows are exported at the end of the file.
+	File string `yaml:"file"`
+	// Capture packets from this interface with an AF_PACKET socket. Only
+	// supported on Linux.
+	Interface   string `yaml:"interface"`
+	Promiscuous bool   `yaml:"promiscuous"`
+	// Flows are exported this long after their first packet even if they are
+	// still active. Default is 1m.
+	ActiveTimeout time.Duration `yaml:"active_timeout"`
+	// Flows are exported after not seeing any packets for this long. Default
+	// is 15s.
+	InactiveTimeout time.Duration `yaml:"inactive_timeout"`
+	// Maximum number of flows in the cache. When the cache is full the least
+	// recently seen flow is exported early. Default is 65536.
+	MaxFlows int `yaml:"max_flows"`
+	// Value of `sampler_address` in the flow messages. Default is 0.0.0.0.
+	SamplerAddress string `yaml:"sampler_address"`
+}
+
+func mergeDefaultProbeConfig(in *ProbeConfig) *ProbeConfig {
+	if in == nil {
+		in = &ProbeConfig{}
+	}
+	if in.ActiveTimeout == 0 {
+		in.ActiveTimeout = time.Minute
+	}
+	if in.InactiveTimeout == 0 {
+		in.InactiveTimeout = 15 * time.Second
+	}
+	if in.MaxFlows == 0 {
+		in.MaxFlows = 65536
+	}
+	if in.SamplerAddress == "" {
+		in.SamplerAddress = "0.0.0.0"
+	}
+	return in
+}
+
+type probeFlowKey struct {
+	srcAddr  netip.Addr
+	dstAddr  netip.Addr
+	srcPort  uint16
+	dstPort  uint16
+	proto    uint8
+	etype    uint16
+	vlanID   uint16
+	icmpType uint8
+	icmpCode uint8
+}
+
+type probeFlow struct {
+	key     probeFlowKey
+	first   *packet.Packet
+	start   time.Time
+	last    time.Time
+	bytes   uint64
+	packets uint64
+	// TCP flags of all packets in the flow OR'd together.
+	tcpFlags uint8
+}
+
+// LRU flow cache ordered by the time each flow was last seen.
+type probeFlowCache struct {
+	config *ProbeConfig
+	flows  map[probeFlowKey]*list.Element
+	order  *list.List
+}
+
+func newProbeFlowCache(config *ProbeConfig) *probeFlowCache {
+	return &probeFlowCache{
+		config: config,
+		flows:  make(map[probeFlowKey]*list.Element),
+		order:  list.New(),
+	}
+}
+
+func (c *probeFlowCache) remove(e *list.Element, reason string) *probeFlow {
+	f := c.order.Remove(e).(*probeFlow)
+	delete(c.flows, f.key)
+	MetricProbeFlowsExported.With(prometheus.Labels{"reason": reason}).Inc()
+	MetricProbeFlowsActive.Set(float64(len(c.flows)))
+	return f
+}
+
+// Accounts a packet and returns any flows that have to be exported because of
+// it: the packet's own flow once it sees a TCP FIN or RST, or the least
+// recently seen flow if the cache is full.
+func (c *probeFlowCache) add(p *packet.Packet, ts time.Time) []*probeFlow {
+	var expired []*probeFlow
+	key := probeFlowKey{
+		srcAddr:  p.SrcAddr,
+		dstAddr:  p.DstAddr,
+		srcPort:  p.SrcPort,
+		dstPort:  p.DstPort,
+		proto:    p.Proto,
+		etype:    p.Etype,
+		vlanID:   p.VlanID,
+		icmpType: p.IcmpType,
+		icmpCode: p.IcmpCode,
+	}
+	e, ok := c.flows[key]
+	if !ok {
+		if len(c.flows) >= c.config.MaxFlows {
+			expired = append(expired, c.remove(c.order.Back(), "evicted"))
+		}
+		// Only the headers of the first packet are kept.
+		p.Payload = nil
+		e = c.order.PushFront(&probeFlow{key: key, first: p, start: ts})
+		c.flows[key] = e
+		MetricProbeFlowsActive.Set(float64(len(c.flows)))
+	} else {
+		c.order.MoveToFront(e)
+	}
+	f := e.Value.(*probeFlow)
+	f.last = ts
+	f.bytes += uint64(p.IPLength)
+	f.packets++
+	f.tcpFlags |= p.TCPFlags
+	// FIN or RST
+	if p.Proto == packet.ProtoTCP && p.TCPFlags&0x05 != 0 {
+		expired = append(expired, c.remove(e, "end"))
+	}
+	return expired
+}
+
+// Returns the flows that have hit the active or inactive timeout as of now.
+func (c *probeFlowCache) expire(now time.Time) []*probeFlow {
+	var expired []*probeFlow
+	for e := c.order.Back(); e != nil; {
+		prev := e.Prev()
+		f := e.Value.(*probeFlow)
+		if now.Sub(f.last) >= c.config.InactiveTimeout {
+			expired = append(expired, c.remove(e, "inactive"))
+		} else if now.Sub(f.start) >= c.config.ActiveTimeout {
+			expired = append(expired, c.remove(e, "active"))
+		}
+		e = prev
+	}
+	return expired
+}
+
+// Returns all flows, oldest first, and empties the cache.
+func (c *probeFlowCache) flush() []*probeFlow {
+	var expired []*probeFlow
+	for e := c.order.Back(); e != nil; e = c.order.Back() {
+		expired = append(expired, c.remove(e, "flush"))
+	}
+	return expired
+}
+
+func formatProbeFlow(config *ProbeConfig, f *probeFlow, timeReceived time.Time, sequenceNum uint32, ifIndex int) map[string]interface{} {
+	p := f.first
+	msg := map[string]interface{}{
+		"type":            ProbeMessageType,
+		"time_received":   int(timeReceived.Unix()),
+		"sequence_num":    int(sequenceNum),
+		"sampling_rate":   1,
+		"sampler_address": config.SamplerAddress,
+		"time_flow_start": int(f.start.Unix()),
+		"time_flow_end":   int(f.last.Unix()),
+		"bytes":           int(f.bytes),
+		"packets":         int(f.packets),
+		"src_addr":        p.SrcAddr.String(),
+		"dst_addr":        p.DstAddr.String(),
+		"ethernet_type":   int(p.Etype),
+		"proto":           int(p.Proto),
+		"src_port":        int(p.SrcPort),
+		"dst_port":        int(p.DstPort),
+		"in_interface":    ifIndex,
+		"out_interface":   0,
+		"src_vlan":        int(p.VlanID),
+		"dst_vlan":        int(p.VlanID),
+		"vlan_id":         int(p.VlanID),
+		"ip_tos":          int(p.IPTos),
+		"ip_ttl":          int(p.IPTTL),
+		"tcp_flags":       int(f.tcpFlags),
+		"icmp_types":      int(p.IcmpType),
+		"icmp_code":       int(p.IcmpCode),
+		"ipv6_flow_label": int(p.IPv6FlowLabel),
+		"fragment_id":     int(p.FragmentID),
+		"fragment_offset": int(p.FragmentOffset),
+		"src_net":         0,
+		"dst_net":         0,
+	}
+	if len(p.SrcMAC) != 0 {
+		msg["src_mac"] = p.SrcMAC.String()
+	}
+	if len(p.DstMAC) != 0 {
+		msg["dst_mac"] = p.DstMAC.String()
+	}
+	return msg
+}
+
+// Returned by probe sources when no packet arrived before the read timeout,
+// so flows can still be expired on an idle link.
+var errProbeIdle = errors.New("probe: no packets")
+
+type probeSource interface {
+	next() (capture.PcapPacket, error)
+	// Interface index to use for `in_interface`.
+	ifIndex() int
+	Close() error
+}
+
+type pcapProbeSource struct {
+	f *os.File
+	r *capture.PcapReader
+}
+
+func (ps *pcapProbeSource) next() (capture.PcapPacket, error) {
+	return ps.r.Next()
+}
+
+func (ps *pcapProbeSource) ifIndex() int {
+	return 0
+}
+
+func (ps *pcapProbeSource) Close() error {
+	return ps.f.Close()
+}
+
+func (s *Server) openProbeSource() (probeSource, error) {
+	config := s.Config.Probe
+	switch {
+	case config.File != "" && config.Interface != "":
+		return nil, errors.New("probe: only one of file and interface can be set")
+	case config.File != "":
+		f, err := os.Open(config.File)
+		if err != nil {
+			return nil, err
+		}
+		r, err := capture.NewPcapReader(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("probe: %s: %w", config.File, err)
+		}
+		return &pcapProbeSource{f: f, r: r}, nil
+	case config.Interface != "":
+		return newAFPacketProbeSource(config.Interface, config.Promiscuous)
+	}
+	return nil, errors.New("probe: one of file or interface is required")
+}
+
+// RunProbe generates flows from the packets read from a pcap file or a live
+// interface. When reading a file it returns nil once the whole file has been
+// read and all flows exported.
+func (s *Server) RunProbe() error {
+	src, err := s.openProbeSource()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	config := s.Config.Probe
+	cache := newProbeFlowCache(config)
+	var sequenceNum uint32
+	publish := func(flows []*probeFlow, now time.Time) {
+		for _, f := range flows {
+			sequenceNum++
+			s.Config.Transport.PublishMessage(formatProbeFlow(config, f, now, sequenceNum, src.ifIndex()))
+		}
+	}
+
+	var lastScan, lastPacket time.Time
+	for {
+		pkt, err := src.next()
+		now := pkt.Timestamp
+		switch {
+		case err == nil:
+			lastPacket = now
+		case errors.Is(err, errProbeIdle):
+			now = time.Now()
+		case errors.Is(err, io.EOF):
+			publish(cache.flush(), lastPacket)
+			return nil
+		default:
+			return err
+		}
+		// Expire before accounting the packet so it doesn't extend a flow
+		// that has already timed out.
+		if now.Sub(lastScan) >= time.Second {
+			publish(cache.expire(now), now)
+			lastScan = now
+		}
+		if err != nil {
+			continue
+		}
+		p, err := packet.Decode(pkt.LinkType, pkt.Data)
+		// Truncated packets are fine as long as the addresses were decoded.
+		if p == nil || !p.SrcAddr.IsValid() || (err != nil && !errors.Is(err, packet.ErrTruncated)) {
+			MetricProbePackets.With(prometheus.Labels{"status": "skipped"}).Inc()
+			continue
+		}
+		MetricProbePackets.With(prometheus.Labels{"status": "accounted"}).Inc()
+		publish(cache.add(p, now), now)
+	}
+}
@@ -0,0 +1,121 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/sapslaj/morbius/capture"
+	"github.com/sapslaj/morbius/packet"
+)
+
+// From linux/if_ether.h and linux/if_packet.h
+const (
+	ethPAll             = 0x0003
+	solPacket           = 263
+	packetAddMembership = 1
+	packetMRPromisc     = 1
+)
+
+const (
+	afPacketSnapLen     = 65535
+	afPacketReadTimeout = time.Second
+)
+
+// struct packet_mreq
+type packetMreq struct {
+	ifIndex int32
+	mrType  uint16
+	alen    uint16
+	address [8]byte
+}
+
+// Captures packets with an AF_PACKET socket bound to a single interface.
+type afPacketProbeSource struct {
+	fd    int
+	index int
+	buf   []byte
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func newAFPacketProbeSource(name string, promiscuous bool) (probeSource, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPAll)))
+	if err != nil {
+		return nil, err
+	}
+	ps := &afPacketProbeSource{
+		fd:    fd,
+		index: iface.Index,
+		buf:   make([]byte, afPacketSnapLen),
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{
+		Protocol: htons(ethPAll),
+		Ifindex:  iface.Index,
+	})
+	if err == nil && promiscuous {
+		mreq := packetMreq{ifIndex: int32(iface.Index), mrType: packetMRPromisc}
+		_, _, errno := syscall.Syscall6(
+			syscall.SYS_SETSOCKOPT,
+			uintptr(fd),
+			solPacket,
+			packetAddMembership,
+			uintptr(unsafe.Pointer(&mreq)),
+			unsafe.Sizeof(mreq),
+			0,
+		)
+		if errno != 0 {
+			err = errno
+		}
+	}
+	if err == nil {
+		tv := syscall.NsecToTimeval(afPacketReadTimeout.Nanoseconds())
+		err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return ps, nil
+}
+
+func (ps *afPacketProbeSource) next() (capture.PcapPacket, error) {
+	for {
+		n, _, err := syscall.Recvfrom(ps.fd, ps.buf, 0)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if errors.Is(err, syscall.EAGAIN) {
+			return capture.PcapPacket{}, errProbeIdle
+		}
+		if err != nil {
+			return capture.PcapPacket{}, err
+		}
+		return capture.PcapPacket{
+			Timestamp: time.Now(),
+			LinkType:  packet.LinkTypeEthernet,
+			// Decode copies everything the flow cache keeps, so the read
+			// buffer can be reused.
+			Data:    ps.buf[:n],
+			OrigLen: n,
+		}, nil
+	}
+}
+
+func (ps *afPacketProbeSource) ifIndex() int {
+	return ps.index
+}
+
+func (ps *afPacketProbeSource) Close() error {
+	return syscall.Close(ps.fd)
+}
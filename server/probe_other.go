@@ -0,0 +1,11 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+)
+
+func newAFPacketProbeSource(name string, promiscuous bool) (probeSource, error) {
+	return nil, errors.New("probe: live capture is only supported on Linux")
+}
@@ -0,0 +1,154 @@
+package server_test
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/server"
+)
+
+type pcapTestPacket struct {
+	offset time.Duration
+	frame  []byte
+}
+
+func writeTestPcap(t *testing.T, path string, start time.Time, packets ...pcapTestPacket) {
+	t.Helper()
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 65535)
+	binary.LittleEndian.PutUint32(header[20:24], 1)
+	b := header
+	for _, p := range packets {
+		ts := start.Add(p.offset)
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:4], uint32(ts.Unix()))
+		binary.LittleEndian.PutUint32(record[4:8], uint32(ts.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:12], uint32(len(p.frame)))
+		binary.LittleEndian.PutUint32(record[12:16], uint32(len(p.frame)))
+		b = append(b, record...)
+		b = append(b, p.frame...)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tcpFrame(srcPort, dstPort uint16, flags uint8) []byte {
+	frame := ipv4Frame(6, srcPort, dstPort, nil)
+	frame[14+20+13] = flags
+	return frame
+}
+
+func TestServer_RunProbe(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(1666000000, 0)
+	path := filepath.Join(t.TempDir(), "span.pcap")
+	var packets []pcapTestPacket
+	packets = append(packets,
+		pcapTestPacket{0, tcpFrame(50000, 80, 0x02)},
+		pcapTestPacket{0, ipv4Frame(17, 50000, 53, []byte("x"))},
+		pcapTestPacket{time.Second, tcpFrame(50000, 80, 0x10)},
+		pcapTestPacket{2 * time.Second, tcpFrame(50000, 80, 0x11)},
+	)
+	// Stays active past the active timeout.
+	for i := 0; i <= 7; i++ {
+		packets = append(packets, pcapTestPacket{time.Duration(i) * 10 * time.Second, ipv4Frame(17, 50001, 123, []byte("x"))})
+	}
+	// Goes idle past the inactive timeout.
+	packets = append(packets, pcapTestPacket{30 * time.Second, ipv4Frame(17, 50000, 53, []byte("x"))})
+	// Frames are written in timestamp order like a real capture.
+	sort.SliceStable(packets, func(i, j int) bool {
+		return packets[i].offset < packets[j].offset
+	})
+	writeTestPcap(t, path, start, packets...)
+
+	transport := &recordingTransport{}
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{
+		Probe: &server.ProbeConfig{Enable: true, File: path},
+	}, transport, nil)
+	if err := s.RunProbe(); err != nil {
+		t.Fatalf("RunProbe returned err: %v", err)
+	}
+
+	unix := int(start.Unix())
+	wantFirst := map[string]interface{}{
+		"type":            server.ProbeMessageType,
+		"time_received":   unix + 2,
+		"sequence_num":    1,
+		"sampling_rate":   1,
+		"sampler_address": "0.0.0.0",
+		"time_flow_start": unix,
+		"time_flow_end":   unix + 2,
+		"bytes":           120,
+		"packets":         3,
+		"src_addr":        "10.0.0.1",
+		"dst_addr":        "10.0.0.2",
+		"ethernet_type":   0x0800,
+		"proto":           6,
+		"src_port":        50000,
+		"dst_port":        80,
+		"in_interface":    0,
+		"out_interface":   0,
+		"src_mac":         "00:00:00:00:00:00",
+		"dst_mac":         "00:00:00:00:00:00",
+		"src_vlan":        0,
+		"dst_vlan":        0,
+		"vlan_id":         0,
+		"ip_tos":          0,
+		"ip_ttl":          64,
+		"tcp_flags":       0x13,
+		"icmp_types":      0,
+		"icmp_code":       0,
+		"ipv6_flow_label": 0,
+		"fragment_id":     0,
+		"fragment_offset": 0,
+		"src_net":         0,
+		"dst_net":         0,
+	}
+	if len(transport.msgs) == 0 {
+		t.Fatal("expected messages, got none")
+	}
+	if diff := cmp.Diff(wantFirst, transport.msgs[0]); diff != "" {
+		t.Errorf("first message mismatch (-want +got):\n%s", diff)
+	}
+
+	type flow struct {
+		DstPort int
+		Packets int
+		Start   int
+		End     int
+	}
+	want := []flow{
+		// Ended by FIN
+		{DstPort: 80, Packets: 3, Start: unix, End: unix + 2},
+		// Inactive timeouts, the second one at the same scan as the active
+		// timeout below.
+		{DstPort: 53, Packets: 1, Start: unix, End: unix},
+		{DstPort: 53, Packets: 1, Start: unix + 30, End: unix + 30},
+		// Active timeout
+		{DstPort: 123, Packets: 6, Start: unix, End: unix + 50},
+		// Flushed at the end of the file
+		{DstPort: 123, Packets: 2, Start: unix + 60, End: unix + 70},
+	}
+	var got []flow
+	for _, msg := range transport.msgs {
+		got = append(got, flow{
+			DstPort: msg["dst_port"].(int),
+			Packets: msg["packets"].(int),
+			Start:   msg["time_flow_start"].(int),
+			End:     msg["time_flow_end"].(int),
+		})
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("flows mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	MetricRelayDatagrams = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relay_datagrams",
+			Help: "Number of datagrams handled by the relay for each target",
+		},
+		[]string{"type", "target", "status"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(MetricRelayDatagrams)
+}
+
+const (
+	RelayStatusSent       = "sent"
+	RelayStatusFiltered   = "filtered"
+	RelayStatusSampledOut = "sampled_out"
+	RelayStatusDropped    = "dropped"
+	RelayStatusError      = "error"
+)
+
+type RelayTargetConfig struct {
+	// host:port of the downstream collector.
+	Addr string `yaml:"addr"`
+	// Send datagrams with the original exporter address as the source address
+	// instead of our own. Requires CAP_NET_RAW and is only supported for IPv4
+	// on Linux.
+	Spoof bool `yaml:"spoof"`
+	// Forward only 1 out of every SampleRate datagrams.
+	SampleRate int `yaml:"sample_rate"`
+	// Number of datagrams to buffer for this target before dropping.
+	QueueSize int `yaml:"queue_size"`
+
+	DatagramFilterConfig `yaml:",inline"`
+}
+
+type relayDatagram struct {
+	src     netip.AddrPort
+	payload []byte
+}
+
+type relaySender interface {
+	Send(src netip.AddrPort, payload []byte) error
+	Close() error
+}
+
+type udpRelaySender struct {
+	conn *net.UDPConn
+}
+
+func (s *udpRelaySender) Send(_ netip.AddrPort, payload []byte) error {
+	_, err := s.conn.Write(payload)
+	return err
+}
+
+func (s *udpRelaySender) Close() error {
+	return s.conn.Close()
+}
+
+// RelayTarget forwards raw datagrams to a single downstream collector. Sends
+// happen on a dedicated goroutine so a slow or unreachable target can't hold
+// up the listener.
+type RelayTarget struct {
+	Config   *RelayTargetConfig
+	listener string
+	filter   *DatagramFilter
+	sender   relaySender
+	queue    chan relayDatagram
+	counter  int
+}
+
+func NewRelayTarget(config *RelayTargetConfig, listener string) (*RelayTarget, error) {
+	if config.SampleRate <= 0 {
+		config.SampleRate = 1
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1024
+	}
+	filter, err := NewDatagramFilter(&config.DatagramFilterConfig)
+	if err != nil {
+		return nil, fmt.Errorf("NewRelayTarget: %s: %w", config.Addr, err)
+	}
+	dst, err := net.ResolveUDPAddr("udp", config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("NewRelayTarget: error resolving %s: %w", config.Addr, err)
+	}
+	var sender relaySender
+	if config.Spoof {
+		sender, err = newSpoofRelaySender(dst.AddrPort())
+	} else {
+		var conn *net.UDPConn
+		conn, err = net.DialUDP("udp", nil, dst)
+		sender = &udpRelaySender{conn: conn}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("NewRelayTarget: %s: %w", config.Addr, err)
+	}
+	t := &RelayTarget{
+		Config:   config,
+		listener: listener,
+		filter:   filter,
+		sender:   sender,
+		queue:    make(chan relayDatagram, config.QueueSize),
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *RelayTarget) inc(status string) {
+	MetricRelayDatagrams.With(prometheus.Labels{
+		"type":   listenerMetricNames[t.listener],
+		"target": t.Config.Addr,
+		"status": status,
+	}).Inc()
+}
+
+// Forward queues a datagram to be sent to the target if it passes the
+// target's filters and sampling. It never blocks. Forward is not safe for
+// concurrent use.
+func (t *RelayTarget) Forward(src netip.AddrPort, recvTime time.Time, payload []byte) {
+	if !t.filter.IsNoop() {
+		if ok, _ := t.filter.Allow(src.Addr(), recvTime); !ok {
+			t.inc(RelayStatusFiltered)
+			return
+		}
+	}
+	t.counter++
+	if t.counter < t.Config.SampleRate {
+		t.inc(RelayStatusSampledOut)
+		return
+	}
+	t.counter = 0
+	select {
+	case t.queue <- relayDatagram{src: src, payload: payload}:
+	default:
+		t.inc(RelayStatusDropped)
+	}
+}
+
+func (t *RelayTarget) run() {
+	for d := range t.queue {
+		if err := t.sender.Send(d.src, d.payload); err != nil {
+			t.inc(RelayStatusError)
+			continue
+		}
+		t.inc(RelayStatusSent)
+	}
+	t.sender.Close()
+}
+
+func (t *RelayTarget) Close() {
+	close(t.queue)
+}
@@ -0,0 +1,83 @@
+//go:build linux
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"syscall"
+)
+
+var errSpoofIPv6 = errors.New("spoofed relay only supports IPv4")
+
+// Sends datagrams over a raw socket with a hand-built IPv4 and UDP header so
+// the original exporter address can be used as the source.
+type spoofRelaySender struct {
+	fd  int
+	dst netip.AddrPort
+	mu  sync.Mutex
+	id  uint16
+}
+
+func newSpoofRelaySender(dst netip.AddrPort) (relaySender, error) {
+	if !dst.Addr().Unmap().Is4() {
+		return nil, errSpoofIPv6
+	}
+	// IPPROTO_RAW implies IP_HDRINCL.
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return nil, err
+	}
+	return &spoofRelaySender{
+		fd:  fd,
+		dst: netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port()),
+	}, nil
+}
+
+func ipv4HeaderChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func (s *spoofRelaySender) Send(src netip.AddrPort, payload []byte) error {
+	srcAddr := src.Addr().Unmap()
+	if !srcAddr.Is4() {
+		return errSpoofIPv6
+	}
+	s.mu.Lock()
+	s.id++
+	id := s.id
+	s.mu.Unlock()
+
+	pkt := make([]byte, 28+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[4:6], id)
+	pkt[8] = 64
+	pkt[9] = syscall.IPPROTO_UDP
+	src4 := srcAddr.As4()
+	dst4 := s.dst.Addr().As4()
+	copy(pkt[12:16], src4[:])
+	copy(pkt[16:20], dst4[:])
+	binary.BigEndian.PutUint16(pkt[10:12], ipv4HeaderChecksum(pkt[0:20]))
+
+	// UDP checksum is optional for IPv4 so it's left as zero.
+	binary.BigEndian.PutUint16(pkt[20:22], src.Port())
+	binary.BigEndian.PutUint16(pkt[22:24], s.dst.Port())
+	binary.BigEndian.PutUint16(pkt[24:26], uint16(8+len(payload)))
+	copy(pkt[28:], payload)
+
+	return syscall.Sendto(s.fd, pkt, 0, &syscall.SockaddrInet4{Addr: dst4})
+}
+
+func (s *spoofRelaySender) Close() error {
+	return syscall.Close(s.fd)
+}
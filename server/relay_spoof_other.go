@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net/netip"
+)
+
+func newSpoofRelaySender(dst netip.AddrPort) (relaySender, error) {
+	return nil, errors.New("spoofed relay is only supported on Linux")
+}
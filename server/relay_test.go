@@ -0,0 +1,101 @@
+package server_test
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/sapslaj/morbius/server"
+)
+
+func TestRelayTarget(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		config       server.RelayTargetConfig
+		srcs         []string
+		want         []string
+		wantFiltered float64
+	}
+
+	tests := map[string]test{
+		"forwards every datagram by default": {
+			srcs: []string{"192.0.2.1:1", "192.0.2.2:2", "192.0.2.3:3"},
+			want: []string{"192.0.2.1:1", "192.0.2.2:2", "192.0.2.3:3"},
+		},
+		"forwards one in sample_rate datagrams": {
+			config: server.RelayTargetConfig{SampleRate: 2},
+			srcs:   []string{"192.0.2.1:1", "192.0.2.2:2", "192.0.2.3:3", "192.0.2.4:4"},
+			want:   []string{"192.0.2.2:2", "192.0.2.4:4"},
+		},
+		"only forwards datagrams from allowed exporters": {
+			config: server.RelayTargetConfig{
+				DatagramFilterConfig: server.DatagramFilterConfig{
+					AllowCIDRs: []string{"192.0.2.2"},
+				},
+			},
+			srcs:         []string{"192.0.2.1:1", "192.0.2.2:2", "192.0.2.3:3"},
+			want:         []string{"192.0.2.2:2"},
+			wantFiltered: 2,
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			config := tc.config
+			config.Addr = conn.LocalAddr().String()
+			target, err := server.NewRelayTarget(&config, server.ListenerSFlow)
+			if err != nil {
+				t.Fatalf("NewRelayTarget returned err: %v", err)
+			}
+			defer target.Close()
+
+			for _, src := range tc.srcs {
+				// The payload is the exporter address so we can tell which
+				// datagrams made it through.
+				target.Forward(netip.MustParseAddrPort(src), time.Now(), []byte(src))
+			}
+
+			buf := make([]byte, 1500)
+			var got []string
+			for range tc.want {
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				n, err := conn.Read(buf)
+				if err != nil {
+					t.Fatalf("\"%s\": error reading relayed datagram: %v", name, err)
+				}
+				got = append(got, string(buf[:n]))
+			}
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if n, err := conn.Read(buf); err == nil {
+				t.Errorf("\"%s\": unexpected extra datagram %q", name, buf[:n])
+			}
+			for i := range tc.want {
+				if got[i] != tc.want[i] {
+					t.Errorf("\"%s\": datagram %d: got %q, want %q", name, i, got[i], tc.want[i])
+				}
+			}
+			// Labelled with the listener metric name like the traffic metrics.
+			filtered := testutil.ToFloat64(server.MetricRelayDatagrams.With(prometheus.Labels{
+				"type":   "sFlow",
+				"target": config.Addr,
+				"status": server.RelayStatusFiltered,
+			}))
+			if filtered != tc.wantFiltered {
+				t.Errorf("\"%s\": expected %v filtered datagrams, got %v", name, tc.wantFiltered, filtered)
+			}
+		})
+	}
+}
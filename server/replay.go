@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	decoder "github.com/cloudflare/goflow/v3/decoders"
+	"github.com/cloudflare/goflow/v3/utils"
+
+	"github.com/sapslaj/morbius/capture"
+)
+
+type ReplayOptions struct {
+	// Playback speed relative to the original capture. 1 is real-time, 10 is
+	// ten times faster, and 0 plays back as fast as possible.
+	Speed float64
+	// Listener to decode datagrams with. Capture files written by morbius
+	// record this already, so this is only required for pcap files where the
+	// destination port doesn't match one of the configured listener ports.
+	Listener string
+}
+
+type ReplayStats struct {
+	Datagrams int
+	Errors    int
+	Skipped   int
+}
+
+type replaySource interface {
+	next() (capture.Datagram, string, error)
+}
+
+type captureReplaySource struct {
+	r        *capture.Reader
+	listener string
+}
+
+func (rs *captureReplaySource) next() (capture.Datagram, string, error) {
+	d, err := rs.r.Next()
+	return d, rs.listener, err
+}
+
+type pcapReplaySource struct {
+	r        *capture.PcapReader
+	s        *Server
+	listener string
+}
+
+func (rs *pcapReplaySource) next() (capture.Datagram, string, error) {
+	d, dstPort, err := rs.r.NextUDP()
+	if err != nil || rs.listener != "" {
+		return d, rs.listener, err
+	}
+	for _, listener := range []string{ListenerNetFlowV5, ListenerNetFlowV9, ListenerSFlow} {
+		if rs.s.ListenerConfig(listener).Port == int(dstPort) {
+			return d, listener, nil
+		}
+	}
+	return d, "", nil
+}
+
+func (s *Server) openReplaySource(f *os.File, opts ReplayOptions) (replaySource, error) {
+	cr, err := capture.NewReader(f)
+	if err == nil {
+		listener := cr.Listener
+		if opts.Listener != "" {
+			listener = opts.Listener
+		}
+		return &captureReplaySource{r: cr, listener: listener}, nil
+	}
+	if !errors.Is(err, capture.ErrNotCaptureFile) {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	pr, err := capture.NewPcapReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither a morbius capture nor a pcap file", f.Name())
+	}
+	return &pcapReplaySource{r: pr, s: s, listener: opts.Listener}, nil
+}
+
+// Replay feeds the datagrams in a morbius capture or pcap file through the
+// decoders and into the configured transport.
+func (s *Server) Replay(path string, opts ReplayOptions) (ReplayStats, error) {
+	var stats ReplayStats
+
+	if opts.Listener != "" {
+		if _, ok := listenerMetricNames[opts.Listener]; !ok {
+			return stats, fmt.Errorf("Replay: unknown listener `%s`", opts.Listener)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return stats, fmt.Errorf("Replay: error opening %s: %w", path, err)
+	}
+	defer f.Close()
+
+	source, err := s.openReplaySource(f, opts)
+	if err != nil {
+		return stats, fmt.Errorf("Replay: %w", err)
+	}
+
+	ecb := utils.DefaultErrorCallback{
+		Logger: s.Config.Logger,
+	}
+	decodeFuncs := make(map[string]decoder.DecoderFunc)
+
+	var firstRecv time.Time
+	start := time.Now()
+	for {
+		d, listener, err := source.next()
+		if errors.Is(err, io.EOF) {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, fmt.Errorf("Replay: %w", err)
+		}
+		if listener == "" {
+			stats.Skipped++
+			continue
+		}
+
+		if opts.Speed > 0 {
+			if firstRecv.IsZero() {
+				firstRecv = d.RecvTime
+			}
+			offset := time.Duration(float64(d.RecvTime.Sub(firstRecv)) / opts.Speed)
+			if wait := time.Until(start.Add(offset)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		decodeFunc, ok := decodeFuncs[listener]
+		if !ok {
+			decodeFunc, err = s.newDecodeFunc(listener)
+			if err != nil {
+				return stats, fmt.Errorf("Replay: %w", err)
+			}
+			decodeFuncs[listener] = decodeFunc
+		}
+
+		stats.Datagrams++
+		decodeStart := time.Now()
+		err = decodeFunc(utils.BaseMessage{
+			Src:      addrPortIP(d.Src),
+			Port:     int(d.Src.Port()),
+			Payload:  d.Payload,
+			SetTime:  true,
+			RecvTime: d.RecvTime,
+		})
+		if err != nil {
+			stats.Errors++
+			ecb.Callback(listenerMetricNames[listener], 0, decodeStart, time.Now(), err)
+		}
+	}
+}
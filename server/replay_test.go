@@ -0,0 +1,113 @@
+package server_test
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	goflowpb "github.com/cloudflare/goflow/v3/pb"
+
+	"github.com/sapslaj/morbius/capture"
+	"github.com/sapslaj/morbius/server"
+)
+
+type recordingTransport struct {
+	mu     sync.Mutex
+	flows  []*goflowpb.FlowMessage
+	fields []map[string]interface{}
+	msgs   []map[string]interface{}
+}
+
+func (t *recordingTransport) Publish(fmsgs []*goflowpb.FlowMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flows = append(t.flows, fmsgs...)
+}
+
+func (t *recordingTransport) PublishWithFields(fmsgs []*goflowpb.FlowMessage, fields []map[string]interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flows = append(t.flows, fmsgs...)
+	t.fields = append(t.fields, fields...)
+}
+
+func (t *recordingTransport) PublishMessage(msg map[string]interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.msgs = append(t.msgs, msg)
+}
+
+func netflowV5Datagram(src, dst netip.Addr, srcPort, dstPort uint16, proto uint8) []byte {
+	b := make([]byte, 24+48)
+	binary.BigEndian.PutUint16(b[0:2], 5)
+	binary.BigEndian.PutUint16(b[2:4], 1)
+	binary.BigEndian.PutUint32(b[4:8], 1000)
+	binary.BigEndian.PutUint32(b[8:12], 1666000000)
+	r := b[24:]
+	copy(r[0:4], src.AsSlice())
+	copy(r[4:8], dst.AsSlice())
+	binary.BigEndian.PutUint32(r[16:20], 10)
+	binary.BigEndian.PutUint32(r[20:24], 1500)
+	binary.BigEndian.PutUint16(r[32:34], srcPort)
+	binary.BigEndian.PutUint16(r[34:36], dstPort)
+	r[38] = proto
+	return b
+}
+
+func TestServer_Replay(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "v5.cap")
+	w, err := capture.NewWriter(&capture.WriterConfig{Path: path}, server.ListenerNetFlowV5)
+	if err != nil {
+		t.Fatalf("NewWriter returned err: %v", err)
+	}
+	recvTime := time.Unix(1666000000, 0)
+	for i := 0; i < 3; i++ {
+		err := w.Write(capture.Datagram{
+			Src:      netip.MustParseAddrPort("192.0.2.1:50000"),
+			RecvTime: recvTime.Add(time.Duration(i) * time.Millisecond),
+			Payload:  netflowV5Datagram(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), 1234, 443, 6),
+		})
+		if err != nil {
+			t.Fatalf("Write returned err: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &recordingTransport{}
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{}, transport, nil)
+	stats, err := s.Replay(path, server.ReplayOptions{Speed: 0})
+	if err != nil {
+		t.Fatalf("Replay returned err: %v", err)
+	}
+	if stats.Datagrams != 3 || stats.Errors != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if len(transport.flows) != 3 {
+		t.Fatalf("expected 3 flows, got %d", len(transport.flows))
+	}
+	fmsg := transport.flows[0]
+	if net.IP(fmsg.SrcAddr).String() != "10.0.0.1" || fmsg.DstPort != 443 || fmsg.Bytes != 1500 {
+		t.Errorf("unexpected flow %+v", fmsg)
+	}
+	if net.IP(fmsg.SamplerAddress).String() != "192.0.2.1" {
+		t.Errorf("expected sampler address from capture, got %s", net.IP(fmsg.SamplerAddress))
+	}
+	if fmsg.TimeReceived != uint64(recvTime.Unix()) {
+		t.Errorf("expected time received from capture, got %d", fmsg.TimeReceived)
+	}
+}
+
+func TestServer_Replay_UnknownListener(t *testing.T) {
+	t.Parallel()
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{}, &recordingTransport{}, nil)
+	if _, err := s.Replay("/nonexistent", server.ReplayOptions{Listener: "bogus"}); err == nil {
+		t.Fatal("expected error for unknown listener")
+	}
+}
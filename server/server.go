@@ -4,18 +4,38 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
+	decoder "github.com/cloudflare/goflow/v3/decoders"
 	"github.com/cloudflare/goflow/v3/utils"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/sapslaj/morbius/capture"
+	"github.com/sapslaj/morbius/enricher"
+	"github.com/sapslaj/morbius/passivedns"
 	"github.com/sapslaj/morbius/transport"
 )
 
 type ServerPortConfig struct {
-	Enable    bool   `yaml:"enable"`
-	Port      int    `yaml:"port"`
-	Addr      string `yaml:"addr"`
-	Workers   int    `yaml:"workers"`
-	ReusePort bool   `yaml:"reuse_port"`
+	Enable    bool                  `yaml:"enable"`
+	Port      int                   `yaml:"port"`
+	Addr      string                `yaml:"addr"`
+	Workers   int                   `yaml:"workers"`
+	ReusePort bool                  `yaml:"reuse_port"`
+	Capture   *capture.WriterConfig `yaml:"capture"`
+	Relay     []*RelayTargetConfig  `yaml:"relay"`
+	// Only used by the netflowv9 listener.
+	Templates *NetFlowTemplateStoreConfig `yaml:"templates"`
+	Fields    []*NetFlowFieldConfig       `yaml:"fields"`
+	// Only used by the sflow listener.
+	Counters *SFlowCountersConfig `yaml:"counters"`
+	L7       *SFlowL7Config       `yaml:"l7"`
+	// Only used by the http and grpc listeners.
+	Ingest *IngestConfig `yaml:"ingest"`
+	// Only used by the http listener.
+	Admin *AdminConfig `yaml:"admin"`
+
+	DatagramFilterConfig `yaml:",inline"`
 }
 
 func mergeDefaultServerPortConfig(in *ServerPortConfig, port int) *ServerPortConfig {
@@ -34,18 +54,50 @@ func mergeDefaultServerPortConfig(in *ServerPortConfig, port int) *ServerPortCon
 	return in
 }
 
+// Listener names as used in the config file. These are also recorded in
+// capture files so replays know which decoder to use.
+const (
+	ListenerNetFlowV5 = "netflowv5"
+	ListenerNetFlowV9 = "netflowv9"
+	ListenerSFlow     = "sflow"
+)
+
+// Names goflow uses for each listener in its metrics.
+var listenerMetricNames = map[string]string{
+	ListenerNetFlowV5: "NetFlowV5",
+	ListenerNetFlowV9: "NetFlow",
+	ListenerSFlow:     "sFlow",
+}
+
 type ServerConfig struct {
-	Transport    Transport
-	Logger       Logger
-	NetFlowV5    *ServerPortConfig `yaml:"netflowv5"`
-	NetFlowV9    *ServerPortConfig `yaml:"netflowv9"`
-	SFlow        *ServerPortConfig `yaml:"sflow"`
-	HTTP         *ServerPortConfig `yaml:"http"`
-	NoFunAllowed bool              `yaml:"no_fun_allowed"`
+	Transport Transport
+	Logger    Logger
+	// Enricher caches by name, saved on Close and served under /caches.
+	Caches map[string]enricher.Cache `yaml:"-"`
+	// Load the saved NetFlow templates and passive DNS table but never save
+	// them, so replaying next to a running collector with the same config
+	// doesn't overwrite its files.
+	ReadOnlyState bool `yaml:"-"`
+	// Shared with the passive_dns enricher. Created with defaults if the sflow
+	// listener has l7.passive_dns enabled and this isn't set.
+	PassiveDNS   *passivedns.Table  `yaml:"-"`
+	NetFlowV5    *ServerPortConfig  `yaml:"netflowv5"`
+	NetFlowV9    *ServerPortConfig  `yaml:"netflowv9"`
+	SFlow        *ServerPortConfig  `yaml:"sflow"`
+	HTTP         *ServerPortConfig  `yaml:"http"`
+	GRPC         *ServerPortConfig  `yaml:"grpc"`
+	Probe        *ProbeConfig       `yaml:"probe"`
+	Conntrack    *ConntrackConfig   `yaml:"conntrack"`
+	NDJSON       *NDJSONConfig      `yaml:"ndjson"`
+	VPCFlowLogs  *VPCFlowLogsConfig `yaml:"vpc_flow_logs"`
+	Zeek         *ZeekConfig        `yaml:"zeek"`
+	Kafka        *KafkaConfig       `yaml:"kafka"`
+	NoFunAllowed bool               `yaml:"no_fun_allowed"`
 }
 
 type Server struct {
-	Config *ServerConfig
+	Config           *ServerConfig
+	NetFlowTemplates *NetFlowTemplateStore
 }
 
 func NewServerWithTransportAndLogger(config ServerConfig, transport Transport, logger Logger) *Server {
@@ -59,17 +111,65 @@ func NewServer(config ServerConfig) *Server {
 	config.NetFlowV9 = mergeDefaultServerPortConfig(config.NetFlowV9, 2056)
 	config.SFlow = mergeDefaultServerPortConfig(config.SFlow, 6343)
 	config.HTTP = mergeDefaultServerPortConfig(config.HTTP, 6060)
+	config.GRPC = mergeDefaultServerPortConfig(config.GRPC, 6061)
+	config.Probe = mergeDefaultProbeConfig(config.Probe)
+	config.Conntrack = mergeDefaultConntrackConfig(config.Conntrack)
+	config.NDJSON = mergeDefaultNDJSONConfig(config.NDJSON)
+	config.VPCFlowLogs = mergeDefaultVPCFlowLogsConfig(config.VPCFlowLogs)
+	config.Zeek = mergeDefaultZeekConfig(config.Zeek)
+	config.Kafka = mergeDefaultKafkaConfig(config.Kafka)
 	if config.Logger == nil {
 		config.Logger = &transport.StderrLogger{}
 	}
+	if config.PassiveDNS == nil && config.SFlow.L7 != nil && config.SFlow.L7.PassiveDNS {
+		config.PassiveDNS = passivedns.NewTable(nil)
+	}
 	s := &Server{
-		Config: &config,
+		Config:           &config,
+		NetFlowTemplates: NewNetFlowTemplateStore(config.NetFlowV9.Templates),
+	}
+	// A bad template file shouldn't stop the collector from starting; the
+	// templates will be relearned from the exporters.
+	if err := s.NetFlowTemplates.Load(); err != nil {
+		config.Logger.Errorf("error loading NetFlow templates: %v", err)
+	}
+	if config.PassiveDNS != nil {
+		if err := config.PassiveDNS.Load(); err != nil {
+			config.Logger.Errorf("error loading passive DNS table: %v", err)
+		}
 	}
 	return s
 }
 
+// Close saves NetFlow templates, the passive DNS table, and the enricher
+// caches and flushes the transport if it supports it.
+func (s *Server) Close() error {
+	if !s.Config.ReadOnlyState {
+		if err := s.NetFlowTemplates.Save(); err != nil {
+			s.Config.Logger.Errorf("error saving NetFlow templates: %v", err)
+		}
+		if s.Config.PassiveDNS != nil {
+			if err := s.Config.PassiveDNS.Save(); err != nil {
+				s.Config.Logger.Errorf("error saving passive DNS table: %v", err)
+			}
+		}
+	}
+	for name, cache := range s.Config.Caches {
+		if err := cache.CloseCache(); err != nil {
+			s.Config.Logger.Errorf("error saving %s cache: %v", name, err)
+		}
+	}
+	if closer, ok := s.Config.Transport.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 func (s *Server) IsRunnable() bool {
-	if s.Config.NetFlowV5.Enable || s.Config.NetFlowV9.Enable || s.Config.SFlow.Enable {
+	if s.Config.NetFlowV5.Enable || s.Config.NetFlowV9.Enable || s.Config.SFlow.Enable || s.Config.Probe.Enable || s.Config.Conntrack.Enable || s.Config.NDJSON.Enable || s.Config.VPCFlowLogs.Enable || s.Config.Zeek.Enable {
+		return true
+	}
+	if s.Config.Kafka.Enable || s.Config.GRPC.Enable || (s.Config.HTTP.Enable && s.Config.HTTP.Ingest != nil && s.Config.HTTP.Ingest.Enable) {
 		return true
 	}
 	return false
@@ -78,6 +178,10 @@ func (s *Server) IsRunnable() bool {
 func (s *Server) RunAll() {
 	var wg sync.WaitGroup
 
+	if s.Config.PassiveDNS != nil {
+		go s.runPassiveDNSSaver()
+	}
+
 	if s.Config.NetFlowV5.Enable {
 		wg.Add(1)
 		go func() {
@@ -102,6 +206,22 @@ func (s *Server) RunAll() {
 		}()
 	}
 
+	if s.Config.Conntrack.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Config.Logger.Fatal(s.RunConntrack())
+		}()
+	}
+
+	if s.Config.Kafka.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Config.Logger.Fatal(s.RunKafka())
+		}()
+	}
+
 	if s.Config.HTTP.Enable {
 		wg.Add(1)
 		go func() {
@@ -110,51 +230,152 @@ func (s *Server) RunAll() {
 		}()
 	}
 
+	if s.Config.GRPC.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Config.Logger.Fatal(s.RunGRPC())
+		}()
+	}
+
+	if s.Config.Probe.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.RunProbe(); err != nil {
+				s.Config.Logger.Fatal(err)
+			}
+		}()
+	}
+
+	if s.Config.NDJSON.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.RunNDJSON(); err != nil {
+				s.Config.Logger.Fatal(err)
+			}
+		}()
+	}
+
+	if s.Config.VPCFlowLogs.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.RunVPCFlowLogs(); err != nil {
+				s.Config.Logger.Fatal(err)
+			}
+		}()
+	}
+
+	if s.Config.Zeek.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.RunZeek(); err != nil {
+				s.Config.Logger.Fatal(err)
+			}
+		}()
+	}
+
 	wg.Wait()
+	// The only things that return without an error are inputs reading a file
+	// to the end, so at this point they were the only things running.
+	if s.Config.Probe.Enable || s.Config.NDJSON.Enable || s.Config.VPCFlowLogs.Enable || s.Config.Zeek.Enable {
+		if err := s.Close(); err != nil {
+			s.Config.Logger.Errorf("error closing server: %v", err)
+		}
+		return
+	}
 	panic("fuck this shouldn't happen")
 }
 
+func (s *Server) ListenerConfig(listener string) *ServerPortConfig {
+	switch listener {
+	case ListenerNetFlowV5:
+		return s.Config.NetFlowV5
+	case ListenerNetFlowV9:
+		return s.Config.NetFlowV9
+	case ListenerSFlow:
+		return s.Config.SFlow
+	}
+	return nil
+}
+
+func (s *Server) newDecodeFunc(listener string) (decoder.DecoderFunc, error) {
+	switch listener {
+	case ListenerNetFlowV5:
+		state := &utils.StateNFLegacy{
+			Transport: s.Config.Transport,
+			Logger:    s.Config.Logger,
+		}
+		return state.DecodeFlow, nil
+	case ListenerNetFlowV9:
+		state, err := newNetFlowState(s.Config.Transport, s.NetFlowTemplates, s.Config.NetFlowV9.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("netflow_v9: %w", err)
+		}
+		return state.DecodeFlow, nil
+	case ListenerSFlow:
+		state := newSFlowState(s.Config.Transport, s.Config.SFlow.Counters, s.Config.SFlow.L7, s.Config.PassiveDNS)
+		return state.DecodeFlow, nil
+	}
+	return nil, fmt.Errorf("unknown listener `%s`", listener)
+}
+
 func (s *Server) RunNetFlowV5() error {
-	state := utils.StateNFLegacy{
-		Transport: s.Config.Transport,
-		Logger:    s.Config.Logger,
-	}
-	return state.FlowRoutine(
-		s.Config.NetFlowV5.Workers,
-		s.Config.NetFlowV5.Addr,
-		s.Config.NetFlowV5.Port,
-		s.Config.NetFlowV5.ReusePort,
-	)
+	decodeFunc, err := s.newDecodeFunc(ListenerNetFlowV5)
+	if err != nil {
+		return err
+	}
+	return s.listenUDP(ListenerNetFlowV5, s.Config.NetFlowV5, decodeFunc)
 }
 
 func (s *Server) RunNetFlowV9() error {
-	state := utils.StateNetFlow{
-		Transport: s.Config.Transport,
-		Logger:    s.Config.Logger,
-	}
-	return state.FlowRoutine(
-		s.Config.NetFlowV9.Workers,
-		s.Config.NetFlowV9.Addr,
-		s.Config.NetFlowV9.Port,
-		s.Config.NetFlowV9.ReusePort,
-	)
+	decodeFunc, err := s.newDecodeFunc(ListenerNetFlowV9)
+	if err != nil {
+		return err
+	}
+	go s.NetFlowTemplates.runSaver(s.Config.Logger)
+	return s.listenUDP(ListenerNetFlowV9, s.Config.NetFlowV9, decodeFunc)
 }
 
 func (s *Server) RunSFlow() error {
-	state := utils.StateSFlow{
-		Transport: s.Config.Transport,
-		Logger:    s.Config.Logger,
-	}
-	return state.FlowRoutine(
-		s.Config.SFlow.Workers,
-		s.Config.SFlow.Addr,
-		s.Config.SFlow.Port,
-		s.Config.SFlow.ReusePort,
-	)
+	decodeFunc, err := s.newDecodeFunc(ListenerSFlow)
+	if err != nil {
+		return err
+	}
+	return s.listenUDP(ListenerSFlow, s.Config.SFlow, decodeFunc)
+}
+
+func (s *Server) runPassiveDNSSaver() {
+	table := s.Config.PassiveDNS
+	if table.Config.Path == "" {
+		return
+	}
+	for range time.Tick(table.Config.SaveInterval) {
+		if err := table.Save(); err != nil {
+			s.Config.Logger.Errorf("error saving passive DNS table: %v", err)
+		}
+	}
 }
 
 func (s *Server) RunHTTP() error {
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/templates", s.NetFlowTemplates)
+	caches, err := CachesHandler(s.Config.Caches, s.Config.HTTP.Admin)
+	if err != nil {
+		return err
+	}
+	http.Handle("/caches", caches)
+	http.Handle("/caches/", caches)
+	if s.Config.HTTP.Ingest != nil && s.Config.HTTP.Ingest.Enable {
+		ingest, err := s.IngestHandler(s.Config.HTTP.Ingest)
+		if err != nil {
+			return err
+		}
+		http.Handle("/ingest", ingest)
+	}
 	return http.ListenAndServe(
 		fmt.Sprintf("%s:%d", s.Config.HTTP.Addr, s.Config.HTTP.Port),
 		nil,
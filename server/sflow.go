@@ -0,0 +1,372 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/goflow/v3/decoders/sflow"
+	goflowpb "github.com/cloudflare/goflow/v3/pb"
+	"github.com/cloudflare/goflow/v3/producer"
+	"github.com/cloudflare/goflow/v3/utils"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapslaj/morbius/passivedns"
+)
+
+// Message type for sFlow interface counters. Flow messages use the goflow
+// FlowMessage type names instead.
+const SFlowCounterMessageType = "SFLOW_5_COUNTER"
+
+type SFlowCountersConfig struct {
+	// Also publish each interface counter record as a message to the
+	// destinations.
+	EmitMessages bool `yaml:"emit_messages"`
+	// Interfaces that haven't been reported for this long are removed from
+	// the metrics. Default is 10 minutes.
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+type sflowCounterKey struct {
+	agent   string
+	ifIndex uint32
+}
+
+type sflowCounterEntry struct {
+	counters sflow.IfCounters
+	lastSeen time.Time
+}
+
+var (
+	sflowCounterLabels = []string{"agent", "if_index"}
+
+	descSFlowIfInOctets = prometheus.NewDesc(
+		"sflow_if_in_octets",
+		"Octets received on the interface as reported by sFlow counter samples",
+		sflowCounterLabels, nil,
+	)
+	descSFlowIfOutOctets = prometheus.NewDesc(
+		"sflow_if_out_octets",
+		"Octets sent on the interface as reported by sFlow counter samples",
+		sflowCounterLabels, nil,
+	)
+	descSFlowIfInPackets = prometheus.NewDesc(
+		"sflow_if_in_packets",
+		"Packets received on the interface as reported by sFlow counter samples",
+		append(sflowCounterLabels, "cast"), nil,
+	)
+	descSFlowIfOutPackets = prometheus.NewDesc(
+		"sflow_if_out_packets",
+		"Packets sent on the interface as reported by sFlow counter samples",
+		append(sflowCounterLabels, "cast"), nil,
+	)
+	descSFlowIfInErrors = prometheus.NewDesc(
+		"sflow_if_in_errors",
+		"Inbound errors on the interface as reported by sFlow counter samples",
+		sflowCounterLabels, nil,
+	)
+	descSFlowIfOutErrors = prometheus.NewDesc(
+		"sflow_if_out_errors",
+		"Outbound errors on the interface as reported by sFlow counter samples",
+		sflowCounterLabels, nil,
+	)
+	descSFlowIfInDiscards = prometheus.NewDesc(
+		"sflow_if_in_discards",
+		"Inbound discards on the interface as reported by sFlow counter samples",
+		sflowCounterLabels, nil,
+	)
+	descSFlowIfOutDiscards = prometheus.NewDesc(
+		"sflow_if_out_discards",
+		"Outbound discards on the interface as reported by sFlow counter samples",
+		sflowCounterLabels, nil,
+	)
+	descSFlowIfSpeed = prometheus.NewDesc(
+		"sflow_if_speed_bits",
+		"Interface speed in bits per second as reported by sFlow counter samples",
+		sflowCounterLabels, nil,
+	)
+	descSFlowIfAdminStatus = prometheus.NewDesc(
+		"sflow_if_admin_up",
+		"1 if the interface is administratively up as reported by sFlow counter samples",
+		sflowCounterLabels, nil,
+	)
+	descSFlowIfOperStatus = prometheus.NewDesc(
+		"sflow_if_oper_up",
+		"1 if the interface is operationally up as reported by sFlow counter samples",
+		sflowCounterLabels, nil,
+	)
+
+	// Latest interface counters for each agent and ifIndex.
+	SFlowInterfaceCounters = &sflowCounterCollector{
+		entries: make(map[sflowCounterKey]*sflowCounterEntry),
+		expiry:  10 * time.Minute,
+	}
+)
+
+func init() {
+	prometheus.MustRegister(SFlowInterfaceCounters)
+}
+
+// sflowCounterCollector exposes the counters reported by agents as-is rather
+// than tracking them with prometheus.Counter since the agent is the one doing
+// the counting.
+type sflowCounterCollector struct {
+	mu      sync.Mutex
+	entries map[sflowCounterKey]*sflowCounterEntry
+	expiry  time.Duration
+}
+
+func (c *sflowCounterCollector) setExpiry(expiry time.Duration) {
+	c.mu.Lock()
+	c.expiry = expiry
+	c.mu.Unlock()
+}
+
+func (c *sflowCounterCollector) update(agent string, counters sflow.IfCounters) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[sflowCounterKey{agent, counters.IfIndex}] = &sflowCounterEntry{
+		counters: counters,
+		lastSeen: time.Now(),
+	}
+}
+
+func (c *sflowCounterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descSFlowIfInOctets
+	ch <- descSFlowIfOutOctets
+	ch <- descSFlowIfInPackets
+	ch <- descSFlowIfOutPackets
+	ch <- descSFlowIfInErrors
+	ch <- descSFlowIfOutErrors
+	ch <- descSFlowIfInDiscards
+	ch <- descSFlowIfOutDiscards
+	ch <- descSFlowIfSpeed
+	ch <- descSFlowIfAdminStatus
+	ch <- descSFlowIfOperStatus
+}
+
+func (c *sflowCounterCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.Sub(e.lastSeen) > c.expiry {
+			delete(c.entries, k)
+			continue
+		}
+		labels := []string{k.agent, strconv.Itoa(int(k.ifIndex))}
+		counter := func(desc *prometheus.Desc, v float64, extra ...string) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, v, append(labels, extra...)...)
+		}
+		gauge := func(desc *prometheus.Desc, v float64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...)
+		}
+		ifc := e.counters
+		counter(descSFlowIfInOctets, float64(ifc.IfInOctets))
+		counter(descSFlowIfOutOctets, float64(ifc.IfOutOctets))
+		counter(descSFlowIfInPackets, float64(ifc.IfInUcastPkts), "unicast")
+		counter(descSFlowIfInPackets, float64(ifc.IfInMulticastPkts), "multicast")
+		counter(descSFlowIfInPackets, float64(ifc.IfInBroadcastPkts), "broadcast")
+		counter(descSFlowIfOutPackets, float64(ifc.IfOutUcastPkts), "unicast")
+		counter(descSFlowIfOutPackets, float64(ifc.IfOutMulticastPkts), "multicast")
+		counter(descSFlowIfOutPackets, float64(ifc.IfOutBroadcastPkts), "broadcast")
+		counter(descSFlowIfInErrors, float64(ifc.IfInErrors))
+		counter(descSFlowIfOutErrors, float64(ifc.IfOutErrors))
+		counter(descSFlowIfInDiscards, float64(ifc.IfInDiscards))
+		counter(descSFlowIfOutDiscards, float64(ifc.IfOutDiscards))
+		gauge(descSFlowIfSpeed, float64(ifc.IfSpeed))
+		gauge(descSFlowIfAdminStatus, float64(ifc.IfStatus&1))
+		gauge(descSFlowIfOperStatus, float64((ifc.IfStatus>>1)&1))
+	}
+}
+
+// FormatSFlowCounters turns an sFlow interface counters record into a message
+// with the same conventions as transport.FormatFlowMessage.
+func FormatSFlowCounters(agent string, timeReceived uint64, ifc sflow.IfCounters) map[string]interface{} {
+	return map[string]interface{}{
+		"type":                     SFlowCounterMessageType,
+		"time_received":            int(timeReceived),
+		"sampler_address":          agent,
+		"if_index":                 int(ifc.IfIndex),
+		"if_type":                  int(ifc.IfType),
+		"if_speed":                 int(ifc.IfSpeed),
+		"if_direction":             int(ifc.IfDirection),
+		"if_admin_up":              ifc.IfStatus&1 == 1,
+		"if_oper_up":               (ifc.IfStatus>>1)&1 == 1,
+		"if_in_octets":             int(ifc.IfInOctets),
+		"if_in_unicast_packets":    int(ifc.IfInUcastPkts),
+		"if_in_multicast_packets":  int(ifc.IfInMulticastPkts),
+		"if_in_broadcast_packets":  int(ifc.IfInBroadcastPkts),
+		"if_in_discards":           int(ifc.IfInDiscards),
+		"if_in_errors":             int(ifc.IfInErrors),
+		"if_in_unknown_protos":     int(ifc.IfInUnknownProtos),
+		"if_out_octets":            int(ifc.IfOutOctets),
+		"if_out_unicast_packets":   int(ifc.IfOutUcastPkts),
+		"if_out_multicast_packets": int(ifc.IfOutMulticastPkts),
+		"if_out_broadcast_packets": int(ifc.IfOutBroadcastPkts),
+		"if_out_discards":          int(ifc.IfOutDiscards),
+		"if_out_errors":            int(ifc.IfOutErrors),
+		"if_promiscuous":           ifc.IfPromiscuousMode == 1,
+	}
+}
+
+// Replacement for github.com/cloudflare/goflow/v3/utils.StateSFlow that also
+// handles counter samples and sampled header parsing.
+type sflowState struct {
+	transport Transport
+	counters  *SFlowCountersConfig
+	l7        *SFlowL7Config
+	dns       *passivedns.Table
+}
+
+func newSFlowState(transport Transport, counters *SFlowCountersConfig, l7 *SFlowL7Config, dns *passivedns.Table) *sflowState {
+	if counters == nil {
+		counters = &SFlowCountersConfig{}
+	}
+	if counters.Expiry == 0 {
+		counters.Expiry = 10 * time.Minute
+	}
+	SFlowInterfaceCounters.setExpiry(counters.Expiry)
+	if l7 != nil && l7.MaxBytes == 0 {
+		l7.MaxBytes = 256
+	}
+	return &sflowState{
+		transport: transport,
+		counters:  counters,
+		l7:        l7,
+		dns:       dns,
+	}
+}
+
+func (s *sflowState) flowSampleFields(records []sflow.FlowRecord) map[string]interface{} {
+	if !s.l7.enabled() {
+		return nil
+	}
+	p := decodeSampledHeader(records, s.l7.MaxBytes)
+	dns := sampledHeaderDNS(p)
+	if s.l7.PassiveDNS && s.dns != nil {
+		s.dns.AddMessage(dns)
+	}
+	return sampledHeaderHints(s.l7, p, dns)
+}
+
+func (s *sflowState) DecodeFlow(msg interface{}) error {
+	pkt := msg.(utils.BaseMessage)
+	buf := bytes.NewBuffer(pkt.Payload)
+	key := pkt.Src.String()
+
+	ts := uint64(time.Now().UTC().Unix())
+	if pkt.SetTime {
+		ts = uint64(pkt.RecvTime.UTC().Unix())
+	}
+
+	timeTrackStart := time.Now()
+	msgDec, err := sflow.DecodeMessage(buf)
+	if err != nil {
+		errStr := "error_decoding"
+		switch err.(type) {
+		case *sflow.ErrorVersion:
+			errStr = "error_version"
+		case *sflow.ErrorIPVersion:
+			errStr = "error_ip_version"
+		case *sflow.ErrorDataFormat:
+			errStr = "error_data_format"
+		}
+		utils.SFlowErrors.With(
+			prometheus.Labels{
+				"router": key,
+				"error":  errStr,
+			}).
+			Inc()
+		return err
+	}
+
+	var counterMsgs []map[string]interface{}
+	// Extra fields for each flow sample, in the same order the goflow producer
+	// turns them into flow messages.
+	var flowFields []map[string]interface{}
+	hasFlowFields := false
+	if sflowPacket, ok := msgDec.(sflow.Packet); ok {
+		agentStr := net.IP(sflowPacket.AgentIP).String()
+		utils.SFlowStats.With(
+			prometheus.Labels{
+				"router":  key,
+				"agent":   agentStr,
+				"version": "5",
+			}).
+			Inc()
+
+		for _, sample := range sflowPacket.Samples {
+			typeStr := "unknown"
+			countRec := 0
+			switch sampleConv := sample.(type) {
+			case sflow.FlowSample:
+				typeStr = "FlowSample"
+				countRec = len(sampleConv.Records)
+				fields := s.flowSampleFields(sampleConv.Records)
+				hasFlowFields = hasFlowFields || fields != nil
+				flowFields = append(flowFields, fields)
+			case sflow.CounterSample:
+				typeStr = "CounterSample"
+				if sampleConv.Header.Format == 4 {
+					typeStr = "Expanded" + typeStr
+				}
+				countRec = len(sampleConv.Records)
+				for _, record := range sampleConv.Records {
+					ifc, ok := record.Data.(sflow.IfCounters)
+					if !ok {
+						continue
+					}
+					SFlowInterfaceCounters.update(agentStr, ifc)
+					if s.counters.EmitMessages {
+						counterMsgs = append(counterMsgs, FormatSFlowCounters(agentStr, ts, ifc))
+					}
+				}
+			case sflow.ExpandedFlowSample:
+				typeStr = "ExpandedFlowSample"
+				countRec = len(sampleConv.Records)
+				fields := s.flowSampleFields(sampleConv.Records)
+				hasFlowFields = hasFlowFields || fields != nil
+				flowFields = append(flowFields, fields)
+			}
+			labels := prometheus.Labels{
+				"router":  key,
+				"agent":   agentStr,
+				"version": "5",
+				"type":    typeStr,
+			}
+			utils.SFlowSampleStatsSum.With(labels).Inc()
+			utils.SFlowSampleRecordsStatsSum.With(labels).Add(float64(countRec))
+		}
+	}
+
+	var flowMessageSet []*goflowpb.FlowMessage
+	flowMessageSet, _ = producer.ProcessMessageSFlowConfig(msgDec, nil)
+
+	utils.DecoderTime.With(
+		prometheus.Labels{
+			"name": "sFlow",
+		}).
+		Observe(float64((time.Since(timeTrackStart)).Nanoseconds()) / 1000)
+
+	for _, fmsg := range flowMessageSet {
+		fmsg.TimeReceived = ts
+		fmsg.TimeFlowStart = ts
+		fmsg.TimeFlowEnd = ts
+	}
+
+	if s.transport != nil {
+		if publisher, ok := s.transport.(fieldsPublisher); ok && hasFlowFields {
+			publisher.PublishWithFields(flowMessageSet, flowFields)
+		} else {
+			s.transport.Publish(flowMessageSet)
+		}
+		for _, counterMsg := range counterMsgs {
+			s.transport.PublishMessage(counterMsg)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"github.com/cloudflare/goflow/v3/decoders/sflow"
+
+	"github.com/sapslaj/morbius/packet"
+)
+
+type SFlowL7Config struct {
+	// Add `tls_sni` from TLS ClientHellos.
+	TLSSNI bool `yaml:"tls_sni"`
+	// Add `http_host` from HTTP/1.x requests.
+	HTTPHost bool `yaml:"http_host"`
+	// Add `dns_qname` from DNS queries and responses on port 53.
+	DNSQName bool `yaml:"dns_qname"`
+	// Add A and AAAA answers from DNS responses to the passive DNS table.
+	PassiveDNS bool `yaml:"passive_dns"`
+	// Only parse up to this many bytes of each sampled header. Default is 256.
+	MaxBytes int `yaml:"max_bytes"`
+}
+
+func (c *SFlowL7Config) enabled() bool {
+	return c != nil && (c.TLSSNI || c.HTTPHost || c.DNSQName || c.PassiveDNS)
+}
+
+// sFlow header_protocol values mapped to pcap link types.
+var sflowHeaderLinkTypes = map[uint32]uint32{
+	1:  packet.LinkTypeEthernet,
+	11: packet.LinkTypeIPv4,
+	12: packet.LinkTypeIPv6,
+}
+
+// Decodes the raw sampled header of a flow sample, if it has one.
+func decodeSampledHeader(records []sflow.FlowRecord, maxBytes int) *packet.Packet {
+	for _, record := range records {
+		header, ok := record.Data.(sflow.SampledHeader)
+		if !ok {
+			continue
+		}
+		linkType, ok := sflowHeaderLinkTypes[header.Protocol]
+		if !ok {
+			return nil
+		}
+		data := header.HeaderData
+		if maxBytes > 0 && len(data) > maxBytes {
+			data = data[:maxBytes]
+		}
+		// Truncated headers are expected, what matters is whether we got as
+		// far as the payload.
+		p, _ := packet.Decode(linkType, data)
+		return p
+	}
+	return nil
+}
+
+// Returns the DNS message in a decoded sampled header, if it is one.
+func sampledHeaderDNS(p *packet.Packet) *packet.DNSMessage {
+	if p == nil || p.Proto != packet.ProtoUDP || (p.SrcPort != 53 && p.DstPort != 53) {
+		return nil
+	}
+	m, _ := packet.ParseDNS(p.Payload)
+	return m
+}
+
+// Returns the L7 hint fields for a decoded sampled header, or nil if there
+// aren't any.
+func sampledHeaderHints(config *SFlowL7Config, p *packet.Packet, dns *packet.DNSMessage) map[string]interface{} {
+	if p == nil || len(p.Payload) == 0 {
+		return nil
+	}
+	fields := make(map[string]interface{})
+	switch p.Proto {
+	case packet.ProtoTCP:
+		if config.TLSSNI {
+			if sni, ok := packet.ParseTLSServerName(p.Payload); ok {
+				fields["tls_sni"] = sni
+			}
+		}
+		if config.HTTPHost {
+			if host, ok := packet.ParseHTTPHost(p.Payload); ok {
+				fields["http_host"] = host
+			}
+		}
+	case packet.ProtoUDP:
+		if config.DNSQName && dns != nil && len(dns.Questions) > 0 {
+			fields["dns_qname"] = dns.Questions[0].Name
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
@@ -0,0 +1,268 @@
+package server_test
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/sapslaj/morbius/passivedns"
+	"github.com/sapslaj/morbius/server"
+)
+
+func sflowCounterDatagram(agent [4]byte, ifIndex uint32, inOctets, outOctets uint64) []byte {
+	ifCounters := make([]byte, 88)
+	binary.BigEndian.PutUint32(ifCounters[0:4], ifIndex)
+	binary.BigEndian.PutUint32(ifCounters[4:8], 6)
+	binary.BigEndian.PutUint64(ifCounters[8:16], 10000000000)
+	binary.BigEndian.PutUint32(ifCounters[16:20], 1)
+	binary.BigEndian.PutUint32(ifCounters[20:24], 3)
+	binary.BigEndian.PutUint64(ifCounters[24:32], inOctets)
+	binary.BigEndian.PutUint32(ifCounters[48:52], 4) // ifInErrors
+	binary.BigEndian.PutUint64(ifCounters[56:64], outOctets)
+	binary.BigEndian.PutUint32(ifCounters[76:80], 2) // ifOutDiscards
+
+	record := make([]byte, 8, 8+len(ifCounters))
+	binary.BigEndian.PutUint32(record[0:4], 1)
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(ifCounters)))
+	record = append(record, ifCounters...)
+
+	sample := make([]byte, 20, 20+len(record))
+	binary.BigEndian.PutUint32(sample[0:4], 2)
+	binary.BigEndian.PutUint32(sample[4:8], uint32(12+len(record)))
+	binary.BigEndian.PutUint32(sample[8:12], 1)
+	binary.BigEndian.PutUint32(sample[12:16], ifIndex)
+	binary.BigEndian.PutUint32(sample[16:20], 1)
+	sample = append(sample, record...)
+
+	b := make([]byte, 28, 28+len(sample))
+	binary.BigEndian.PutUint32(b[0:4], 5)
+	binary.BigEndian.PutUint32(b[4:8], 1)
+	copy(b[8:12], agent[:])
+	binary.BigEndian.PutUint32(b[16:20], 1)
+	binary.BigEndian.PutUint32(b[24:28], 1)
+	return append(b, sample...)
+}
+
+func TestSFlowCounters(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "sflow.cap")
+	writeTestCapture(t, path, server.ListenerSFlow, sflowCounterDatagram([4]byte{192, 0, 2, 10}, 7, 123456, 654321))
+
+	transport := &recordingTransport{}
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{
+		SFlow: &server.ServerPortConfig{
+			Counters: &server.SFlowCountersConfig{EmitMessages: true},
+		},
+	}, transport, nil)
+	stats, err := s.Replay(path, server.ReplayOptions{Speed: 0})
+	if err != nil {
+		t.Fatalf("Replay returned err: %v", err)
+	}
+	if stats.Errors != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if len(transport.flows) != 0 {
+		t.Errorf("expected no flows, got %d", len(transport.flows))
+	}
+	if len(transport.msgs) != 1 {
+		t.Fatalf("expected 1 counter message, got %d", len(transport.msgs))
+	}
+	msg := transport.msgs[0]
+	want := map[string]interface{}{
+		"type":            server.SFlowCounterMessageType,
+		"sampler_address": "192.0.2.10",
+		"if_index":        7,
+		"if_speed":        10000000000,
+		"if_admin_up":     true,
+		"if_oper_up":      true,
+		"if_in_octets":    123456,
+		"if_in_errors":    4,
+		"if_out_octets":   654321,
+		"if_out_discards": 2,
+	}
+	got := make(map[string]interface{})
+	for k := range want {
+		got[k] = msg[k]
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("counter message mismatch (-want +got):\n%s", diff)
+	}
+
+	expected := `
+# HELP sflow_if_in_octets Octets received on the interface as reported by sFlow counter samples
+# TYPE sflow_if_in_octets counter
+sflow_if_in_octets{agent="192.0.2.10",if_index="7"} 123456
+# HELP sflow_if_oper_up 1 if the interface is operationally up as reported by sFlow counter samples
+# TYPE sflow_if_oper_up gauge
+sflow_if_oper_up{agent="192.0.2.10",if_index="7"} 1
+`
+	err = testutil.CollectAndCompare(server.SFlowInterfaceCounters, strings.NewReader(expected), "sflow_if_in_octets", "sflow_if_oper_up")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func ipv4Frame(proto uint8, srcPort, dstPort uint16, payload []byte) []byte {
+	l4 := make([]byte, 8)
+	if proto == 6 {
+		l4 = make([]byte, 20)
+		l4[12] = 5 << 4
+	}
+	binary.BigEndian.PutUint16(l4[0:2], srcPort)
+	binary.BigEndian.PutUint16(l4[2:4], dstPort)
+	if proto == 17 {
+		binary.BigEndian.PutUint16(l4[4:6], uint16(8+len(payload)))
+	}
+	l4 = append(l4, payload...)
+
+	ip := make([]byte, 20, 20+len(l4))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(l4)))
+	ip[8] = 64
+	ip[9] = proto
+	copy(ip[12:16], []byte{10, 0, 0, 1})
+	copy(ip[16:20], []byte{10, 0, 0, 2})
+	ip = append(ip, l4...)
+
+	eth := make([]byte, 14, 14+len(ip))
+	binary.BigEndian.PutUint16(eth[12:14], 0x0800)
+	return append(eth, ip...)
+}
+
+func sflowFlowDatagram(agent [4]byte, frames ...[]byte) []byte {
+	b := make([]byte, 28)
+	binary.BigEndian.PutUint32(b[0:4], 5)
+	binary.BigEndian.PutUint32(b[4:8], 1)
+	copy(b[8:12], agent[:])
+	binary.BigEndian.PutUint32(b[16:20], 1)
+	binary.BigEndian.PutUint32(b[24:28], uint32(len(frames)))
+	for _, frame := range frames {
+		header := make([]byte, 16, 16+len(frame)+3)
+		binary.BigEndian.PutUint32(header[0:4], 1)
+		binary.BigEndian.PutUint32(header[4:8], uint32(len(frame)))
+		binary.BigEndian.PutUint32(header[12:16], uint32(len(frame)))
+		header = append(header, frame...)
+		for len(header)%4 != 0 {
+			header = append(header, 0)
+		}
+
+		record := make([]byte, 8, 8+len(header))
+		binary.BigEndian.PutUint32(record[0:4], 1)
+		binary.BigEndian.PutUint32(record[4:8], uint32(len(header)))
+		record = append(record, header...)
+
+		sample := make([]byte, 40, 40+len(record))
+		binary.BigEndian.PutUint32(sample[0:4], 1)
+		binary.BigEndian.PutUint32(sample[4:8], uint32(32+len(record)))
+		binary.BigEndian.PutUint32(sample[16:20], 1000)
+		binary.BigEndian.PutUint32(sample[36:40], 1)
+		sample = append(sample, record...)
+		b = append(b, sample...)
+	}
+	return b
+}
+
+func TestSFlowL7Hints(t *testing.T) {
+	t.Parallel()
+	dnsQuery := []byte{
+		0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0, 1, 0, 1,
+	}
+	httpRequest := []byte("GET / HTTP/1.1\r\nHost: example.net\r\n\r\n")
+
+	type test struct {
+		config *server.SFlowL7Config
+		want   []map[string]interface{}
+	}
+
+	tests := map[string]test{
+		"all protocols enabled": {
+			config: &server.SFlowL7Config{DNSQName: true, HTTPHost: true, TLSSNI: true},
+			want: []map[string]interface{}{
+				{"dns_qname": "example.com"},
+				nil,
+				{"http_host": "example.net"},
+			},
+		},
+		"only DNS enabled": {
+			config: &server.SFlowL7Config{DNSQName: true},
+			want: []map[string]interface{}{
+				{"dns_qname": "example.com"},
+				nil,
+				nil,
+			},
+		},
+		"payload beyond max_bytes isn't parsed": {
+			config: &server.SFlowL7Config{DNSQName: true, HTTPHost: true, MaxBytes: 72},
+			want: []map[string]interface{}{
+				{"dns_qname": "example.com"},
+				nil,
+				nil,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "sflow.cap")
+			writeTestCapture(t, path, server.ListenerSFlow, sflowFlowDatagram(
+				[4]byte{192, 0, 2, 20},
+				ipv4Frame(17, 50000, 53, dnsQuery),
+				ipv4Frame(17, 50000, 123, []byte{0x23}),
+				ipv4Frame(6, 50000, 80, httpRequest),
+			))
+
+			transport := &recordingTransport{}
+			s := server.NewServerWithTransportAndLogger(server.ServerConfig{
+				SFlow: &server.ServerPortConfig{L7: tc.config},
+			}, transport, nil)
+			if _, err := s.Replay(path, server.ReplayOptions{Speed: 0}); err != nil {
+				t.Fatalf("\"%s\": Replay returned err: %v", name, err)
+			}
+			if len(transport.flows) != 3 {
+				t.Fatalf("\"%s\": expected 3 flows, got %d", name, len(transport.flows))
+			}
+			if diff := cmp.Diff(tc.want, transport.fields); diff != "" {
+				t.Errorf("\"%s\": fields mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
+
+func TestSFlowPassiveDNS(t *testing.T) {
+	t.Parallel()
+	dnsResponse := []byte{
+		0x12, 0x34, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0, 1, 0, 1,
+		0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 93, 184, 216, 34,
+	}
+
+	path := filepath.Join(t.TempDir(), "sflow.cap")
+	writeTestCapture(t, path, server.ListenerSFlow, sflowFlowDatagram(
+		[4]byte{192, 0, 2, 20},
+		ipv4Frame(17, 53, 50000, dnsResponse),
+	))
+
+	table := passivedns.NewTable(nil)
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{
+		SFlow:      &server.ServerPortConfig{L7: &server.SFlowL7Config{PassiveDNS: true}},
+		PassiveDNS: table,
+	}, &recordingTransport{}, nil)
+	if _, err := s.Replay(path, server.ReplayOptions{Speed: 0}); err != nil {
+		t.Fatalf("Replay returned err: %v", err)
+	}
+	name, ok := table.Lookup(netip.MustParseAddr("93.184.216.34"))
+	if !ok || name != "example.com" {
+		t.Errorf("Lookup = %q, %v; want \"example.com\", true", name, ok)
+	}
+}
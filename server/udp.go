@@ -0,0 +1,207 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	decoder "github.com/cloudflare/goflow/v3/decoders"
+	"github.com/cloudflare/goflow/v3/utils"
+	reuseport "github.com/libp2p/go-reuseport"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapslaj/morbius/capture"
+)
+
+var MetricCaptureDatagrams = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "capture_datagrams",
+		Help: "Number of datagrams written to capture files",
+	},
+	[]string{"type", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(MetricCaptureDatagrams)
+}
+
+const relayDecodeQueueSize = 4096
+
+// Capture write errors are usually persistent (e.g. a full disk) so they're
+// only logged this often. Every error is counted in MetricCaptureDatagrams.
+const captureErrorLogInterval = time.Minute
+
+// Replacement for github.com/cloudflare/goflow/v3/utils.UDPRoutine that lets
+// us hook into datagrams between the socket and the decoder. The goflow
+// traffic metrics are kept as-is so existing dashboards keep working.
+func (s *Server) listenUDP(listener string, config *ServerPortConfig, decodeFunc decoder.DecoderFunc) error {
+	name := listenerMetricNames[listener]
+	filter, err := NewDatagramFilter(&config.DatagramFilterConfig)
+	if err != nil {
+		return err
+	}
+
+	var captureWriter *capture.Writer
+	if config.Capture != nil {
+		captureWriter, err = capture.NewWriter(config.Capture, listener)
+		if err != nil {
+			return err
+		}
+		defer captureWriter.Close()
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := captureWriter.Flush(); err != nil {
+						s.Config.Logger.Errorf("error flushing %s capture: %v", listener, err)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	relayTargets := make([]*RelayTarget, 0, len(config.Relay))
+	for _, targetConfig := range config.Relay {
+		target, err := NewRelayTarget(targetConfig, listener)
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+		relayTargets = append(relayTargets, target)
+	}
+
+	ecb := utils.DefaultErrorCallback{
+		Logger: s.Config.Logger,
+	}
+	processor := decoder.CreateProcessor(config.Workers, decoder.DecoderParams{
+		DecoderFunc:   decodeFunc,
+		DoneCallback:  utils.DefaultAccountCallback,
+		ErrorCallback: ecb.Callback,
+	}, name)
+	processor.Start()
+
+	// Decoding normally applies backpressure to the socket. When relaying, the
+	// socket has to keep being drained even if the pipeline is backed up, so
+	// datagrams are handed off through a queue that drops when full instead.
+	dispatch := func(msg utils.BaseMessage) {
+		processor.ProcessMessage(msg)
+	}
+	if len(relayTargets) > 0 {
+		decodeQueue := make(chan utils.BaseMessage, relayDecodeQueueSize)
+		defer close(decodeQueue)
+		go func() {
+			for msg := range decodeQueue {
+				processor.ProcessMessage(msg)
+			}
+		}()
+		dispatch = func(msg utils.BaseMessage) {
+			select {
+			case decodeQueue <- msg:
+			default:
+				MetricListenerDatagramsRejected.With(prometheus.Labels{"type": name, "reason": ListenerRejectReasonDecodeQueueFull}).Inc()
+			}
+		}
+	}
+
+	addrUDP := net.UDPAddr{
+		IP:   net.ParseIP(config.Addr),
+		Port: config.Port,
+	}
+
+	var udpconn *net.UDPConn
+	if config.ReusePort {
+		pconn, err := reuseport.ListenPacket("udp", addrUDP.String())
+		if err != nil {
+			return err
+		}
+		defer pconn.Close()
+		udpconn = pconn.(*net.UDPConn)
+	} else {
+		udpconn, err = net.ListenUDP("udp", &addrUDP)
+		if err != nil {
+			return err
+		}
+		defer udpconn.Close()
+	}
+
+	localIP := addrUDP.IP.String()
+	if addrUDP.IP == nil {
+		localIP = ""
+	}
+	localPort := strconv.Itoa(addrUDP.Port)
+
+	var lastCaptureErrorLog time.Time
+	payload := make([]byte, 9000)
+	for {
+		size, pktAddr, err := udpconn.ReadFromUDPAddrPort(payload)
+		if err != nil {
+			return err
+		}
+		recvTime := time.Now()
+
+		if !filter.IsNoop() {
+			if ok, reason := filter.Allow(pktAddr.Addr(), recvTime); !ok {
+				MetricListenerDatagramsRejected.With(prometheus.Labels{"type": name, "reason": reason}).Inc()
+				continue
+			}
+		}
+
+		// Only counted once the datagram is accepted since these are labelled
+		// by source, and a spoofed source per datagram would otherwise create a
+		// series per datagram.
+		labels := prometheus.Labels{
+			"remote_ip":   pktAddr.Addr().Unmap().String(),
+			"remote_port": strconv.Itoa(int(pktAddr.Port())),
+			"local_ip":    localIP,
+			"local_port":  localPort,
+			"type":        name,
+		}
+		utils.MetricTrafficBytes.With(labels).Add(float64(size))
+		utils.MetricTrafficPackets.With(labels).Inc()
+		utils.MetricPacketSizeSum.With(labels).Observe(float64(size))
+
+		payloadCut := make([]byte, size)
+		copy(payloadCut, payload[0:size])
+
+		for _, target := range relayTargets {
+			target.Forward(pktAddr, recvTime, payloadCut)
+		}
+
+		if captureWriter != nil {
+			err := captureWriter.Write(capture.Datagram{
+				Src:      pktAddr,
+				RecvTime: recvTime,
+				Payload:  payloadCut,
+			})
+			if err != nil {
+				MetricCaptureDatagrams.With(prometheus.Labels{"type": name, "status": "error"}).Inc()
+				if recvTime.Sub(lastCaptureErrorLog) >= captureErrorLogInterval {
+					s.Config.Logger.Errorf("error writing %s capture: %v", listener, err)
+					lastCaptureErrorLog = recvTime
+				}
+			} else {
+				MetricCaptureDatagrams.With(prometheus.Labels{"type": name, "status": "written"}).Inc()
+			}
+		}
+
+		dispatch(utils.BaseMessage{
+			Src:      addrPortIP(pktAddr),
+			Port:     int(pktAddr.Port()),
+			Payload:  payloadCut,
+			SetTime:  true,
+			RecvTime: recvTime,
+		})
+	}
+}
+
+func addrPortIP(addrPort netip.AddrPort) net.IP {
+	addr := addrPort.Addr().Unmap()
+	return net.IP(addr.AsSlice())
+}
@@ -0,0 +1,475 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	AWSVPCFlowLogMessageType = "AWS_VPC_FLOW_LOG"
+	GCPVPCFlowLogMessageType = "GCP_VPC_FLOW_LOG"
+)
+
+var MetricVPCFlowLogRecords = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "vpc_flow_log_records",
+		Help: "Number of records read by the VPC flow log input",
+	},
+	[]string{"provider", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(MetricVPCFlowLogRecords)
+}
+
+type VPCFlowLogsConfig struct {
+	Enable bool `yaml:"enable"`
+	// File or directory to read flow logs from. Files can be plain or
+	// gzipped.
+	Path string `yaml:"path"`
+	// Only read files in the directory matching this glob. Default is `*`.
+	Pattern string `yaml:"pattern"`
+	// `aws`, `gcp`, or `auto` to treat JSON records as GCP and anything else
+	// as AWS. Default is `auto`.
+	Format string `yaml:"format"`
+	// AWS log format (`${version} ${account-id} ...`) of files without a
+	// header line. Default is the AWS default format.
+	AWSLogFormat string `yaml:"aws_log_format"`
+	// Prefix for fields that don't map onto the standard ones. Default is
+	// `cloud_`.
+	FieldPrefix string `yaml:"field_prefix"`
+	// How often to check the directory for new files. Default is 10s.
+	PollInterval   time.Duration `yaml:"poll_interval"`
+	SamplerAddress string        `yaml:"sampler_address"`
+}
+
+// The default format of AWS VPC flow logs (version 2).
+const awsDefaultLogFormat = "${version} ${account-id} ${interface-id} ${srcaddr} ${dstaddr} ${srcport} ${dstport} ${protocol} ${packets} ${bytes} ${start} ${end} ${action} ${log-status}"
+
+func mergeDefaultVPCFlowLogsConfig(in *VPCFlowLogsConfig) *VPCFlowLogsConfig {
+	if in == nil {
+		in = &VPCFlowLogsConfig{}
+	}
+	if in.Pattern == "" {
+		in.Pattern = "*"
+	}
+	if in.Format == "" {
+		in.Format = "auto"
+	}
+	if in.AWSLogFormat == "" {
+		in.AWSLogFormat = awsDefaultLogFormat
+	}
+	if in.FieldPrefix == "" {
+		in.FieldPrefix = "cloud_"
+	}
+	if in.PollInterval == 0 {
+		in.PollInterval = 10 * time.Second
+	}
+	if in.SamplerAddress == "" {
+		in.SamplerAddress = "0.0.0.0"
+	}
+	return in
+}
+
+// All fields of AWS flow log versions 2 through 8, used to recognize the
+// header line files delivered to S3 start with.
+var awsFlowLogFields = map[string]bool{
+	"version":                    true,
+	"account-id":                 true,
+	"interface-id":               true,
+	"srcaddr":                    true,
+	"dstaddr":                    true,
+	"srcport":                    true,
+	"dstport":                    true,
+	"protocol":                   true,
+	"packets":                    true,
+	"bytes":                      true,
+	"start":                      true,
+	"end":                        true,
+	"action":                     true,
+	"log-status":                 true,
+	"vpc-id":                     true,
+	"subnet-id":                  true,
+	"instance-id":                true,
+	"tcp-flags":                  true,
+	"type":                       true,
+	"pkt-srcaddr":                true,
+	"pkt-dstaddr":                true,
+	"region":                     true,
+	"az-id":                      true,
+	"sublocation-type":           true,
+	"sublocation-id":             true,
+	"pkt-src-aws-service":        true,
+	"pkt-dst-aws-service":        true,
+	"flow-direction":             true,
+	"traffic-path":               true,
+	"ecs-cluster-arn":            true,
+	"ecs-cluster-name":           true,
+	"ecs-container-instance-arn": true,
+	"ecs-container-instance-id":  true,
+	"ecs-container-id":           true,
+	"ecs-second-container-id":    true,
+	"ecs-service-name":           true,
+	"ecs-task-definition-arn":    true,
+	"ecs-task-arn":               true,
+	"ecs-task-id":                true,
+	"reject-reason":              true,
+}
+
+// AWS flow log fields that map onto the standard field names.
+var awsFlowLogStandardFields = map[string]string{
+	"srcaddr":   "src_addr",
+	"dstaddr":   "dst_addr",
+	"srcport":   "src_port",
+	"dstport":   "dst_port",
+	"protocol":  "proto",
+	"packets":   "packets",
+	"bytes":     "bytes",
+	"start":     "time_flow_start",
+	"end":       "time_flow_end",
+	"tcp-flags": "tcp_flags",
+}
+
+var awsFlowLogIntFields = map[string]bool{
+	"version":      true,
+	"srcport":      true,
+	"dstport":      true,
+	"protocol":     true,
+	"packets":      true,
+	"bytes":        true,
+	"start":        true,
+	"end":          true,
+	"tcp-flags":    true,
+	"traffic-path": true,
+}
+
+// GCP connection fields that map onto the standard field names.
+var gcpFlowLogConnectionFields = map[string]string{
+	"src_ip":    "src_addr",
+	"dest_ip":   "dst_addr",
+	"src_port":  "src_port",
+	"dest_port": "dst_port",
+	"protocol":  "proto",
+}
+
+// Cloud Logging encodes int64 values as strings.
+var gcpFlowLogIntFields = map[string]bool{
+	"bytes_sent":   true,
+	"packets_sent": true,
+	"rtt_msec":     true,
+}
+
+// ParseAWSLogFormat returns the field names of an AWS flow log format
+// string, such as `${version} ${srcaddr} ${dstaddr}`.
+func ParseAWSLogFormat(format string) []string {
+	fields := strings.Fields(format)
+	for i, field := range fields {
+		fields[i] = strings.TrimSuffix(strings.TrimPrefix(field, "${"), "}")
+	}
+	return fields
+}
+
+func isAWSFlowLogHeader(tokens []string) bool {
+	for _, token := range tokens {
+		if !awsFlowLogFields[token] {
+			return false
+		}
+	}
+	return len(tokens) > 0
+}
+
+func setFlowLogEtype(msg map[string]interface{}) {
+	if src, ok := msg["src_addr"].(string); ok {
+		if addr, err := netip.ParseAddr(src); err == nil {
+			msg["ethernet_type"] = addrEtype(addr.Unmap())
+		}
+	}
+}
+
+// Adds value under key, with nested objects flattened into key_subkey.
+func flattenFlowLogField(msg map[string]interface{}, key string, value interface{}) {
+	if m, ok := value.(map[string]interface{}); ok {
+		for k, v := range m {
+			flattenFlowLogField(msg, key+"_"+k, v)
+		}
+		return
+	}
+	msg[key] = value
+}
+
+// Accepts ints as well as the strings Cloud Logging encodes int64 as.
+func flowLogInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case string:
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+type vpcFlowLogReader struct {
+	s         *Server
+	config    *VPCFlowLogsConfig
+	awsFields []string
+}
+
+func (r *vpcFlowLogReader) baseMessage(messageType string, provider string, timeReceived time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"type":                            messageType,
+		"time_received":                   int(timeReceived.Unix()),
+		"sampling_rate":                   1,
+		"sampler_address":                 r.config.SamplerAddress,
+		r.config.FieldPrefix + "provider": provider,
+	}
+}
+
+// Returns a nil message for records without flow data, such as ones with a
+// log-status of NODATA or SKIPDATA.
+func (r *vpcFlowLogReader) formatAWSRecord(fields []string, values []string, timeReceived time.Time) (map[string]interface{}, error) {
+	if len(values) != len(fields) {
+		return nil, fmt.Errorf("expected %d fields, got %d", len(fields), len(values))
+	}
+	msg := r.baseMessage(AWSVPCFlowLogMessageType, "aws", timeReceived)
+	for i, field := range fields {
+		value := values[i]
+		if field == "log-status" && value != "OK" {
+			return nil, nil
+		}
+		if value == "-" {
+			continue
+		}
+		key, ok := awsFlowLogStandardFields[field]
+		if !ok {
+			key = r.config.FieldPrefix + strings.ReplaceAll(field, "-", "_")
+		}
+		if awsFlowLogIntFields[field] {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", field, err)
+			}
+			msg[key] = n
+		} else {
+			msg[key] = value
+		}
+	}
+	setFlowLogEtype(msg)
+	return msg, nil
+}
+
+// Accepts Cloud Logging entries as exported to Cloud Storage, as well as bare
+// jsonPayload objects.
+func (r *vpcFlowLogReader) formatGCPRecord(line []byte, timeReceived time.Time) (map[string]interface{}, error) {
+	entry, err := decodeNDJSONLine(line)
+	if err != nil {
+		return nil, err
+	}
+	payload := entry
+	if p, ok := entry["jsonPayload"].(map[string]interface{}); ok {
+		payload = p
+	}
+	conn, ok := payload["connection"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("record has no connection")
+	}
+	msg := r.baseMessage(GCPVPCFlowLogMessageType, "gcp", timeReceived)
+	for k, v := range conn {
+		if key, ok := gcpFlowLogConnectionFields[k]; ok {
+			msg[key] = v
+		} else {
+			flattenFlowLogField(msg, r.config.FieldPrefix+k, v)
+		}
+	}
+	for k, v := range payload {
+		switch k {
+		case "connection":
+		case "bytes_sent", "packets_sent":
+			n, ok := flowLogInt(v)
+			if !ok {
+				return nil, fmt.Errorf("%s: not an integer: %v", k, v)
+			}
+			msg[strings.TrimSuffix(k, "_sent")] = n
+		case "start_time", "end_time":
+			s, _ := v.(string)
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			msg["time_flow_"+strings.TrimSuffix(k, "_time")] = int(t.Unix())
+		default:
+			if gcpFlowLogIntFields[k] {
+				if n, ok := flowLogInt(v); ok {
+					v = n
+				}
+			}
+			flattenFlowLogField(msg, r.config.FieldPrefix+k, v)
+		}
+	}
+	setFlowLogEtype(msg)
+	return msg, nil
+}
+
+func (r *vpcFlowLogReader) isGCPRecord(line []byte) bool {
+	switch r.config.Format {
+	case "gcp":
+		return true
+	case "aws":
+		return false
+	}
+	return line[0] == '{'
+}
+
+// Publishes every record in the file at path, decompressing it first if it
+// is gzipped.
+func (r *vpcFlowLogReader) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	awsFields := r.awsFields
+	first := true
+	for {
+		line, err := br.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			r.publishRecord(line, &awsFields, first)
+			first = false
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *vpcFlowLogReader) publishRecord(line []byte, awsFields *[]string, first bool) {
+	var msg map[string]interface{}
+	var err error
+	provider := "aws"
+	if r.isGCPRecord(line) {
+		provider = "gcp"
+		msg, err = r.formatGCPRecord(line, time.Now())
+	} else {
+		tokens := strings.Fields(string(line))
+		// Files AWS delivers to S3 start with the field names.
+		if first && isAWSFlowLogHeader(tokens) {
+			*awsFields = tokens
+			return
+		}
+		msg, err = r.formatAWSRecord(*awsFields, tokens, time.Now())
+	}
+	if err != nil {
+		MetricVPCFlowLogRecords.With(prometheus.Labels{"provider": provider, "status": "error"}).Inc()
+		r.s.Config.Logger.Debugf("vpc_flow_logs: error decoding %s record: %v", provider, err)
+		return
+	}
+	if msg == nil {
+		MetricVPCFlowLogRecords.With(prometheus.Labels{"provider": provider, "status": "skipped"}).Inc()
+		return
+	}
+	MetricVPCFlowLogRecords.With(prometheus.Labels{"provider": provider, "status": "published"}).Inc()
+	r.s.Config.Transport.PublishMessage(msg)
+}
+
+func (r *vpcFlowLogReader) watchDir() error {
+	done := make(map[string]bool)
+	sizes := make(map[string]int64)
+	for {
+		paths, err := filepath.Glob(filepath.Join(r.config.Path, r.config.Pattern))
+		if err != nil {
+			return err
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			if done[path] {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			// Wait until a file stops growing so objects that are still
+			// being synced aren't read half way.
+			if size, seen := sizes[path]; !seen || size != info.Size() {
+				sizes[path] = info.Size()
+				continue
+			}
+			delete(sizes, path)
+			done[path] = true
+			if err := r.readFile(path); err != nil {
+				r.s.Config.Logger.Errorf("vpc_flow_logs: error reading %s: %v", path, err)
+			}
+		}
+		// Forget files that were removed or moved away so done doesn't grow
+		// forever, and so a new file with the same name is read.
+		matched := make(map[string]bool, len(paths))
+		for _, path := range paths {
+			matched[path] = true
+		}
+		for path := range done {
+			if !matched[path] {
+				delete(done, path)
+			}
+		}
+		for path := range sizes {
+			if !matched[path] {
+				delete(sizes, path)
+			}
+		}
+		time.Sleep(r.config.PollInterval)
+	}
+}
+
+// RunVPCFlowLogs publishes AWS and GCP VPC flow log records from a file or a
+// directory. Reading a file returns nil at EOF; directories are watched for
+// new files until an error occurs. Each file in a directory is read once.
+func (s *Server) RunVPCFlowLogs() error {
+	config := s.Config.VPCFlowLogs
+	switch config.Format {
+	case "auto", "aws", "gcp":
+	default:
+		return fmt.Errorf("vpc_flow_logs: unknown format %q", config.Format)
+	}
+	if config.Path == "" {
+		return errors.New("vpc_flow_logs: path is required")
+	}
+	r := &vpcFlowLogReader{
+		s:         s,
+		config:    config,
+		awsFields: ParseAWSLogFormat(config.AWSLogFormat),
+	}
+	info, err := os.Stat(config.Path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return r.watchDir()
+	}
+	return r.readFile(config.Path)
+}
@@ -0,0 +1,257 @@
+package server_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/sapslaj/morbius/server"
+)
+
+var ignoreTimeReceived = cmpopts.IgnoreMapEntries(func(k string, v interface{}) bool {
+	return k == "time_received"
+})
+
+func TestServer_RunVPCFlowLogs(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		input  string
+		gzip   bool
+		config server.VPCFlowLogsConfig
+		want   []map[string]interface{}
+	}
+
+	tests := map[string]test{
+		"aws default format": {
+			input: "2 123456789010 eni-1235b8ca123456789 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n" +
+				"2 123456789010 eni-1235b8ca123456789 - - - - - - - 1431280876 1431280934 - NODATA\n",
+			want: []map[string]interface{}{
+				{
+					"type":               server.AWSVPCFlowLogMessageType,
+					"sampling_rate":      1,
+					"sampler_address":    "0.0.0.0",
+					"cloud_provider":     "aws",
+					"cloud_version":      2,
+					"cloud_account_id":   "123456789010",
+					"cloud_interface_id": "eni-1235b8ca123456789",
+					"src_addr":           "172.31.16.139",
+					"dst_addr":           "172.31.16.21",
+					"src_port":           20641,
+					"dst_port":           22,
+					"proto":              6,
+					"packets":            20,
+					"bytes":              4249,
+					"time_flow_start":    1418530010,
+					"time_flow_end":      1418530070,
+					"cloud_action":       "ACCEPT",
+					"cloud_log_status":   "OK",
+					"ethernet_type":      0x800,
+				},
+			},
+		},
+		"aws gzipped file with a v5 header": {
+			input: "version vpc-id srcaddr dstaddr srcport dstport protocol bytes packets start end tcp-flags type pkt-srcaddr region flow-direction traffic-path pkt-dst-aws-service\n" +
+				"5 vpc-abcdefab012345678 2001:db8::1 2001:db8::2 443 49152 6 5000 4 1620140661 1620140721 19 IPv6 2001:db8::1 us-east-1 egress 8 -\n",
+			gzip: true,
+			want: []map[string]interface{}{
+				{
+					"type":                 server.AWSVPCFlowLogMessageType,
+					"sampling_rate":        1,
+					"sampler_address":      "0.0.0.0",
+					"cloud_provider":       "aws",
+					"cloud_version":        5,
+					"cloud_vpc_id":         "vpc-abcdefab012345678",
+					"src_addr":             "2001:db8::1",
+					"dst_addr":             "2001:db8::2",
+					"src_port":             443,
+					"dst_port":             49152,
+					"proto":                6,
+					"bytes":                5000,
+					"packets":              4,
+					"time_flow_start":      1620140661,
+					"time_flow_end":        1620140721,
+					"tcp_flags":            19,
+					"cloud_type":           "IPv6",
+					"cloud_pkt_srcaddr":    "2001:db8::1",
+					"cloud_region":         "us-east-1",
+					"cloud_flow_direction": "egress",
+					"cloud_traffic_path":   8,
+					"ethernet_type":        0x86dd,
+				},
+			},
+		},
+		"aws custom format and prefix": {
+			input: "vpc-1 10.0.0.1 10.0.0.2 100\n" +
+				"vpc-1 10.0.0.1 10.0.0.2\n" +
+				"vpc-1 10.0.0.1 10.0.0.2 lots\n",
+			config: server.VPCFlowLogsConfig{
+				AWSLogFormat: "${vpc-id} ${srcaddr} ${dstaddr} ${bytes}",
+				FieldPrefix:  "aws_",
+			},
+			want: []map[string]interface{}{
+				{
+					"type":            server.AWSVPCFlowLogMessageType,
+					"sampling_rate":   1,
+					"sampler_address": "0.0.0.0",
+					"aws_provider":    "aws",
+					"aws_vpc_id":      "vpc-1",
+					"src_addr":        "10.0.0.1",
+					"dst_addr":        "10.0.0.2",
+					"bytes":           100,
+					"ethernet_type":   0x800,
+				},
+			},
+		},
+		"gcp cloud logging export": {
+			input: `{"insertId":"abc","jsonPayload":{"bytes_sent":"1234","packets_sent":"5","connection":{"dest_ip":"10.128.0.3","dest_port":443,"protocol":6,"src_ip":"10.128.0.2","src_port":51234},"start_time":"2024-01-02T03:04:05.123456Z","end_time":"2024-01-02T03:04:35Z","reporter":"SRC","rtt_msec":"12","src_instance":{"project_id":"proj","vm_name":"web-1","zone":"us-central1-a"}},"logName":"projects/proj/logs/compute.googleapis.com%2Fvpc_flows"}` + "\n" +
+				`{"jsonPayload":{"reporter":"DEST"}}` + "\n",
+			want: []map[string]interface{}{
+				{
+					"type":                          server.GCPVPCFlowLogMessageType,
+					"sampling_rate":                 1,
+					"sampler_address":               "0.0.0.0",
+					"cloud_provider":                "gcp",
+					"src_addr":                      "10.128.0.2",
+					"dst_addr":                      "10.128.0.3",
+					"src_port":                      51234,
+					"dst_port":                      443,
+					"proto":                         6,
+					"bytes":                         1234,
+					"packets":                       5,
+					"time_flow_start":               1704164645,
+					"time_flow_end":                 1704164675,
+					"cloud_reporter":                "SRC",
+					"cloud_rtt_msec":                12,
+					"cloud_src_instance_project_id": "proj",
+					"cloud_src_instance_vm_name":    "web-1",
+					"cloud_src_instance_zone":       "us-central1-a",
+					"ethernet_type":                 0x800,
+				},
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			data := []byte(tc.input)
+			if tc.gzip {
+				var buf bytes.Buffer
+				gz := gzip.NewWriter(&buf)
+				gz.Write(data)
+				gz.Close()
+				data = buf.Bytes()
+			}
+			path := filepath.Join(t.TempDir(), "flows.log")
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			config := tc.config
+			config.Enable = true
+			config.Path = path
+			transport := &recordingTransport{}
+			s := server.NewServerWithTransportAndLogger(server.ServerConfig{VPCFlowLogs: &config}, transport, nil)
+
+			if err := s.RunVPCFlowLogs(); err != nil {
+				t.Fatalf("\"%s\": RunVPCFlowLogs returned err: %v", name, err)
+			}
+			if diff := cmp.Diff(tc.want, transport.msgs, ignoreTimeReceived); diff != "" {
+				t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
+
+func TestServer_RunVPCFlowLogs_Directory(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	config := server.VPCFlowLogsConfig{
+		Enable:       true,
+		Path:         dir,
+		Pattern:      "*.log",
+		PollInterval: 10 * time.Millisecond,
+	}
+	transport := &recordingTransport{}
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{VPCFlowLogs: &config}, transport, nil)
+	go s.RunVPCFlowLogs()
+
+	line := "2 123456789010 eni-1 10.0.0.1 10.0.0.2 1 2 17 1 100 1418530010 1418530070 ACCEPT OK\n"
+	for _, name := range []string{"a.log", "b.log", "ignored.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(line), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		transport.mu.Lock()
+		n := len(transport.msgs)
+		transport.mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Give it a chance to read files again or pick up the ignored one.
+	time.Sleep(50 * time.Millisecond)
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if len(transport.msgs) != 2 {
+		t.Errorf("expected 2 messages, got %d", len(transport.msgs))
+	}
+}
+
+func TestServer_RunVPCFlowLogs_DirectoryRemovedFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	config := server.VPCFlowLogsConfig{
+		Enable:       true,
+		Path:         dir,
+		Pattern:      "*.log",
+		PollInterval: 10 * time.Millisecond,
+	}
+	transport := &recordingTransport{}
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{VPCFlowLogs: &config}, transport, nil)
+	go s.RunVPCFlowLogs()
+
+	waitForMsgs := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			transport.mu.Lock()
+			got := len(transport.msgs)
+			transport.mu.Unlock()
+			if got >= n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %d messages", n)
+	}
+
+	path := filepath.Join(dir, "a.log")
+	line := "2 123456789010 eni-1 10.0.0.1 10.0.0.2 1 2 17 1 100 1418530010 1418530070 ACCEPT OK\n"
+	if err := os.WriteFile(path, []byte(line), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForMsgs(1)
+
+	// A processed file that's removed and then replaced by one with the same
+	// name is read again rather than skipped as already done.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(path, []byte(line), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForMsgs(2)
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const ZeekMessageType = "ZEEK_CONN"
+
+var MetricZeekRecords = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "zeek_records",
+		Help: "Number of records read by the Zeek conn.log input",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(MetricZeekRecords)
+}
+
+type ZeekConfig struct {
+	Enable bool `yaml:"enable"`
+	// Path to conn.log, written either as TSV (the default) or JSON.
+	Path string `yaml:"path"`
+	// Read the file once and stop instead of following it.
+	Once bool `yaml:"once"`
+	// How often to check for new data. Default is 1s.
+	PollInterval   time.Duration `yaml:"poll_interval"`
+	SamplerAddress string        `yaml:"sampler_address"`
+}
+
+func mergeDefaultZeekConfig(in *ZeekConfig) *ZeekConfig {
+	if in == nil {
+		in = &ZeekConfig{}
+	}
+	if in.PollInterval == 0 {
+		in.PollInterval = time.Second
+	}
+	if in.SamplerAddress == "" {
+		in.SamplerAddress = "0.0.0.0"
+	}
+	return in
+}
+
+// The #-prefixed header of a Zeek TSV log.
+type zeekHeader struct {
+	separator    string
+	setSeparator string
+	emptyField   string
+	unsetField   string
+	path         string
+	fields       []string
+	types        []string
+}
+
+func defaultZeekHeader() zeekHeader {
+	return zeekHeader{
+		separator:    "\t",
+		setSeparator: ",",
+		emptyField:   "(empty)",
+		unsetField:   "-",
+	}
+}
+
+// Decodes the \xNN escapes Zeek uses for separators and non-printable
+// characters.
+func unescapeZeek(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if n, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func (h *zeekHeader) parseDirective(line string) {
+	// The separator directive is always separated by a space since it
+	// defines the separator for the rest of the header.
+	if value, ok := strings.CutPrefix(line, "#separator "); ok {
+		h.separator = unescapeZeek(value)
+		return
+	}
+	parts := strings.Split(line, h.separator)
+	values := parts[1:]
+	switch strings.TrimPrefix(parts[0], "#") {
+	case "set_separator":
+		if len(values) > 0 {
+			h.setSeparator = values[0]
+		}
+	case "empty_field":
+		if len(values) > 0 {
+			h.emptyField = values[0]
+		}
+	case "unset_field":
+		if len(values) > 0 {
+			h.unsetField = values[0]
+		}
+	case "path":
+		if len(values) > 0 {
+			h.path = values[0]
+		}
+	case "fields":
+		h.fields = values
+	case "types":
+		h.types = values
+	}
+}
+
+func (h *zeekHeader) parseValue(typ string, value string) (interface{}, error) {
+	switch {
+	case typ == "count" || typ == "int" || typ == "port":
+		return strconv.Atoi(value)
+	case typ == "time" || typ == "interval" || typ == "double":
+		return strconv.ParseFloat(value, 64)
+	case typ == "bool":
+		return value == "T", nil
+	case strings.HasPrefix(typ, "set[") || strings.HasPrefix(typ, "vector["):
+		items := []interface{}{}
+		if value == h.emptyField {
+			return items, nil
+		}
+		for _, item := range strings.Split(value, h.setSeparator) {
+			items = append(items, unescapeZeek(item))
+		}
+		return items, nil
+	}
+	return unescapeZeek(value), nil
+}
+
+// Unset fields are left out of the record.
+func (h *zeekHeader) parseRecord(line string) (map[string]interface{}, error) {
+	if len(h.fields) == 0 {
+		return nil, errors.New("record before #fields header")
+	}
+	values := strings.Split(line, h.separator)
+	if len(values) != len(h.fields) {
+		return nil, fmt.Errorf("expected %d fields, got %d", len(h.fields), len(values))
+	}
+	rec := make(map[string]interface{}, len(values))
+	for i, field := range h.fields {
+		value := values[i]
+		if value == h.unsetField {
+			continue
+		}
+		typ := "string"
+		if i < len(h.types) {
+			typ = h.types[i]
+		}
+		v, err := h.parseValue(typ, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		rec[field] = v
+	}
+	return rec, nil
+}
+
+// Accepts both the ints and floats records decode to.
+func zeekFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func zeekInt(v interface{}) int {
+	f, _ := zeekFloat(v)
+	return int(f)
+}
+
+// Timestamps are epoch seconds unless Zeek is configured to write ISO 8601
+// timestamps in JSON logs.
+func zeekTime(v interface{}) (time.Time, error) {
+	if s, ok := v.(string); ok {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	f, ok := zeekFloat(v)
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid timestamp %v", v)
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), nil
+}
+
+var zeekProtos = map[string]int{
+	"icmp": 1,
+	"tcp":  6,
+	"udp":  17,
+}
+
+// conn.log fields that are mapped explicitly by FormatZeekConn. The rest are
+// added with a `zeek_` prefix and dots replaced by underscores.
+var zeekStandardFields = map[string]bool{
+	"uid":           true,
+	"service":       true,
+	"conn_state":    true,
+	"orig_bytes":    true,
+	"resp_bytes":    true,
+	"ts":            true,
+	"id.orig_h":     true,
+	"id.orig_p":     true,
+	"id.resp_h":     true,
+	"id.resp_p":     true,
+	"proto":         true,
+	"orig_pkts":     true,
+	"resp_pkts":     true,
+	"orig_ip_bytes": true,
+	"resp_ip_bytes": true,
+	"orig_l2_addr":  true,
+	"resp_l2_addr":  true,
+}
+
+// FormatZeekConn builds a message for a conn.log record. Like conntrack
+// flows, the originator's side uses the same fields as FormatFlowMessage and
+// the responder's side is added as `reply_*` fields.
+func FormatZeekConn(samplerAddress string, timeReceived uint64, rec map[string]interface{}) (map[string]interface{}, error) {
+	ts, err := zeekTime(rec["ts"])
+	if err != nil {
+		return nil, fmt.Errorf("ts: %w", err)
+	}
+	srcAddr, err := netip.ParseAddr(fmt.Sprint(rec["id.orig_h"]))
+	if err != nil {
+		return nil, fmt.Errorf("id.orig_h: %w", err)
+	}
+	dstAddr, err := netip.ParseAddr(fmt.Sprint(rec["id.resp_h"]))
+	if err != nil {
+		return nil, fmt.Errorf("id.resp_h: %w", err)
+	}
+	duration, _ := zeekFloat(rec["duration"])
+	end := ts.Add(time.Duration(duration * float64(time.Second)))
+
+	proto := zeekProtos[fmt.Sprint(rec["proto"])]
+	if proto == 1 && srcAddr.Is6() && !srcAddr.Is4In6() {
+		proto = 58
+	}
+	// The IP bytes include headers like NetFlow and sFlow byte counts do. Fall
+	// back to the payload bytes for logs that leave them out.
+	bytesKey := "ip_bytes"
+	if _, ok := rec["orig_ip_bytes"]; !ok {
+		bytesKey = "bytes"
+	}
+
+	msg := map[string]interface{}{
+		"type":            ZeekMessageType,
+		"time_received":   int(timeReceived),
+		"sampling_rate":   1,
+		"sampler_address": samplerAddress,
+		"time_flow_start": int(ts.Unix()),
+		"time_flow_end":   int(end.Unix()),
+		"bytes":           zeekInt(rec["orig_"+bytesKey]),
+		"packets":         zeekInt(rec["orig_pkts"]),
+		"src_addr":        srcAddr.String(),
+		"dst_addr":        dstAddr.String(),
+		"ethernet_type":   addrEtype(srcAddr.Unmap()),
+		"proto":           proto,
+		"reply_bytes":     zeekInt(rec["resp_"+bytesKey]),
+		"reply_packets":   zeekInt(rec["resp_pkts"]),
+	}
+	// Zeek logs the ICMP type and code as the ports.
+	if proto == 1 || proto == 58 {
+		msg["icmp_types"] = zeekInt(rec["id.orig_p"])
+		msg["icmp_code"] = zeekInt(rec["id.resp_p"])
+	} else {
+		msg["src_port"] = zeekInt(rec["id.orig_p"])
+		msg["dst_port"] = zeekInt(rec["id.resp_p"])
+	}
+	// Always set with the same types whether the log is TSV or JSON. The
+	// payload bytes are kept separately from `bytes` and `reply_bytes`.
+	if uid, ok := rec["uid"].(string); ok {
+		msg["zeek_uid"] = uid
+	}
+	if service, ok := rec["service"].(string); ok {
+		msg["zeek_service"] = service
+	}
+	if state, ok := rec["conn_state"].(string); ok {
+		msg["zeek_conn_state"] = state
+	}
+	if v, ok := rec["orig_bytes"]; ok {
+		msg["zeek_orig_bytes"] = zeekInt(v)
+	}
+	if v, ok := rec["resp_bytes"]; ok {
+		msg["zeek_resp_bytes"] = zeekInt(v)
+	}
+	if mac, ok := rec["orig_l2_addr"].(string); ok {
+		msg["src_mac"] = mac
+	}
+	if mac, ok := rec["resp_l2_addr"].(string); ok {
+		msg["dst_mac"] = mac
+	}
+	for k, v := range rec {
+		if zeekStandardFields[k] || k == "_path" {
+			continue
+		}
+		// JSON logs can have fields like _write_ts.
+		k = strings.TrimPrefix(k, "_")
+		msg["zeek_"+strings.ReplaceAll(k, ".", "_")] = v
+	}
+	return msg, nil
+}
+
+type zeekReader struct {
+	s      *Server
+	header zeekHeader
+	file   os.FileInfo
+	offset int64
+}
+
+func (r *zeekReader) publishLine(line []byte) {
+	var rec map[string]interface{}
+	var err error
+	switch {
+	case line[0] == '#':
+		r.header.parseDirective(string(line))
+		return
+	case line[0] == '{':
+		rec, err = decodeNDJSONLine(line)
+		if path, ok := rec["_path"]; ok && path != "conn" {
+			MetricZeekRecords.With(prometheus.Labels{"status": "skipped"}).Inc()
+			return
+		}
+	default:
+		if r.header.path != "" && r.header.path != "conn" {
+			MetricZeekRecords.With(prometheus.Labels{"status": "skipped"}).Inc()
+			return
+		}
+		rec, err = r.header.parseRecord(string(line))
+	}
+	var msg map[string]interface{}
+	if err == nil {
+		msg, err = FormatZeekConn(r.s.Config.Zeek.SamplerAddress, uint64(time.Now().Unix()), rec)
+	}
+	if err != nil {
+		MetricZeekRecords.With(prometheus.Labels{"status": "error"}).Inc()
+		r.s.Config.Logger.Debugf("zeek: error decoding record: %v", err)
+		return
+	}
+	MetricZeekRecords.With(prometheus.Labels{"status": "published"}).Inc()
+	r.s.Config.Transport.PublishMessage(msg)
+}
+
+// Publishes new complete lines in the log, starting over when Zeek rotates
+// it. A trailing line without a newline is only published if partial is
+// true.
+func (r *zeekReader) read(path string, partial bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if r.file == nil || !os.SameFile(r.file, info) || info.Size() < r.offset {
+		r.header = defaultZeekHeader()
+		r.offset = 0
+	}
+	r.file = info
+	if _, err := f.Seek(r.offset, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && !partial {
+			return nil
+		}
+		r.offset += int64(len(line))
+		if line = bytes.TrimRight(line, "\r\n"); len(line) > 0 {
+			r.publishLine(line)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// RunZeek publishes a message for each connection in a Zeek conn.log. The log
+// is followed across rotations unless once is set, in which case it returns
+// nil at EOF.
+func (s *Server) RunZeek() error {
+	config := s.Config.Zeek
+	if config.Path == "" {
+		return errors.New("zeek: path is required")
+	}
+	r := &zeekReader{s: s}
+	if config.Once {
+		return r.read(config.Path, true)
+	}
+	for {
+		// conn.log doesn't exist for a moment while Zeek rotates it.
+		if err := r.read(config.Path, false); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("zeek: %w", err)
+		}
+		time.Sleep(config.PollInterval)
+	}
+}
@@ -0,0 +1,204 @@
+package server_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sapslaj/morbius/server"
+)
+
+const zeekTSVHeader = `#separator \x09
+#set_separator	,
+#empty_field	(empty)
+#unset_field	-
+#path	conn
+#open	2011-03-18-19-06-08
+#fields	ts	uid	id.orig_h	id.orig_p	id.resp_h	id.resp_p	proto	service	duration	orig_bytes	resp_bytes	conn_state	local_orig	local_resp	missed_bytes	history	orig_pkts	orig_ip_bytes	resp_pkts	resp_ip_bytes	tunnel_parents
+#types	time	string	addr	port	addr	port	enum	string	interval	count	count	string	bool	bool	count	string	count	count	count	count	set[string]
+`
+
+func TestServer_RunZeek(t *testing.T) {
+	t.Parallel()
+	type test struct {
+		input string
+		want  []map[string]interface{}
+	}
+
+	tests := map[string]test{
+		"tsv": {
+			input: zeekTSVHeader +
+				"1300475168.853899\tC9hM3h3DjA4Xhk\t141.142.220.118\t43927\t141.142.2.2\t53\tudp\tdns\t2.500435\t38\t89\tSF\t-\tT\t0\tDd\t1\t66\t1\t117\t(empty)\n" +
+				"1300475168.853899\tbroken\n" +
+				"#close\t2011-03-18-19-06-13\n",
+			want: []map[string]interface{}{
+				{
+					"type":                server.ZeekMessageType,
+					"sampling_rate":       1,
+					"sampler_address":     "0.0.0.0",
+					"time_flow_start":     1300475168,
+					"time_flow_end":       1300475171,
+					"bytes":               66,
+					"packets":             1,
+					"reply_bytes":         117,
+					"reply_packets":       1,
+					"src_addr":            "141.142.220.118",
+					"dst_addr":            "141.142.2.2",
+					"src_port":            43927,
+					"dst_port":            53,
+					"ethernet_type":       0x800,
+					"proto":               17,
+					"zeek_uid":            "C9hM3h3DjA4Xhk",
+					"zeek_service":        "dns",
+					"zeek_duration":       2.500435,
+					"zeek_orig_bytes":     38,
+					"zeek_resp_bytes":     89,
+					"zeek_conn_state":     "SF",
+					"zeek_local_resp":     true,
+					"zeek_missed_bytes":   0,
+					"zeek_history":        "Dd",
+					"zeek_tunnel_parents": []interface{}{},
+				},
+			},
+		},
+		"json": {
+			input: `{"ts":1591367999.430166,"uid":"C5bLoe2Mvxqhawzqqd","id.orig_h":"2001:db8::1","id.orig_p":128,"id.resp_h":"2001:db8::2","id.resp_p":129,"proto":"icmp","conn_state":"OTH","orig_bytes":8,"resp_bytes":8,"orig_pkts":1,"resp_pkts":1,"orig_l2_addr":"00:00:5e:00:53:01","resp_l2_addr":"00:00:5e:00:53:02"}` + "\n" +
+				`{"_path":"dns","ts":1591367999.430166,"uid":"C5bLoe2Mvxqhawzqqd"}` + "\n" +
+				`{"_path":"conn","_write_ts":"2020-06-05T14:40:00Z","ts":"2020-06-05T14:39:59.5Z","uid":"CHhAvVGS1DHFjwGM9","id.orig_h":"192.0.2.1","id.orig_p":51234,"id.resp_h":"198.51.100.1","id.resp_p":443,"proto":"tcp","service":"ssl","duration":0.25,"orig_bytes":517,"resp_bytes":3000,"conn_state":"SF","orig_pkts":5,"orig_ip_bytes":785,"resp_pkts":4,"resp_ip_bytes":3208}`,
+			want: []map[string]interface{}{
+				{
+					"type":            server.ZeekMessageType,
+					"sampling_rate":   1,
+					"sampler_address": "0.0.0.0",
+					"time_flow_start": 1591367999,
+					"time_flow_end":   1591367999,
+					"bytes":           8,
+					"packets":         1,
+					"reply_bytes":     8,
+					"reply_packets":   1,
+					"src_addr":        "2001:db8::1",
+					"dst_addr":        "2001:db8::2",
+					"icmp_types":      128,
+					"icmp_code":       129,
+					"src_mac":         "00:00:5e:00:53:01",
+					"dst_mac":         "00:00:5e:00:53:02",
+					"ethernet_type":   0x86dd,
+					"proto":           58,
+					"zeek_uid":        "C5bLoe2Mvxqhawzqqd",
+					"zeek_conn_state": "OTH",
+					"zeek_orig_bytes": 8,
+					"zeek_resp_bytes": 8,
+				},
+				{
+					"type":            server.ZeekMessageType,
+					"sampling_rate":   1,
+					"sampler_address": "0.0.0.0",
+					"time_flow_start": 1591367999,
+					"time_flow_end":   1591367999,
+					"bytes":           785,
+					"packets":         5,
+					"reply_bytes":     3208,
+					"reply_packets":   4,
+					"src_addr":        "192.0.2.1",
+					"dst_addr":        "198.51.100.1",
+					"src_port":        51234,
+					"dst_port":        443,
+					"ethernet_type":   0x800,
+					"proto":           6,
+					"zeek_write_ts":   "2020-06-05T14:40:00Z",
+					"zeek_uid":        "CHhAvVGS1DHFjwGM9",
+					"zeek_service":    "ssl",
+					"zeek_duration":   0.25,
+					"zeek_orig_bytes": 517,
+					"zeek_resp_bytes": 3000,
+					"zeek_conn_state": "SF",
+				},
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "conn.log")
+			if err := os.WriteFile(path, []byte(tc.input), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			transport := &recordingTransport{}
+			s := server.NewServerWithTransportAndLogger(server.ServerConfig{
+				Zeek: &server.ZeekConfig{Enable: true, Path: path, Once: true},
+			}, transport, nil)
+
+			if err := s.RunZeek(); err != nil {
+				t.Fatalf("\"%s\": RunZeek returned err: %v", name, err)
+			}
+			if diff := cmp.Diff(tc.want, transport.msgs, ignoreTimeReceived); diff != "" {
+				t.Errorf("\"%s\": mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
+
+func TestServer_RunZeek_Follow(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "conn.log")
+	record := func(uid string) string {
+		return "1300475168.853899\t" + uid + "\t141.142.220.118\t43927\t141.142.2.2\t53\tudp\tdns\t0.000435\t38\t89\tSF\t-\t-\t0\tDd\t1\t66\t1\t117\t(empty)\n"
+	}
+	if err := os.WriteFile(path, []byte(zeekTSVHeader+record("C1")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	transport := &recordingTransport{}
+	s := server.NewServerWithTransportAndLogger(server.ServerConfig{
+		Zeek: &server.ZeekConfig{Enable: true, Path: path, PollInterval: 10 * time.Millisecond},
+	}, transport, nil)
+	go s.RunZeek()
+
+	uids := func() []string {
+		transport.mu.Lock()
+		defer transport.mu.Unlock()
+		var got []string
+		for _, msg := range transport.msgs {
+			got = append(got, msg["zeek_uid"].(string))
+		}
+		return got
+	}
+	waitFor := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(uids()) < n && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(1)
+
+	// A partial line isn't published until it's complete.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := record("C2")
+	f.WriteString(line[:10])
+	time.Sleep(50 * time.Millisecond)
+	f.WriteString(line[10:])
+	f.Close()
+	waitFor(2)
+
+	// Rotate the way Zeek does, with a new header in the new file.
+	if err := os.Rename(path, filepath.Join(dir, "conn.2011-03-18-19-06-08.log")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(zeekTSVHeader+record("C3")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(3)
+
+	if diff := cmp.Diff([]string{"C1", "C2", "C3"}, uids()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	goflowpb "github.com/cloudflare/goflow/v3/pb"
 	"github.com/prometheus/client_golang/prometheus"
@@ -45,7 +46,7 @@ var TransportDispatchGoroutineCount int64
 type Transport struct {
 	Destinations            []destination.Destination
 	Enrichers               []enricher.Enricher
-	workerPool              *WorkerPool[*goflowpb.FlowMessage]
+	workerPool              *WorkerPool[flowMessageWithFields]
 	DispatchMethod          TransportDispatchMethod
 	MaxGoroutines           int64
 	ParallelizeDestinations bool
@@ -84,31 +85,67 @@ func NewGoroutineTransport(parallelizeDestinations bool, destinations []destinat
 	return t
 }
 
+// A flow message along with extra message fields that goflow doesn't know
+// about, such as custom NetFlow/IPFIX elements.
+type flowMessageWithFields struct {
+	fmsg   *goflowpb.FlowMessage
+	fields map[string]interface{}
+}
+
 func (s *Transport) Publish(fmsgs []*goflowpb.FlowMessage) {
+	s.PublishWithFields(fmsgs, nil)
+}
+
+// PublishWithFields is like Publish but merges fields[i] into the formatted
+// message for fmsgs[i]. fields may be shorter than fmsgs or contain nil maps.
+func (s *Transport) PublishWithFields(fmsgs []*goflowpb.FlowMessage, fields []map[string]interface{}) {
 	MetricFlowMessageBatchCount.Inc()
-	switch s.DispatchMethod {
-	case TransportDispatchLinear:
-		for _, fmsg := range fmsgs {
-			s.messageWorkerPublish(fmsg)
+	for i, fmsg := range fmsgs {
+		m := flowMessageWithFields{fmsg: fmsg}
+		if i < len(fields) {
+			m.fields = fields[i]
 		}
-	case TransportDispatchWorkerPool:
-		for _, fmsg := range fmsgs {
-			s.workerPool.Push(fmsg)
-		}
-	case TransportDispatchGoroutine:
-		for i := range fmsgs {
+		switch s.DispatchMethod {
+		case TransportDispatchLinear:
+			s.messageWorkerPublish(m)
+		case TransportDispatchWorkerPool:
+			s.workerPool.Push(m)
+		case TransportDispatchGoroutine:
 			if s.MaxGoroutines > 0 && TransportDispatchGoroutineCount >= s.MaxGoroutines {
 				return
 			}
 			atomic.AddInt64(&TransportDispatchGoroutineCount, 1)
-			go func(fmesg *goflowpb.FlowMessage) {
-				s.messageWorkerPublish(fmesg)
+			go func(m flowMessageWithFields) {
+				s.messageWorkerPublish(m)
 				atomic.AddInt64(&TransportDispatchGoroutineCount, -1)
-			}(fmsgs[i])
+			}(m)
 		}
 	}
 }
 
+// Close waits for messages that have already been dispatched to finish
+// publishing, then closes destinations that buffer messages. The transport
+// should not be used after it is closed.
+func (s *Transport) Close() error {
+	var err error
+	switch s.DispatchMethod {
+	case TransportDispatchWorkerPool:
+		err = s.workerPool.Stop()
+	case TransportDispatchGoroutine:
+		for atomic.LoadInt64(&TransportDispatchGoroutineCount) > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for _, d := range s.Destinations {
+		if closer, ok := d.(interface{ Close() error }); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
 func (s *Transport) PublishMessage(msg map[string]interface{}) {
 	for _, enricher := range s.Enrichers {
 		msg = enricher.Process(msg)
@@ -131,9 +168,12 @@ func (s *Transport) PublishMessage(msg map[string]interface{}) {
 	}
 }
 
-func (s *Transport) messageWorkerPublish(fmsg *goflowpb.FlowMessage) {
+func (s *Transport) messageWorkerPublish(m flowMessageWithFields) {
 	MetricFlowMessageCount.Inc()
-	msg := s.FormatFlowMessage(fmsg)
+	msg := s.FormatFlowMessage(m.fmsg)
+	for k, v := range m.fields {
+		msg[k] = v
+	}
 	s.PublishMessage(msg)
 }
 